@@ -1,16 +1,53 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"html/template"
+	"io"
 	"log"
+	"math"
+	"math/big"
+	"mime"
+	"net"
 	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	texttemplate "text/template"
 	"time"
 )
 
@@ -33,6 +70,8 @@ type SystemStats struct {
 	DiskUsedSpace      string `json:"disk_used_space"`
 	DiskAvailableSpace string `json:"disk_available_space"`
 	DiskUsage          string `json:"disk_usage"`
+	DiskReadSpeed      string `json:"disk_read_speed"`
+	DiskWriteSpeed     string `json:"disk_write_speed"`
 	ReceiveSpeed       string `json:"receive_speed"`
 	TransmitSpeed      string `json:"transmit_speed"`
 	ReceiveTotal       string `json:"receive_total"`
@@ -45,14 +84,152 @@ type Config struct {
 	Interface string
 	Port      int
 	Interval  time.Duration
+	// Intervals 各采集器的采集周期，未配置的采集器使用 defaultIntervals
+	Intervals map[string]time.Duration
+	// Timeout 单次采集的超时时间
+	Timeout time.Duration
+	// HistorySize 每个指标在内存中保留的历史样本数，每 Interval 记录一个样本
+	HistorySize int
+	// DataDir 磁盘时序存储的目录，为空时不持久化历史
+	DataDir string
+	// Retention 各分辨率数据的保留时长，未配置的使用 storeTierSpecs 中的默认值
+	Retention map[string]time.Duration
+	// BillingDay 流量统计的账单日（每月1-31日，当月没有该日时为月末）
+	BillingDay int
+	// TrafficQuota 每个网卡每个账单周期的流量配额（字节，收发合计），0表示不限
+	TrafficQuota uint64
+	// Influx InfluxDB 输出配置，URL为空时不启用
+	Influx InfluxConfig
+	// Graphite Graphite 输出配置，Addr为空时不启用
+	Graphite GraphiteConfig
+	// StatsD StatsD 输出配置，Addr为空时不启用
+	StatsD StatsDConfig
+	// OTLP OpenTelemetry 输出配置，Endpoint为空时不启用
+	OTLP OTLPConfig
+	// MQTT MQTT 输出配置，Broker为空时不启用
+	MQTT MQTTConfig
+	// ForecastWindow 容量预测拟合趋势使用的历史时长，0表示不预测
+	ForecastWindow time.Duration
+	// Anomaly 异常检测配置
+	Anomaly AnomalyConfig
+	// AlertRules 告警规则文件，为空时不启用告警
+	AlertRules string
+	// Maintenance 分号分隔的维护窗口，窗口内匹配的告警不发送通知
+	Maintenance string
+	// Webhook 告警 Webhook 通知配置，URL为空时不启用
+	Webhook WebhookConfig
+	// SMTP 邮件配置，用于告警通知和每日报告，Addr为空时不启用
+	SMTP SMTPConfig
+	// TLSCert/TLSKey Web服务器的证书和私钥，设置后使用 HTTPS
+	TLSCert string
+	TLSKey  string
+	// Auth 面板和API的认证配置
+	Auth AuthConfig
+	// Hub 多主机汇总配置
+	Hub HubConfig
+	// ShutdownTimeout 退出时等待HTTP请求处理完毕的最长时间
+	ShutdownTimeout time.Duration
+}
+
+// defaultIntervals 各采集器的默认采集周期
+var defaultIntervals = map[string]time.Duration{
+	"system":  5 * time.Second,
+	"cpu":     1 * time.Second,
+	"memory":  1 * time.Second,
+	"disk":    10 * time.Second,
+	"network": 1 * time.Second,
+	"traffic": 10 * time.Second,
 }
 
 // Monitor 系统监控器
 type Monitor struct {
-	config      Config
+	config  Config
+	traffic *TrafficAccounting
+
+	// mu 保护以下所有字段，采集器在各自的协程中更新
+	mu          sync.RWMutex
 	prevNetRx   uint64
 	prevNetTx   uint64
+	prevNetTime time.Time
 	prevCPUStat CPUStat
+	prevCores   []CPUStat
+	prevIfTime  time.Time
+	prevDiskIO  [2]uint64
+	prevIOTime  time.Time
+
+	// 各采集器最近一次的采集结果
+	uptime        float64
+	loadAvg       [3]float64
+	cpuTemp       float64
+	hasCPUTemp    bool
+	cpuUsage      float64
+	coreUsage     []float64
+	memInfo       map[string]uint64
+	swapInfo      map[string]uint64
+	diskInfo      map[string]uint64
+	diskMounts    []DiskMount
+	diskRead      float64 // KB/s
+	diskWrite     float64 // KB/s
+	netCounters   map[string][2]uint64
+	netRates      map[string][2]float64 // 各网卡的收发速率（字节/秒）
+	netRx         uint64
+	netTx         uint64
+	receiveSpeed  float64
+	transmitSpeed float64
+	latestTime    time.Time
+}
+
+// Collector 采集器，每个采集器拥有独立的采集周期和超时时间
+type Collector struct {
+	Name     string
+	Interval time.Duration
+	Timeout  time.Duration
+	collect  func(ctx context.Context) error
+
+	mu            sync.Mutex
+	running       bool
+	runs          uint64
+	failures      uint64
+	lastErr       error
+	lastErrorTime time.Time
+	lastSuccess   time.Time
+	lastDuration  time.Duration
+}
+
+// CollectorHealth 采集器健康状态
+type CollectorHealth struct {
+	Name          string  `json:"name"`
+	Interval      string  `json:"interval"`
+	Healthy       bool    `json:"healthy"`
+	Runs          uint64  `json:"runs"`
+	Failures      uint64  `json:"failures"`
+	LastError     string  `json:"last_error,omitempty"`
+	LastErrorTime string  `json:"last_error_time,omitempty"`
+	LastSuccess   string  `json:"last_success,omitempty"`
+	DurationMs    float64 `json:"duration_ms"`
+}
+
+// readyTimeout 启动后超过该时长仍有采集器从未成功时，不再等待这些采集器
+const readyTimeout = 30 * time.Second
+
+// Scheduler 采集调度器
+type Scheduler struct {
+	collectors []*Collector
+	// onCollect 每次采集成功后调用，参数为采集器名称
+	onCollect func(name string)
+
+	mu       sync.Mutex
+	started  time.Time
+	degraded bool // 因等待超时而就绪
+}
+
+// DiskMount 单个挂载点的磁盘空间（KB）
+type DiskMount struct {
+	Device    string
+	Mount     string
+	Total     uint64
+	Used      uint64
+	Available uint64
 }
 
 // CPUStat CPU统计信息
@@ -68,9 +245,51 @@ type CPUStat struct {
 
 // EnhancedMonitor 增强监控器
 type EnhancedMonitor struct {
-	config       Config
-	monitor      *Monitor
-	currentStats SystemStats
+	config    Config
+	monitor   *Monitor
+	scheduler *Scheduler
+	history   *History
+	store     *Store
+	stream    *Stream
+	replay    *Replay
+	alerts    *AlertManager
+	forecast  *Forecaster
+	anomaly   *AnomalyDetector
+	fleet     *Fleet
+	agents    *AgentRegistry
+	hubTLS    *tls.Config // 连接 hub 或被拉取实例时使用的 TLS 配置
+	auth      *Authenticator
+	notifiers []Notifier
+	mailer    *Mailer
+	outputs   []Output
+}
+
+// Output 把指标推送到外部系统的输出，Run 阻塞直到ctx被取消
+type Output interface {
+	Run(ctx context.Context, source func() []MetricPoint)
+}
+
+// History 内存中的指标历史，每个指标一个定长的环形缓冲区
+type History struct {
+	mu     sync.RWMutex
+	size   int
+	series map[string]*historyRing
+}
+
+// historyRing 单个指标的环形缓冲区，写满后覆盖最旧的样本
+type historyRing struct {
+	times  []int64 // unix秒
+	values []float64
+	next   int
+	full   bool
+}
+
+// HistoryPoint 历史数据点，降采样时为一个时间桶内的平均/最小/最大值
+type HistoryPoint struct {
+	Time int64   `json:"t"`
+	Avg  float64 `json:"avg"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
 }
 
 var htmlTemplate = `
@@ -214,6 +433,120 @@ var htmlTemplate = `
             backdrop-filter: blur(10px);
             transition: opacity 0.3s ease;
         }
+        .history-chart {
+            display: block;
+            width: 100%;
+            height: 60px;
+            margin-top: 12px;
+            border-radius: 6px;
+            background: rgba(0,0,0,0.03);
+        }
+        .health-strip {
+            display: flex;
+            flex-wrap: wrap;
+            justify-content: center;
+            gap: 10px;
+            margin: -20px 0 25px;
+        }
+        .health-item {
+            display: flex;
+            align-items: center;
+            gap: 6px;
+            padding: 4px 12px;
+            border-radius: 12px;
+            background: rgba(255,255,255,0.15);
+            color: white;
+            font-size: 13px;
+            cursor: default;
+        }
+        .health-dot {
+            width: 8px;
+            height: 8px;
+            border-radius: 50%;
+            background: #bdc3c7;
+        }
+        .health-item.ok .health-dot { background: #2ecc71; }
+        .health-item.failed { background: rgba(231, 76, 60, 0.6); }
+        .health-item.failed .health-dot { background: #e74c3c; box-shadow: 0 0 0 2px white; }
+        .alert-banner {
+            display: none;
+            margin: 0 0 25px;
+            border-radius: 10px;
+            overflow: hidden;
+            box-shadow: 0 4px 15px rgba(0,0,0,0.15);
+        }
+        .alert-item {
+            display: flex;
+            align-items: center;
+            gap: 12px;
+            padding: 10px 16px;
+            color: white;
+            font-size: 14px;
+            background: #e67e22;
+        }
+        .alert-item.critical { background: #e74c3c; }
+        .alert-item.info { background: #3498db; }
+        .alert-item .alert-severity {
+            font-size: 12px;
+            font-weight: bold;
+            text-transform: uppercase;
+        }
+        .alert-item .alert-since {
+            margin-left: auto;
+            font-size: 12px;
+            opacity: 0.85;
+        }
+        .alert-item.muted { background: #95a5a6; }
+        .alert-item .alert-tag {
+            font-size: 12px;
+            padding: 2px 8px;
+            border-radius: 10px;
+            background: rgba(255,255,255,0.25);
+        }
+        .alert-item button, .silence-bar button {
+            border: none;
+            border-radius: 6px;
+            padding: 4px 10px;
+            font-size: 12px;
+            cursor: pointer;
+            background: rgba(255,255,255,0.25);
+            color: white;
+        }
+        .silence-bar {
+            display: none;
+            margin: -15px 0 25px;
+            padding: 10px 16px;
+            border-radius: 10px;
+            background: rgba(255,255,255,0.15);
+            color: white;
+            font-size: 13px;
+        }
+        .silence-bar .silence-row {
+            display: flex;
+            align-items: center;
+            gap: 10px;
+            padding: 3px 0;
+        }
+        .silence-bar .silence-row span:first-child { flex: 1; }
+        .replay-bar {
+            display: flex;
+            align-items: center;
+            gap: 12px;
+            margin: 0 0 25px;
+            padding: 10px 16px;
+            border-radius: 10px;
+            background: rgba(255,255,255,0.15);
+            color: white;
+            font-size: 13px;
+        }
+        .replay-bar button, .replay-bar select {
+            padding: 4px 10px;
+            border: none;
+            border-radius: 4px;
+            font-size: 13px;
+            cursor: pointer;
+        }
+        .replay-bar input[type=range] { flex: 1; }
         .network-speed {
             display: flex;
             gap: 15px;
@@ -244,8 +577,30 @@ var htmlTemplate = `
     <div class="container">
         <div class="header">
             <h1>🖥️ 系统监控面板</h1>
-            <p>实时系统性能监控</p>
+            <p>实时系统性能监控 · <a href="/traffic" style="color: white;">📈 流量统计</a> · <a href="/api/report" style="color: white;">📧 每日报告</a>{{if .Hub}} · <a href="/fleet" style="color: white;">🖧 主机总览</a>{{end}}{{if .User}} · 👤 {{.User}} <a href="/logout" style="color: white;">退出</a>{{end}}</p>
+        </div>
+
+        <div class="health-strip" id="health-strip"></div>
+
+        <div class="alert-banner" id="alert-banner"></div>
+        <div class="silence-bar" id="silence-bar"></div>
+
+        {{if .Replay}}
+        <div class="replay-bar">
+            <span>⏪ 回放</span>
+            <button id="replay-toggle"{{if not .Can.replay}} disabled{{end}}>▶</button>
+            <input type="range" id="replay-seek" min="0" max="1000" value="0"{{if not .Can.replay}} disabled{{end}}>
+            <span id="replay-time"></span>
+            <select id="replay-speed"{{if not .Can.replay}} disabled{{end}}>
+                <option value="0.5">0.5x</option>
+                <option value="1">1x</option>
+                <option value="2">2x</option>
+                <option value="5">5x</option>
+                <option value="10">10x</option>
+                <option value="60">60x</option>
+            </select>
         </div>
+        {{end}}
         
         <div class="stats-grid">
             <!-- 系统信息 -->
@@ -266,6 +621,7 @@ var htmlTemplate = `
                     <span class="stat-label">CPU温度:</span>
                     <span class="stat-value">{{.Stats.CPUTemp}}</span>
                 </div>
+                <canvas class="history-chart" data-metric="last1" data-color="#3498db"></canvas>
             </div>
 
             <!-- CPU使用率 -->
@@ -281,6 +637,7 @@ var htmlTemplate = `
                 <div class="progress-bar">
                     <div class="progress-fill cpu-usage" style="width: {{.Stats.CPUUsage}}%"></div>
                 </div>
+                <canvas class="history-chart" data-metric="cpu_usage" data-color="#e74c3c" data-max="100"></canvas>
             </div>
 
             <!-- 内存信息 -->
@@ -308,6 +665,7 @@ var htmlTemplate = `
                 <div class="progress-bar">
                     <div class="progress-fill memory-usage" style="width: {{.Stats.MemUsage}}%"></div>
                 </div>
+                <canvas class="history-chart" data-metric="mem_usage" data-color="#1abc9c" data-max="100"></canvas>
             </div>
 
             <!-- 磁盘信息 -->
@@ -332,9 +690,19 @@ var htmlTemplate = `
                     <span class="stat-label">使用率:</span>
                     <span class="stat-value">{{.Stats.DiskUsage}}%</span>
                 </div>
+                <div class="stat-item">
+                    <span class="stat-label">读/写:</span>
+                    <span class="stat-value" id="disk-io">{{.Stats.DiskReadSpeed}} / {{.Stats.DiskWriteSpeed}} KB/s</span>
+                </div>
+                <div class="stat-item">
+                    <span class="stat-label">预计写满:</span>
+                    <span class="stat-value" id="disk-forecast">-</span>
+                </div>
                 <div class="progress-bar">
                     <div class="progress-fill disk-usage" style="width: {{.Stats.DiskUsage}}%"></div>
                 </div>
+                <canvas class="history-chart" data-metric="disk_usage" data-color="#3498db" data-max="100"></canvas>
+                <canvas class="history-chart" data-metric="disk_read_speed,disk_write_speed" data-color="#2ecc71,#e67e22"></canvas>
             </div>
 
             <!-- 网络信息 -->
@@ -342,7 +710,7 @@ var htmlTemplate = `
                 <div class="stat-title">
                     <span class="icon">🌐</span>
                     网络信息
-                    <select id="interface-selector" style="margin-left: 10px; padding: 2px 5px; border-radius: 3px; border: 1px solid #ddd; font-size: 12px;">
+                    <select id="interface-selector"{{if not .Can.interface}} disabled title="没有切换网卡的权限"{{end}} style="margin-left: 10px; padding: 2px 5px; border-radius: 3px; border: 1px solid #ddd; font-size: 12px;">
                         <option value="">加载中...</option>
                     </select>
                 </div>
@@ -364,6 +732,7 @@ var htmlTemplate = `
                     <span class="stat-label">累计发送:</span>
                     <span class="stat-value">{{.Stats.TransmitTotal}} GB</span>
                 </div>
+                <canvas class="history-chart" data-metric="receive_speed,transmit_speed" data-color="#9b59b6,#f39c12"></canvas>
             </div>
 
             <!-- SWAP信息 -->
@@ -384,6 +753,7 @@ var htmlTemplate = `
                     <span class="stat-label">空闲:</span>
                     <span class="stat-value">{{.Stats.SwapFreeSpace}} MB</span>
                 </div>
+                <canvas class="history-chart" data-metric="swap_used_space" data-color="#f39c12"></canvas>
             </div>
         </div>
         
@@ -394,7 +764,14 @@ var htmlTemplate = `
     
     <script>
         let updateInterval = {{.Interval}} * 1000; // 转换为毫秒
+        const replayMode = {{.Replay}};
+        // 当前用户拥有的写权限，没有权限的操作不显示按钮
+        const can = {{.Can}};
+        // 启用异常检测的指标，图表上会画出预期范围
+        const anomalyMetrics = {{.AnomalyMetrics}};
+        let replayState = null;
         
+        // 轮询获取一次系统状态，实时推送不可用时使用
         function updateStats() {
             fetch('/api/stats')
                 .then(response => {
@@ -403,65 +780,487 @@ var htmlTemplate = `
                     }
                     return response.json();
                 })
-                .then(data => {
-                    // 更新系统信息
-                    document.querySelector('.system-card .stat-item:nth-child(2) .stat-value').textContent = data.run_time;
-                    document.querySelector('.system-card .stat-item:nth-child(3) .stat-value').textContent = data.last1 + ' ' + data.last5 + ' ' + data.last15;
-                    document.querySelector('.system-card .stat-item:nth-child(4) .stat-value').textContent = data.cpu_temp;
-                    
-                    // 更新CPU使用率
-                    document.querySelector('.cpu-card .stat-value').textContent = data.cpu_usage + '%';
-                    const cpuValue = parseFloat(data.cpu_usage);
-                    document.querySelector('.cpu-usage').style.width = cpuValue + '%';
-                    
-                    // 更新内存信息
-                    const memoryItems = document.querySelectorAll('.memory-card .stat-item .stat-value');
-                    memoryItems[0].textContent = data.mem_total_space + ' MB';
-                    memoryItems[1].textContent = data.mem_used_space + ' MB';
-                    memoryItems[2].textContent = data.mem_free_space + ' MB';
-                    memoryItems[3].textContent = data.mem_usage + '%';
-                    const memValue = parseFloat(data.mem_usage);
-                    document.querySelector('.memory-usage').style.width = memValue + '%';
-                    
-                    // 更新磁盘信息
-                    const diskItems = document.querySelectorAll('.disk-card .stat-item .stat-value');
-                    diskItems[0].textContent = data.disk_total_space + ' GB';
-                    diskItems[1].textContent = data.disk_used_space + ' GB';
-                    diskItems[2].textContent = data.disk_available_space + ' GB';
-                    diskItems[3].textContent = data.disk_usage + '%';
-                    const diskValue = parseFloat(data.disk_usage);
-                    document.querySelector('.disk-usage').style.width = diskValue + '%';
-                    
-                    // 更新网络信息
-                    const speedValues = document.querySelectorAll('.network-card .speed-value');
-                    speedValues[0].textContent = data.receive_speed;
-                    speedValues[1].textContent = data.transmit_speed;
-                    const networkItems = document.querySelectorAll('.network-card .stat-item .stat-value');
-                    networkItems[0].textContent = data.receive_total + ' GB';
-                    networkItems[1].textContent = data.transmit_total + ' GB';
-                    
-                    // 更新SWAP信息
-                    const swapItems = document.querySelectorAll('.swap-card .stat-item .stat-value');
-                    swapItems[0].textContent = data.swap_total_space + ' MB';
-                    swapItems[1].textContent = data.swap_used_space + ' MB';
-                    swapItems[2].textContent = data.swap_free_space + ' MB';
-                    
-                    // 更新时间戳
-                    document.getElementById('last-update').textContent = data.lastest_time;
-                    
-                    // 添加轻微的更新指示效果（避免抖动）
-                    document.querySelector('.update-time').style.opacity = '0.7';
-                    setTimeout(() => {
-                        document.querySelector('.update-time').style.opacity = '1';
-                    }, 100);
-                })
+                .then(renderStats)
                 .catch(error => {
                     console.error('更新数据失败:', error);
                     // 显示错误提示
                     document.getElementById('last-update').textContent = '更新失败 - ' + new Date().toLocaleTimeString();
                 });
         }
+
+        // 把系统状态渲染到页面
+        function renderStats(data) {
+            // 更新系统信息
+            document.querySelector('.system-card .stat-item:nth-child(2) .stat-value').textContent = data.run_time;
+            document.querySelector('.system-card .stat-item:nth-child(3) .stat-value').textContent = data.last1 + ' ' + data.last5 + ' ' + data.last15;
+            document.querySelector('.system-card .stat-item:nth-child(4) .stat-value').textContent = data.cpu_temp;
+            
+            // 更新CPU使用率
+            document.querySelector('.cpu-card .stat-value').textContent = data.cpu_usage + '%';
+            const cpuValue = parseFloat(data.cpu_usage);
+            document.querySelector('.cpu-usage').style.width = cpuValue + '%';
+            
+            // 更新内存信息
+            const memoryItems = document.querySelectorAll('.memory-card .stat-item .stat-value');
+            memoryItems[0].textContent = data.mem_total_space + ' MB';
+            memoryItems[1].textContent = data.mem_used_space + ' MB';
+            memoryItems[2].textContent = data.mem_free_space + ' MB';
+            memoryItems[3].textContent = data.mem_usage + '%';
+            const memValue = parseFloat(data.mem_usage);
+            document.querySelector('.memory-usage').style.width = memValue + '%';
+            
+            // 更新磁盘信息
+            const diskItems = document.querySelectorAll('.disk-card .stat-item .stat-value');
+            diskItems[0].textContent = data.disk_total_space + ' GB';
+            diskItems[1].textContent = data.disk_used_space + ' GB';
+            diskItems[2].textContent = data.disk_available_space + ' GB';
+            diskItems[3].textContent = data.disk_usage + '%';
+            document.getElementById('disk-io').textContent = data.disk_read_speed + ' / ' + data.disk_write_speed + ' KB/s';
+            const diskValue = parseFloat(data.disk_usage);
+            document.querySelector('.disk-usage').style.width = diskValue + '%';
+            
+            // 更新网络信息
+            const speedValues = document.querySelectorAll('.network-card .speed-value');
+            speedValues[0].textContent = data.receive_speed;
+            speedValues[1].textContent = data.transmit_speed;
+            const networkItems = document.querySelectorAll('.network-card .stat-item .stat-value');
+            networkItems[0].textContent = data.receive_total + ' GB';
+            networkItems[1].textContent = data.transmit_total + ' GB';
+            
+            // 更新SWAP信息
+            const swapItems = document.querySelectorAll('.swap-card .stat-item .stat-value');
+            swapItems[0].textContent = data.swap_total_space + ' MB';
+            swapItems[1].textContent = data.swap_used_space + ' MB';
+            swapItems[2].textContent = data.swap_free_space + ' MB';
+            
+            // 更新时间戳
+            document.getElementById('last-update').textContent = data.lastest_time;
+            
+            // 添加轻微的更新指示效果（避免抖动）
+            document.querySelector('.update-time').style.opacity = '0.7';
+            setTimeout(() => {
+                document.querySelector('.update-time').style.opacity = '1';
+            }, 100);
+        }
+
+        // 实时推送连接和各定时器，页面隐藏时全部停止，重新可见时再启动
+        let eventSource = null;
+        let pollTimer = null;
+        let healthTimer = null;
+        let historyTimer = null;
+        let replayTimer = null;
+        let alertsTimer = null;
+        let forecastTimer = null;
+
+        // 更新回放控制条，拖动进度条期间不覆盖其位置
+        let seeking = false;
+        function updateReplay() {
+            fetch('/api/replay')
+                .then(response => response.json())
+                .then(renderReplay)
+                .catch(error => {
+                    console.error('获取回放状态失败:', error);
+                });
+        }
+
+        function renderReplay(state) {
+            replayState = state;
+            document.getElementById('replay-toggle').textContent = state.playing ? '⏸' : '▶';
+            document.getElementById('replay-speed').value = String(state.speed);
+            document.getElementById('replay-time').textContent = new Date(state.position * 1000).toLocaleString();
+            if (!seeking && state.end > state.start) {
+                document.getElementById('replay-seek').value = Math.round((state.position - state.start) / (state.end - state.start) * 1000);
+            }
+        }
+
+        // 发送回放控制操作，随后立即刷新历史图表
+        function controlReplay(body) {
+            fetch('/api/replay', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                },
+                body: JSON.stringify(body)
+            })
+            .then(response => response.json())
+            .then(state => {
+                renderReplay(state);
+                updateHistory();
+            })
+            .catch(error => {
+                console.error('回放控制失败:', error);
+            });
+        }
+
+        // 开始轮询，已在轮询时不重复启动
+        function startPolling() {
+            if (pollTimer) {
+                return;
+            }
+            updateStats();
+            pollTimer = setInterval(updateStats, updateInterval);
+        }
+
+        function stopPolling() {
+            clearInterval(pollTimer);
+            pollTimer = null;
+        }
+
+        // 通过 /api/stream 接收实时推送，连接中断期间退回轮询，推送恢复后停止轮询
+        // 浏览器自动重连时会携带 Last-Event-ID，服务端据此补发断线期间的事件
+        function startStream() {
+            if (!window.EventSource) {
+                startPolling();
+                return;
+            }
+            eventSource = new EventSource('/api/stream');
+            eventSource.onmessage = function(event) {
+                stopPolling();
+                renderStats(JSON.parse(event.data));
+            };
+            eventSource.onerror = function() {
+                startPolling();
+            };
+        }
+
+        function stopStream() {
+            if (eventSource) {
+                eventSource.close();
+                eventSource = null;
+            }
+        }
+
+        function startUpdates() {
+            startStream();
+            updateHealth();
+            updateHistory();
+            healthTimer = setInterval(updateHealth, updateInterval * 5);
+            historyTimer = setInterval(updateHistory, historyStep * 1000);
+            updateAlerts();
+            alertsTimer = setInterval(updateAlerts, updateInterval * 5);
+            updateForecast();
+            forecastTimer = setInterval(updateForecast, 60000);
+            if (replayMode) {
+                updateReplay();
+                replayTimer = setInterval(updateReplay, 1000);
+            }
+        }
+
+        function stopUpdates() {
+            stopStream();
+            stopPolling();
+            clearInterval(healthTimer);
+            clearInterval(historyTimer);
+            clearInterval(replayTimer);
+            clearInterval(alertsTimer);
+            clearInterval(forecastTimer);
+            healthTimer = null;
+            historyTimer = null;
+            replayTimer = null;
+            alertsTimer = null;
+            forecastTimer = null;
+        }
         
+        // 历史图表显示的时间范围（秒）和降采样间隔（秒）
+        const historyRange = 600;
+        const historyStep = 5;
+
+        // 加载各卡片的历史图表，启用异常检测的指标同时加载预期范围
+        function updateHistory() {
+            // 回放时以回放位置为当前时间
+            const to = Math.floor(replayState ? replayState.position : Date.now() / 1000);
+            const from = to - historyRange;
+            const query = metric =>
+                fetch('/api/history?metric=' + encodeURIComponent(metric) + '&from=' + from + '&to=' + to + '&step=' + historyStep)
+                    .then(response => response.ok ? response.json() : { points: [] })
+                    .then(r => r.points);
+            document.querySelectorAll('.history-chart').forEach(canvas => {
+                const metrics = canvas.dataset.metric.split(',');
+                Promise.all(metrics.map(metric => {
+                    if (!anomalyMetrics.includes(metric)) {
+                        return Promise.all([query(metric)]);
+                    }
+                    return Promise.all([
+                        query(metric),
+                        query('anomaly_lower{metric="' + metric + '"}'),
+                        query('anomaly_upper{metric="' + metric + '"}')
+                    ]);
+                }))
+                    .then(results => drawChart(canvas, results.map(r => r[0]), from, to,
+                        results.map(r => r.length > 1 ? { lower: r[1], upper: r[2] } : null)))
+                    .catch(error => {
+                        console.error('加载历史数据失败:', error);
+                    });
+            });
+        }
+
+        // 绘制历史曲线，平均值为实线，最小/最大值范围为半透明区域
+        // bands 为各曲线的预期范围（虚线），超出范围的点用红点标出
+        function drawChart(canvas, seriesList, from, to, bands) {
+            const colors = canvas.dataset.color.split(',');
+            const ratio = window.devicePixelRatio || 1;
+            const width = canvas.clientWidth;
+            const height = canvas.clientHeight;
+            canvas.width = width * ratio;
+            canvas.height = height * ratio;
+            const ctx = canvas.getContext('2d');
+            ctx.scale(ratio, ratio);
+            ctx.clearRect(0, 0, width, height);
+
+            let max = parseFloat(canvas.dataset.max) || 0;
+            if (!canvas.dataset.max) {
+                seriesList.forEach(points => points.forEach(p => { if (p.max > max) max = p.max; }));
+            }
+            if (max <= 0) {
+                max = 1;
+            }
+            const x = t => (t - from) / (to - from) * width;
+            const y = v => height - 2 - Math.min(v, max) / max * (height - 4);
+            const line = points => {
+                ctx.beginPath();
+                points.forEach((p, j) => j === 0 ? ctx.moveTo(x(p.t), y(p.avg)) : ctx.lineTo(x(p.t), y(p.avg)));
+                ctx.stroke();
+            };
+
+            seriesList.forEach((points, i) => {
+                if (points.length === 0) {
+                    return;
+                }
+                const color = colors[i % colors.length];
+
+                ctx.globalAlpha = 0.2;
+                ctx.fillStyle = color;
+                ctx.beginPath();
+                points.forEach((p, j) => j === 0 ? ctx.moveTo(x(p.t), y(p.max)) : ctx.lineTo(x(p.t), y(p.max)));
+                for (let j = points.length - 1; j >= 0; j--) {
+                    ctx.lineTo(x(points[j].t), y(points[j].min));
+                }
+                ctx.closePath();
+                ctx.fill();
+
+                ctx.globalAlpha = 1;
+                ctx.strokeStyle = color;
+                ctx.lineWidth = 1.5;
+                line(points);
+
+                const band = bands && bands[i];
+                if (!band || band.upper.length === 0) {
+                    return;
+                }
+                ctx.globalAlpha = 0.6;
+                ctx.lineWidth = 1;
+                ctx.setLineDash([4, 3]);
+                line(band.lower);
+                line(band.upper);
+                ctx.setLineDash([]);
+
+                ctx.globalAlpha = 1;
+                ctx.fillStyle = '#e74c3c';
+                const lower = new Map(band.lower.map(p => [p.t, p.avg]));
+                const upper = new Map(band.upper.map(p => [p.t, p.avg]));
+                points.forEach(p => {
+                    if (upper.has(p.t) && (p.avg > upper.get(p.t) || p.avg < lower.get(p.t))) {
+                        ctx.beginPath();
+                        ctx.arc(x(p.t), y(p.avg), 2.5, 0, Math.PI * 2);
+                        ctx.fill();
+                    }
+                });
+            });
+        }
+
+        // 更新采集器健康状态
+        function updateHealth() {
+            fetch('/api/health')
+                .then(response => response.json())
+                .then(data => {
+                    const strip = document.getElementById('health-strip');
+                    strip.innerHTML = '';
+                    data.collectors.forEach(c => {
+                        const item = document.createElement('span');
+                        item.className = 'health-item ' + (c.healthy ? 'ok' : (c.runs > 0 ? 'failed' : ''));
+                        item.title = c.healthy
+                            ? '最后成功: ' + c.last_success + ' (耗时 ' + c.duration_ms.toFixed(1) + 'ms, 周期 ' + c.interval + ')'
+                            : '错误: ' + (c.last_error || '尚未采集') + (c.last_error_time ? ' (' + c.last_error_time + ')' : '');
+                        const dot = document.createElement('span');
+                        dot.className = 'health-dot';
+                        item.appendChild(dot);
+                        item.appendChild(document.createTextNode(c.name));
+                        strip.appendChild(item);
+                    });
+                })
+                .catch(error => {
+                    console.error('获取采集器状态失败:', error);
+                });
+        }
+
+        // 更新告警横幅，只显示触发中的告警；已静默或处于维护窗口的告警显示为灰色
+        function updateAlerts() {
+            fetch('/api/alerts')
+                .then(response => response.json())
+                .then(data => {
+                    const banner = document.getElementById('alert-banner');
+                    const firing = data.alerts.filter(a => a.state === 'firing');
+                    banner.innerHTML = '';
+                    banner.style.display = firing.length > 0 ? 'block' : 'none';
+                    firing.forEach(a => {
+                        const item = document.createElement('div');
+                        item.className = 'alert-item ' + (a.silenced_by ? 'muted' : a.severity);
+                        const severity = document.createElement('span');
+                        severity.className = 'alert-severity';
+                        severity.textContent = a.severity;
+                        const text = document.createElement('span');
+                        text.textContent = '🚨 ' + a.id + ' 当前值 ' + a.value.toFixed(2) + '（' + a.expr + '）';
+                        item.appendChild(severity);
+                        item.appendChild(text);
+                        if (a.silenced_by) {
+                            const tag = document.createElement('span');
+                            tag.className = 'alert-tag';
+                            tag.textContent = a.silenced_by.startsWith('silence:') ? '🔕 已静默' : '🛠 维护中';
+                            item.appendChild(tag);
+                        }
+                        if (a.acknowledged) {
+                            const tag = document.createElement('span');
+                            tag.className = 'alert-tag';
+                            tag.textContent = '✔ 已确认' + (a.acknowledged.comment ? ': ' + a.acknowledged.comment : '');
+                            item.appendChild(tag);
+                        }
+                        const since = document.createElement('span');
+                        since.className = 'alert-since';
+                        since.textContent = '触发于 ' + a.fired_at;
+                        item.appendChild(since);
+                        if (!replayMode && can.alerts) {
+                            item.appendChild(a.acknowledged
+                                ? actionButton('取消确认', () => alertAction('DELETE', '/api/alerts/ack?id=' + encodeURIComponent(a.id)))
+                                : actionButton('确认', () => {
+                                    const comment = prompt('确认备注', '');
+                                    if (comment !== null) alertAction('POST', '/api/alerts/ack', { id: a.id, comment: comment });
+                                }));
+                            item.appendChild(actionButton('静默', () => silenceAlert(a)));
+                        }
+                        banner.appendChild(item);
+                    });
+                    renderSilences(data);
+                })
+                .catch(error => {
+                    console.error('获取告警失败:', error);
+                });
+        }
+
+        // 显示静默和维护窗口列表，配置了告警规则时才显示
+        function renderSilences(data) {
+            const bar = document.getElementById('silence-bar');
+            bar.innerHTML = '';
+            bar.style.display = data.rules.length > 0 && !replayMode ? 'block' : 'none';
+            data.silences.forEach(s => {
+                const comment = s.comment ? '（' + s.comment + '）' : '';
+                bar.appendChild(silenceRow('🔕 静默 ' + s.matchers + ' 至 ' + new Date(s.ends_at).toLocaleString('zh-CN') + comment,
+                    can.alerts ? actionButton('解除', () => alertAction('DELETE', '/api/silences?id=' + s.id)) : null));
+            });
+            data.maintenance.forEach(w => {
+                const state = w.active ? ' · 生效中' : '';
+                const comment = w.comment ? '（' + w.comment + '）' : '';
+                bar.appendChild(silenceRow('🛠 维护窗口 ' + w.spec + state + comment,
+                    w.source === 'config' || !can.alerts ? null : actionButton('删除', () => alertAction('DELETE', '/api/maintenance?id=' + w.id))));
+            });
+            if (!can.alerts) return;
+            const tools = silenceRow('', actionButton('＋ 静默', () => {
+                const matchers = prompt('标签选择器，如 {rule="high_cpu"}', '{rule=""}');
+                if (matchers === null) return;
+                const duration = prompt('静默时长，如 30m、2h', '1h');
+                if (duration === null) return;
+                alertAction('POST', '/api/silences', { matchers: matchers, duration: duration, comment: prompt('备注', '') || '' });
+            }));
+            tools.appendChild(actionButton('＋ 维护窗口', () => {
+                const spec = prompt('维护窗口（北京时间），如 sun 02:00-04:00 或 mon-fri 23:30-00:30 {rule="high_cpu"}', '');
+                if (spec === null || spec === '') return;
+                alertAction('POST', '/api/maintenance', { spec: spec, comment: prompt('备注', '') || '' });
+            }));
+            bar.appendChild(tools);
+        }
+
+        // 静默列表中的一行
+        function silenceRow(text, button) {
+            const row = document.createElement('div');
+            row.className = 'silence-row';
+            const label = document.createElement('span');
+            label.textContent = text;
+            row.appendChild(label);
+            if (button) row.appendChild(button);
+            return row;
+        }
+
+        // 创建操作按钮
+        function actionButton(text, onClick) {
+            const button = document.createElement('button');
+            button.textContent = text;
+            button.addEventListener('click', onClick);
+            return button;
+        }
+
+        // 按告警的规则名和标签静默
+        function silenceAlert(a) {
+            const duration = prompt('静默 ' + a.id + ' 的时长，如 30m、2h', '1h');
+            if (duration === null) return;
+            const labels = Object.entries(a.labels || {}).map(([k, v]) => ',' + k + '="' + v + '"').join('');
+            alertAction('POST', '/api/silences', {
+                matchers: '{rule="' + a.rule + '"' + labels + '}',
+                duration: duration,
+                comment: prompt('备注', '') || ''
+            });
+        }
+
+        // 执行告警管理操作，完成后刷新告警
+        function alertAction(method, url, body) {
+            fetch(url, {
+                method: method,
+                headers: { 'Content-Type': 'application/json' },
+                body: body ? JSON.stringify(body) : undefined
+            })
+                .then(response => {
+                    if (!response.ok) {
+                        return response.text().then(text => { throw new Error(text); });
+                    }
+                    updateAlerts();
+                })
+                .catch(error => {
+                    alert('操作失败: ' + error.message);
+                });
+        }
+
+        // 把秒数格式化为 3天4小时 这样的剩余时间
+        function formatETA(seconds) {
+            const minutes = Math.floor(seconds / 60);
+            const days = Math.floor(minutes / 1440);
+            const hours = Math.floor(minutes % 1440 / 60);
+            if (days > 0) return days + '天' + hours + '小时';
+            if (hours > 0) return hours + '小时' + minutes % 60 + '分钟';
+            return Math.max(minutes, 1) + '分钟';
+        }
+
+        // 在磁盘卡片上显示最先写满的挂载点，悬停显示所有挂载点的预测
+        function updateForecast() {
+            fetch('/api/forecast')
+                .then(response => response.json())
+                .then(data => {
+                    const el = document.getElementById('disk-forecast');
+                    const disks = data.forecasts.filter(f => f.resource === 'disk');
+                    const growing = disks.filter(f => f.status === 'growing')
+                        .sort((a, b) => a.seconds_to_full - b.seconds_to_full);
+                    if (growing.length > 0) {
+                        el.textContent = formatETA(growing[0].seconds_to_full) + '（' + growing[0].labels.mount + '）';
+                    } else if (disks.some(f => f.status === 'stable')) {
+                        el.textContent = '无增长趋势';
+                    } else {
+                        el.textContent = disks.length > 0 ? '数据不足' : '-';
+                    }
+                    el.title = disks.map(f => f.labels.mount + ': ' +
+                        (f.status === 'growing' ? formatETA(f.seconds_to_full) + '后写满' : f.status === 'stable' ? '无增长' : '数据不足')).join('\n');
+                })
+                .catch(error => {
+                    console.error('获取容量预测失败:', error);
+                });
+        }
+
         // 加载网络接口列表
         function loadInterfaces() {
             fetch('/api/interfaces')
@@ -513,10 +1312,28 @@ var htmlTemplate = `
         // 页面加载完成后开始定时更新
         document.addEventListener('DOMContentLoaded', function() {
             loadInterfaces();
-            // 立即执行一次更新
-            setTimeout(updateStats, 1000);
-            // 设置定时更新
-            setInterval(updateStats, updateInterval);
+            startUpdates();
+
+            // 绑定回放控制
+            if (replayMode) {
+                document.getElementById('replay-toggle').addEventListener('click', function() {
+                    controlReplay({ action: replayState && replayState.playing ? 'pause' : 'play' });
+                });
+                const seek = document.getElementById('replay-seek');
+                seek.addEventListener('input', function() {
+                    seeking = true;
+                });
+                seek.addEventListener('change', function() {
+                    seeking = false;
+                    if (replayState) {
+                        const position = replayState.start + (replayState.end - replayState.start) * this.value / 1000;
+                        controlReplay({ action: 'seek', position: position });
+                    }
+                });
+                document.getElementById('replay-speed').addEventListener('change', function() {
+                    controlReplay({ action: 'speed', speed: parseFloat(this.value) });
+                });
+            }
             
             // 绑定接口选择器事件
             document.getElementById('interface-selector').addEventListener('change', function() {
@@ -528,12 +1345,11 @@ var htmlTemplate = `
         });
         
         // 添加页面可见性检测，当页面不可见时停止更新
-        let updateTimer;
         document.addEventListener('visibilitychange', function() {
             if (document.hidden) {
-                clearInterval(updateTimer);
+                stopUpdates();
             } else {
-                updateTimer = setInterval(updateStats, updateInterval);
+                startUpdates();
             }
         });
     </script>
@@ -541,488 +1357,10576 @@ var htmlTemplate = `
 </html>
 `
 
-func main() {
-	// 解析命令行参数
-	var (
-		port = flag.Int("port", 8080, "Web服务器端口")
-	)
-	flag.Parse()
+var trafficTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>流量统计</title>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        * { margin: 0; padding: 0; box-sizing: border-box; }
+        body {
+            font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            padding: 20px;
+        }
+        .container { max-width: 1400px; margin: 0 auto; }
+        .header {
+            text-align: center;
+            color: white;
+            margin-bottom: 30px;
+            text-shadow: 0 2px 4px rgba(0,0,0,0.3);
+        }
+        .header h1 { font-size: 2.5rem; font-weight: 300; margin-bottom: 10px; }
+        .header a { color: white; }
+        .tabs { display: flex; flex-wrap: wrap; justify-content: center; gap: 10px; margin-bottom: 25px; }
+        .tab {
+            padding: 6px 16px;
+            border-radius: 14px;
+            background: rgba(255,255,255,0.15);
+            color: white;
+            text-decoration: none;
+        }
+        .tab.active { background: rgba(255,255,255,0.95); color: #764ba2; font-weight: 600; }
+        .stats-grid {
+            display: grid;
+            grid-template-columns: repeat(auto-fit, minmax(320px, 1fr));
+            gap: 25px;
+        }
+        .stat-card {
+            background: rgba(255, 255, 255, 0.95);
+            padding: 25px;
+            border-radius: 16px;
+            box-shadow: 0 8px 32px rgba(0,0,0,0.1);
+        }
+        .stat-title { font-size: 20px; font-weight: 600; color: #9b59b6; margin-bottom: 20px; }
+        .stat-item {
+            display: flex;
+            justify-content: space-between;
+            margin: 12px 0;
+            padding: 8px 0;
+            border-bottom: 1px solid rgba(0,0,0,0.05);
+        }
+        .stat-label { color: #7f8c8d; font-weight: 500; }
+        .stat-value { font-weight: 700; color: #2c3e50; }
+        .progress-bar {
+            width: 100%;
+            height: 8px;
+            background-color: rgba(0,0,0,0.1);
+            border-radius: 4px;
+            overflow: hidden;
+            margin: 10px 0;
+        }
+        .progress-fill { height: 100%; border-radius: 4px; background: linear-gradient(90deg, #9b59b6, #b07cc6); }
+        .progress-fill.over { background: linear-gradient(90deg, #e74c3c, #ff6b6b); }
+        table { width: 100%; border-collapse: collapse; font-size: 14px; }
+        th, td { padding: 6px 4px; text-align: right; border-bottom: 1px solid rgba(0,0,0,0.05); }
+        th:first-child, td:first-child { text-align: left; }
+        th { color: #7f8c8d; font-weight: 500; }
+        .table-scroll { max-height: 420px; overflow-y: auto; }
+        .empty { color: white; text-align: center; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="header">
+            <h1>📈 流量统计</h1>
+            <p><a href="/">返回监控面板</a> · 账单日: 每月{{.BillingDay}}日</p>
+        </div>
+        {{if .Report}}
+        <div class="tabs">
+            {{range .Reports}}
+            <a class="tab{{if eq .Interface $.Report.Interface}} active{{end}}" href="/traffic?interface={{.Interface}}">{{.Interface}}</a>
+            {{end}}
+        </div>
+        {{with .Report}}
+        <div class="stats-grid">
+            <div class="stat-card">
+                <div class="stat-title">本账单周期</div>
+                <div class="stat-item">
+                    <span class="stat-label">周期:</span>
+                    <span class="stat-value">{{day .Cycle.Start}} ~ {{day .Cycle.End}}</span>
+                </div>
+                <div class="stat-item">
+                    <span class="stat-label">接收:</span>
+                    <span class="stat-value">{{bytes .Cycle.Rx}}</span>
+                </div>
+                <div class="stat-item">
+                    <span class="stat-label">发送:</span>
+                    <span class="stat-value">{{bytes .Cycle.Tx}}</span>
+                </div>
+                <div class="stat-item">
+                    <span class="stat-label">合计:</span>
+                    <span class="stat-value">{{bytes .Cycle.Total}}</span>
+                </div>
+                <div class="stat-item">
+                    <span class="stat-label">预计周期用量:</span>
+                    <span class="stat-value">{{bytes .Cycle.Projected}}</span>
+                </div>
+                {{if .Cycle.Quota}}
+                <div class="stat-item">
+                    <span class="stat-label">配额:</span>
+                    <span class="stat-value">{{bytes .Cycle.Quota}} ({{printf "%.1f" .Cycle.QuotaUsage}}%)</span>
+                </div>
+                <div class="progress-bar">
+                    <div class="progress-fill{{if ge .Cycle.QuotaUsage 100.0}} over{{end}}" style="width: {{printf "%.1f" .Cycle.QuotaUsage}}%"></div>
+                </div>
+                {{end}}
+            </div>
 
-	// 创建临时监控器来获取可用网卡
-	tempMonitor := &Monitor{}
-	interfaces := tempMonitor.getAvailableInterfaces()
-	defaultInterface := ""
+            <div class="stat-card">
+                <div class="stat-title">按月</div>
+                <table>
+                    <tr><th>周期起始</th><th>接收</th><th>发送</th><th>合计</th></tr>
+                    {{range .Months}}
+                    <tr><td>{{day .Start}}</td><td>{{bytes .Rx}}</td><td>{{bytes .Tx}}</td><td>{{bytes (.Total)}}</td></tr>
+                    {{end}}
+                </table>
+            </div>
 
-	// 自动选择第一个可用网卡
-	if len(interfaces) > 0 {
+            <div class="stat-card">
+                <div class="stat-title">按天</div>
+                <div class="table-scroll">
+                    <table>
+                        <tr><th>日期</th><th>接收</th><th>发送</th><th>合计</th></tr>
+                        {{range .Days}}
+                        <tr><td>{{day .Start}}</td><td>{{bytes .Rx}}</td><td>{{bytes .Tx}}</td><td>{{bytes (.Total)}}</td></tr>
+                        {{end}}
+                    </table>
+                </div>
+            </div>
+
+            <div class="stat-card">
+                <div class="stat-title">按小时</div>
+                <div class="table-scroll">
+                    <table>
+                        <tr><th>时间</th><th>接收</th><th>发送</th><th>合计</th></tr>
+                        {{range .Hours}}
+                        <tr><td>{{hour .Start}}</td><td>{{bytes .Rx}}</td><td>{{bytes .Tx}}</td><td>{{bytes (.Total)}}</td></tr>
+                        {{end}}
+                    </table>
+                </div>
+            </div>
+        </div>
+        {{end}}
+        {{else}}
+        <p class="empty">暂无流量数据</p>
+        {{end}}
+    </div>
+</body>
+</html>
+`
+
+// reportTemplate 每日报告邮件，邮件客户端大多会忽略<style>，因此使用行内样式
+var reportTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{.Host}} 每日报告</title>
+    <meta charset="UTF-8">
+</head>
+<body style="font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif; color: #333; margin: 0; padding: 20px; background: #f5f6fa;">
+    <div style="max-width: 640px; margin: 0 auto; background: white; border-radius: 10px; padding: 24px;">
+        <h2 style="margin: 0 0 4px 0; color: #667eea;">🖥️ {{.Host}} 每日报告</h2>
+        <p style="margin: 0 0 20px 0; color: #888; font-size: 13px;">{{.From}} 至 {{.To}}</p>
+
+        <h3 style="margin: 0 0 8px 0; font-size: 15px;">系统指标</h3>
+        <table style="width: 100%; border-collapse: collapse; font-size: 14px; margin-bottom: 20px;">
+            <tr style="background: #f0f1f7;">
+                <th style="text-align: left; padding: 8px;">指标</th>
+                <th style="text-align: right; padding: 8px;">最小</th>
+                <th style="text-align: right; padding: 8px;">平均</th>
+                <th style="text-align: right; padding: 8px;">最大</th>
+            </tr>
+            {{range .Metrics}}
+            <tr style="border-bottom: 1px solid #eee;">
+                <td style="padding: 8px;">{{.Name}}</td>
+                <td style="text-align: right; padding: 8px;">{{.Min}}</td>
+                <td style="text-align: right; padding: 8px;">{{.Avg}}</td>
+                <td style="text-align: right; padding: 8px;">{{.Max}}</td>
+            </tr>
+            {{end}}
+        </table>
+
+        <h3 style="margin: 0 0 8px 0; font-size: 15px;">网络流量</h3>
+        {{if .Traffic}}
+        <table style="width: 100%; border-collapse: collapse; font-size: 14px; margin-bottom: 20px;">
+            <tr style="background: #f0f1f7;">
+                <th style="text-align: left; padding: 8px;">网卡</th>
+                <th style="text-align: right; padding: 8px;">接收</th>
+                <th style="text-align: right; padding: 8px;">发送</th>
+                <th style="text-align: right; padding: 8px;">合计</th>
+            </tr>
+            {{range .Traffic}}
+            <tr style="border-bottom: 1px solid #eee;">
+                <td style="padding: 8px;">{{.Interface}}</td>
+                <td style="text-align: right; padding: 8px;">{{bytes .Rx}}</td>
+                <td style="text-align: right; padding: 8px;">{{bytes .Tx}}</td>
+                <td style="text-align: right; padding: 8px;">{{bytes .Total}}</td>
+            </tr>
+            {{end}}
+        </table>
+        {{else}}
+        <p style="color: #888; font-size: 14px; margin-bottom: 20px;">暂无流量数据</p>
+        {{end}}
+
+        {{if .Alerts}}
+        <h3 style="margin: 0 0 8px 0; font-size: 15px;">正在触发的告警</h3>
+        <ul style="font-size: 14px; padding-left: 20px; margin: 0;">
+            {{range .Alerts}}
+            <li style="margin-bottom: 4px;"><b>[{{.Severity}}] {{.ID}}</b> 当前值 {{printf "%.2f" .Value}}，规则 {{.Expr}}，自 {{.FiredAt}} 起</li>
+            {{end}}
+        </ul>
+        {{end}}
+    </div>
+</body>
+</html>
+`
+
+// fleetPage hub 模式的主机总览页面，数据由页面通过 /api/fleet 获取
+var fleetPage = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>主机总览</title>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        * { margin: 0; padding: 0; box-sizing: border-box; }
+        body {
+            font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            padding: 20px;
+        }
+        .container { max-width: 1400px; margin: 0 auto; }
+        .header {
+            text-align: center;
+            color: white;
+            margin-bottom: 30px;
+            text-shadow: 0 2px 4px rgba(0,0,0,0.3);
+        }
+        .header h1 { font-size: 2.5rem; font-weight: 300; margin-bottom: 10px; }
+        .header a { color: white; }
+        .stat-card {
+            background: rgba(255, 255, 255, 0.95);
+            padding: 25px;
+            border-radius: 16px;
+            box-shadow: 0 8px 32px rgba(0,0,0,0.1);
+            overflow-x: auto;
+        }
+        table { width: 100%; border-collapse: collapse; font-size: 14px; }
+        th, td { padding: 8px 6px; text-align: right; border-bottom: 1px solid rgba(0,0,0,0.05); white-space: nowrap; }
+        th:first-child, td:first-child, th:nth-child(2), td:nth-child(2) { text-align: left; }
+        th { color: #7f8c8d; font-weight: 500; }
+        td a { color: #667eea; font-weight: 600; text-decoration: none; }
+        tr.offline td { color: #95a5a6; }
+        .dot { display: inline-block; width: 10px; height: 10px; border-radius: 50%; margin-right: 6px; }
+        .dot.ok { background: #2ecc71; }
+        .dot.degraded { background: #f39c12; }
+        .dot.offline { background: #e74c3c; }
+        .bar { display: inline-block; width: 60px; height: 6px; margin-left: 6px; background: rgba(0,0,0,0.1); border-radius: 3px; overflow: hidden; vertical-align: middle; }
+        .bar span { display: block; height: 100%; background: #2ecc71; }
+        .bar span.warn { background: #f39c12; }
+        .bar span.crit { background: #e74c3c; }
+        .alerts { color: #e74c3c; font-weight: 700; }
+        .error { color: #e74c3c; font-size: 12px; }
+        button { padding: 2px 8px; border: none; border-radius: 8px; background: #ecf0f1; color: #7f8c8d; cursor: pointer; }
+        .empty { color: #7f8c8d; text-align: center; padding: 20px; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="header">
+            <h1>🖧 主机总览</h1>
+            <p><a href="/">返回监控面板</a> · <span id="summary"></span></p>
+        </div>
+        <div class="stat-card">
+            <table>
+                <thead>
+                    <tr>
+                        <th>主机</th><th>状态</th><th>CPU</th><th>内存</th><th>磁盘</th><th>负载</th>
+                        <th>下载</th><th>上传</th><th>告警</th><th>最后上报</th><th></th>
+                    </tr>
+                </thead>
+                <tbody id="hosts"></tbody>
+            </table>
+        </div>
+    </div>
+    <script>
+        function escapeHTML(s) {
+            return String(s).replace(/[&<>"']/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'}[c]));
+        }
+
+        function usage(value) {
+            const v = parseFloat(value);
+            if (isNaN(v)) return '-';
+            const level = v >= 90 ? 'crit' : v >= 75 ? 'warn' : '';
+            return v.toFixed(1) + '%<span class="bar"><span class="' + level + '" style="width: ' + Math.min(v, 100) + '%"></span></span>';
+        }
+
+        function speed(value) {
+            const v = parseFloat(value);
+            if (isNaN(v)) return '-';
+            return v >= 1024 ? (v / 1024).toFixed(2) + ' MB/s' : v.toFixed(0) + ' KB/s';
+        }
+
+        // 只把 http/https 地址（包括本机的相对地址）显示为链接
+        function safeURL(raw) {
+            if (!raw) return false;
+            try {
+                const u = new URL(raw, location.href);
+                return u.protocol === 'http:' || u.protocol === 'https:';
+            } catch (e) {
+                return false;
+            }
+        }
+
+        function hostRow(h) {
+            const s = h.stats || {};
+            const state = !h.online ? 'offline' : h.health === 'degraded' ? 'degraded' : 'ok';
+            const label = {ok: '在线', degraded: '采集异常', offline: '离线'}[state];
+            const name = safeURL(h.url) ? '<a href="' + escapeHTML(h.url) + '" target="_blank" rel="noopener">' + escapeHTML(h.host) + '</a>' : escapeHTML(h.host);
+            const error = h.error ? '<div class="error">' + escapeHTML(h.error) + '</div>' : '';
+            const remove = h.online ? '' : '<button onclick="removeHost(\'' + encodeURIComponent(h.host) + '\')">移除</button>';
+            return '<tr class="' + (h.online ? '' : 'offline') + '">' +
+                '<td>' + name + '</td>' +
+                '<td><span class="dot ' + state + '"></span>' + label + error + '</td>' +
+                '<td>' + usage(s.cpu_usage) + '</td>' +
+                '<td>' + usage(s.mem_usage) + '</td>' +
+                '<td>' + usage(s.disk_usage) + '</td>' +
+                '<td>' + escapeHTML(s.last1 || '-') + '</td>' +
+                '<td>' + speed(s.receive_speed) + '</td>' +
+                '<td>' + speed(s.transmit_speed) + '</td>' +
+                '<td class="' + (h.alerts > 0 ? 'alerts' : '') + '">' + h.alerts + '</td>' +
+                '<td>' + escapeHTML(h.last_seen || '从未') + '</td>' +
+                '<td>' + remove + '</td>' +
+                '</tr>';
+        }
+
+        function updateFleet() {
+            fetch('/api/fleet')
+                .then(response => response.json())
+                .then(data => {
+                    document.getElementById('summary').textContent =
+                        '共 ' + data.hosts.length + ' 台 · 在线 ' + data.online + ' · 离线 ' + data.offline + ' · 超过 ' + data.offline_after + ' 未上报视为离线';
+                    document.getElementById('hosts').innerHTML = data.hosts.length > 0
+                        ? data.hosts.map(hostRow).join('')
+                        : '<tr><td colspan="11" class="empty">暂无主机上报</td></tr>';
+                })
+                .catch(error => console.error('获取主机列表失败:', error));
+        }
+
+        function removeHost(host) {
+            if (!confirm('从列表中移除 ' + decodeURIComponent(host) + '？主机再次上报时会重新出现。')) return;
+            fetch('/api/fleet?host=' + host, {method: 'DELETE'}).then(updateFleet);
+        }
+
+        updateFleet();
+        setInterval(updateFleet, 5000);
+    </script>
+</body>
+</html>
+`
+
+// loginTemplate 登录页面
+var loginTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>登录 - 系统监控面板</title>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        * { margin: 0; padding: 0; box-sizing: border-box; }
+        body {
+            font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            padding: 20px;
+        }
+        .login-card {
+            background: rgba(255, 255, 255, 0.95);
+            padding: 35px;
+            border-radius: 16px;
+            box-shadow: 0 8px 32px rgba(0,0,0,0.1);
+            width: 100%;
+            max-width: 360px;
+        }
+        h1 { font-size: 22px; font-weight: 600; color: #667eea; margin-bottom: 25px; text-align: center; }
+        label { display: block; color: #7f8c8d; font-weight: 500; margin-bottom: 6px; }
+        input[type=text], input[type=password] {
+            width: 100%;
+            padding: 10px 12px;
+            margin-bottom: 18px;
+            border: 1px solid rgba(0,0,0,0.1);
+            border-radius: 8px;
+            font-size: 15px;
+        }
+        button {
+            width: 100%;
+            padding: 11px;
+            border: none;
+            border-radius: 8px;
+            background: linear-gradient(90deg, #667eea, #764ba2);
+            color: white;
+            font-size: 16px;
+            cursor: pointer;
+        }
+        .error { color: #e74c3c; margin-bottom: 15px; text-align: center; }
+    </style>
+</head>
+<body>
+    <form class="login-card" method="POST" action="/login">
+        <h1>🖥️ 系统监控面板</h1>
+        {{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+        <input type="hidden" name="next" value="{{.Next}}">
+        <label for="username">用户名</label>
+        <input type="text" id="username" name="username" value="{{.Username}}" autocomplete="username" autofocus required>
+        <label for="password">密码</label>
+        <input type="password" id="password" name="password" autocomplete="current-password" required>
+        <button type="submit">登录</button>
+    </form>
+</body>
+</html>
+`
+
+func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "record":
+			runRecord(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "ca":
+			runCA(os.Args[2:])
+			return
+		case "passwd":
+			runPasswd(os.Args[2:])
+			return
+		}
+	}
+
+	// 解析命令行参数
+	var (
+		port      = flag.Int("port", 8080, "Web服务器端口")
+		intervals = flag.String("intervals", "", "各采集器的采集周期，如 disk=30s,cpu=2s (采集器: system,cpu,memory,disk,network,traffic)")
+		timeout   = flag.Duration("timeout", 5*time.Second, "单次采集的超时时间")
+		shutdown  = flag.Duration("shutdown-timeout", 10*time.Second, "退出时等待HTTP请求处理完毕的最长时间")
+		history   = flag.Int("history", 3600, "每个指标在内存中保留的历史样本数（每秒一个）")
+		dataDir   = flag.String("data-dir", "", "持久化历史数据的目录，为空时不持久化")
+		retention = flag.String("retention", "", "各分辨率数据的保留时长，如 raw=48h,1m=30d,1h=365d")
+		billing   = flag.Int("billing-day", 1, "流量统计的账单日（每月1-31日，当月没有该日时为月末）")
+		quota     = flag.String("traffic-quota", "", "每个网卡每个账单周期的流量配额（收发合计），如 500GB、1TB")
+
+		influxURL      = flag.String("influx-url", "", "InfluxDB 地址，如 http://localhost:8086（v1 可在地址中带用户名密码）")
+		influxDB       = flag.String("influx-db", "sysmon", "InfluxDB v1 数据库名")
+		influxOrg      = flag.String("influx-org", "", "InfluxDB v2 组织")
+		influxBucket   = flag.String("influx-bucket", "", "InfluxDB v2 存储桶，设置后使用 v2 写入接口")
+		influxToken    = flag.String("influx-token", "", "InfluxDB v2 API Token")
+		influxInterval = flag.Duration("influx-interval", 10*time.Second, "推送到 InfluxDB 的间隔")
+		influxBatch    = flag.Int("influx-batch", 5000, "单次写入 InfluxDB 的最大行数")
+		influxQueue    = flag.Int("influx-queue", 100000, "InfluxDB 不可用时最多缓存的行数，超出后丢弃最旧的数据")
+
+		graphiteAddr     = flag.String("graphite-addr", "", "Graphite plaintext 地址，如 localhost:2003")
+		graphitePrefix   = flag.String("graphite-prefix", "sysmon.{hostname}", "Graphite 指标路径前缀，支持 {hostname} 占位符")
+		graphiteInterval = flag.Duration("graphite-interval", 10*time.Second, "推送到 Graphite 的间隔")
+		graphiteQueue    = flag.Int("graphite-queue", 100000, "Graphite 不可用时最多缓存的行数，超出后丢弃最旧的数据")
+		statsdAddr       = flag.String("statsd-addr", "", "StatsD 地址（UDP），如 localhost:8125")
+		statsdPrefix     = flag.String("statsd-prefix", "sysmon.{hostname}", "StatsD 指标名前缀，支持 {hostname} 占位符")
+		statsdInterval   = flag.Duration("statsd-interval", 10*time.Second, "推送到 StatsD 的间隔")
+
+		otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP 地址，如 http://localhost:4318（未指定路径时使用 /v1/metrics）")
+		otlpHeaders  = flag.String("otlp-headers", "", "OTLP 请求附加的头，如 Authorization=Bearer xxx,X-Tenant=a")
+		otlpInterval = flag.Duration("otlp-interval", 10*time.Second, "推送到 OTLP 的间隔")
+
+		mqttBroker    = flag.String("mqtt-broker", "", "MQTT broker 地址，如 tcp://localhost:1883 或 ssl://broker:8883")
+		mqttTopic     = flag.String("mqtt-topic", "sysmon/{hostname}", "MQTT 主题前缀，支持 {hostname} 占位符")
+		mqttUser      = flag.String("mqtt-username", "", "MQTT 用户名")
+		mqttPassword  = flag.String("mqtt-password", "", "MQTT 密码，需要同时设置 -mqtt-username")
+		mqttClientID  = flag.String("mqtt-client-id", "sysmon-{hostname}", "MQTT 客户端ID，支持 {hostname} 占位符")
+		mqttQoS       = flag.Int("mqtt-qos", 0, "MQTT 发布的 QoS（0或1）")
+		mqttRetain    = flag.Bool("mqtt-retain", false, "MQTT 发布指标时设置 retain 标志")
+		mqttJSON      = flag.Bool("mqtt-json", false, "把所有指标作为一条 JSON 发布到 <主题前缀>/state，而不是每个指标一个主题")
+		mqttDiscovery = flag.Bool("mqtt-ha-discovery", false, "发布 Home Assistant 自动发现消息")
+		mqttHAPrefix  = flag.String("mqtt-ha-prefix", "homeassistant", "Home Assistant 自动发现的主题前缀")
+		mqttInterval  = flag.Duration("mqtt-interval", 10*time.Second, "发布到 MQTT 的间隔")
+		mqttCAFile    = flag.String("mqtt-ca-file", "", "校验 MQTT broker 证书的 CA 文件（PEM）")
+		mqttInsecure  = flag.Bool("mqtt-insecure", false, "不校验 MQTT broker 的证书")
+
+		forecastWindow = flag.Duration("forecast-window", 6*time.Hour, "预测磁盘、内存和SWAP写满时间时拟合趋势使用的历史时长，0表示不预测")
+
+		anomaly          = flag.Bool("anomaly", false, "对CPU、负载、网络和磁盘读写速度启用异常检测")
+		anomalyThreshold = flag.Float64("anomaly-threshold", 3, "偏离预期值多少个标准差视为异常")
+		anomalyHalfLife  = flag.Duration("anomaly-halflife", 30*time.Minute, "异常检测基线（EWMA）的半衰期，越长基线变化越慢")
+		anomalySeasonal  = flag.Bool("anomaly-seasonal", false, "按一天中的小时分别建立异常检测基线，适合有日周期的负载")
+
+		alertRules  = flag.String("alert-rules", "", "告警规则文件，每行一条规则，如 high_cpu: cpu_usage > 90 for 5m")
+		maintenance = flag.String("maintenance", "", "维护窗口（北京时间），多个用分号分隔，如 sun 02:00-04:00;mon-fri 23:30-00:30 {rule=\"high_cpu\"}")
+
+		webhookURL      = flag.String("webhook-url", "", "告警 Webhook 地址，告警触发和恢复时发送 POST 请求")
+		webhookTemplate = flag.String("webhook-template", "", "Webhook 请求体的 Go text/template 模板文件，为空时发送JSON")
+		webhookHeaders  = flag.String("webhook-headers", "", "Webhook 请求附加的头，如 Authorization=Bearer xxx,X-Tenant=a")
+		webhookSecret   = flag.String("webhook-secret", "", "用于 HMAC-SHA256 签名请求体的密钥")
+		webhookRenotify = flag.Duration("webhook-renotify", 4*time.Hour, "告警持续触发时重复通知的间隔，0表示不重复")
+		webhookRetries  = flag.Int("webhook-retries", 5, "发送失败时的最大重试次数")
+
+		smtpAddr       = flag.String("smtp-addr", "", "SMTP 服务器地址，如 smtp.example.com:587")
+		smtpTLS        = flag.String("smtp-tls", "auto", "SMTP 加密方式: auto(服务器支持时使用STARTTLS)、starttls、tls(隐式TLS，通常为465端口)、none")
+		smtpUsername   = flag.String("smtp-username", "", "SMTP 认证用户名，为空时不认证")
+		smtpPassword   = flag.String("smtp-password", "", "SMTP 认证密码")
+		smtpFrom       = flag.String("smtp-from", "", "发件人地址")
+		smtpTo         = flag.String("smtp-to", "", "收件人地址，多个用逗号分隔")
+		smtpInsecure   = flag.Bool("smtp-insecure", false, "不校验 SMTP 服务器的证书")
+		smtpRenotify   = flag.Duration("smtp-renotify", 4*time.Hour, "告警持续触发时重复发送邮件的间隔，0表示不重复")
+		smtpRetries    = flag.Int("smtp-retries", 5, "邮件发送失败时的最大重试次数")
+		smtpReportTime = flag.String("report-time", "", "每天发送报告邮件的时间（北京时间），如 08:00，为空时不发送")
+
+		hubMode         = flag.Bool("hub", false, "作为 hub 接收其他 sysmon 上报的状态，并提供 /fleet 主机总览")
+		hubPull         = flag.String("hub-pull", "", "hub 主动拉取的 sysmon 地址，逗号分隔，如 http://web1:8080,http://web2:8080（隐含 -hub）")
+		hubPullInterval = flag.Duration("hub-pull-interval", 10*time.Second, "hub 拉取的间隔")
+		hubOffline      = flag.Duration("hub-offline-after", time.Minute, "超过这个时间没有收到主机的数据时视为离线")
+		hubURL          = flag.String("hub-url", "", "hub 地址，如 http://hub:8080，设置后定期把本机状态推送到 hub")
+		hubName         = flag.String("hub-name", "", "上报到 hub 的主机名，为空时使用本机主机名")
+		hubAdvertise    = flag.String("hub-advertise", "", "上报到 hub 的本机面板地址，用于从总览页跳转，为空时由 hub 按来源地址和 -port 推断")
+		hubInterval     = flag.Duration("hub-interval", 10*time.Second, "推送到 hub 的间隔")
+
+		tlsCert           = flag.String("tls-cert", "", "Web服务器的证书文件（PEM），与 -tls-key 一起设置后使用 HTTPS")
+		tlsKey            = flag.String("tls-key", "", "Web服务器的私钥文件（PEM）")
+		hubEnrollSecret   = flag.String("hub-enroll-secret", "", "hub: agent 注册时使用的共享密钥，注册成功后为每个 agent 分配独立的令牌，为空时不开放注册")
+		hubClientCA       = flag.String("hub-client-ca", "", "hub: 校验 agent 客户端证书的 CA 文件（PEM），需要同时启用 HTTPS")
+		hubCAKey          = flag.String("hub-ca-key", "", "hub: -hub-client-ca 对应的CA私钥，设置后注册时为 agent 签发客户端证书")
+		hubAllowAnonymous = flag.Bool("hub-allow-anonymous", false, "hub: 接受未认证的推送（仅用于可信网络）")
+		hubCA             = flag.String("hub-ca", "", "校验 hub（或被拉取实例）服务器证书的 CA 文件（PEM）")
+		hubCert           = flag.String("hub-cert", "", "连接 hub（或被拉取实例）时使用的客户端证书（PEM）")
+		hubKey            = flag.String("hub-key", "", "客户端证书的私钥（PEM）")
+		hubToken          = flag.String("hub-token", "", "agent: hub 分配的令牌")
+		hubJoin           = flag.String("hub-join", "", "agent: 用于向 hub 注册的共享密钥（与 hub 的 -hub-enroll-secret 相同）")
+		hubPullToken      = flag.String("hub-pull-token", "", "hub 拉取启用了认证的实例时使用的令牌")
+
+		authUsers      = flag.String("auth-users", "", "用户文件，每行 用户名:bcrypt哈希[:viewer|admin]（可用 sysmon passwd 生成，省略角色时为 viewer），设置后需要登录")
+		authTokens     = flag.String("auth-tokens", "", "API 令牌文件，每行 名称:令牌[:权限,...]，客户端以 Authorization: Bearer <令牌> 访问；未写权限时只读")
+		authSessionTTL = flag.Duration("auth-session-ttl", 12*time.Hour, "登录会话的有效期")
+	)
+	flag.Parse()
+
+	collectIntervals, err := parseIntervals(*intervals)
+	if err != nil {
+		log.Fatalf("无效的 -intervals 参数: %v", err)
+	}
+	storeRetention, err := parseRetention(*retention)
+	if err != nil {
+		log.Fatalf("无效的 -retention 参数: %v", err)
+	}
+	if *billing < 1 || *billing > 31 {
+		log.Fatalf("无效的 -billing-day 参数: 必须在1-31之间")
+	}
+	trafficQuota, err := parseBytes(*quota)
+	if err != nil {
+		log.Fatalf("无效的 -traffic-quota 参数: %v", err)
+	}
+
+	// 创建临时监控器来获取可用网卡
+	tempMonitor := &Monitor{}
+	interfaces := tempMonitor.getAvailableInterfaces()
+	defaultInterface := ""
+
+	// 自动选择第一个可用网卡
+	if len(interfaces) > 0 {
 		defaultInterface = interfaces[0]
 		// 保存自动选择的网卡到内存
 		setSelectedInterface(defaultInterface)
 	}
 
-	// 创建配置
-	config := Config{
-		Interface: defaultInterface,
-		Port:      *port,
-		Interval:  1 * time.Second,
+	// 创建配置
+	config := Config{
+		Interface: defaultInterface,
+		Port:      *port,
+		Interval:  1 * time.Second,
+		Intervals: collectIntervals,
+		Timeout:   *timeout,
+
+		ShutdownTimeout: *shutdown,
+		HistorySize:     *history,
+		DataDir:         *dataDir,
+		Retention:       storeRetention,
+		BillingDay:      *billing,
+		TrafficQuota:    trafficQuota,
+		Influx: InfluxConfig{
+			URL:       *influxURL,
+			Database:  *influxDB,
+			Org:       *influxOrg,
+			Bucket:    *influxBucket,
+			Token:     *influxToken,
+			Interval:  *influxInterval,
+			BatchSize: *influxBatch,
+			QueueSize: *influxQueue,
+		},
+		Graphite: GraphiteConfig{
+			Addr:      *graphiteAddr,
+			Prefix:    *graphitePrefix,
+			Interval:  *graphiteInterval,
+			QueueSize: *graphiteQueue,
+		},
+		StatsD: StatsDConfig{
+			Addr:     *statsdAddr,
+			Prefix:   *statsdPrefix,
+			Interval: *statsdInterval,
+		},
+		OTLP: OTLPConfig{
+			Endpoint: *otlpEndpoint,
+			Headers:  *otlpHeaders,
+			Interval: *otlpInterval,
+		},
+		MQTT: MQTTConfig{
+			Broker:          *mqttBroker,
+			Topic:           *mqttTopic,
+			Username:        *mqttUser,
+			Password:        *mqttPassword,
+			ClientID:        *mqttClientID,
+			QoS:             *mqttQoS,
+			Retain:          *mqttRetain,
+			JSON:            *mqttJSON,
+			Discovery:       *mqttDiscovery,
+			DiscoveryPrefix: *mqttHAPrefix,
+			Interval:        *mqttInterval,
+			CAFile:          *mqttCAFile,
+			Insecure:        *mqttInsecure,
+		},
+		ForecastWindow: *forecastWindow,
+		Anomaly: AnomalyConfig{
+			Enabled:   *anomaly,
+			Threshold: *anomalyThreshold,
+			HalfLife:  *anomalyHalfLife,
+			Seasonal:  *anomalySeasonal,
+		},
+		AlertRules:  *alertRules,
+		Maintenance: *maintenance,
+		Webhook: WebhookConfig{
+			URL:        *webhookURL,
+			Template:   *webhookTemplate,
+			Headers:    *webhookHeaders,
+			Secret:     *webhookSecret,
+			Renotify:   *webhookRenotify,
+			MaxRetries: *webhookRetries,
+		},
+		SMTP: SMTPConfig{
+			Addr:       *smtpAddr,
+			TLS:        *smtpTLS,
+			Username:   *smtpUsername,
+			Password:   *smtpPassword,
+			From:       *smtpFrom,
+			To:         *smtpTo,
+			Insecure:   *smtpInsecure,
+			Renotify:   *smtpRenotify,
+			MaxRetries: *smtpRetries,
+			ReportTime: *smtpReportTime,
+		},
+		Hub: HubConfig{
+			Enabled:      *hubMode || *hubPull != "",
+			Pull:         *hubPull,
+			PullInterval: *hubPullInterval,
+			OfflineAfter: *hubOffline,
+			URL:          *hubURL,
+			Name:         *hubName,
+			Advertise:    *hubAdvertise,
+			Interval:     *hubInterval,
+
+			EnrollSecret:   *hubEnrollSecret,
+			ClientCA:       *hubClientCA,
+			CAKey:          *hubCAKey,
+			AllowAnonymous: *hubAllowAnonymous,
+			CA:             *hubCA,
+			Cert:           *hubCert,
+			Key:            *hubKey,
+			Token:          *hubToken,
+			Join:           *hubJoin,
+			PullToken:      *hubPullToken,
+		},
+		Auth: AuthConfig{
+			UsersFile:  *authUsers,
+			TokensFile: *authTokens,
+			SessionTTL: *authSessionTTL,
+		},
+		TLSCert: *tlsCert,
+		TLSKey:  *tlsKey,
+	}
+
+	// 创建增强监控器
+	enhancedMonitor := &EnhancedMonitor{
+		config:  config,
+		history: NewHistory(config.HistorySize),
+		stream:  NewStream(streamBacklog),
+	}
+	if config.ForecastWindow > 0 {
+		enhancedMonitor.forecast = &Forecaster{window: config.ForecastWindow}
+	}
+	if config.Anomaly.Enabled {
+		if config.Anomaly.Threshold <= 0 || config.Anomaly.HalfLife <= 0 {
+			log.Fatalf("无效的异常检测配置: 阈值和半衰期必须大于0")
+		}
+		enhancedMonitor.anomaly = NewAnomalyDetector(config)
+	}
+
+	// 打开磁盘时序存储
+	if config.DataDir != "" {
+		store, err := OpenStore(config.DataDir, config.Retention)
+		if err != nil {
+			log.Fatalf("打开数据目录失败: %v", err)
+		}
+		enhancedMonitor.store = store
+	}
+
+	// 加载告警规则
+	if config.AlertRules != "" {
+		rules, err := LoadAlertRules(config.AlertRules)
+		if err != nil {
+			log.Fatalf("加载告警规则失败: %v", err)
+		}
+		enhancedMonitor.alerts = NewAlertManager(rules)
+		log.Printf("已加载 %d 条告警规则", len(rules))
+
+		for _, spec := range strings.Split(config.Maintenance, ";") {
+			if strings.TrimSpace(spec) == "" {
+				continue
+			}
+			if _, err := enhancedMonitor.alerts.AddMaintenance(spec, "", "config"); err != nil {
+				log.Fatalf("无效的维护窗口 %q: %v", spec, err)
+			}
+		}
+		// 静默、确认和通过API添加的维护窗口保存在数据目录中，重启后恢复
+		if config.DataDir != "" {
+			if err := enhancedMonitor.alerts.LoadState(filepath.Join(config.DataDir, "alert-state.json")); err != nil {
+				log.Printf("读取告警状态失败: %v", err)
+			}
+		}
+	} else if config.Maintenance != "" {
+		log.Fatalf("配置维护窗口时需要同时指定 -alert-rules")
+	}
+
+	// 创建告警通知
+	if config.Webhook.URL != "" {
+		notifier, err := NewWebhookNotifier(config.Webhook)
+		if err != nil {
+			log.Fatalf("无效的 Webhook 配置: %v", err)
+		}
+		enhancedMonitor.notifiers = append(enhancedMonitor.notifiers, notifier)
+	}
+	if len(enhancedMonitor.notifiers) > 0 && enhancedMonitor.alerts == nil {
+		log.Fatalf("配置告警通知时需要同时指定 -alert-rules")
+	}
+
+	// 邮件：未配置告警规则时只发送每日报告
+	if config.SMTP.Addr != "" {
+		mailer, err := NewMailer(config.SMTP)
+		if err != nil {
+			log.Fatalf("无效的 SMTP 配置: %v", err)
+		}
+		enhancedMonitor.mailer = mailer
+		if enhancedMonitor.alerts != nil {
+			enhancedMonitor.notifiers = append(enhancedMonitor.notifiers, NewSMTPNotifier(mailer, config.SMTP))
+		}
+	} else if config.SMTP.ReportTime != "" {
+		log.Fatalf("发送每日报告时需要同时指定 -smtp-addr")
+	}
+
+	// 创建推送输出
+	if config.Influx.URL != "" {
+		output, err := NewInfluxOutput(config.Influx)
+		if err != nil {
+			log.Fatalf("无效的 InfluxDB 配置: %v", err)
+		}
+		enhancedMonitor.outputs = append(enhancedMonitor.outputs, output)
+	}
+	if config.Graphite.Addr != "" {
+		output, err := NewGraphiteOutput(config.Graphite)
+		if err != nil {
+			log.Fatalf("无效的 Graphite 配置: %v", err)
+		}
+		enhancedMonitor.outputs = append(enhancedMonitor.outputs, output)
+	}
+	if config.StatsD.Addr != "" {
+		output, err := NewStatsDOutput(config.StatsD)
+		if err != nil {
+			log.Fatalf("无效的 StatsD 配置: %v", err)
+		}
+		enhancedMonitor.outputs = append(enhancedMonitor.outputs, output)
+	}
+	if config.OTLP.Endpoint != "" {
+		output, err := NewOTLPOutput(config.OTLP)
+		if err != nil {
+			log.Fatalf("无效的 OTLP 配置: %v", err)
+		}
+		enhancedMonitor.outputs = append(enhancedMonitor.outputs, output)
+	}
+	if config.MQTT.Broker != "" {
+		output, err := NewMQTTOutput(config.MQTT)
+		if err != nil {
+			log.Fatalf("无效的 MQTT 配置: %v", err)
+		}
+		enhancedMonitor.outputs = append(enhancedMonitor.outputs, output)
+	}
+
+	// 面板和API认证
+	if config.Auth.UsersFile != "" || config.Auth.TokensFile != "" {
+		auth, err := NewAuthenticator(config.Auth)
+		if err != nil {
+			log.Fatalf("加载认证配置失败: %v", err)
+		}
+		enhancedMonitor.auth = auth
+		if config.TLSCert == "" {
+			log.Printf("警告: 未启用 HTTPS，密码和令牌将以明文传输")
+		}
+	}
+
+	// HTTPS
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		log.Fatalf("-tls-cert 和 -tls-key 需要同时指定")
+	}
+	if config.TLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey); err != nil {
+			log.Fatalf("加载证书失败: %v", err)
+		}
+	}
+
+	// 多主机汇总
+	if config.Hub.Enabled {
+		fleet, err := NewFleet(config)
+		if err != nil {
+			log.Fatalf("无效的 hub 配置: %v", err)
+		}
+		enhancedMonitor.fleet = fleet
+		agents, err := NewAgentRegistry(config)
+		if err != nil {
+			log.Fatalf("无效的 hub 认证配置: %v", err)
+		}
+		enhancedMonitor.agents = agents
+	}
+	if config.Hub.Enabled || config.Hub.URL != "" {
+		tlsConfig, err := newHubTLSConfig(config.Hub)
+		if err != nil {
+			log.Fatalf("无效的 hub 证书配置: %v", err)
+		}
+		enhancedMonitor.hubTLS = tlsConfig
+	}
+	if config.Hub.URL != "" {
+		if err := validateHubAgent(config.Hub); err != nil {
+			log.Fatalf("无效的 hub 配置: %v", err)
+		}
+	}
+
+	// 创建基础监控器
+	enhancedMonitor.monitor = &Monitor{
+		config:  config,
+		traffic: NewTrafficAccounting(config),
+	}
+
+	// 初始化统计
+	enhancedMonitor.monitor.initStats()
+
+	// 创建采集调度器
+	enhancedMonitor.scheduler = &Scheduler{
+		collectors: enhancedMonitor.monitor.newCollectors(),
+		onCollect: func(name string) {
+			enhancedMonitor.stream.Notify()
+		},
+	}
+
+	// 收到 SIGINT/SIGTERM 时停止采集并关闭Web服务器
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// 启动采集调度
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		enhancedMonitor.scheduler.Run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		enhancedMonitor.recordHistory(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		enhancedMonitor.stream.Run(ctx, enhancedMonitor.monitor.snapshot)
+	}()
+	for _, notifier := range enhancedMonitor.notifiers {
+		wg.Add(1)
+		go func(notifier Notifier, events <-chan AlertEvent) {
+			defer wg.Done()
+			notifier.Run(ctx, events)
+		}(notifier, enhancedMonitor.alerts.Subscribe())
+	}
+	if enhancedMonitor.alerts != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enhancedMonitor.evaluateAlerts(ctx)
+		}()
+	}
+	if enhancedMonitor.forecast != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enhancedMonitor.runForecasts(ctx)
+		}()
+	}
+	if enhancedMonitor.fleet != nil {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			enhancedMonitor.runFleet(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			enhancedMonitor.pullFleet(ctx)
+		}()
+	}
+	if config.Hub.URL != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enhancedMonitor.runHubAgent(ctx)
+		}()
+	}
+	if enhancedMonitor.mailer != nil && config.SMTP.ReportTime != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enhancedMonitor.runDailyReport(ctx)
+		}()
+	}
+	for _, output := range enhancedMonitor.outputs {
+		wg.Add(1)
+		go func(output Output) {
+			defer wg.Done()
+			output.Run(ctx, enhancedMonitor.metricPoints)
+		}(output)
+	}
+
+	// 启动Web服务器
+	err = enhancedMonitor.startWebServer(ctx)
+	stop()
+	wg.Wait()
+	if enhancedMonitor.store != nil {
+		if cerr := enhancedMonitor.store.Close(); cerr != nil {
+			log.Printf("关闭数据存储失败: %v", cerr)
+		}
+	}
+	if cerr := enhancedMonitor.monitor.traffic.Save(); cerr != nil {
+		log.Printf("保存流量统计失败: %v", cerr)
+	}
+	if enhancedMonitor.fleet != nil {
+		if cerr := enhancedMonitor.fleet.Save(); cerr != nil {
+			log.Printf("保存主机列表失败: %v", cerr)
+		}
+		if cerr := enhancedMonitor.agents.Save(); cerr != nil {
+			log.Printf("保存 agent 列表失败: %v", cerr)
+		}
+	}
+	if enhancedMonitor.anomaly != nil {
+		if cerr := enhancedMonitor.anomaly.Save(); cerr != nil {
+			log.Printf("保存异常检测基线失败: %v", cerr)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("已退出")
+}
+
+// parseIntervals 解析形如 disk=30s,cpu=2s 的采集周期配置
+func parseIntervals(s string) (map[string]time.Duration, error) {
+	intervals := make(map[string]time.Duration)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q 缺少 '='", item)
+		}
+		name := strings.TrimSpace(parts[0])
+		if _, ok := defaultIntervals[name]; !ok {
+			return nil, fmt.Errorf("未知的采集器 %q", name)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("采集器 %s 的周期必须大于0", name)
+		}
+		intervals[name] = d
+	}
+	return intervals, nil
+}
+
+// Run 启动所有采集器，阻塞直到ctx被取消
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	s.started = time.Now()
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range s.collectors {
+		wg.Add(1)
+		go func(c *Collector) {
+			defer wg.Done()
+			s.loop(ctx, c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// loop 按采集器的周期循环采集
+// 下一次触发时间基于上一次的计划时间推算（单调时钟），采集耗时不会造成累积漂移；
+// 采集落后超过一个周期时直接跳过错过的触发点
+func (s *Scheduler) loop(ctx context.Context, c *Collector) {
+	next := time.Now()
+	for {
+		start := time.Now()
+		err := c.runOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		c.record(start, err)
+		if err == nil && s.onCollect != nil {
+			s.onCollect(c.Name)
+		}
+
+		now := time.Now()
+		next = next.Add(c.Interval)
+		if !next.After(now) {
+			missed := now.Sub(next)/c.Interval + 1
+			next = next.Add(missed * c.Interval)
+		}
+
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// record 记录一次采集的结果，仅在健康状态变化时输出日志，避免持续失败时刷屏
+func (c *Collector) record(start time.Time, err error) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wasHealthy := c.runs == 0 || c.lastSuccess.After(c.lastErrorTime)
+	c.runs++
+	c.lastDuration = now.Sub(start)
+	if err != nil {
+		c.failures++
+		c.lastErr = err
+		c.lastErrorTime = now
+		if wasHealthy {
+			log.Printf("采集器 %s 采集失败: %v", c.Name, err)
+		}
+		return
+	}
+	c.lastSuccess = now
+	if !wasHealthy {
+		log.Printf("采集器 %s 已恢复", c.Name)
+	}
+}
+
+// Health 返回采集器当前的健康状态
+func (c *Collector) Health() CollectorHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h := CollectorHealth{
+		Name:          c.Name,
+		Interval:      c.Interval.String(),
+		Healthy:       c.runs > 0 && c.lastSuccess.After(c.lastErrorTime),
+		Runs:          c.runs,
+		Failures:      c.failures,
+		LastErrorTime: formatTime(c.lastErrorTime),
+		LastSuccess:   formatTime(c.lastSuccess),
+		DurationMs:    float64(c.lastDuration.Microseconds()) / 1000,
+	}
+	if c.lastErr != nil {
+		h.LastError = c.lastErr.Error()
+	}
+	return h
+}
+
+// Health 返回所有采集器的健康状态
+func (s *Scheduler) Health() []CollectorHealth {
+	health := make([]CollectorHealth, 0, len(s.collectors))
+	for _, c := range s.collectors {
+		health = append(health, c.Health())
+	}
+	return health
+}
+
+// Ready 所有采集器都至少成功采集过一次时返回true；
+// 启动超过 readyTimeout 后不再等待一直失败的采集器（例如缺少传感器），并记录这些采集器
+func (s *Scheduler) Ready() bool {
+	pending := s.pending()
+	if len(pending) == 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started.IsZero() || time.Since(s.started) < readyTimeout {
+		return false
+	}
+	if !s.degraded {
+		s.degraded = true
+		log.Printf("采集器 %s 启动%s后仍未成功采集，不再等待，相应数据缺失", strings.Join(pending, ", "), readyTimeout)
+	}
+	return true
+}
+
+// pending 返回还没有成功采集过的采集器名称
+func (s *Scheduler) pending() []string {
+	var names []string
+	for _, c := range s.collectors {
+		c.mu.Lock()
+		if c.lastSuccess.IsZero() {
+			names = append(names, c.Name)
+		}
+		c.mu.Unlock()
+	}
+	return names
+}
+
+// runOnce 执行一次采集，超过超时时间则放弃等待
+// 超时的采集协程可能仍阻塞在系统调用中（例如卡住的NFS），在其返回前不会再次启动该采集器
+func (c *Collector) runOnce(ctx context.Context) error {
+	c.mu.Lock()
+	if c.running {
+		c.mu.Unlock()
+		return fmt.Errorf("上一次采集尚未结束")
+	}
+	c.running = true
+	c.mu.Unlock()
+
+	cctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		err := c.collect(cctx)
+		c.mu.Lock()
+		c.running = false
+		c.mu.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-cctx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("采集超时 (%s)", c.Timeout)
+	}
+}
+
+// serverTLSConfig 返回 HTTPS 服务的 TLS 配置（不含服务器证书）。
+// 客户端证书是可选的：浏览器访问面板不需要证书，推送时由 handleFleetPush 决定是否接受
+func (em *EnhancedMonitor) serverTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if em.agents != nil && em.agents.clientCAs != nil {
+		tlsConfig.ClientCAs = em.agents.clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig
+}
+
+// startWebServer 启动Web服务器，阻塞直到ctx被取消后完成优雅关闭
+func (em *EnhancedMonitor) startWebServer(ctx context.Context) error {
+	addr := fmt.Sprintf(":%d", em.config.Port)
+	srv := &http.Server{Addr: addr, Handler: em.newHandler(ctx)}
+
+	errCh := make(chan error, 1)
+	if em.config.TLSCert != "" {
+		srv.TLSConfig = em.serverTLSConfig()
+		go func() {
+			errCh <- srv.ListenAndServeTLS(em.config.TLSCert, em.config.TLSKey)
+		}()
+		log.Printf("Web服务器启动在 %s (HTTPS)", addr)
+	} else {
+		go func() {
+			errCh <- srv.ListenAndServe()
+		}()
+		log.Printf("Web服务器启动在 %s", addr)
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("正在关闭Web服务器...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), em.config.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("Web服务器关闭超时: %v", err)
+	}
+	return nil
+}
+
+// newHandler 注册所有页面和接口，启用认证时外面包一层认证中间件；WebSocket 连接在ctx取消时关闭
+func (em *EnhancedMonitor) newHandler(ctx context.Context) http.Handler {
+	tmpl := template.Must(template.New("monitor").Parse(htmlTemplate))
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		data := struct {
+			Stats          SystemStats
+			Interval       int
+			Replay         bool
+			Hub            bool
+			User           string
+			Can            map[string]bool
+			AnomalyMetrics []string
+		}{
+			Stats:          em.monitor.snapshot(),
+			Interval:       int(em.config.Interval.Seconds()),
+			Replay:         em.replay != nil,
+			Hub:            em.fleet != nil,
+			AnomalyMetrics: []string{},
+		}
+		if em.anomaly != nil {
+			for _, am := range anomalyMetrics {
+				data.AnomalyMetrics = append(data.AnomalyMetrics, am.name)
+			}
+		}
+		id := requestIdentity(r)
+		if id != nil {
+			data.User = id.Name
+		}
+		data.Can = id.permissions()
+		tmpl.Execute(w, data)
+	})
+
+	mux.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(em.monitor.snapshot())
+	})
+
+	// 实时推送系统状态（Server-Sent Events）
+	mux.HandleFunc("/api/stream", func(w http.ResponseWriter, r *http.Request) {
+		em.stream.ServeHTTP(ctx, w, r)
+	})
+
+	// 采集器健康状态
+	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		collectors := em.scheduler.Health()
+		status := "ok"
+		for _, c := range collectors {
+			if !c.Healthy {
+				status = "degraded"
+				break
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     status,
+			"collectors": collectors,
+		})
+	})
+
+	// Prometheus 指标
+	mux.HandleFunc("/metrics", em.handleMetrics)
+
+	// 流量统计报表
+	trafficTmpl := template.Must(template.New("traffic").Funcs(template.FuncMap{
+		"bytes": formatBytes,
+		"hour": func(ts int64) string {
+			return time.Unix(ts, 0).In(displayZone).Format("01-02 15:00")
+		},
+		"day": func(ts int64) string {
+			return time.Unix(ts, 0).In(displayZone).Format("2006-01-02")
+		},
+	}).Parse(trafficTemplate))
+	mux.HandleFunc("/traffic", func(w http.ResponseWriter, r *http.Request) {
+		reports := em.monitor.traffic.Reports(time.Now())
+		selected := r.URL.Query().Get("interface")
+		if selected == "" {
+			selected = getSelectedInterface()
+		}
+		var report *TrafficReport
+		for i := range reports {
+			if reports[i].Interface == selected {
+				report = &reports[i]
+			}
+		}
+		if report == nil && len(reports) > 0 {
+			report = &reports[0]
+		}
+		data := struct {
+			Reports    []TrafficReport
+			Report     *TrafficReport
+			BillingDay int
+		}{
+			Reports:    reports,
+			Report:     report,
+			BillingDay: em.config.BillingDay,
+		}
+		trafficTmpl.Execute(w, data)
+	})
+	mux.HandleFunc("/api/traffic", func(w http.ResponseWriter, r *http.Request) {
+		reports := em.monitor.traffic.Reports(time.Now())
+		if intf := r.URL.Query().Get("interface"); intf != "" {
+			filtered := []TrafficReport{}
+			for _, report := range reports {
+				if report.Interface == intf {
+					filtered = append(filtered, report)
+				}
+			}
+			if len(filtered) == 0 {
+				http.Error(w, "Interface not found", http.StatusNotFound)
+				return
+			}
+			reports = filtered
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"billing_day": em.config.BillingDay,
+			"quota":       em.config.TrafficQuota,
+			"interfaces":  reports,
+		})
+	})
+
+	// 指标历史，支持按时间范围查询和降采样
+	mux.HandleFunc("/api/history", em.handleHistory)
+
+	// 获取可用网络接口列表
+	mux.HandleFunc("/api/interfaces", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		interfaces := em.monitor.getAvailableInterfaces()
+		if em.replay != nil {
+			interfaces = em.replay.Interfaces()
+		}
+		response := map[string]interface{}{
+			"interfaces": interfaces,
+			"current":    getSelectedInterface(),
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+
+	// 切换网络接口
+	mux.HandleFunc("/api/switch-interface", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Interface string `json:"interface"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if em.replay != nil {
+			http.Error(w, "Not available in replay mode", http.StatusConflict)
+			return
+		}
+		if err := em.switchInterface(req.Interface); err != nil {
+			http.Error(w, "Interface not found", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	})
+
+	// 告警
+	mux.HandleFunc("/api/forecast", em.handleForecast)
+	mux.HandleFunc("/api/anomalies", em.handleAnomalies)
+	mux.HandleFunc("/api/alerts", em.handleAlerts)
+	mux.HandleFunc("/api/alerts/ack", em.handleAck)
+	mux.HandleFunc("/api/silences", em.handleSilences)
+	mux.HandleFunc("/api/maintenance", em.handleMaintenance)
+
+	// 每日报告：GET 预览，POST 立即发送
+	mux.HandleFunc("/api/report", em.handleReport)
+
+	// 多主机汇总：每个实例都提供本机状态供 hub 拉取，hub 另外接收上报并提供总览
+	mux.HandleFunc("/api/fleet/self", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(em.selfReport())
+	})
+	if em.fleet != nil {
+		mux.HandleFunc("/fleet", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, fleetPage)
+		})
+		mux.HandleFunc("/api/fleet", em.handleFleet)
+		mux.HandleFunc("/api/fleet/push", em.handleFleetPush)
+		mux.HandleFunc("/api/fleet/enroll", em.handleEnroll)
+		mux.HandleFunc("/api/fleet/agents", em.handleAgents)
+		mux.HandleFunc("/api/fleet/agents/revoke", em.handleRevoke)
+	}
+
+	// 回放控制
+	if em.replay != nil {
+		mux.HandleFunc("/api/replay", em.replay.ServeHTTP)
+	}
+
+	// WebSocket：按采集器订阅增量数据，并可在同一连接上执行命令
+	mux.HandleFunc("/api/ws", func(w http.ResponseWriter, r *http.Request) {
+		em.handleWebSocket(ctx, w, r)
+	})
+
+	// 存活探针：进程能响应请求即视为存活
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+
+	// 就绪探针：所有采集器完成首次采集后才就绪，一直失败的采集器最多等待 readyTimeout
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !em.scheduler.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "not ready")
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	// 登录
+	var handler http.Handler = mux
+	if em.auth != nil {
+		mux.HandleFunc("/login", em.auth.handleLogin)
+		mux.HandleFunc("/logout", em.auth.handleLogout)
+		handler = em.auth.Middleware(mux)
+	}
+	return handler
+}
+
+// switchInterface 切换监控的网卡，网卡不存在时返回错误
+func (em *EnhancedMonitor) switchInterface(intf string) error {
+	if em.replay != nil {
+		return fmt.Errorf("回放模式下不能切换网卡")
+	}
+	// 验证接口是否存在
+	valid := false
+	for _, name := range em.monitor.getAvailableInterfaces() {
+		if name == intf {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("网卡 %s 不存在", intf)
+	}
+	// 切换接口并重置网络统计，同时保存用户选择到内存
+	// 整个切换在锁内完成，并发切换时监控的网卡和记录的选择不会不一致
+	selectedInterface.Lock()
+	em.monitor.switchInterface(intf)
+	selectedInterface.name = intf
+	selectedInterface.Unlock()
+	em.stream.Notify()
+	return nil
+}
+
+// getAvailableInterfaces 获取可用的网络接口列表
+func (m *Monitor) getAvailableInterfaces() []string {
+	data, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		return []string{}
+	}
+
+	lines := strings.Split(string(data), "\n")
+	var interfaces []string
+	for i := 2; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "" {
+			continue
+		}
+		parts := strings.Split(lines[i], ":")
+		if len(parts) >= 2 {
+			intf := strings.TrimSpace(parts[0])
+			if intf != "lo" {
+				interfaces = append(interfaces, intf)
+			}
+		}
+	}
+	return interfaces
+}
+
+// selectedInterface 当前选择的网卡接口（内存中保存）
+// HTTP 接口、WebSocket 命令和回放在各自的 goroutine 中读写，需要加锁
+var selectedInterface struct {
+	sync.RWMutex
+	name string
+}
+
+// setSelectedInterface 设置当前选择的网卡接口
+func setSelectedInterface(interfaceName string) {
+	selectedInterface.Lock()
+	defer selectedInterface.Unlock()
+	selectedInterface.name = interfaceName
+}
+
+// getSelectedInterface 获取当前选择的网卡接口
+func getSelectedInterface() string {
+	selectedInterface.RLock()
+	defer selectedInterface.RUnlock()
+	return selectedInterface.name
+}
+
+// initStats 初始化统计数据
+func (m *Monitor) initStats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prevCPUStat, m.prevCores, _ = m.getCPUStats()
+}
+
+// newCollectors 创建各采集器，未单独配置周期的采集器使用默认周期
+func (m *Monitor) newCollectors() []*Collector {
+	collectors := []*Collector{
+		{Name: "system", collect: m.collectSystem},
+		{Name: "cpu", collect: m.collectCPU},
+		{Name: "memory", collect: m.collectMemory},
+		{Name: "disk", collect: m.collectDisk},
+		{Name: "network", collect: m.collectNetwork},
+		{Name: "traffic", collect: m.collectTraffic},
+	}
+	for _, c := range collectors {
+		c.Interval = defaultIntervals[c.Name]
+		if d, ok := m.config.Intervals[c.Name]; ok {
+			c.Interval = d
+		}
+		c.Timeout = m.config.Timeout
+	}
+	return collectors
+}
+
+// collectSystem 采集运行时间、负载和CPU温度
+func (m *Monitor) collectSystem(ctx context.Context) error {
+	uptime, err := m.getUptime()
+	if err != nil {
+		return err
+	}
+	loadAvg, err := m.getLoadAverage()
+	if err != nil {
+		return err
+	}
+	cpuTemp, hasCPUTemp := m.getCPUTemperature()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uptime, m.loadAvg = uptime, loadAvg
+	m.cpuTemp, m.hasCPUTemp = cpuTemp, hasCPUTemp
+	m.latestTime = time.Now()
+	return nil
+}
+
+// collectCPU 采集CPU总使用率和各核心的使用率
+func (m *Monitor) collectCPU(ctx context.Context) error {
+	curr, cores, err := m.getCPUStats()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cpuUsage = m.calculateCPUUsage(m.prevCPUStat, curr)
+	m.prevCPUStat = curr
+	// 核心数变化（CPU热插拔）时本次不计算各核心使用率
+	if len(cores) == len(m.prevCores) {
+		m.coreUsage = make([]float64, len(cores))
+		for i := range cores {
+			m.coreUsage[i] = m.calculateCPUUsage(m.prevCores[i], cores[i])
+		}
+	}
+	m.prevCores = cores
+	m.latestTime = time.Now()
+	return nil
+}
+
+// collectMemory 采集内存和SWAP信息
+func (m *Monitor) collectMemory(ctx context.Context) error {
+	memInfo, err := m.getMemoryInfo()
+	if err != nil {
+		return err
+	}
+	swapInfo, err := m.getSwapInfo()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.memInfo, m.swapInfo = memInfo, swapInfo
+	m.latestTime = time.Now()
+	return nil
+}
+
+// collectDisk 采集磁盘信息
+func (m *Monitor) collectDisk(ctx context.Context) error {
+	diskInfo, mounts, err := m.getDiskInfo(ctx)
+	if err != nil {
+		return err
+	}
+	// 部分容器中没有 /proc/diskstats，此时只是没有读写速度
+	ioStats, ioErr := getDiskIOStats()
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.diskInfo, m.diskMounts = diskInfo, mounts
+	if ioErr == nil {
+		if !m.prevIOTime.IsZero() {
+			elapsed := now.Sub(m.prevIOTime).Seconds()
+			m.diskRead = counterRate(m.prevDiskIO[0], ioStats[0], elapsed) / 1024
+			m.diskWrite = counterRate(m.prevDiskIO[1], ioStats[1], elapsed) / 1024
+		}
+		m.prevDiskIO, m.prevIOTime = ioStats, now
+	}
+	m.latestTime = now
+	return nil
+}
+
+// getDiskIOStats 读取 /proc/diskstats 中所有物理磁盘累计读取和写入的字节数
+// 只统计 /sys/block 下的整块磁盘，跳过分区、loop、ram 以及 dm、md 这类叠加在其他磁盘上的设备，避免重复计算
+func getDiskIOStats() ([2]uint64, error) {
+	var counters [2]uint64
+	data, err := os.ReadFile("/proc/diskstats")
+	if err != nil {
+		return counters, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "zram") ||
+			strings.HasPrefix(name, "dm-") || strings.HasPrefix(name, "md") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join("/sys/block", name)); err != nil {
+			continue
+		}
+		read, err1 := strconv.ParseUint(fields[5], 10, 64)
+		written, err2 := strconv.ParseUint(fields[9], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		// 扇区固定为512字节，与磁盘实际的扇区大小无关
+		counters[0] += read * 512
+		counters[1] += written * 512
+	}
+	return counters, nil
+}
+
+// collectNetwork 采集网络流量，速率按两次采集之间的实际间隔计算
+// 同时计算所有网卡的速率，当前监控的网卡另外记录用于面板显示
+func (m *Monitor) collectNetwork(ctx context.Context) error {
+	m.mu.RLock()
+	intf := m.config.Interface
+	m.mu.RUnlock()
+
+	counters, err := m.getAllNetworkStats()
+	if err != nil {
+		return err
+	}
+	rx, tx := counters[intf][0], counters[intf][1]
+	if _, ok := counters[intf]; !ok {
+		// getAllNetworkStats 不包含 lo
+		if rx, tx, err = m.getNetworkStats(intf); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.prevIfTime.IsZero() {
+		elapsed := now.Sub(m.prevIfTime).Seconds()
+		rates := make(map[string][2]float64, len(counters))
+		for name, c := range counters {
+			if prev, ok := m.netCounters[name]; ok {
+				rates[name] = [2]float64{counterRate(prev[0], c[0], elapsed), counterRate(prev[1], c[1], elapsed)}
+			}
+		}
+		m.netRates = rates
+	}
+	m.netCounters, m.prevIfTime = counters, now
+
+	// 采集期间网卡已被切换，丢弃本次结果
+	if intf != m.config.Interface {
+		return nil
+	}
+	if !m.prevNetTime.IsZero() {
+		elapsed := now.Sub(m.prevNetTime).Seconds()
+		m.receiveSpeed = counterRate(m.prevNetRx, rx, elapsed) / 1024
+		m.transmitSpeed = counterRate(m.prevNetTx, tx, elapsed) / 1024
+	}
+	m.prevNetRx, m.prevNetTx, m.prevNetTime = rx, tx, now
+	m.netRx, m.netTx = rx, tx
+	m.latestTime = now
+	return nil
+}
+
+// collectTraffic 采集所有网卡的流量计数并累加到流量统计
+func (m *Monitor) collectTraffic(ctx context.Context) error {
+	counters, err := m.getAllNetworkStats()
+	if err != nil {
+		return err
+	}
+
+	return m.traffic.Update(time.Now(), counters)
+}
+
+// counterRate 计算计数器每秒的增量，计数器重置（如重启网卡）时返回0
+func counterRate(prev, curr uint64, elapsed float64) float64 {
+	if curr < prev || elapsed <= 0 {
+		return 0
+	}
+	return float64(curr-prev) / elapsed
+}
+
+// switchInterface 切换监控的网卡并重置网络统计
+func (m *Monitor) switchInterface(intf string) {
+	rx, tx, _ := m.getNetworkStats(intf)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config.Interface = intf
+	m.prevNetRx, m.prevNetTx, m.prevNetTime = rx, tx, time.Now()
+	m.receiveSpeed, m.transmitSpeed = 0, 0
+	m.netRx, m.netTx = rx, tx
+}
+
+// snapshot 汇总各采集器最近的结果生成系统状态
+func (m *Monitor) snapshot() SystemStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cpuTemp := "N/A"
+	if m.hasCPUTemp {
+		cpuTemp = fmt.Sprintf("%.1f°C", m.cpuTemp)
+	}
+
+	return SystemStats{
+		RunTime:            formatUptime(m.uptime),
+		Last1:              fmt.Sprintf("%.2f", m.loadAvg[0]),
+		Last5:              fmt.Sprintf("%.2f", m.loadAvg[1]),
+		Last15:             fmt.Sprintf("%.2f", m.loadAvg[2]),
+		CPUUsage:           fmt.Sprintf("%.2f", m.cpuUsage),
+		CPUTemp:            cpuTemp,
+		MemTotalSpace:      fmt.Sprintf("%.2f", float64(m.memInfo["total"])/1024),
+		MemUsedSpace:       fmt.Sprintf("%.2f", float64(m.memInfo["used"])/1024),
+		MemFreeSpace:       fmt.Sprintf("%.2f", float64(m.memInfo["total"]-m.memInfo["used"])/1024),
+		MemUsage:           fmt.Sprintf("%.2f", percent(m.memInfo["used"], m.memInfo["total"])),
+		SwapTotalSpace:     fmt.Sprintf("%.2f", float64(m.swapInfo["total"])/1024),
+		SwapUsedSpace:      fmt.Sprintf("%.2f", float64(m.swapInfo["used"])/1024),
+		SwapFreeSpace:      fmt.Sprintf("%.2f", float64(m.swapInfo["free"])/1024),
+		DiskTotalSpace:     fmt.Sprintf("%.2f", float64(m.diskInfo["total"])/1024/1024),
+		DiskUsedSpace:      fmt.Sprintf("%.2f", float64(m.diskInfo["used"])/1024/1024),
+		DiskAvailableSpace: fmt.Sprintf("%.2f", float64(m.diskInfo["available"])/1024/1024),
+		DiskUsage:          fmt.Sprintf("%.2f", percent(m.diskInfo["used"], m.diskInfo["total"])),
+		DiskReadSpeed:      fmt.Sprintf("%.2f", m.diskRead),
+		DiskWriteSpeed:     fmt.Sprintf("%.2f", m.diskWrite),
+		ReceiveSpeed:       fmt.Sprintf("%.2f", m.receiveSpeed),
+		TransmitSpeed:      fmt.Sprintf("%.2f", m.transmitSpeed),
+		ReceiveTotal:       fmt.Sprintf("%.2f", float64(m.netRx)/1024/1024/1024),
+		TransmitTotal:      fmt.Sprintf("%.2f", float64(m.netTx)/1024/1024/1024),
+		LatestTime:         formatTime(m.latestTime),
+	}
+}
+
+// values 返回当前的数值指标，键与 /api/stats 中对应的字段名一致
+// 尚未成功采集过的指标不会出现在结果中
+func (m *Monitor) values() map[string]float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	v := map[string]float64{
+		"last1":     m.loadAvg[0],
+		"last5":     m.loadAvg[1],
+		"last15":    m.loadAvg[2],
+		"cpu_usage": m.cpuUsage,
+	}
+	if m.hasCPUTemp {
+		v["cpu_temp"] = m.cpuTemp
+	}
+	if m.memInfo != nil {
+		v["mem_total_space"] = float64(m.memInfo["total"]) / 1024
+		v["mem_used_space"] = float64(m.memInfo["used"]) / 1024
+		v["mem_free_space"] = float64(m.memInfo["total"]-m.memInfo["used"]) / 1024
+		v["mem_usage"] = percent(m.memInfo["used"], m.memInfo["total"])
+	}
+	if m.swapInfo != nil {
+		v["swap_total_space"] = float64(m.swapInfo["total"]) / 1024
+		v["swap_used_space"] = float64(m.swapInfo["used"]) / 1024
+		v["swap_free_space"] = float64(m.swapInfo["free"]) / 1024
+	}
+	if m.diskInfo != nil {
+		v["disk_total_space"] = float64(m.diskInfo["total"]) / 1024 / 1024
+		v["disk_used_space"] = float64(m.diskInfo["used"]) / 1024 / 1024
+		v["disk_available_space"] = float64(m.diskInfo["available"]) / 1024 / 1024
+		v["disk_usage"] = percent(m.diskInfo["used"], m.diskInfo["total"])
+	}
+	if !m.prevIOTime.IsZero() {
+		v["disk_read_speed"] = m.diskRead
+		v["disk_write_speed"] = m.diskWrite
+	}
+	if !m.prevNetTime.IsZero() {
+		v["receive_speed"] = m.receiveSpeed
+		v["transmit_speed"] = m.transmitSpeed
+		v["receive_total"] = float64(m.netRx) / 1024 / 1024 / 1024
+		v["transmit_total"] = float64(m.netTx) / 1024 / 1024 / 1024
+	}
+	return v
+}
+
+// percent 计算百分比，总量为0（采集器尚未成功）时返回0而不是NaN
+func percent(used, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(used) * 100 / float64(total)
+}
+
+// displayZone 面板显示时间和流量统计分时段使用的时区
+var displayZone = time.FixedZone("CST", 8*3600)
+
+// formatTime 按面板统一的时区和格式输出时间，零值返回空字符串
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(displayZone).Format("2006-01-02 15:04:05")
+}
+
+// getNetworkStats 获取指定网卡的网络统计信息
+func (m *Monitor) getNetworkStats(intf string) (uint64, uint64, error) {
+	data, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines {
+		if strings.Contains(line, intf+":") {
+			fields := strings.Fields(line)
+			if len(fields) >= 10 {
+				rx, err1 := strconv.ParseUint(fields[1], 10, 64)
+				tx, err2 := strconv.ParseUint(fields[9], 10, 64)
+				if err1 != nil || err2 != nil {
+					return 0, 0, fmt.Errorf("无法解析网卡 %s 的流量计数", intf)
+				}
+				return rx, tx, nil
+			}
+		}
+	}
+	return 0, 0, fmt.Errorf("网卡 %s 不存在", intf)
+}
+
+// getAllNetworkStats 获取除 lo 外所有网卡的收发字节数
+func (m *Monitor) getAllNetworkStats() (map[string][2]uint64, error) {
+	data, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string][2]uint64)
+	lines := strings.Split(string(data), "\n")
+	for i := 2; i < len(lines); i++ {
+		parts := strings.SplitN(lines[i], ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		intf := strings.TrimSpace(parts[0])
+		fields := strings.Fields(parts[1])
+		if intf == "lo" || len(fields) < 9 {
+			continue
+		}
+		rx, err1 := strconv.ParseUint(fields[0], 10, 64)
+		tx, err2 := strconv.ParseUint(fields[8], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		counters[intf] = [2]uint64{rx, tx}
+	}
+	return counters, nil
+}
+
+// getCPUStats 获取CPU总的统计信息和各核心的统计信息（按核心编号排序）
+func (m *Monitor) getCPUStats() (CPUStat, []CPUStat, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return CPUStat{}, nil, err
+	}
+
+	var total CPUStat
+	found := false
+	var cores []CPUStat
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "cpu") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		stat := parseCPUStat(fields)
+		if fields[0] == "cpu" {
+			total, found = stat, true
+		} else {
+			cores = append(cores, stat)
+		}
+	}
+	if !found {
+		return CPUStat{}, nil, fmt.Errorf("/proc/stat 中没有 cpu 行")
+	}
+	return total, cores, nil
+}
+
+// parseCPUStat 解析 /proc/stat 中一行 cpu 统计
+func parseCPUStat(fields []string) CPUStat {
+	user, _ := strconv.ParseUint(fields[1], 10, 64)
+	nice, _ := strconv.ParseUint(fields[2], 10, 64)
+	system, _ := strconv.ParseUint(fields[3], 10, 64)
+	idle, _ := strconv.ParseUint(fields[4], 10, 64)
+	iowait, _ := strconv.ParseUint(fields[5], 10, 64)
+	irq, _ := strconv.ParseUint(fields[6], 10, 64)
+	softirq, _ := strconv.ParseUint(fields[7], 10, 64)
+	return CPUStat{
+		User:    user,
+		Nice:    nice,
+		System:  system,
+		Idle:    idle,
+		Iowait:  iowait,
+		Irq:     irq,
+		Softirq: softirq,
+	}
+}
+
+// calculateCPUUsage 计算CPU使用率
+func (m *Monitor) calculateCPUUsage(prev, curr CPUStat) float64 {
+	prevTotal := prev.User + prev.Nice + prev.System + prev.Idle + prev.Iowait + prev.Irq + prev.Softirq
+	currTotal := curr.User + curr.Nice + curr.System + curr.Idle + curr.Iowait + curr.Irq + curr.Softirq
+
+	prevIdle := prev.Idle + prev.Iowait
+	currIdle := curr.Idle + curr.Iowait
+
+	totalDiff := currTotal - prevTotal
+	idleDiff := currIdle - prevIdle
+
+	if totalDiff == 0 {
+		return 0
+	}
+
+	return float64(totalDiff-idleDiff) * 100.0 / float64(totalDiff)
+}
+
+// getUptime 获取系统运行时间（秒）
+func (m *Monitor) getUptime() (float64, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("/proc/uptime 内容为空")
+	}
+
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// formatUptime 格式化系统运行时间
+func formatUptime(uptime float64) string {
+	days := int(uptime) / 86400
+	hours := (int(uptime) % 86400) / 3600
+	minutes := (int(uptime) % 3600) / 60
+
+	return fmt.Sprintf("%d天%d小时%d分钟", days, hours, minutes)
+}
+
+// getLoadAverage 获取系统负载
+func (m *Monitor) getLoadAverage() ([3]float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return [3]float64{0, 0, 0}, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return [3]float64{0, 0, 0}, fmt.Errorf("/proc/loadavg 格式错误")
+	}
+
+	load1, _ := strconv.ParseFloat(fields[0], 64)
+	load5, _ := strconv.ParseFloat(fields[1], 64)
+	load15, _ := strconv.ParseFloat(fields[2], 64)
+
+	return [3]float64{load1, load5, load15}, nil
+}
+
+// getCPUTemperature 获取CPU温度（摄氏度）
+// 很多虚拟机没有温度传感器，读取失败时返回false而不视为采集错误
+func (m *Monitor) getCPUTemperature() (float64, bool) {
+	data, err := os.ReadFile("/sys/class/thermal/thermal_zone0/temp")
+	if err != nil {
+		return 0, false
+	}
+
+	tempStr := strings.TrimSpace(string(data))
+	temp, err := strconv.Atoi(tempStr)
+	if err != nil {
+		return 0, false
+	}
+
+	return float64(temp) / 1000.0, true
+}
+
+// getMemoryInfo 获取内存信息
+func (m *Monitor) getMemoryInfo() (map[string]uint64, error) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+
+	memInfo := make(map[string]uint64)
+	lines := strings.Split(string(data), "\n")
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "MemTotal:") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				val, _ := strconv.ParseUint(fields[1], 10, 64)
+				memInfo["total"] = val
+			}
+		} else if strings.HasPrefix(line, "MemFree:") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				val, _ := strconv.ParseUint(fields[1], 10, 64)
+				memInfo["free"] = val
+			}
+		} else if strings.HasPrefix(line, "Buffers:") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				val, _ := strconv.ParseUint(fields[1], 10, 64)
+				memInfo["buffers"] = val
+			}
+		} else if strings.HasPrefix(line, "Cached:") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				val, _ := strconv.ParseUint(fields[1], 10, 64)
+				memInfo["cached"] = val
+			}
+		} else if strings.HasPrefix(line, "SReclaimable:") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				val, _ := strconv.ParseUint(fields[1], 10, 64)
+				memInfo["sreclaimable"] = val
+			}
+		}
+	}
+
+	if memInfo["total"] == 0 {
+		return nil, fmt.Errorf("/proc/meminfo 中没有 MemTotal")
+	}
+
+	// 已使用内存 = 总内存 - 空闲内存 - 缓冲区 - 缓存 - 可回收内存
+	memInfo["used"] = memInfo["total"] - memInfo["free"] - memInfo["buffers"] - memInfo["cached"] - memInfo["sreclaimable"]
+	return memInfo, nil
+}
+
+// getSwapInfo 获取SWAP信息
+func (m *Monitor) getSwapInfo() (map[string]uint64, error) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+
+	swapInfo := make(map[string]uint64)
+	lines := strings.Split(string(data), "\n")
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "SwapTotal:") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				val, _ := strconv.ParseUint(fields[1], 10, 64)
+				swapInfo["total"] = val
+			}
+		} else if strings.HasPrefix(line, "SwapFree:") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				val, _ := strconv.ParseUint(fields[1], 10, 64)
+				swapInfo["free"] = val
+			}
+		}
+	}
+
+	swapInfo["used"] = swapInfo["total"] - swapInfo["free"]
+	return swapInfo, nil
+}
+
+// getDiskInfo 获取磁盘信息（合计及各挂载点），ctx取消时终止df进程
+func (m *Monitor) getDiskInfo(ctx context.Context) (map[string]uint64, []DiskMount, error) {
+	cmd := exec.CommandContext(ctx, "df")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines := strings.Split(string(output), "\n")
+	totalSpace := uint64(0)
+	usedSpace := uint64(0)
+	availableSpace := uint64(0)
+	var mounts []DiskMount
+
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+
+		filesystem := fields[0]
+
+		// 参考shell脚本的过滤逻辑：排除虚拟文件系统和临时文件系统
+		if strings.Contains(filesystem, "-") ||
+			filesystem == "none" ||
+			strings.HasPrefix(filesystem, "tmpfs") ||
+			strings.HasPrefix(filesystem, "devtmpfs") ||
+			strings.Contains(filesystem, "by-uuid") ||
+			strings.Contains(filesystem, "chroot") ||
+			strings.HasPrefix(filesystem, "udev") ||
+			strings.Contains(filesystem, "docker") ||
+			strings.Contains(filesystem, "storage") {
+			continue
+		}
+
+		// 累加所有实际磁盘的空间信息
+		total, err1 := strconv.ParseUint(fields[1], 10, 64)
+		used, err2 := strconv.ParseUint(fields[2], 10, 64)
+		available, err3 := strconv.ParseUint(fields[3], 10, 64)
+
+		if err1 == nil && err2 == nil && err3 == nil {
+			totalSpace += total
+			usedSpace += used
+			availableSpace += available
+			mounts = append(mounts, DiskMount{
+				Device:    filesystem,
+				Mount:     strings.Join(fields[5:], " "),
+				Total:     total,
+				Used:      used,
+				Available: available,
+			})
+		}
+	}
+
+	return map[string]uint64{
+		"total":     totalSpace,
+		"used":      usedSpace,
+		"available": availableSpace,
+	}, mounts, nil
+}
+
+// NewHistory 创建历史记录，size 为每个指标保留的样本数
+func NewHistory(size int) *History {
+	if size < 1 {
+		size = 1
+	}
+	return &History{
+		size:   size,
+		series: make(map[string]*historyRing),
+	}
+}
+
+// Add 记录一个时刻的全部指标
+func (h *History) Add(t time.Time, values map[string]float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ts := t.Unix()
+	for name, v := range values {
+		r, ok := h.series[name]
+		if !ok {
+			r = &historyRing{
+				times:  make([]int64, h.size),
+				values: make([]float64, h.size),
+			}
+			h.series[name] = r
+		}
+		r.times[r.next] = ts
+		r.values[r.next] = v
+		r.next++
+		if r.next == h.size {
+			r.next = 0
+			r.full = true
+		}
+	}
+}
+
+// Metrics 返回已记录的指标名（按字母排序）
+func (h *History) Metrics() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	names := make([]string, 0, len(h.series))
+	for name := range h.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Query 查询 [from, to] 范围内的历史数据
+// step 大于0时按 step 对齐分桶并计算每个桶的平均/最小/最大值，否则返回原始样本
+func (h *History) Query(metric string, from, to time.Time, step time.Duration) ([]HistoryPoint, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	r, ok := h.series[metric]
+	if !ok {
+		return nil, false
+	}
+
+	start, n := 0, r.next
+	if r.full {
+		start, n = r.next, h.size
+	}
+
+	stepSec := int64(step / time.Second)
+	fromSec, toSec := from.Unix(), to.Unix()
+	points := []HistoryPoint{}
+	var sum float64
+	var count int
+	for i := 0; i < n; i++ {
+		idx := (start + i) % h.size
+		t, v := r.times[idx], r.values[idx]
+		if t < fromSec || t > toSec {
+			continue
+		}
+		if stepSec <= 0 {
+			points = append(points, HistoryPoint{Time: t, Avg: v, Min: v, Max: v})
+			continue
+		}
+
+		bucket := t - t%stepSec
+		if last := len(points) - 1; last >= 0 && points[last].Time == bucket {
+			p := &points[last]
+			sum += v
+			count++
+			p.Avg = sum / float64(count)
+			if v < p.Min {
+				p.Min = v
+			}
+			if v > p.Max {
+				p.Max = v
+			}
+			continue
+		}
+		sum, count = v, 1
+		points = append(points, HistoryPoint{Time: bucket, Avg: v, Min: v, Max: v})
+	}
+	return points, true
+}
+
+// Oldest 返回指标在内存中最早的样本时间
+func (h *History) Oldest(metric string) (time.Time, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	r, ok := h.series[metric]
+	if !ok {
+		return time.Time{}, false
+	}
+	idx := 0
+	if r.full {
+		idx = r.next
+	}
+	return time.Unix(r.times[idx], 0), true
+}
+
+// queryHistory 内存历史覆盖查询起点时使用内存数据，否则从磁盘存储读取
+// 返回实际使用的降采样间隔
+// 回放模式下只返回回放位置之前的数据
+func (em *EnhancedMonitor) queryHistory(metric string, from, to time.Time, step time.Duration) ([]HistoryPoint, time.Duration, bool) {
+	if em.replay != nil {
+		if pos := em.replay.Position(); to.After(pos) {
+			to = pos
+		}
+	}
+	if em.store != nil {
+		oldest, ok := em.history.Oldest(metric)
+		if !ok || from.Before(oldest) {
+			points, step := em.store.Query(metric, from, to, step)
+			return points, step, ok || len(points) > 0
+		}
+	}
+	points, ok := em.history.Query(metric, from, to, step)
+	return points, step, ok
+}
+
+// recordHistory 每个 Interval 将当前指标记录到历史中，直到ctx被取消
+func (em *EnhancedMonitor) recordHistory(ctx context.Context) {
+	ticker := time.NewTicker(em.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			values := em.monitor.values()
+			for name, v := range em.monitor.mountValues() {
+				values[name] = v
+			}
+			// 采集器完成首次采集前的数值为0，不能用来建立基线
+			if em.anomaly != nil && em.scheduler.Ready() {
+				for name, v := range em.anomaly.Observe(now, values) {
+					values[name] = v
+				}
+			}
+			em.history.Add(now, values)
+			if em.store != nil {
+				em.store.Add(now, values)
+			}
+		}
+	}
+}
+
+// handleHistory 处理 /api/history 请求
+// 参数: metric 指标名；from/to 为unix秒或RFC3339时间，默认最近一小时；step 为降采样间隔，如 10s 或 60
+// 不带 metric 时返回可查询的指标列表
+func (em *EnhancedMonitor) handleHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	if metric == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metrics": em.history.Metrics(),
+		})
+		return
+	}
+
+	now := time.Now()
+	if em.replay != nil {
+		now = em.replay.Position()
+	}
+	to, err := parseTimeParam(q.Get("to"), now)
+	if err != nil {
+		http.Error(w, "Invalid to", http.StatusBadRequest)
+		return
+	}
+	from, err := parseTimeParam(q.Get("from"), to.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, "Invalid from", http.StatusBadRequest)
+		return
+	}
+	step, err := parseStepParam(q.Get("step"))
+	if err != nil {
+		http.Error(w, "Invalid step", http.StatusBadRequest)
+		return
+	}
+
+	points, step, ok := em.queryHistory(metric, from, to, step)
+	if !ok {
+		http.Error(w, "Metric not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"metric": metric,
+		"from":   from.Unix(),
+		"to":     to.Unix(),
+		"step":   int64(step / time.Second),
+		"points": points,
+	})
+}
+
+// maxTimeParam 时间参数允许的最大unix秒（9999-12-31T23:59:59Z）
+const maxTimeParam = 253402300799
+
+// parseTimeParam 解析unix秒或RFC3339格式的时间参数，为空时返回默认值；早于1970年或晚于9999年的时间视为无效
+func parseTimeParam(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if sec, perr := strconv.ParseInt(s, 10, 64); perr == nil {
+		t, err = time.Unix(sec, 0), nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if sec := t.Unix(); sec < 0 || sec > maxTimeParam {
+		return time.Time{}, fmt.Errorf("时间超出范围")
+	}
+	return t, nil
+}
+
+// parseStepParam 解析降采样间隔，支持 10s 形式的时长或秒数，为空表示不降采样
+func parseStepParam(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if sec < 0 {
+			return 0, fmt.Errorf("step 不能为负数")
+		}
+		return time.Duration(sec) * time.Second, nil
+	}
+	step, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if step < 0 {
+		return 0, fmt.Errorf("step 不能为负数")
+	}
+	return step, nil
+}
+
+// storeTierSpecs 磁盘存储的各分辨率：原始1s样本、1分钟汇总和1小时汇总
+// 每个分辨率的数据按 segment 切分成文件，整段过期后删除
+var storeTierSpecs = []struct {
+	name       string
+	resolution time.Duration
+	segment    time.Duration
+	retention  time.Duration
+}{
+	{"raw", time.Second, time.Hour, 48 * time.Hour},
+	{"1m", time.Minute, 24 * time.Hour, 30 * 24 * time.Hour},
+	{"1h", time.Hour, 30 * 24 * time.Hour, 365 * 24 * time.Hour},
+}
+
+// 单次查询最多返回的点数，超出时自动增大降采样间隔
+const maxStorePoints = 4000
+
+// 原始样本每累积多少个时刻写一次盘
+const rawFlushEvery = 60
+
+// 数据块类型
+const (
+	chunkRaw    = 0
+	chunkRollup = 1
+)
+
+// Store 只追加写入的磁盘时序存储
+//
+// 每个分辨率一个子目录，文件名为分段的起始unix时间。文件由若干记录组成，
+// 每条记录为 [4字节长度][4字节CRC32][数据块]，数据块内按指标分列存储，
+// 时间戳采用差分变长编码。崩溃导致的半条记录在下次打开时被截断。
+type Store struct {
+	mu    sync.Mutex
+	dir   string
+	tiers []*storeTier
+}
+
+// storeTier 某一分辨率的存储
+type storeTier struct {
+	name       string
+	resolution int64 // 秒
+	segment    int64 // 秒
+	retention  time.Duration
+	dir        string
+	flushEvery int
+
+	file    *os.File
+	fileSeg int64
+
+	// 尚未写盘的数据
+	pending      map[string][]storePoint
+	pendingCount int
+	pendingSeg   int64
+
+	// 汇总层当前时间桶的累加值
+	acc       map[string]storePoint
+	accBucket int64
+}
+
+// storePoint 存储中的数据点，原始样本的 avg/min/max 相同且 count 为1
+type storePoint struct {
+	t     int64
+	avg   float64
+	min   float64
+	max   float64
+	count uint64
+}
+
+// merge 合并同一时间桶内的两个数据点
+func (p storePoint) merge(o storePoint) storePoint {
+	total := p.count + o.count
+	p.avg = (p.avg*float64(p.count) + o.avg*float64(o.count)) / float64(total)
+	p.count = total
+	if o.min < p.min {
+		p.min = o.min
+	}
+	if o.max > p.max {
+		p.max = o.max
+	}
+	return p
+}
+
+// OpenStore 打开（或创建）dir 下的时序存储，修复崩溃时写了一半的记录并清理过期数据
+func OpenStore(dir string, retention map[string]time.Duration) (*Store, error) {
+	s := &Store{dir: dir}
+	now := time.Now()
+	for _, spec := range storeTierSpecs {
+		t := &storeTier{
+			name:       spec.name,
+			resolution: int64(spec.resolution / time.Second),
+			segment:    int64(spec.segment / time.Second),
+			retention:  spec.retention,
+			dir:        filepath.Join(dir, spec.name),
+			flushEvery: 1,
+			pending:    make(map[string][]storePoint),
+			acc:        make(map[string]storePoint),
+		}
+		if t.resolution == 1 {
+			t.flushEvery = rawFlushEvery
+		}
+		if d, ok := retention[spec.name]; ok {
+			t.retention = d
+		}
+		if err := os.MkdirAll(t.dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := t.repair(); err != nil {
+			return nil, err
+		}
+		t.enforceRetention(now)
+		s.tiers = append(s.tiers, t)
+	}
+	return s, nil
+}
+
+// Add 写入一个时刻的全部指标，并逐级汇总到更粗的分辨率
+func (s *Store) Add(t time.Time, values map[string]float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := t.Unix()
+	points := make(map[string]storePoint, len(values))
+	for name, v := range values {
+		points[name] = storePoint{t: ts, avg: v, min: v, max: v, count: 1}
+	}
+	for _, tier := range s.tiers {
+		ts, points = tier.add(ts, points)
+		if len(points) == 0 {
+			break
+		}
+	}
+}
+
+// Close 写出所有未落盘的数据（包括未结束时间桶的部分汇总）并关闭文件
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	var carry map[string]storePoint
+	var carryTs int64
+	for _, tier := range s.tiers {
+		if len(carry) > 0 {
+			tier.add(carryTs, carry)
+		}
+		carry, carryTs = nil, 0
+		if tier.resolution > 1 && len(tier.acc) > 0 {
+			carry, carryTs = tier.acc, tier.accBucket
+			tier.append(carryTs, carry)
+			tier.acc = make(map[string]storePoint)
+		}
+		if err := tier.flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if tier.file != nil {
+			if err := tier.file.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			tier.file = nil
+		}
+	}
+	return firstErr
+}
+
+// Query 查询 [from, to] 范围内的历史数据，返回数据点和实际使用的降采样间隔
+// 自动选择保留时长能覆盖 from 的最细分辨率，降采样间隔不小于该分辨率；
+// 查询范围限制在最粗分辨率的保留时长到当前时间之内，只读取与范围重叠的分段文件。
+// 持有锁时只记下分段文件当前的长度和未写盘的数据，读取和解码文件时不阻塞写入
+func (s *Store) Query(metric string, from, to time.Time, step time.Duration) ([]HistoryPoint, time.Duration) {
+	s.mu.Lock()
+	now := time.Now()
+	tier := s.tiers[len(s.tiers)-1]
+	if oldest := now.Add(-tier.retention); from.Before(oldest) {
+		from = oldest
+	}
+	if to.After(now) {
+		to = now
+	}
+	for _, t := range s.tiers {
+		if !from.Before(now.Add(-t.retention)) {
+			tier = t
+			break
+		}
+	}
+
+	fromSec, toSec := from.Unix(), to.Unix()
+	if fromSec > toSec {
+		s.mu.Unlock()
+		return []HistoryPoint{}, time.Duration(tier.resolution) * time.Second
+	}
+	stepSec := int64(step / time.Second)
+	if stepSec < tier.resolution {
+		stepSec = tier.resolution
+	}
+	if span := toSec - fromSec; span/stepSec > maxStorePoints {
+		stepSec = (span/maxStorePoints + tier.resolution) / tier.resolution * tier.resolution
+	}
+
+	// 文件只在持有锁时追加，读取时截断到此刻的长度，之后写盘的数据已包含在 pending 的快照中
+	type segmentFile struct {
+		path string
+		size int64
+	}
+	var files []segmentFile
+	segs := tier.segments()
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	for _, seg := range segs {
+		if seg+tier.segment <= fromSec || seg > toSec {
+			continue
+		}
+		path := tier.segmentPath(seg)
+		if info, err := os.Stat(path); err == nil {
+			files = append(files, segmentFile{path, info.Size()})
+		}
+	}
+	// 尚未写盘的数据
+	pending := append([]storePoint(nil), tier.pending[metric]...)
+	if p, ok := tier.acc[metric]; ok {
+		pending = append(pending, p)
+	}
+	s.mu.Unlock()
+
+	var points []storePoint
+	collect := func(p storePoint) {
+		if p.t >= fromSec && p.t <= toSec {
+			points = append(points, p)
+		}
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			continue
+		}
+		if int64(len(data)) > f.size {
+			data = data[:f.size]
+		}
+		scanRecords(data, func(payload []byte) {
+			decodeChunk(payload, metric, collect)
+		})
+	}
+	for _, p := range pending {
+		collect(p)
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].t < points[j].t })
+
+	result := []HistoryPoint{}
+	var bucket storePoint
+	for i, p := range points {
+		b := p.t - p.t%stepSec
+		if i > 0 && b == bucket.t {
+			bucket = bucket.merge(p)
+			continue
+		}
+		if i > 0 {
+			result = append(result, HistoryPoint{Time: bucket.t, Avg: bucket.avg, Min: bucket.min, Max: bucket.max})
+		}
+		bucket = p
+		bucket.t = b
+	}
+	if len(points) > 0 {
+		result = append(result, HistoryPoint{Time: bucket.t, Avg: bucket.avg, Min: bucket.min, Max: bucket.max})
+	}
+	return result, time.Duration(stepSec) * time.Second
+}
+
+// add 向该层写入一个时刻的数据点，返回需要传给下一层的数据
+// 原始层原样传递；汇总层在时间桶结束时传出该桶的汇总
+func (t *storeTier) add(ts int64, points map[string]storePoint) (int64, map[string]storePoint) {
+	if t.resolution == 1 {
+		t.append(ts, points)
+		return ts, points
+	}
+
+	bucket := ts - ts%t.resolution
+	var emitted map[string]storePoint
+	emittedTs := t.accBucket
+	if len(t.acc) > 0 && bucket != t.accBucket {
+		emitted = t.acc
+		t.append(emittedTs, emitted)
+		t.acc = make(map[string]storePoint)
+	}
+	t.accBucket = bucket
+	for name, p := range points {
+		p.t = bucket
+		if a, ok := t.acc[name]; ok {
+			p = a.merge(p)
+		}
+		t.acc[name] = p
+	}
+	return emittedTs, emitted
+}
+
+// append 把数据点放入写盘缓冲，跨分段或缓冲满时写盘
+func (t *storeTier) append(ts int64, points map[string]storePoint) {
+	seg := ts - ts%t.segment
+	if t.pendingCount > 0 && seg != t.pendingSeg {
+		t.flushLogged()
+	}
+	t.pendingSeg = seg
+	for name, p := range points {
+		t.pending[name] = append(t.pending[name], p)
+	}
+	t.pendingCount++
+	if t.pendingCount >= t.flushEvery {
+		t.flushLogged()
+	}
+}
+
+// flushLogged 写盘，失败时记录日志并丢弃该批数据
+func (t *storeTier) flushLogged() {
+	if err := t.flush(); err != nil {
+		log.Printf("写入 %s 数据失败: %v", t.name, err)
+	}
+}
+
+// flush 把缓冲中的数据作为一个数据块追加到当前分段文件
+func (t *storeTier) flush() error {
+	if t.pendingCount == 0 {
+		return nil
+	}
+	pending, seg := t.pending, t.pendingSeg
+	t.pending = make(map[string][]storePoint)
+	t.pendingCount = 0
+
+	if t.file == nil || t.fileSeg != seg {
+		if t.file != nil {
+			t.file.Close()
+			t.file = nil
+		}
+		f, err := os.OpenFile(t.segmentPath(seg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		t.file, t.fileSeg = f, seg
+		t.enforceRetention(time.Now())
+	}
+
+	payload := encodeChunk(pending, t.resolution == 1)
+	record := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[8:], payload)
+	_, err := t.file.Write(record)
+	return err
+}
+
+// segmentPath 返回分段文件路径
+func (t *storeTier) segmentPath(seg int64) string {
+	return filepath.Join(t.dir, fmt.Sprintf("%d.dat", seg))
+}
+
+// segments 返回目录中所有分段的起始时间
+func (t *storeTier) segments() []int64 {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil
+	}
+	var segs []int64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".dat") {
+			continue
+		}
+		seg, err := strconv.ParseInt(strings.TrimSuffix(name, ".dat"), 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// repair 截断各分段文件末尾不完整或校验失败的记录
+func (t *storeTier) repair() error {
+	for _, seg := range t.segments() {
+		path := t.segmentPath(seg)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		valid := scanRecords(data, nil)
+		if valid < len(data) {
+			log.Printf("修复数据文件 %s: 截断 %d 字节损坏的数据", path, len(data)-valid)
+			if err := os.Truncate(path, int64(valid)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enforceRetention 删除整段都已超过保留时长的分段文件
+func (t *storeTier) enforceRetention(now time.Time) {
+	cutoff := now.Add(-t.retention).Unix()
+	for _, seg := range t.segments() {
+		if seg+t.segment > cutoff || (t.file != nil && seg == t.fileSeg) {
+			continue
+		}
+		if err := os.Remove(t.segmentPath(seg)); err != nil {
+			log.Printf("删除过期数据文件失败: %v", err)
+		}
+	}
+}
+
+// scanRecords 依次校验文件中的记录并回调数据块，返回最后一条完整记录结束的偏移
+func scanRecords(data []byte, fn func(payload []byte)) int {
+	offset := 0
+	for len(data)-offset >= 8 {
+		size := int(binary.LittleEndian.Uint32(data[offset : offset+4]))
+		sum := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
+		if size > len(data)-offset-8 {
+			break
+		}
+		payload := data[offset+8 : offset+8+size]
+		if crc32.ChecksumIEEE(payload) != sum {
+			break
+		}
+		if fn != nil {
+			fn(payload)
+		}
+		offset += 8 + size
+	}
+	return offset
+}
+
+// encodeChunk 编码数据块
+// 格式: 类型 | 基准时间 | 指标数 | 每个指标 [名称长度 | 名称 | 点数 | 每个点 [时间差 | 数值]]
+// 原始块的数值为一个float64，汇总块为 avg/min/max 三个float64加样本数
+func encodeChunk(series map[string][]storePoint, raw bool) []byte {
+	names := make([]string, 0, len(series))
+	base := int64(math.MaxInt64)
+	for name, points := range series {
+		names = append(names, name)
+		if len(points) > 0 && points[0].t < base {
+			base = points[0].t
+		}
+	}
+	sort.Strings(names)
+
+	buf := make([]byte, 0, 64)
+	if raw {
+		buf = append(buf, chunkRaw)
+	} else {
+		buf = append(buf, chunkRollup)
+	}
+	buf = appendVarint(buf, base)
+	buf = appendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		points := series[name]
+		buf = appendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = appendUvarint(buf, uint64(len(points)))
+		prev := base
+		for _, p := range points {
+			buf = appendVarint(buf, p.t-prev)
+			prev = p.t
+			buf = appendFloat64(buf, p.avg)
+			if !raw {
+				buf = appendFloat64(buf, p.min)
+				buf = appendFloat64(buf, p.max)
+				buf = appendUvarint(buf, p.count)
+			}
+		}
+	}
+	return buf
+}
+
+// decodeChunk 解码数据块，只回调指定指标的数据点
+func decodeChunk(buf []byte, metric string, fn func(storePoint)) error {
+	errCorrupt := fmt.Errorf("数据块格式错误")
+	if len(buf) == 0 {
+		return errCorrupt
+	}
+	raw := buf[0] == chunkRaw
+	buf = buf[1:]
+
+	base, n := binary.Varint(buf)
+	if n <= 0 {
+		return errCorrupt
+	}
+	buf = buf[n:]
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return errCorrupt
+	}
+	buf = buf[n:]
+
+	valueSize := 8
+	if !raw {
+		valueSize = 24
+	}
+	for i := uint64(0); i < count; i++ {
+		nameLen, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < nameLen {
+			return errCorrupt
+		}
+		name := string(buf[n : n+int(nameLen)])
+		buf = buf[n+int(nameLen):]
+		npoints, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errCorrupt
+		}
+		buf = buf[n:]
+
+		t := base
+		for j := uint64(0); j < npoints; j++ {
+			delta, n := binary.Varint(buf)
+			if n <= 0 || len(buf)-n < valueSize {
+				return errCorrupt
+			}
+			t += delta
+			buf = buf[n:]
+			p := storePoint{t: t, count: 1}
+			p.avg = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+			p.min, p.max = p.avg, p.avg
+			buf = buf[8:]
+			if !raw {
+				p.min = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+				p.max = math.Float64frombits(binary.LittleEndian.Uint64(buf[8:]))
+				buf = buf[16:]
+				p.count, n = binary.Uvarint(buf)
+				if n <= 0 {
+					return errCorrupt
+				}
+				buf = buf[n:]
+			}
+			if name == metric {
+				fn(p)
+			}
+		}
+	}
+	return nil
+}
+
+// appendUvarint 追加无符号变长整数
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// appendVarint 追加有符号变长整数
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// appendFloat64 追加小端序的float64
+func appendFloat64(buf []byte, v float64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+	return append(buf, tmp[:]...)
+}
+
+// parseRetention 解析形如 raw=48h,1m=30d 的保留时长配置
+func parseRetention(s string) (map[string]time.Duration, error) {
+	retention := make(map[string]time.Duration)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q 缺少 '='", item)
+		}
+		name := strings.TrimSpace(parts[0])
+		known := false
+		for _, spec := range storeTierSpecs {
+			if spec.name == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("未知的分辨率 %q", name)
+		}
+		d, err := parseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("分辨率 %s 的保留时长必须大于0", name)
+		}
+		retention[name] = d
+	}
+	return retention, nil
+}
+
+// parseDuration 在 time.ParseDuration 的基础上支持以天为单位，如 30d
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("无效的时长 %q", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// 流量统计各粒度保留的时段数
+const (
+	trafficKeepHours  = 72
+	trafficKeepDays   = 62
+	trafficKeepMonths = 24
+)
+
+// 流量统计写盘的最小间隔
+const trafficSaveInterval = time.Minute
+
+// TrafficCounter 一个时段内的流量（字节）
+type TrafficCounter struct {
+	Start int64  `json:"start"` // 时段起始unix秒
+	Rx    uint64 `json:"rx"`
+	Tx    uint64 `json:"tx"`
+}
+
+// Total 收发合计
+func (c TrafficCounter) Total() uint64 {
+	return c.Rx + c.Tx
+}
+
+// interfaceTraffic 单个网卡的流量记录
+type interfaceTraffic struct {
+	LastRx uint64           `json:"last_rx"`
+	LastTx uint64           `json:"last_tx"`
+	Hours  []TrafficCounter `json:"hours"`
+	Days   []TrafficCounter `json:"days"`
+	Months []TrafficCounter `json:"months"`
+}
+
+// trafficFile 流量统计的持久化格式
+type trafficFile struct {
+	BootID     string                       `json:"boot_id"`
+	Interfaces map[string]*interfaceTraffic `json:"interfaces"`
+}
+
+// TrafficAccounting 按网卡累计小时/天/账单月的流量
+// 网卡计数器在重启或网卡重建后会归零，这里记录上次读数和启动ID，
+// 只累加增量，因此统计结果不受计数器重置影响
+type TrafficAccounting struct {
+	mu         sync.Mutex
+	path       string
+	billingDay int
+	quota      uint64
+	data       trafficFile
+	lastSave   time.Time
+	dirty      bool
+}
+
+// TrafficCycle 当前账单周期的用量
+type TrafficCycle struct {
+	Start      int64   `json:"start"`
+	End        int64   `json:"end"`
+	Rx         uint64  `json:"rx"`
+	Tx         uint64  `json:"tx"`
+	Total      uint64  `json:"total"`
+	Projected  uint64  `json:"projected"`
+	Quota      uint64  `json:"quota"`
+	QuotaUsage float64 `json:"quota_usage"`
+}
+
+// TrafficReport 单个网卡的流量报表，各列表按时间倒序
+type TrafficReport struct {
+	Interface string           `json:"interface"`
+	Cycle     TrafficCycle     `json:"cycle"`
+	Hours     []TrafficCounter `json:"hours"`
+	Days      []TrafficCounter `json:"days"`
+	Months    []TrafficCounter `json:"months"`
+}
+
+// NewTrafficAccounting 创建流量统计，配置了数据目录时从 traffic.json 恢复
+func NewTrafficAccounting(config Config) *TrafficAccounting {
+	ta := &TrafficAccounting{
+		billingDay: config.BillingDay,
+		quota:      config.TrafficQuota,
+		data:       trafficFile{Interfaces: make(map[string]*interfaceTraffic)},
+	}
+	if config.DataDir == "" {
+		return ta
+	}
+	ta.path = filepath.Join(config.DataDir, "traffic.json")
+	data, err := os.ReadFile(ta.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取流量统计失败: %v", err)
+		}
+		return ta
+	}
+	var saved trafficFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("流量统计文件损坏，重新开始统计: %v", err)
+		return ta
+	}
+	if saved.Interfaces != nil {
+		ta.data = saved
+	}
+	return ta
+}
+
+// Update 根据各网卡当前的计数器累加流量
+func (ta *TrafficAccounting) Update(now time.Time, counters map[string][2]uint64) error {
+	bootID := readBootID()
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	rebooted := bootID != "" && bootID != ta.data.BootID
+	ta.data.BootID = bootID
+	for intf, c := range counters {
+		rx, tx := c[0], c[1]
+		it, ok := ta.data.Interfaces[intf]
+		if !ok {
+			// 第一次见到该网卡，只记录基准读数
+			ta.data.Interfaces[intf] = &interfaceTraffic{LastRx: rx, LastTx: tx}
+			ta.dirty = true
+			continue
+		}
+		drx, dtx := counterDelta(it.LastRx, rx, rebooted), counterDelta(it.LastTx, tx, rebooted)
+		it.LastRx, it.LastTx = rx, tx
+		if drx == 0 && dtx == 0 {
+			continue
+		}
+		it.Hours = addTraffic(it.Hours, ta.hourStart(now), drx, dtx, trafficKeepHours)
+		it.Days = addTraffic(it.Days, ta.dayStart(now), drx, dtx, trafficKeepDays)
+		it.Months = addTraffic(it.Months, ta.cycleStart(now).Unix(), drx, dtx, trafficKeepMonths)
+		ta.dirty = true
+	}
+
+	if ta.dirty && now.Sub(ta.lastSave) >= trafficSaveInterval {
+		ta.lastSave = now
+		return ta.saveLocked()
+	}
+	return nil
+}
+
+// Save 立即写盘
+func (ta *TrafficAccounting) Save() error {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	return ta.saveLocked()
+}
+
+// saveLocked 先写临时文件再改名，避免崩溃时留下不完整的文件
+func (ta *TrafficAccounting) saveLocked() error {
+	if ta.path == "" || !ta.dirty {
+		return nil
+	}
+	data, err := json.Marshal(ta.data)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(ta.path, data); err != nil {
+		return err
+	}
+	ta.dirty = false
+	return nil
+}
+
+// writeFileAtomic 先写临时文件再重命名，避免写到一半时退出导致文件损坏
+func writeFileAtomic(path string, data []byte) error {
+	return writeFileAtomicMode(path, data, 0666)
+}
+
+// writeFileAtomicMode 与 writeFileAtomic 相同，但可以指定文件权限，用于保存密钥等敏感数据
+func writeFileAtomicMode(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Reports 生成所有网卡的流量报表（按网卡名排序）
+func (ta *TrafficAccounting) Reports(now time.Time) []TrafficReport {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	cycleStart := ta.cycleStart(now)
+	cycleEnd := ta.billingDate(cycleStart.Year(), cycleStart.Month()+1)
+	reports := []TrafficReport{}
+	for intf, it := range ta.data.Interfaces {
+		report := TrafficReport{
+			Interface: intf,
+			Cycle: TrafficCycle{
+				Start: cycleStart.Unix(),
+				End:   cycleEnd.Add(-time.Second).Unix(),
+				Quota: ta.quota,
+			},
+			Hours:  reversedTraffic(it.Hours),
+			Days:   reversedTraffic(it.Days),
+			Months: reversedTraffic(it.Months),
+		}
+		if n := len(it.Months); n > 0 && it.Months[n-1].Start == cycleStart.Unix() {
+			c := &report.Cycle
+			c.Rx, c.Tx = it.Months[n-1].Rx, it.Months[n-1].Tx
+			c.Total = c.Rx + c.Tx
+			// 按本周期已过去的时间线性估算整个周期的用量
+			elapsed := now.Sub(cycleStart).Seconds()
+			if elapsed > 0 {
+				c.Projected = uint64(float64(c.Total) * cycleEnd.Sub(cycleStart).Seconds() / elapsed)
+			}
+			if ta.quota > 0 {
+				c.QuotaUsage = float64(c.Total) * 100 / float64(ta.quota)
+			}
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Interface < reports[j].Interface })
+	return reports
+}
+
+// hourStart 返回 t 所在小时的起始时间
+func (ta *TrafficAccounting) hourStart(t time.Time) int64 {
+	t = t.In(displayZone)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, displayZone).Unix()
+}
+
+// dayStart 返回 t 所在日的起始时间
+func (ta *TrafficAccounting) dayStart(t time.Time) int64 {
+	t = t.In(displayZone)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, displayZone).Unix()
+}
+
+// cycleStart 返回 t 所在账单周期的起始时间
+func (ta *TrafficAccounting) cycleStart(t time.Time) time.Time {
+	t = t.In(displayZone)
+	start := ta.billingDate(t.Year(), t.Month())
+	if t.Before(start) {
+		start = ta.billingDate(t.Year(), t.Month()-1)
+	}
+	return start
+}
+
+// billingDate 返回某月账单日的零点，当月没有账单日（如2月30日）时取当月最后一天
+func (ta *TrafficAccounting) billingDate(year int, month time.Month) time.Time {
+	day := ta.billingDay
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, displayZone).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, displayZone)
+}
+
+// counterDelta 计算计数器增量
+// 重启后或计数器变小（网卡重建）时计数器已从0重新开始，当前读数即为增量
+func counterDelta(last, curr uint64, rebooted bool) uint64 {
+	if rebooted || curr < last {
+		return curr
+	}
+	return curr - last
+}
+
+// addTraffic 把流量累加到 start 对应的时段，超出保留数量时丢弃最旧的时段
+func addTraffic(counters []TrafficCounter, start int64, rx, tx uint64, keep int) []TrafficCounter {
+	if n := len(counters); n > 0 && counters[n-1].Start == start {
+		counters[n-1].Rx += rx
+		counters[n-1].Tx += tx
+		return counters
+	}
+	counters = append(counters, TrafficCounter{Start: start, Rx: rx, Tx: tx})
+	if len(counters) > keep {
+		counters = append([]TrafficCounter(nil), counters[len(counters)-keep:]...)
+	}
+	return counters
+}
+
+// reversedTraffic 返回按时间倒序排列的副本
+func reversedTraffic(counters []TrafficCounter) []TrafficCounter {
+	reversed := make([]TrafficCounter, len(counters))
+	for i, c := range counters {
+		reversed[len(counters)-1-i] = c
+	}
+	return reversed
+}
+
+// readBootID 读取本次启动的唯一ID，用于判断系统是否重启过
+func readBootID() string {
+	data, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readBootTime 从 /proc/stat 的 btime 读取系统启动时间，读取失败时返回零值
+func readBootTime() time.Time {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "btime" {
+			if sec, err := strconv.ParseInt(fields[1], 10, 64); err == nil && sec > 0 {
+				return time.Unix(sec, 0)
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// formatBytes 以合适的单位格式化字节数
+func formatBytes(b uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	v := float64(b)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", b)
+	}
+	return fmt.Sprintf("%.2f %s", v, units[i])
+}
+
+// parseBytes 解析 500GB、1.5TB 这样的容量（按1024进位），为空时返回0
+func parseBytes(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	multipliers := []struct {
+		suffix string
+		value  float64
+	}{
+		{"PB", 1 << 50}, {"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+	}
+	for _, m := range multipliers {
+		if strings.HasSuffix(s, m.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, m.suffix)), 64)
+			if err != nil || v < 0 {
+				return 0, fmt.Errorf("无效的容量 %q", s)
+			}
+			return uint64(v * m.value), nil
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("无效的容量 %q", s)
+	}
+	return v, nil
+}
+
+// MetricPoint 带标签的数值指标，Prometheus 等各种输出共用这一数据模型
+// 数值统一使用基本单位（字节、秒），名称不含 sysmon_ 前缀，计数器不含 _total 后缀
+type MetricPoint struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// metricDesc 指标说明
+type metricDesc struct {
+	Name string
+	Type string // gauge 或 counter
+	Unit string
+	Help string
+}
+
+// metricDescs 所有指标的说明，输出时按此顺序排列
+var metricDescs = []metricDesc{
+	{"uptime_seconds", "gauge", "seconds", "系统运行时间"},
+	{"load1", "gauge", "", "1分钟平均负载"},
+	{"load5", "gauge", "", "5分钟平均负载"},
+	{"load15", "gauge", "", "15分钟平均负载"},
+	{"cpu_usage_percent", "gauge", "percent", "CPU使用率"},
+	{"cpu_seconds", "counter", "seconds", "各模式下累计的CPU时间"},
+	{"cpu_core_usage_percent", "gauge", "percent", "各CPU核心的使用率"},
+	{"cpu_temperature_celsius", "gauge", "celsius", "CPU温度"},
+	{"memory_total_bytes", "gauge", "bytes", "内存总容量"},
+	{"memory_used_bytes", "gauge", "bytes", "已使用内存（不含缓冲区、缓存和可回收内存）"},
+	{"memory_available_bytes", "gauge", "bytes", "可用内存"},
+	{"memory_usage_percent", "gauge", "percent", "内存使用率"},
+	{"swap_total_bytes", "gauge", "bytes", "SWAP总容量"},
+	{"swap_used_bytes", "gauge", "bytes", "已使用SWAP"},
+	{"swap_free_bytes", "gauge", "bytes", "空闲SWAP"},
+	{"disk_total_bytes", "gauge", "bytes", "挂载点总容量"},
+	{"disk_used_bytes", "gauge", "bytes", "挂载点已使用空间"},
+	{"disk_available_bytes", "gauge", "bytes", "挂载点可用空间"},
+	{"disk_usage_percent", "gauge", "percent", "挂载点使用率"},
+	{"disk_read_bytes_per_second", "gauge", "bytes_per_second", "所有物理磁盘的读取速率"},
+	{"disk_write_bytes_per_second", "gauge", "bytes_per_second", "所有物理磁盘的写入速率"},
+	{"network_receive_bytes", "counter", "bytes", "网卡累计接收字节数（网卡计数器）"},
+	{"network_transmit_bytes", "counter", "bytes", "网卡累计发送字节数（网卡计数器）"},
+	{"network_receive_bytes_per_second", "gauge", "bytes_per_second", "网卡的接收速率"},
+	{"network_transmit_bytes_per_second", "gauge", "bytes_per_second", "网卡的发送速率"},
+	{"disk_time_to_full_seconds", "gauge", "seconds", "按使用量趋势预计挂载点写满的剩余时间，使用量未增长时不输出"},
+	{"memory_time_to_full_seconds", "gauge", "seconds", "按使用量趋势预计内存耗尽的剩余时间，使用量未增长时不输出"},
+	{"swap_time_to_full_seconds", "gauge", "seconds", "按使用量趋势预计SWAP耗尽的剩余时间，使用量未增长时不输出"},
+	{"anomaly_zscore", "gauge", "", "指标偏离异常检测基线的标准差倍数（z分数），基线建立前不输出"},
+	{"anomaly_detected", "gauge", "", "指标是否超出预期范围（1为异常）"},
+	{"fleet_host_up", "gauge", "", "hub 模式下各主机是否在线（1为在线）"},
+	{"collector_up", "gauge", "", "采集器最近一次采集是否成功"},
+	{"collector_duration_seconds", "gauge", "seconds", "采集器最近一次采集的耗时"},
+	{"collector_runs", "counter", "", "采集器累计采集次数"},
+	{"collector_failures", "counter", "", "采集器累计失败次数"},
+}
+
+// userHZ /proc/stat 中CPU时间的单位（每秒的时钟节拍数）
+const userHZ = 100
+
+// points 返回当前所有带标签的数值指标，与 snapshot 读取同一份采集结果
+func (m *Monitor) points() []MetricPoint {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var points []MetricPoint
+	add := func(name string, v float64, labels ...string) {
+		p := MetricPoint{Name: name, Value: v}
+		if len(labels) > 0 {
+			p.Labels = make(map[string]string, len(labels)/2)
+			for i := 0; i+1 < len(labels); i += 2 {
+				p.Labels[labels[i]] = labels[i+1]
+			}
+		}
+		points = append(points, p)
+	}
+
+	if m.uptime > 0 {
+		add("uptime_seconds", m.uptime)
+		add("load1", m.loadAvg[0])
+		add("load5", m.loadAvg[1])
+		add("load15", m.loadAvg[2])
+	}
+	add("cpu_usage_percent", m.cpuUsage)
+	cpu := m.prevCPUStat
+	for _, mode := range []struct {
+		name  string
+		value uint64
+	}{
+		{"user", cpu.User}, {"nice", cpu.Nice}, {"system", cpu.System}, {"idle", cpu.Idle},
+		{"iowait", cpu.Iowait}, {"irq", cpu.Irq}, {"softirq", cpu.Softirq},
+	} {
+		add("cpu_seconds", float64(mode.value)/userHZ, "mode", mode.name)
+	}
+	for i, usage := range m.coreUsage {
+		add("cpu_core_usage_percent", usage, "core", strconv.Itoa(i))
+	}
+	if m.hasCPUTemp {
+		add("cpu_temperature_celsius", m.cpuTemp)
+	}
+	if m.memInfo != nil {
+		add("memory_total_bytes", float64(m.memInfo["total"])*1024)
+		add("memory_used_bytes", float64(m.memInfo["used"])*1024)
+		add("memory_available_bytes", float64(m.memInfo["total"]-m.memInfo["used"])*1024)
+		add("memory_usage_percent", percent(m.memInfo["used"], m.memInfo["total"]))
+	}
+	if m.swapInfo != nil {
+		add("swap_total_bytes", float64(m.swapInfo["total"])*1024)
+		add("swap_used_bytes", float64(m.swapInfo["used"])*1024)
+		add("swap_free_bytes", float64(m.swapInfo["free"])*1024)
+	}
+	for _, d := range m.diskMounts {
+		add("disk_total_bytes", float64(d.Total)*1024, "device", d.Device, "mount", d.Mount)
+		add("disk_used_bytes", float64(d.Used)*1024, "device", d.Device, "mount", d.Mount)
+		add("disk_available_bytes", float64(d.Available)*1024, "device", d.Device, "mount", d.Mount)
+		add("disk_usage_percent", percent(d.Used, d.Used+d.Available), "device", d.Device, "mount", d.Mount)
+	}
+	if !m.prevIOTime.IsZero() {
+		add("disk_read_bytes_per_second", m.diskRead*1024)
+		add("disk_write_bytes_per_second", m.diskWrite*1024)
+	}
+	counters := m.netCounters
+	if counters == nil && !m.prevNetTime.IsZero() {
+		counters = map[string][2]uint64{m.config.Interface: {m.netRx, m.netTx}}
+	}
+	names := make([]string, 0, len(counters))
+	for intf := range counters {
+		names = append(names, intf)
+	}
+	sort.Strings(names)
+	for _, intf := range names {
+		add("network_receive_bytes", float64(counters[intf][0]), "interface", intf)
+		add("network_transmit_bytes", float64(counters[intf][1]), "interface", intf)
+	}
+	if len(m.netRates) > 0 {
+		names = names[:0]
+		for intf := range m.netRates {
+			names = append(names, intf)
+		}
+		sort.Strings(names)
+		for _, intf := range names {
+			add("network_receive_bytes_per_second", m.netRates[intf][0], "interface", intf)
+			add("network_transmit_bytes_per_second", m.netRates[intf][1], "interface", intf)
+		}
+	} else if !m.prevNetTime.IsZero() {
+		add("network_receive_bytes_per_second", m.receiveSpeed*1024, "interface", m.config.Interface)
+		add("network_transmit_bytes_per_second", m.transmitSpeed*1024, "interface", m.config.Interface)
+	}
+	return points
+}
+
+// points 返回采集器自身的健康指标
+func (s *Scheduler) points() []MetricPoint {
+	var points []MetricPoint
+	for _, h := range s.Health() {
+		labels := map[string]string{"collector": h.Name}
+		up := 0.0
+		if h.Healthy {
+			up = 1
+		}
+		points = append(points,
+			MetricPoint{Name: "collector_up", Labels: labels, Value: up},
+			MetricPoint{Name: "collector_duration_seconds", Labels: labels, Value: h.DurationMs / 1000},
+			MetricPoint{Name: "collector_runs", Labels: labels, Value: float64(h.Runs)},
+			MetricPoint{Name: "collector_failures", Labels: labels, Value: float64(h.Failures)},
+		)
+	}
+	return points
+}
+
+// metricPoints 返回输出给外部系统的全部指标
+func (em *EnhancedMonitor) metricPoints() []MetricPoint {
+	points := append(em.monitor.points(), em.scheduler.points()...)
+	points = append(points, em.forecastPoints()...)
+	if em.anomaly != nil {
+		points = append(points, em.anomaly.points()...)
+	}
+	if em.fleet != nil {
+		points = append(points, em.fleet.points()...)
+	}
+	return points
+}
+
+// handleMetrics 以 Prometheus 文本格式输出指标，客户端接受 OpenMetrics 时使用 OpenMetrics 格式
+func (em *EnhancedMonitor) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	w.Write(formatPrometheus(em.metricPoints(), openMetrics))
+}
+
+// formatPrometheus 按指标说明的顺序输出 Prometheus/OpenMetrics 文本格式
+func formatPrometheus(points []MetricPoint, openMetrics bool) []byte {
+	byName := make(map[string][]MetricPoint)
+	for _, p := range points {
+		byName[p.Name] = append(byName[p.Name], p)
+	}
+
+	var b strings.Builder
+	for _, desc := range metricDescs {
+		samples := byName[desc.Name]
+		if len(samples) == 0 {
+			continue
+		}
+		family := "sysmon_" + desc.Name
+		sample := family
+		if desc.Type == "counter" {
+			sample += "_total"
+		}
+		if openMetrics {
+			fmt.Fprintf(&b, "# TYPE %s %s\n", family, desc.Type)
+			if desc.Unit != "" {
+				fmt.Fprintf(&b, "# UNIT %s %s\n", family, desc.Unit)
+			}
+			fmt.Fprintf(&b, "# HELP %s %s\n", family, escapeHelp(desc.Help))
+		} else {
+			fmt.Fprintf(&b, "# HELP %s %s\n", sample, escapeHelp(desc.Help))
+			fmt.Fprintf(&b, "# TYPE %s %s\n", sample, desc.Type)
+		}
+		for _, p := range samples {
+			b.WriteString(sample)
+			writeLabels(&b, p.Labels)
+			b.WriteByte(' ')
+			b.WriteString(formatFloat(p.Value))
+			b.WriteByte('\n')
+		}
+	}
+	if openMetrics {
+		b.WriteString("# EOF\n")
+	}
+	return []byte(b.String())
+}
+
+// writeLabels 按标签名排序输出 {name="value",...}
+func writeLabels(b *strings.Builder, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+}
+
+// escapeLabelValue 转义标签值中的反斜杠、双引号和换行
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// escapeHelp 转义说明文字中的反斜杠和换行
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// formatFloat 按 Prometheus 的约定格式化数值
+func formatFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// InfluxConfig InfluxDB 输出配置
+type InfluxConfig struct {
+	URL       string
+	Database  string // v1
+	Org       string // v2
+	Bucket    string // v2，非空时使用 v2 接口
+	Token     string // v2
+	Interval  time.Duration
+	BatchSize int
+	QueueSize int
+}
+
+// InfluxOutput 以行协议把指标批量推送到 InfluxDB
+// 写入失败时数据留在有界队列中，按指数退避重试
+type InfluxOutput struct {
+	config   InfluxConfig
+	writeURL string
+	host     string
+	client   *http.Client
+	queue    *lineQueue
+}
+
+// NewInfluxOutput 根据配置创建 InfluxDB 输出，配置了 Bucket 时使用 v2 写入接口，否则使用 v1
+func NewInfluxOutput(config InfluxConfig) (*InfluxOutput, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("不支持的协议 %q", u.Scheme)
+	}
+	if config.Interval <= 0 || config.BatchSize <= 0 || config.QueueSize <= 0 {
+		return nil, fmt.Errorf("推送间隔、批大小和队列长度必须大于0")
+	}
+
+	q := url.Values{"precision": {"s"}}
+	if config.Bucket != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		q.Set("org", config.Org)
+		q.Set("bucket", config.Bucket)
+	} else {
+		if config.Database == "" {
+			return nil, fmt.Errorf("v1 需要指定数据库名")
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		q.Set("db", config.Database)
+	}
+	u.RawQuery = q.Encode()
+
+	return &InfluxOutput{
+		config:   config,
+		writeURL: u.String(),
+		host:     hostname(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    newLineQueue("InfluxDB", config.QueueSize, config.BatchSize),
+	}, nil
+}
+
+// Run 每个推送间隔采样一次并尝试写入，退出前再尝试写出队列中剩余的数据
+func (o *InfluxOutput) Run(ctx context.Context, source func() []MetricPoint) {
+	log.Printf("InfluxDB 输出已启用: %s", redactURL(o.writeURL))
+	ticker := time.NewTicker(o.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			o.queue.drain(func(lines []string) (bool, error) {
+				return o.write(flushCtx, lines)
+			})
+			cancel()
+			return
+		case now := <-ticker.C:
+			o.queue.push(formatLineProtocol(source(), o.host, now))
+			o.queue.flush(now, func(lines []string) (bool, error) {
+				return o.write(ctx, lines)
+			})
+		}
+	}
+}
+
+// write 发送一批数据，返回的 retry 表示失败是否可以重试
+func (o *InfluxOutput) write(ctx context.Context, lines []string) (retry bool, err error) {
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequest("POST", o.writeURL, strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if o.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+o.config.Token)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	msg := make([]byte, 512)
+	n, _ := resp.Body.Read(msg)
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg[:n])))
+	// 5xx 和限流可能是暂时的，其余4xx（包括鉴权失败和库不存在）重试也不会成功
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// formatLineProtocol 把指标转换为 InfluxDB 行协议，每个指标一行
+// 度量名为 sysmon_<指标名>，标签带上本机 host，数值写在 value 字段
+// 指标自带的 host 标签改名为 exported_host
+func formatLineProtocol(points []MetricPoint, host string, t time.Time) []string {
+	lines := make([]string, 0, len(points))
+	ts := strconv.FormatInt(t.Unix(), 10)
+	for _, p := range points {
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		var b strings.Builder
+		b.WriteString(influxEscape("sysmon_"+p.Name, false))
+		labels := make(map[string]string, len(p.Labels)+1)
+		for k, v := range p.Labels {
+			if k == "host" {
+				// 集群汇总的指标自带被监控主机的 host 标签，改名保留，避免冒充本机
+				k = "exported_host"
+			}
+			labels[k] = v
+		}
+		labels["host"] = host
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if labels[k] == "" {
+				continue
+			}
+			b.WriteByte(',')
+			b.WriteString(influxEscape(k, true))
+			b.WriteByte('=')
+			b.WriteString(influxEscape(labels[k], true))
+		}
+		b.WriteString(" value=")
+		b.WriteString(strconv.FormatFloat(p.Value, 'g', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(ts)
+		lines = append(lines, b.String())
+	}
+	return lines
+}
+
+// influxEscape 转义行协议中的度量名（逗号、空格）或标签（另加等号）
+func influxEscape(s string, tag bool) string {
+	if tag {
+		return strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`).Replace(s)
+	}
+	return strings.NewReplacer(",", `\,`, " ", `\ `).Replace(s)
+}
+
+// redactURL 隐藏地址中的密码，用于日志输出
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// hostname 返回本机主机名，获取失败时返回 unknown
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "unknown"
+	}
+	return name
+}
+
+// 推送输出重试的退避范围
+const (
+	outputMinBackoff = time.Second
+	outputMaxBackoff = 5 * time.Minute
+)
+
+// lineQueue 推送输出共用的有界发送队列
+// 发送失败时数据留在队列中并按指数退避重试，超出容量时丢弃最旧的数据
+type lineQueue struct {
+	name    string
+	max     int
+	batch   int
+	lines   []string
+	backoff time.Duration
+	nextTry time.Time
+	dropped int
+}
+
+// newLineQueue 创建发送队列，batch 为单次发送的最大行数
+func newLineQueue(name string, max, batch int) *lineQueue {
+	return &lineQueue{name: name, max: max, batch: batch}
+}
+
+// push 把新数据加入队列
+func (q *lineQueue) push(lines []string) {
+	q.lines = append(q.lines, lines...)
+	if over := len(q.lines) - q.max; over > 0 {
+		q.lines = append([]string(nil), q.lines[over:]...)
+		q.dropped += over
+	}
+}
+
+// flush 按批发送队列中的数据，send 返回的 retry 表示失败是否可以重试
+func (q *lineQueue) flush(now time.Time, send func(lines []string) (retry bool, err error)) {
+	if now.Before(q.nextTry) {
+		return
+	}
+	for len(q.lines) > 0 {
+		n := len(q.lines)
+		if n > q.batch {
+			n = q.batch
+		}
+		retry, err := send(q.lines[:n])
+		if err != nil && retry {
+			if q.backoff == 0 {
+				q.backoff = outputMinBackoff
+				log.Printf("推送到 %s 失败，将退避重试: %v", q.name, err)
+			} else if q.backoff *= 2; q.backoff > outputMaxBackoff {
+				q.backoff = outputMaxBackoff
+			}
+			q.nextTry = now.Add(q.backoff)
+			return
+		}
+		if err != nil {
+			// 数据本身被拒绝（如格式错误），重试没有意义
+			log.Printf("%s 拒绝了 %d 行数据: %v", q.name, n, err)
+		}
+		q.lines = q.lines[n:]
+		if q.backoff > 0 {
+			log.Printf("推送到 %s 已恢复", q.name)
+			q.backoff = 0
+		}
+	}
+	if q.dropped > 0 {
+		log.Printf("%s 队列已满，丢弃了 %d 行最旧的数据", q.name, q.dropped)
+		q.dropped = 0
+	}
+}
+
+// drain 退出前忽略退避再尝试发送一次，仍未发送的数据被丢弃
+func (q *lineQueue) drain(send func(lines []string) (retry bool, err error)) {
+	q.nextTry = time.Time{}
+	q.flush(time.Now(), send)
+	if len(q.lines) > 0 {
+		log.Printf("%s 输出退出，丢弃 %d 行未发送的数据", q.name, len(q.lines))
+	}
+}
+
+// GraphiteConfig Graphite 输出配置
+type GraphiteConfig struct {
+	Addr      string
+	Prefix    string
+	Interval  time.Duration
+	QueueSize int
+}
+
+// GraphiteOutput 通过 TCP plaintext 协议把指标推送到 Graphite
+// 连接断开后在下一次推送时重连，期间数据缓存在队列中
+type GraphiteOutput struct {
+	config GraphiteConfig
+	prefix string
+	conn   net.Conn
+	queue  *lineQueue
+}
+
+// graphiteBatch 单次写入 Graphite 的最大行数
+const graphiteBatch = 5000
+
+// NewGraphiteOutput 创建 Graphite 输出
+func NewGraphiteOutput(config GraphiteConfig) (*GraphiteOutput, error) {
+	if _, _, err := net.SplitHostPort(config.Addr); err != nil {
+		return nil, err
+	}
+	if config.Interval <= 0 || config.QueueSize <= 0 {
+		return nil, fmt.Errorf("推送间隔和队列长度必须大于0")
+	}
+	return &GraphiteOutput{
+		config: config,
+		prefix: expandPrefix(config.Prefix),
+		queue:  newLineQueue("Graphite", config.QueueSize, graphiteBatch),
+	}, nil
+}
+
+// Run 每个推送间隔采样一次并发送
+func (o *GraphiteOutput) Run(ctx context.Context, source func() []MetricPoint) {
+	log.Printf("Graphite 输出已启用: %s", o.config.Addr)
+	ticker := time.NewTicker(o.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			o.queue.drain(o.send)
+			if o.conn != nil {
+				o.conn.Close()
+			}
+			return
+		case now := <-ticker.C:
+			lines := make([]string, 0)
+			ts := strconv.FormatInt(now.Unix(), 10)
+			for _, p := range source() {
+				if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+					continue
+				}
+				lines = append(lines, metricPath(o.prefix, p)+" "+strconv.FormatFloat(p.Value, 'f', -1, 64)+" "+ts)
+			}
+			o.queue.push(lines)
+			o.queue.flush(now, o.send)
+		}
+	}
+}
+
+// send 把一批数据写入连接，未连接或连接出错时重连
+func (o *GraphiteOutput) send(lines []string) (bool, error) {
+	if o.conn == nil {
+		conn, err := net.DialTimeout("tcp", o.config.Addr, 5*time.Second)
+		if err != nil {
+			return true, err
+		}
+		o.conn = conn
+	}
+	o.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(o.conn, strings.Join(lines, "\n")+"\n"); err != nil {
+		o.conn.Close()
+		o.conn = nil
+		return true, err
+	}
+	return false, nil
+}
+
+// StatsDConfig StatsD 输出配置
+type StatsDConfig struct {
+	Addr     string
+	Prefix   string
+	Interval time.Duration
+}
+
+// StatsDOutput 通过 UDP 把指标发送到 StatsD
+// 瞬时值作为 gauge 发送，累计计数器换算成两次推送之间的增量作为 counter 发送
+type StatsDOutput struct {
+	config StatsDConfig
+	prefix string
+	conn   net.Conn
+	last   map[string]float64
+}
+
+// statsdPacketSize 单个UDP包的最大字节数，避免在常见网络上被分片
+const statsdPacketSize = 1432
+
+// NewStatsDOutput 创建 StatsD 输出
+func NewStatsDOutput(config StatsDConfig) (*StatsDOutput, error) {
+	if _, _, err := net.SplitHostPort(config.Addr); err != nil {
+		return nil, err
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("推送间隔必须大于0")
+	}
+	return &StatsDOutput{
+		config: config,
+		prefix: expandPrefix(config.Prefix),
+		last:   make(map[string]float64),
+	}, nil
+}
+
+// Run 每个推送间隔采样一次并发送，UDP发送失败的数据不重试
+func (o *StatsDOutput) Run(ctx context.Context, source func() []MetricPoint) {
+	log.Printf("StatsD 输出已启用: %s", o.config.Addr)
+	ticker := time.NewTicker(o.config.Interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			if o.conn != nil {
+				o.conn.Close()
+			}
+			return
+		case <-ticker.C:
+			err := o.send(o.format(source()))
+			if err != nil && !failing {
+				log.Printf("发送到 StatsD 失败: %v", err)
+			} else if err == nil && failing {
+				log.Printf("发送到 StatsD 已恢复")
+			}
+			failing = err != nil
+		}
+	}
+}
+
+// format 把指标转换成 StatsD 格式的行
+func (o *StatsDOutput) format(points []MetricPoint) []string {
+	counters := make(map[string]bool)
+	for _, desc := range metricDescs {
+		if desc.Type == "counter" {
+			counters[desc.Name] = true
+		}
+	}
+
+	var lines []string
+	for _, p := range points {
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		path := metricPath(o.prefix, p)
+		if !counters[p.Name] {
+			lines = append(lines, path+":"+strconv.FormatFloat(p.Value, 'f', -1, 64)+"|g")
+			continue
+		}
+		prev, ok := o.last[path]
+		o.last[path] = p.Value
+		// 首次出现或计数器重置时没有可用的增量
+		if !ok || p.Value < prev {
+			continue
+		}
+		lines = append(lines, path+":"+strconv.FormatFloat(p.Value-prev, 'f', -1, 64)+"|c")
+	}
+	return lines
+}
+
+// send 把多行数据合并成不超过 statsdPacketSize 的UDP包发送，出错时重新建立套接字
+func (o *StatsDOutput) send(lines []string) error {
+	if o.conn == nil {
+		conn, err := net.Dial("udp", o.config.Addr)
+		if err != nil {
+			return err
+		}
+		o.conn = conn
+	}
+
+	var packet strings.Builder
+	write := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := io.WriteString(o.conn, packet.String())
+		packet.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			if err := write(); err != nil {
+				o.conn.Close()
+				o.conn = nil
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if err := write(); err != nil {
+		o.conn.Close()
+		o.conn = nil
+		return err
+	}
+	return nil
+}
+
+// expandPrefix 展开指标前缀模板中的 {hostname}，主机名中的点替换为下划线
+func expandPrefix(template string) string {
+	host := strings.ReplaceAll(hostname(), ".", "_")
+	return strings.Trim(strings.ReplaceAll(template, "{hostname}", host), ".")
+}
+
+// metricPath 生成点分隔的指标路径：前缀.指标名（下划线转为点）.各标签值（按标签名排序）
+// 如 servers.web1.cpu.usage.percent、servers.web1.disk.used.bytes.dev_sda1.root
+func metricPath(prefix string, p MetricPoint) string {
+	parts := []string{}
+	if prefix != "" {
+		parts = append(parts, prefix)
+	}
+	parts = append(parts, strings.ReplaceAll(p.Name, "_", "."))
+	keys := make([]string, 0, len(p.Labels))
+	for k := range p.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, sanitizePathComponent(p.Labels[k]))
+	}
+	return strings.Join(parts, ".")
+}
+
+// sanitizePathComponent 把标签值转换成合法的路径片段，如 / 转为 root，/dev/sda1 转为 dev_sda1
+func sanitizePathComponent(s string) string {
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return "root"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// OTLPConfig OpenTelemetry OTLP/HTTP 输出配置
+type OTLPConfig struct {
+	Endpoint string
+	Headers  string
+	Interval time.Duration
+}
+
+// OTLPOutput 以 OTLP/HTTP JSON 编码把指标推送到 OpenTelemetry Collector
+// gauge 映射为 Gauge，counter 映射为单调递增的累计 Sum
+type OTLPOutput struct {
+	config    OTLPConfig
+	url       string
+	headers   map[string]string
+	resource  otlpResource
+	startTime time.Time
+	bootTime  time.Time
+	counters  map[string]otlpCounter
+	client    *http.Client
+	queue     *lineQueue
+}
+
+// otlpCounter 一条累计序列的起始时间和上一次的读数，读数变小说明计数器被重置
+type otlpCounter struct {
+	start time.Time
+	last  float64
+	seen  time.Time
+}
+
+// otlpKernelCounters 由内核维护、从开机开始累计的计数器，其余计数器从程序启动开始累计
+var otlpKernelCounters = map[string]bool{
+	"cpu_seconds":            true,
+	"network_receive_bytes":  true,
+	"network_transmit_bytes": true,
+}
+
+// otlpQueueSize OTLP 不可用时最多缓存的请求数
+const otlpQueueSize = 60
+
+// OTLP/JSON 编码使用的结构，字段名遵循 opentelemetry-proto 的 JSON 映射
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpTemporalityCumulative AGGREGATION_TEMPORALITY_CUMULATIVE
+const otlpTemporalityCumulative = 2
+
+// otlpUnits 指标单位到 UCUM 单位的映射
+var otlpUnits = map[string]string{
+	"":                 "1",
+	"seconds":          "s",
+	"bytes":            "By",
+	"bytes_per_second": "By/s",
+	"percent":          "%",
+	"celsius":          "Cel",
+}
+
+// NewOTLPOutput 创建 OTLP 输出
+func NewOTLPOutput(config OTLPConfig) (*OTLPOutput, error) {
+	u, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("不支持的协议 %q", u.Scheme)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/metrics"
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("推送间隔必须大于0")
+	}
+
+	headers, err := parseHeaders(config.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OTLPOutput{
+		config:  config,
+		url:     u.String(),
+		headers: headers,
+		resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: "sysmon"}},
+			{Key: "host.name", Value: otlpAnyValue{StringValue: hostname()}},
+			{Key: "os.type", Value: otlpAnyValue{StringValue: "linux"}},
+		}},
+		startTime: time.Now(),
+		bootTime:  readBootTime(),
+		counters:  make(map[string]otlpCounter),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		queue:     newLineQueue("OTLP", otlpQueueSize, 1),
+	}, nil
+}
+
+// Run 每个推送间隔采样一次并发送，失败的请求缓存后按指数退避重试
+func (o *OTLPOutput) Run(ctx context.Context, source func() []MetricPoint) {
+	log.Printf("OTLP 输出已启用: %s", o.url)
+	ticker := time.NewTicker(o.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			o.queue.drain(func(bodies []string) (bool, error) {
+				return o.post(flushCtx, bodies[0])
+			})
+			cancel()
+			return
+		case now := <-ticker.C:
+			body, err := json.Marshal(o.request(source(), now))
+			if err != nil {
+				log.Printf("编码 OTLP 数据失败: %v", err)
+				continue
+			}
+			o.queue.push([]string{string(body)})
+			o.queue.flush(now, func(bodies []string) (bool, error) {
+				return o.post(ctx, bodies[0])
+			})
+		}
+	}
+}
+
+// request 把指标转换成 OTLP ExportMetricsServiceRequest
+func (o *OTLPOutput) request(points []MetricPoint, now time.Time) otlpRequest {
+	byName := make(map[string][]otlpDataPoint)
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+	for _, p := range points {
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		dp := otlpDataPoint{TimeUnixNano: ts, AsDouble: p.Value}
+		keys := make([]string, 0, len(p.Labels))
+		for k := range p.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			dp.Attributes = append(dp.Attributes, otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: p.Labels[k]}})
+		}
+		byName[p.Name] = append(byName[p.Name], dp)
+	}
+
+	counters := make(map[string]otlpCounter, len(o.counters))
+	var metrics []otlpMetric
+	for _, desc := range metricDescs {
+		dps, ok := byName[desc.Name]
+		if !ok {
+			continue
+		}
+		m := otlpMetric{
+			Name:        "sysmon." + desc.Name,
+			Description: desc.Help,
+			Unit:        otlpUnits[desc.Unit],
+		}
+		if desc.Type == "counter" {
+			for i := range dps {
+				key := otlpSeriesKey(desc.Name, dps[i].Attributes)
+				c := o.counterStart(desc.Name, o.counters[key], dps[i].AsDouble, now)
+				counters[key] = c
+				dps[i].StartTimeUnixNano = strconv.FormatInt(c.start.UnixNano(), 10)
+			}
+			m.Sum = &otlpSum{DataPoints: dps, AggregationTemporality: otlpTemporalityCumulative, IsMonotonic: true}
+		} else {
+			m.Gauge = &otlpGauge{DataPoints: dps}
+		}
+		metrics = append(metrics, m)
+	}
+
+	// 只保留本次出现的序列，消失的网卡等重新出现时作为新序列
+	o.counters = counters
+
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     o.resource,
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "sysmon"}, Metrics: metrics}},
+	}}}
+}
+
+// counterStart 返回累计序列本次的起始时间
+// 内核计数器从开机开始累计，程序自身的计数器从程序启动开始累计；
+// 读数比上次小说明计数器已重置（如网卡重建），起始时间改为上一次采样的时间
+func (o *OTLPOutput) counterStart(name string, prev otlpCounter, value float64, now time.Time) otlpCounter {
+	switch {
+	case prev.seen.IsZero():
+		prev.start = o.startTime
+		if otlpKernelCounters[name] && !o.bootTime.IsZero() {
+			prev.start = o.bootTime
+		}
+	case value < prev.last:
+		prev.start = prev.seen
+	}
+	prev.last, prev.seen = value, now
+	return prev
+}
+
+// otlpSeriesKey 由指标名和数据点属性组成序列的唯一键
+func otlpSeriesKey(name string, attrs []otlpKeyValue) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, kv := range attrs {
+		b.WriteByte(0)
+		b.WriteString(kv.Key)
+		b.WriteByte('=')
+		b.WriteString(kv.Value.StringValue)
+	}
+	return b.String()
+}
+
+// post 发送一次导出请求，按 OTLP 规范 429/502/503/504 和网络错误可以重试
+func (o *OTLPOutput) post(ctx context.Context, body string) (retry bool, err error) {
+	req, err := http.NewRequest("POST", o.url, strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	msg := make([]byte, 512)
+	n, _ := resp.Body.Read(msg)
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg[:n])))
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, err
+	}
+	return false, err
+}
+
+// MQTTConfig MQTT 输出配置
+type MQTTConfig struct {
+	Broker          string
+	Topic           string
+	Username        string
+	Password        string
+	ClientID        string
+	QoS             int
+	Retain          bool
+	JSON            bool
+	Discovery       bool
+	DiscoveryPrefix string
+	Interval        time.Duration
+	CAFile          string
+	Insecure        bool
+}
+
+// MQTTOutput 通过 MQTT 3.1.1 发布指标
+// 连接时设置遗嘱消息，<主题前缀>/status 在线时为 online，断线或退出后为 offline（retain）；
+// 可选发布 Home Assistant 自动发现消息，使每个指标自动成为一个传感器
+type MQTTOutput struct {
+	config    MQTTConfig
+	addr      string
+	tlsConfig *tls.Config
+	topic     string
+	clientID  string
+	nodeID    string
+	timeout   time.Duration
+
+	conn       net.Conn
+	reader     *bufio.Reader
+	packetID   uint16
+	discovered map[string]bool
+	backoff    time.Duration
+	nextTry    time.Time
+}
+
+// mqttTimeout 单个报文读写（包括等待 CONNACK 和 PUBACK）的超时
+const mqttTimeout = 10 * time.Second
+
+// MQTT 控制报文类型
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttDisconnect = 0xE0
+)
+
+// mqttConnackErrors CONNACK 返回码的含义
+var mqttConnackErrors = map[byte]string{
+	1: "不支持的协议版本",
+	2: "客户端ID被拒绝",
+	3: "服务不可用",
+	4: "用户名或密码错误",
+	5: "未授权",
+}
+
+// NewMQTTOutput 创建 MQTT 输出，broker 地址的协议为 ssl/tls/mqtts 时使用TLS
+func NewMQTTOutput(config MQTTConfig) (*MQTTOutput, error) {
+	u, err := url.Parse(config.Broker)
+	if err != nil {
+		return nil, err
+	}
+	o := &MQTTOutput{
+		config:   config,
+		topic:    strings.TrimSuffix(strings.ReplaceAll(config.Topic, "{hostname}", hostname()), "/"),
+		clientID: strings.ReplaceAll(config.ClientID, "{hostname}", hostname()),
+		nodeID:   "sysmon_" + sanitizePathComponent(hostname()),
+		timeout:  mqttTimeout,
+	}
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		port = "8883"
+		o.tlsConfig = &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: config.Insecure}
+		if config.CAFile != "" {
+			pool, err := loadCertPool(config.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			o.tlsConfig.RootCAs = pool
+		}
+	default:
+		return nil, fmt.Errorf("不支持的协议 %q", u.Scheme)
+	}
+	o.addr = u.Host
+	if u.Port() == "" {
+		o.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if config.QoS != 0 && config.QoS != 1 {
+		return nil, fmt.Errorf("只支持 QoS 0 和 1")
+	}
+	if config.Password != "" && config.Username == "" {
+		return nil, fmt.Errorf("设置了密码时必须同时设置用户名")
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("发布间隔必须大于0")
+	}
+	if o.topic == "" {
+		return nil, fmt.Errorf("主题前缀不能为空")
+	}
+	return o, nil
+}
+
+// Run 每个发布间隔发布一次指标，断线后按指数退避重连
+func (o *MQTTOutput) Run(ctx context.Context, source func() []MetricPoint) {
+	log.Printf("MQTT 输出已启用: %s, 主题 %s", o.addr, o.topic)
+	ticker := time.NewTicker(o.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if o.conn != nil {
+				o.publish(o.topic+"/status", []byte("offline"), 1, true)
+				o.conn.Write([]byte{mqttDisconnect, 0})
+				o.conn.Close()
+			}
+			return
+		case now := <-ticker.C:
+			if o.conn == nil {
+				if now.Before(o.nextTry) {
+					continue
+				}
+				if err := o.connect(); err != nil {
+					o.fail(now, err)
+					continue
+				}
+			}
+			if err := o.publishPoints(source(), now); err != nil {
+				o.fail(now, err)
+				continue
+			}
+			if o.backoff > 0 {
+				log.Printf("MQTT 发布已恢复")
+				o.backoff = 0
+			}
+		}
+	}
+}
+
+// fail 关闭连接并进入退避
+func (o *MQTTOutput) fail(now time.Time, err error) {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+	if o.backoff == 0 {
+		o.backoff = outputMinBackoff
+		log.Printf("MQTT 发布失败，将退避重连: %v", err)
+	} else if o.backoff *= 2; o.backoff > outputMaxBackoff {
+		o.backoff = outputMaxBackoff
+	}
+	o.nextTry = now.Add(o.backoff)
+}
+
+// connect 建立连接并完成握手
+func (o *MQTTOutput) connect() error {
+	dialer := &net.Dialer{Timeout: o.timeout}
+	var conn net.Conn
+	var err error
+	if o.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", o.addr, o.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", o.addr)
+	}
+	if err != nil {
+		return err
+	}
+	return o.handshake(conn)
+}
+
+// handshake 在已建立的连接上发送 CONNECT 并等待 CONNACK，成功后发布在线状态
+func (o *MQTTOutput) handshake(conn net.Conn) error {
+	// 保活时间取发布间隔的3倍，每次发布都会刷新保活计时，因此不需要单独发送 PINGREQ
+	keepAlive := int(o.config.Interval.Seconds()) * 3
+	if keepAlive < 30 {
+		keepAlive = 30
+	}
+	if keepAlive > 65535 {
+		keepAlive = 65535
+	}
+
+	// 遗嘱消息: QoS 1, retain
+	flags := byte(0x02 | 0x04 | 1<<3 | 0x20)
+	if o.config.Username != "" {
+		flags |= 0x80
+	}
+	if o.config.Password != "" {
+		flags |= 0x40
+	}
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendMQTTString(body, o.clientID)
+	body = appendMQTTString(body, o.topic+"/status")
+	body = appendMQTTString(body, "offline")
+	if o.config.Username != "" {
+		body = appendMQTTString(body, o.config.Username)
+	}
+	if o.config.Password != "" {
+		body = appendMQTTString(body, o.config.Password)
+	}
+
+	o.conn, o.reader = conn, bufio.NewReader(conn)
+	o.discovered = make(map[string]bool)
+	if err := o.writePacket(mqttConnect, body); err != nil {
+		return err
+	}
+	packetType, payload, err := o.readPacket()
+	if err != nil {
+		return err
+	}
+	if packetType != mqttConnack || len(payload) != 2 {
+		return fmt.Errorf("期望 CONNACK，收到报文类型 0x%x", packetType)
+	}
+	if code := payload[1]; code != 0 {
+		if msg, ok := mqttConnackErrors[code]; ok {
+			return fmt.Errorf("broker 拒绝连接: %s", msg)
+		}
+		return fmt.Errorf("broker 拒绝连接: 返回码 %d", code)
+	}
+	return o.publish(o.topic+"/status", []byte("online"), 1, true)
+}
+
+// publishPoints 发布一次指标，需要时先发布 Home Assistant 自动发现消息
+func (o *MQTTOutput) publishPoints(points []MetricPoint, now time.Time) error {
+	descs := make(map[string]metricDesc, len(metricDescs))
+	for _, d := range metricDescs {
+		descs[d.Name] = d
+	}
+
+	state := map[string]interface{}{"time": now.Unix()}
+	for _, p := range points {
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		id := metricID(p)
+		if o.config.Discovery && !o.discovered[id] {
+			if err := o.publishDiscovery(id, p, descs[p.Name]); err != nil {
+				return err
+			}
+			o.discovered[id] = true
+		}
+		if o.config.JSON {
+			state[id] = p.Value
+			continue
+		}
+		value := strconv.FormatFloat(p.Value, 'f', -1, 64)
+		if err := o.publish(o.topic+"/"+id, []byte(value), byte(o.config.QoS), o.config.Retain); err != nil {
+			return err
+		}
+	}
+	if !o.config.JSON {
+		return nil
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return o.publish(o.topic+"/state", payload, byte(o.config.QoS), o.config.Retain)
+}
+
+// publishDiscovery 发布单个指标的 Home Assistant 传感器配置（retain）
+func (o *MQTTOutput) publishDiscovery(id string, p MetricPoint, desc metricDesc) error {
+	name := desc.Help
+	if name == "" {
+		name = p.Name
+	}
+	keys := make([]string, 0, len(p.Labels))
+	for k := range p.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name += " " + p.Labels[k]
+	}
+
+	config := map[string]interface{}{
+		"name":                  name,
+		"unique_id":             o.nodeID + "_" + id,
+		"object_id":             o.nodeID + "_" + id,
+		"availability_topic":    o.topic + "/status",
+		"payload_available":     "online",
+		"payload_not_available": "offline",
+		"state_class":           "measurement",
+		"device": map[string]interface{}{
+			"identifiers":  []string{o.nodeID},
+			"name":         hostname(),
+			"manufacturer": "sysmon",
+			"model":        "sysmon",
+		},
+	}
+	if o.config.JSON {
+		config["state_topic"] = o.topic + "/state"
+		config["value_template"] = "{{ value_json['" + id + "'] }}"
+	} else {
+		config["state_topic"] = o.topic + "/" + id
+	}
+	if desc.Type == "counter" {
+		config["state_class"] = "total_increasing"
+	}
+	switch desc.Unit {
+	case "bytes":
+		config["unit_of_measurement"] = "B"
+		config["device_class"] = "data_size"
+	case "bytes_per_second":
+		config["unit_of_measurement"] = "B/s"
+		config["device_class"] = "data_rate"
+	case "seconds":
+		config["unit_of_measurement"] = "s"
+		config["device_class"] = "duration"
+	case "celsius":
+		config["unit_of_measurement"] = "°C"
+		config["device_class"] = "temperature"
+	case "percent":
+		config["unit_of_measurement"] = "%"
+	}
+
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	topic := o.config.DiscoveryPrefix + "/sensor/" + o.nodeID + "/" + id + "/config"
+	return o.publish(topic, payload, 1, true)
+}
+
+// publish 发送 PUBLISH 报文，QoS 1 时等待 PUBACK
+func (o *MQTTOutput) publish(topic string, payload []byte, qos byte, retain bool) error {
+	header := byte(mqttPublish) | qos<<1
+	if retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, topic)
+	var id uint16
+	if qos > 0 {
+		o.packetID++
+		if o.packetID == 0 {
+			o.packetID = 1
+		}
+		id = o.packetID
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = append(body, payload...)
+	if err := o.writePacket(header, body); err != nil {
+		return err
+	}
+	if qos == 0 {
+		return nil
+	}
+
+	for {
+		packetType, ack, err := o.readPacket()
+		if err != nil {
+			return err
+		}
+		if packetType == mqttPuback && len(ack) == 2 && uint16(ack[0])<<8|uint16(ack[1]) == id {
+			return nil
+		}
+	}
+}
+
+// writePacket 写出一个控制报文
+func (o *MQTTOutput) writePacket(header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+	o.conn.SetWriteDeadline(time.Now().Add(o.timeout))
+	_, err := o.conn.Write(packet)
+	return err
+}
+
+// readPacket 读取一个控制报文，返回报文类型（高4位）和剩余部分
+func (o *MQTTOutput) readPacket() (byte, []byte, error) {
+	o.conn.SetReadDeadline(time.Now().Add(o.timeout))
+	header, err := o.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := o.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, fmt.Errorf("报文长度格式错误")
+		}
+		multiplier *= 128
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(o.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return header & 0xF0, payload, nil
+}
+
+// appendMQTTString 追加带2字节长度前缀的UTF-8字符串
+func appendMQTTString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+// metricID 生成指标的唯一标识：指标名加各标签值（按标签名排序），如 disk_used_bytes_dev_sda1_root
+func metricID(p MetricPoint) string {
+	keys := make([]string, 0, len(p.Labels))
+	for k := range p.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	id := p.Name
+	for _, k := range keys {
+		id += "_" + sanitizePathComponent(p.Labels[k])
+	}
+	return id
+}
+
+// streamBacklog /api/stream 保留用于断线续传的事件数
+const streamBacklog = 120
+
+// streamKeepAlive /api/stream 空闲时发送注释行的间隔，防止代理因超时断开连接
+const streamKeepAlive = 15 * time.Second
+
+// streamDebounce 收到采集通知后等待的时间，把同时完成的多个采集器合并为一个事件
+const streamDebounce = 100 * time.Millisecond
+
+// Stream 把新采集到的系统状态广播给 /api/stream 的订阅者，并保留最近的事件用于断线续传
+// 事件ID为 "<启动时间>-<序号>"，重启后客户端携带的旧ID不会被误认为仍可续传
+type Stream struct {
+	mu          sync.Mutex
+	epoch       int64
+	seq         uint64
+	size        int
+	events      []StreamEvent
+	subscribers map[chan StreamEvent]struct{}
+	notify      chan struct{}
+}
+
+// StreamEvent 一个推送事件，Data 为 SystemStats 的JSON
+type StreamEvent struct {
+	Seq  uint64
+	ID   string
+	Data []byte
+}
+
+// NewStream 创建事件流，最多保留size个最近的事件
+func NewStream(size int) *Stream {
+	return &Stream{
+		epoch:       time.Now().Unix(),
+		size:        size,
+		subscribers: make(map[chan StreamEvent]struct{}),
+		notify:      make(chan struct{}, 1),
+	}
+}
+
+// Notify 通知有新的采集结果，不会阻塞调用方
+func (s *Stream) Notify() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run 收到采集通知后生成新的状态快照并广播，阻塞直到ctx被取消
+func (s *Stream) Run(ctx context.Context, snapshot func() SystemStats) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.notify:
+		}
+
+		timer := time.NewTimer(streamDebounce)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		// 合并等待期间到达的通知
+		select {
+		case <-s.notify:
+		default:
+		}
+
+		data, err := json.Marshal(snapshot())
+		if err != nil {
+			log.Printf("编码实时状态失败: %v", err)
+			continue
+		}
+		s.publish(data)
+	}
+}
+
+// publish 记录并广播一个事件，订阅者的缓冲区已满时跳过该订阅者（每个事件都是完整快照，下一个事件即可补上）
+func (s *Stream) publish(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	event := StreamEvent{Seq: s.seq, ID: fmt.Sprintf("%d-%d", s.epoch, s.seq), Data: data}
+	s.events = append(s.events, event)
+	if len(s.events) > s.size {
+		s.events = s.events[len(s.events)-s.size:]
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// subscribe 注册订阅者，返回需要先补发的事件
+// lastID 为客户端最后收到的事件ID：仍在保留范围内时补发其后的所有事件，否则只补发最新的一个事件
+func (s *Stream) subscribe(lastID string) (chan StreamEvent, []StreamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan StreamEvent, 16)
+	s.subscribers[ch] = struct{}{}
+	if len(s.events) == 0 {
+		return ch, nil
+	}
+
+	var epoch int64
+	var seq uint64
+	if _, err := fmt.Sscanf(lastID, "%d-%d", &epoch, &seq); err == nil && epoch == s.epoch && seq >= s.events[0].Seq-1 {
+		var backlog []StreamEvent
+		for _, e := range s.events {
+			if e.Seq > seq {
+				backlog = append(backlog, e)
+			}
+		}
+		return ch, backlog
+	}
+	return ch, s.events[len(s.events)-1:]
+}
+
+// unsubscribe 注销订阅者
+func (s *Stream) unsubscribe(ch chan StreamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, ch)
+}
+
+// ServeHTTP 处理 /api/stream 请求，直到客户端断开或ctx被取消（服务器关闭）
+func (s *Stream) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	ch, backlog := s.subscribe(lastID)
+	defer s.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	// 断线后浏览器3秒后重连
+	fmt.Fprint(w, "retry: 3000\n\n")
+	for _, e := range backlog {
+		fmt.Fprintf(w, "id: %s\ndata: %s\n\n", e.ID, e.Data)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", e.ID, e.Data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// websocketGUID 计算 Sec-WebSocket-Accept 使用的固定GUID（RFC 6455）
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket 帧类型
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsMaxMessage 客户端消息的最大长度
+const wsMaxMessage = 64 * 1024
+
+// wsMinInterval 订阅允许的最小推送间隔
+const wsMinInterval = 500 * time.Millisecond
+
+// wsPingInterval 空闲时发送 ping 的间隔
+const wsPingInterval = 30 * time.Second
+
+// wsConn 服务端的 WebSocket 连接，写操作可以在多个协程中并发调用
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	wmu    sync.Mutex
+}
+
+// upgradeWebSocket 完成 WebSocket 握手并接管底层连接，握手失败时已向客户端返回错误
+// 带 Origin 头时要求与 Host 一致，防止其他网站的页面借用户的浏览器连接并执行命令
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("不是 WebSocket 握手请求")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusBadRequest)
+		return nil, fmt.Errorf("不支持的 WebSocket 版本")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("缺少 Sec-WebSocket-Key")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return nil, fmt.Errorf("不允许的来源 %s", origin)
+		}
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking unsupported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("连接不支持接管")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// headerContains 判断以逗号分隔的请求头中是否包含指定的值（不区分大小写）
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage 读取一条完整的消息，自动应答 ping，收到 close 帧时回应后返回 io.EOF
+// 违反 RFC 6455 的帧（未加掩码、使用保留位、控制帧分片或超过125字节、分片消息中插入新的数据帧等）
+// 以 1002 关闭连接
+func (c *wsConn) ReadMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	protocolError := func(reason string) (byte, []byte, error) {
+		c.WriteClose(1002, reason)
+		return 0, nil, fmt.Errorf("WebSocket 协议错误: %s", reason)
+	}
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return 0, nil, err
+		}
+		fin := header[0]&0x80 != 0
+		op := header[0] & 0x0F
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if !masked {
+			return protocolError("frame not masked")
+		}
+		if header[0]&0x70 != 0 {
+			return protocolError("reserved bits set")
+		}
+		switch op {
+		case wsPing, wsPong, wsClose:
+			if !fin || length > 125 {
+				return protocolError("invalid control frame")
+			}
+		case wsText, wsBinary:
+			if opcode != 0 {
+				return protocolError("data frame inside fragmented message")
+			}
+		case wsContinuation:
+			if opcode == 0 {
+				return protocolError("unexpected continuation frame")
+			}
+		default:
+			return protocolError("unknown opcode")
+		}
+		if length > wsMaxMessage || uint64(len(message))+length > wsMaxMessage {
+			c.WriteClose(1009, "message too big")
+			return 0, nil, fmt.Errorf("消息过大")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return 0, nil, err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch op {
+		case wsPing:
+			if err := c.WriteMessage(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.WriteMessage(wsClose, payload)
+			return 0, nil, io.EOF
+		case wsText, wsBinary:
+			opcode = op
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// WriteMessage 发送一个不分片、不加掩码的帧
+func (c *wsConn) WriteMessage(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// WriteJSON 以文本帧发送JSON
+func (c *wsConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(wsText, data)
+}
+
+// WriteClose 发送带状态码的 close 帧
+func (c *wsConn) WriteClose(code int, reason string) error {
+	payload := append([]byte{byte(code >> 8), byte(code)}, reason...)
+	return c.WriteMessage(wsClose, payload)
+}
+
+// wsRequest 客户端发送的消息
+// subscribe: collectors 为要订阅的采集器，interfaces 限定网卡（为空时不限），interval 为推送间隔，如 "2s"
+// command: 执行命令，目前支持 switch_interface 和 interfaces
+type wsRequest struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id,omitempty"`
+	Collectors []string `json:"collectors,omitempty"`
+	Interfaces []string `json:"interfaces,omitempty"`
+	Interval   string   `json:"interval,omitempty"`
+	Command    string   `json:"command,omitempty"`
+	Interface  string   `json:"interface,omitempty"`
+}
+
+// wsSubscription 一个连接当前的订阅
+type wsSubscription struct {
+	collectors map[string]bool
+	interfaces map[string]bool
+	interval   time.Duration
+	last       map[string]float64 // 上一次发给客户端的值，用于计算增量
+}
+
+// metricCollector 返回产生该指标的采集器名称，采集器自身的健康指标归为 health
+func metricCollector(name string) string {
+	switch {
+	case name == "uptime_seconds" || strings.HasPrefix(name, "load") || name == "cpu_temperature_celsius":
+		return "system"
+	case strings.HasPrefix(name, "cpu_"):
+		return "cpu"
+	case strings.HasPrefix(name, "memory_") || strings.HasPrefix(name, "swap_"):
+		return "memory"
+	case strings.HasPrefix(name, "disk_"):
+		return "disk"
+	case strings.HasPrefix(name, "network_"):
+		return "network"
+	case strings.HasPrefix(name, "collector_"):
+		return "health"
+	}
+	return ""
+}
+
+// wsCollectors 可以通过 WebSocket 订阅的采集器，流量统计请使用 /api/traffic
+var wsCollectors = map[string]bool{"system": true, "cpu": true, "memory": true, "disk": true, "network": true, "health": true}
+
+// seriesKey 生成与 Prometheus 格式相同的序列名，如 disk_used_bytes{device="/dev/sda1",mount="/"}
+func seriesKey(p MetricPoint) string {
+	var b strings.Builder
+	b.WriteString(p.Name)
+	writeLabels(&b, p.Labels)
+	return b.String()
+}
+
+// values 返回订阅范围内的当前值
+func (sub *wsSubscription) values(points []MetricPoint) map[string]float64 {
+	values := make(map[string]float64)
+	for _, p := range points {
+		if !sub.collectors[metricCollector(p.Name)] {
+			continue
+		}
+		if intf, ok := p.Labels["interface"]; ok && len(sub.interfaces) > 0 && !sub.interfaces[intf] {
+			continue
+		}
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		values[seriesKey(p)] = p.Value
+	}
+	return values
+}
+
+// handleWebSocket 处理 /api/ws 连接
+// 订阅后首先推送一次完整数据（type=snapshot），之后每个推送间隔只发送变化的值（type=delta）
+// 和已消失的序列（removed），没有变化时不发送
+func (em *EnhancedMonitor) handleWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.conn.Close()
+
+	requests := make(chan []byte)
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(done)
+		for {
+			opcode, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if opcode != wsText {
+				continue
+			}
+			select {
+			case requests <- message:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var sub *wsSubscription
+	var push <-chan time.Time
+	var pushTicker *time.Ticker
+	defer func() {
+		if pushTicker != nil {
+			pushTicker.Stop()
+		}
+	}()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			conn.WriteClose(1001, "server shutting down")
+			return
+		case <-done:
+			return
+		case <-ping.C:
+			err = conn.WriteMessage(wsPing, nil)
+		case <-push:
+			err = em.sendDelta(conn, sub)
+		case message := <-requests:
+			var req wsRequest
+			if jerr := json.Unmarshal(message, &req); jerr != nil {
+				err = conn.WriteJSON(map[string]string{"type": "error", "error": "无效的JSON"})
+				break
+			}
+			switch req.Type {
+			case "subscribe":
+				newSub, serr := em.newSubscription(req)
+				if serr != nil {
+					err = conn.WriteJSON(map[string]string{"type": "error", "id": req.ID, "error": serr.Error()})
+					break
+				}
+				sub = newSub
+				if pushTicker != nil {
+					pushTicker.Stop()
+				}
+				pushTicker = time.NewTicker(sub.interval)
+				push = pushTicker.C
+				if err = conn.WriteJSON(map[string]interface{}{
+					"type":     "subscribed",
+					"id":       req.ID,
+					"interval": sub.interval.String(),
+				}); err == nil {
+					err = em.sendDelta(conn, sub)
+				}
+			case "unsubscribe":
+				sub, push = nil, nil
+				if pushTicker != nil {
+					pushTicker.Stop()
+					pushTicker = nil
+				}
+				err = conn.WriteJSON(map[string]string{"type": "unsubscribed", "id": req.ID})
+			case "command":
+				err = conn.WriteJSON(em.runCommand(req, requestIdentity(r)))
+			default:
+				err = conn.WriteJSON(map[string]string{"type": "error", "id": req.ID, "error": "未知的消息类型 " + req.Type})
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// newSubscription 校验订阅请求，未指定采集器时订阅全部，未指定间隔时使用 Interval
+func (em *EnhancedMonitor) newSubscription(req wsRequest) (*wsSubscription, error) {
+	sub := &wsSubscription{
+		collectors: make(map[string]bool),
+		interfaces: make(map[string]bool),
+		interval:   em.config.Interval,
+	}
+	for _, name := range req.Collectors {
+		if !wsCollectors[name] {
+			return nil, fmt.Errorf("未知的采集器 %s", name)
+		}
+		sub.collectors[name] = true
+	}
+	if len(sub.collectors) == 0 {
+		for name := range wsCollectors {
+			sub.collectors[name] = true
+		}
+	}
+	for _, intf := range req.Interfaces {
+		sub.interfaces[intf] = true
+	}
+	if req.Interval != "" {
+		d, err := parseStepParam(req.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("无效的推送间隔 %q", req.Interval)
+		}
+		if d < wsMinInterval {
+			return nil, fmt.Errorf("推送间隔不能小于 %s", wsMinInterval)
+		}
+		sub.interval = d
+	}
+	return sub, nil
+}
+
+// sendDelta 计算并发送与上一次相比变化的值，首次发送完整数据
+func (em *EnhancedMonitor) sendDelta(conn *wsConn, sub *wsSubscription) error {
+	values := sub.values(em.metricPoints())
+	msgType := "delta"
+	changed := values
+	var removed []string
+	if sub.last == nil {
+		msgType = "snapshot"
+	} else {
+		changed = make(map[string]float64)
+		for k, v := range values {
+			if old, ok := sub.last[k]; !ok || old != v {
+				changed[k] = v
+			}
+		}
+		for k := range sub.last {
+			if _, ok := values[k]; !ok {
+				removed = append(removed, k)
+			}
+		}
+		if len(changed) == 0 && len(removed) == 0 {
+			return nil
+		}
+		sort.Strings(removed)
+	}
+	sub.last = values
+	msg := map[string]interface{}{
+		"type":   msgType,
+		"time":   time.Now().Unix(),
+		"values": changed,
+	}
+	if len(removed) > 0 {
+		msg["removed"] = removed
+	}
+	return conn.WriteJSON(msg)
+}
+
+// runCommand 执行客户端通过 WebSocket 发送的命令，id 为连接的认证信息
+func (em *EnhancedMonitor) runCommand(req wsRequest, id *authIdentity) map[string]interface{} {
+	result := map[string]interface{}{"type": "result", "id": req.ID, "command": req.Command}
+	switch req.Command {
+	case "interfaces":
+		result["ok"] = true
+		result["interfaces"] = em.monitor.getAvailableInterfaces()
+		result["current"] = getSelectedInterface()
+	case "switch_interface":
+		if !id.can("interface") {
+			log.Printf("拒绝 %s 的命令: switch_interface 需要 interface 权限", id.Name)
+			result["ok"] = false
+			result["error"] = "没有切换网卡的权限"
+			break
+		}
+		if err := em.switchInterface(req.Interface); err != nil {
+			result["ok"] = false
+			result["error"] = err.Error()
+			break
+		}
+		result["ok"] = true
+	default:
+		result["ok"] = false
+		result["error"] = "未知的命令 " + req.Command
+	}
+	return result
+}
+
+// recordFields 录制文件中的数值字段及顺序，字段名和单位与 /api/stats 一致，uptime 为秒
+var recordFields = []string{
+	"uptime", "last1", "last5", "last15", "cpu_usage", "cpu_temp",
+	"mem_total_space", "mem_used_space", "mem_free_space", "mem_usage",
+	"swap_total_space", "swap_used_space", "swap_free_space",
+	"disk_total_space", "disk_used_space", "disk_available_space", "disk_usage",
+	"disk_read_speed", "disk_write_speed", "receive_speed", "transmit_speed", "receive_total", "transmit_total",
+}
+
+// recordWaitWarning 录制开始后超过该时长仍在等待采集器时输出警告
+const recordWaitWarning = 10 * time.Second
+
+// recordFlushEvery gzip 输出刷新到文件的间隔，每条都刷新会明显降低压缩率
+const recordFlushEvery = 10 * time.Second
+
+// RecordSample 录制的一个样本
+type RecordSample struct {
+	Time      time.Time
+	Interface string
+	Values    map[string]float64
+}
+
+// runRecord 录制模式：不启动Web服务器，按采样间隔把每个样本写入 JSON Lines 或 CSV 文件
+func runRecord(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	var (
+		format      = fs.String("format", "jsonl", "输出格式: jsonl 或 csv")
+		output      = fs.String("o", "-", "输出文件，- 表示标准输出")
+		duration    = fs.Duration("duration", 0, "录制时长，0表示直到收到 SIGINT/SIGTERM")
+		interval    = fs.Duration("interval", time.Second, "采样间隔")
+		intervals   = fs.String("intervals", "", "各采集器的采集周期，如 disk=30s,cpu=2s")
+		timeout     = fs.Duration("timeout", 5*time.Second, "单次采集的超时时间")
+		intf        = fs.String("interface", "", "记录的网卡，默认为第一个可用网卡")
+		rotateSize  = fs.String("rotate-size", "", "文件（未压缩）超过该大小时切换到新文件，如 100MB")
+		rotateEvery = fs.Duration("rotate-every", 0, "每隔该时长切换到新文件，如 1h")
+		compress    = fs.Bool("gzip", false, "使用 gzip 压缩输出（文件名以 .gz 结尾时自动启用）")
+	)
+	fs.Parse(args)
+
+	if *format != "jsonl" && *format != "csv" {
+		log.Fatalf("无效的 -format 参数: 只支持 jsonl 和 csv")
+	}
+	if *interval <= 0 {
+		log.Fatalf("无效的 -interval 参数: 必须大于0")
+	}
+	collectIntervals, err := parseIntervals(*intervals)
+	if err != nil {
+		log.Fatalf("无效的 -intervals 参数: %v", err)
+	}
+	maxSize, err := parseBytes(*rotateSize)
+	if err != nil {
+		log.Fatalf("无效的 -rotate-size 参数: %v", err)
+	}
+	if *output == "-" && (maxSize > 0 || *rotateEvery > 0) {
+		log.Fatalf("输出到标准输出时不支持文件切换")
+	}
+
+	monitor := &Monitor{}
+	if *intf == "" {
+		if interfaces := monitor.getAvailableInterfaces(); len(interfaces) > 0 {
+			*intf = interfaces[0]
+		}
+	}
+	config := Config{
+		Interface: *intf,
+		Interval:  *interval,
+		Intervals: collectIntervals,
+		Timeout:   *timeout,
+	}
+	monitor = &Monitor{config: config, traffic: NewTrafficAccounting(config)}
+	monitor.initStats()
+	scheduler := &Scheduler{collectors: monitor.newCollectors()}
+
+	writer, err := newRecordWriter(*output, *format, *compress || strings.HasSuffix(*output, ".gz"), maxSize, *rotateEvery)
+	if err != nil {
+		log.Fatalf("创建录制文件失败: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scheduler.Run(ctx)
+	}()
+	log.Printf("开始录制: 格式 %s, 采样间隔 %s, 网卡 %s", *format, *interval, *intf)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	samples := 0
+	started, warned := time.Now(), false
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case now := <-ticker.C:
+			// 所有采集器完成首次采集前的数据不完整，不记录
+			if !scheduler.Ready() {
+				if !warned && now.Sub(started) >= recordWaitWarning {
+					warned = true
+					log.Printf("已等待%s，采集器 %s 仍未完成首次采集，尚未写入样本", recordWaitWarning, strings.Join(scheduler.pending(), ", "))
+				}
+				continue
+			}
+			if err := writer.Write(monitor.recordSample(now)); err != nil {
+				log.Printf("写入录制文件失败: %v", err)
+				break loop
+			}
+			samples++
+		}
+	}
+	stop()
+	wg.Wait()
+	if err := writer.Close(); err != nil {
+		log.Fatalf("关闭录制文件失败: %v", err)
+	}
+	if samples == 0 {
+		log.Fatalf("录制结束，没有写入任何样本")
+	}
+	log.Printf("录制结束，共 %d 个样本", samples)
+}
+
+// recordSample 生成当前时刻的录制样本
+func (m *Monitor) recordSample(now time.Time) RecordSample {
+	values := m.values()
+	m.mu.RLock()
+	values["uptime"] = m.uptime
+	intf := m.config.Interface
+	m.mu.RUnlock()
+	return RecordSample{Time: now, Interface: intf, Values: values}
+}
+
+// recordWriter 写入录制文件，支持按大小或时间切换文件和 gzip 压缩
+// 启用切换时文件名中插入打开时间，如 load.jsonl 变为 load-20060102-150405.jsonl
+type recordWriter struct {
+	path        string
+	format      string
+	compress    bool
+	rotateSize  uint64
+	rotateEvery time.Duration
+
+	file      *os.File
+	gz        *gzip.Writer
+	buf       *bufio.Writer
+	size      uint64
+	opened    time.Time
+	lastFlush time.Time
+}
+
+// newRecordWriter 创建录制文件写入器并打开第一个文件
+func newRecordWriter(path, format string, compress bool, rotateSize uint64, rotateEvery time.Duration) (*recordWriter, error) {
+	if compress && path != "-" && !strings.HasSuffix(path, ".gz") {
+		path += ".gz"
+	}
+	w := &recordWriter{
+		path:        path,
+		format:      format,
+		compress:    compress,
+		rotateSize:  rotateSize,
+		rotateEvery: rotateEvery,
+	}
+	if err := w.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open 打开新文件，CSV 格式在每个文件开头写入表头
+func (w *recordWriter) open(now time.Time) error {
+	var dst io.Writer = os.Stdout
+	if w.path != "-" {
+		name := w.path
+		if w.rotateSize > 0 || w.rotateEvery > 0 {
+			name = w.rotatedName(now)
+		}
+		if dir := filepath.Dir(name); dir != "." {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		w.file, dst = f, f
+		log.Printf("写入录制文件 %s", name)
+	}
+	if w.compress {
+		w.gz = gzip.NewWriter(dst)
+		dst = w.gz
+	}
+	w.buf = bufio.NewWriter(dst)
+	w.size, w.opened, w.lastFlush = 0, now, now
+
+	if w.format == "csv" {
+		return w.writeLine(append([]string{"time", "unix", "interface"}, recordFields...))
+	}
+	return nil
+}
+
+// rotatedName 生成切换后的文件名，同一秒内多次切换时追加序号
+func (w *recordWriter) rotatedName(now time.Time) string {
+	base, ext := strings.TrimSuffix(w.path, ".gz"), ""
+	if w.compress {
+		ext = ".gz"
+	}
+	ext = filepath.Ext(base) + ext
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	stamp := now.In(displayZone).Format("20060102-150405")
+	name := base + "-" + stamp + ext
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s-%s-%d%s", base, stamp, i, ext)
+	}
+}
+
+// Write 写入一个样本，需要时先切换到新文件
+func (w *recordWriter) Write(sample RecordSample) error {
+	if (w.rotateSize > 0 && w.size >= w.rotateSize) || (w.rotateEvery > 0 && sample.Time.Sub(w.opened) >= w.rotateEvery) {
+		if err := w.closeFile(); err != nil {
+			return err
+		}
+		if err := w.open(sample.Time); err != nil {
+			return err
+		}
+	}
+
+	timestamp := sample.Time.In(displayZone).Format("2006-01-02T15:04:05.000Z07:00")
+	unix := float64(sample.Time.UnixMilli()) / 1000
+	if w.format == "csv" {
+		record := []string{timestamp, strconv.FormatFloat(unix, 'f', 3, 64), sample.Interface}
+		for _, field := range recordFields {
+			v, ok := sample.Values[field]
+			if !ok {
+				record = append(record, "")
+				continue
+			}
+			record = append(record, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		if err := w.writeLine(record); err != nil {
+			return err
+		}
+	} else {
+		line := map[string]interface{}{"time": timestamp, "unix": unix, "interface": sample.Interface}
+		for _, field := range recordFields {
+			if v, ok := sample.Values[field]; ok {
+				line[field] = v
+			}
+		}
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		if _, err := w.buf.Write(data); err != nil {
+			return err
+		}
+		w.size += uint64(len(data))
+	}
+
+	// 每个样本都刷新缓冲区，便于用 tail -f 查看；gzip 只定期刷新
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.gz != nil && sample.Time.Sub(w.lastFlush) >= recordFlushEvery {
+		w.lastFlush = sample.Time
+		return w.gz.Flush()
+	}
+	return nil
+}
+
+// writeLine 写入一行CSV
+func (w *recordWriter) writeLine(record []string) error {
+	var line bytes.Buffer
+	cw := csv.NewWriter(&line)
+	cw.Write(record)
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	w.size += uint64(line.Len())
+	_, err := w.buf.Write(line.Bytes())
+	return err
+}
+
+// closeFile 刷新并关闭当前文件
+func (w *recordWriter) closeFile() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Close 关闭录制文件
+func (w *recordWriter) Close() error {
+	return w.closeFile()
+}
+
+// replayTick 回放推进的间隔
+const replayTick = 100 * time.Millisecond
+
+// Replay 按录制文件中的时间线回放样本，驱动面板、/api/stats 和历史接口
+// 播放位置按实际经过的时间乘以倍速推进，每当越过一个样本就把它应用到监控器
+type Replay struct {
+	files   []string
+	samples []RecordSample
+	monitor *Monitor
+	notify  func()
+
+	mu       sync.Mutex
+	position time.Time
+	speed    float64
+	playing  bool
+	applied  int // 当前已应用的样本下标，-1表示尚未应用
+}
+
+// ReplayStatus 回放状态，时间均为unix秒
+type ReplayStatus struct {
+	Files    []string `json:"files"`
+	Samples  int      `json:"samples"`
+	Start    float64  `json:"start"`
+	End      float64  `json:"end"`
+	Position float64  `json:"position"`
+	Speed    float64  `json:"speed"`
+	Playing  bool     `json:"playing"`
+}
+
+// runReplay 回放模式：加载录制文件，用其中的样本驱动Web服务器
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		port   = fs.Int("port", 8080, "Web服务器端口")
+		speed  = fs.Float64("speed", 1, "回放倍速")
+		paused = fs.Bool("paused", false, "启动后暂停在录制开头")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: %s replay [参数] 录制文件...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *speed <= 0 {
+		log.Fatalf("无效的 -speed 参数: 必须大于0")
+	}
+
+	samples, err := loadRecording(fs.Args())
+	if err != nil {
+		log.Fatalf("加载录制文件失败: %v", err)
+	}
+	first, last := samples[0].Time, samples[len(samples)-1].Time
+	log.Printf("已加载 %d 个样本: %s - %s", len(samples), formatTime(first), formatTime(last))
+
+	config := Config{
+		Interface:       samples[0].Interface,
+		Port:            *port,
+		Interval:        time.Second,
+		ShutdownTimeout: 10 * time.Second,
+		HistorySize:     len(samples),
+	}
+	setSelectedInterface(config.Interface)
+
+	em := &EnhancedMonitor{
+		config:    config,
+		history:   NewHistory(config.HistorySize),
+		stream:    NewStream(streamBacklog),
+		scheduler: &Scheduler{},
+		monitor:   &Monitor{config: config, traffic: NewTrafficAccounting(config)},
+	}
+	// 历史接口直接使用整个录制，查询时截止到回放位置
+	for _, sample := range samples {
+		values := make(map[string]float64, len(sample.Values))
+		for k, v := range sample.Values {
+			if k != "uptime" {
+				values[k] = v
+			}
+		}
+		em.history.Add(sample.Time, values)
+	}
+	em.replay = NewReplay(fs.Args(), samples, em.monitor, em.stream.Notify, *speed, !*paused)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		em.stream.Run(ctx, em.monitor.snapshot)
+	}()
+	go func() {
+		defer wg.Done()
+		em.replay.Run(ctx)
+	}()
+
+	err = em.startWebServer(ctx)
+	stop()
+	wg.Wait()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("已退出")
+}
+
+// loadRecording 读取录制文件（JSON Lines 或 CSV，可为 gzip 压缩），按时间排序合并
+func loadRecording(paths []string) ([]RecordSample, error) {
+	var samples []RecordSample
+	for _, path := range paths {
+		loaded, err := loadRecordingFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		samples = append(samples, loaded...)
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("录制文件中没有样本")
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Time.Before(samples[j].Time)
+	})
+	return samples, nil
+}
+
+// loadRecordingFile 读取单个录制文件，根据gzip头和首个字符自动识别压缩和格式
+func loadRecordingFile(path string) ([]RecordSample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+	}
+	if first, err := reader.Peek(1); err == nil && first[0] == '{' {
+		return parseRecordJSONL(reader)
+	}
+	return parseRecordCSV(reader)
+}
+
+// parseRecordJSONL 解析 JSON Lines 格式的录制
+func parseRecordJSONL(r io.Reader) ([]RecordSample, error) {
+	var samples []RecordSample
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var raw map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil {
+			return nil, fmt.Errorf("第 %d 行: %v", line, err)
+		}
+		unix, ok := raw["unix"].(float64)
+		if !ok {
+			return nil, fmt.Errorf("第 %d 行: 缺少 unix 字段", line)
+		}
+		sample := RecordSample{
+			Time:   time.UnixMilli(int64(math.Round(unix * 1000))),
+			Values: make(map[string]float64),
+		}
+		sample.Interface, _ = raw["interface"].(string)
+		for _, field := range recordFields {
+			if v, ok := raw[field].(float64); ok {
+				sample.Values[field] = v
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return samples, scanner.Err()
+}
+
+// parseRecordCSV 解析 CSV 格式的录制，按表头识别列，切换文件后重复出现的表头会被跳过
+func parseRecordCSV(r io.Reader) ([]RecordSample, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	var header map[string]int
+	var samples []RecordSample
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) > 0 && record[0] == "time" {
+			header = make(map[string]int, len(record))
+			for i, name := range record {
+				header[name] = i
+			}
+			continue
+		}
+		if header == nil {
+			return nil, fmt.Errorf("缺少表头")
+		}
+		field := func(name string) string {
+			if i, ok := header[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		unix, err := strconv.ParseFloat(field("unix"), 64)
+		if err != nil {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("第 %d 行: 无效的 unix 字段", line)
+		}
+		sample := RecordSample{
+			Time:      time.UnixMilli(int64(math.Round(unix * 1000))),
+			Interface: field("interface"),
+			Values:    make(map[string]float64),
+		}
+		for _, name := range recordFields {
+			if v, err := strconv.ParseFloat(field(name), 64); err == nil {
+				sample.Values[name] = v
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// applySample 用录制的样本替换监控器的当前状态，单位换算与 values 相反
+func (m *Monitor) applySample(sample RecordSample) {
+	v := sample.Values
+	kb := func(name string, scale float64) uint64 {
+		return uint64(math.Round(v[name] * scale))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config.Interface = sample.Interface
+	m.uptime = v["uptime"]
+	m.loadAvg = [3]float64{v["last1"], v["last5"], v["last15"]}
+	m.cpuUsage = v["cpu_usage"]
+	m.cpuTemp, m.hasCPUTemp = v["cpu_temp"]
+	m.memInfo = map[string]uint64{"total": kb("mem_total_space", 1024), "used": kb("mem_used_space", 1024)}
+	m.swapInfo = map[string]uint64{
+		"total": kb("swap_total_space", 1024),
+		"used":  kb("swap_used_space", 1024),
+		"free":  kb("swap_free_space", 1024),
+	}
+	m.diskInfo = map[string]uint64{
+		"total":     kb("disk_total_space", 1024*1024),
+		"used":      kb("disk_used_space", 1024*1024),
+		"available": kb("disk_available_space", 1024*1024),
+	}
+	m.diskRead, m.diskWrite = v["disk_read_speed"], v["disk_write_speed"]
+	m.prevIOTime = sample.Time
+	m.receiveSpeed, m.transmitSpeed = v["receive_speed"], v["transmit_speed"]
+	m.netRx = kb("receive_total", 1024*1024*1024)
+	m.netTx = kb("transmit_total", 1024*1024*1024)
+	m.prevNetTime = sample.Time
+	m.latestTime = sample.Time
+}
+
+// NewReplay 创建回放，播放位置从录制开头开始
+func NewReplay(files []string, samples []RecordSample, monitor *Monitor, notify func(), speed float64, playing bool) *Replay {
+	r := &Replay{
+		files:    files,
+		samples:  samples,
+		monitor:  monitor,
+		notify:   notify,
+		position: samples[0].Time,
+		speed:    speed,
+		playing:  playing,
+		applied:  -1,
+	}
+	r.mu.Lock()
+	r.applyLocked()
+	r.mu.Unlock()
+	return r
+}
+
+// Run 推进播放位置，播放到结尾时自动暂停，阻塞直到ctx被取消
+func (r *Replay) Run(ctx context.Context) {
+	ticker := time.NewTicker(replayTick)
+	defer ticker.Stop()
+	last := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(last)
+			last = now
+
+			r.mu.Lock()
+			if r.playing {
+				r.position = r.position.Add(time.Duration(float64(elapsed) * r.speed))
+				if end := r.samples[len(r.samples)-1].Time; !r.position.Before(end) {
+					r.position, r.playing = end, false
+					log.Printf("回放结束")
+				}
+				r.applyLocked()
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// applyLocked 应用播放位置上的样本（不晚于播放位置的最后一个样本），调用方需持有 r.mu
+func (r *Replay) applyLocked() {
+	i := sort.Search(len(r.samples), func(i int) bool {
+		return r.samples[i].Time.After(r.position)
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i == r.applied {
+		return
+	}
+	r.applied = i
+	r.monitor.applySample(r.samples[i])
+	setSelectedInterface(r.samples[i].Interface)
+	r.notify()
+}
+
+// Position 返回当前播放位置
+func (r *Replay) Position() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.position
+}
+
+// Interfaces 返回录制中出现过的网卡
+func (r *Replay) Interfaces() []string {
+	seen := make(map[string]bool)
+	interfaces := []string{}
+	for _, s := range r.samples {
+		if s.Interface != "" && !seen[s.Interface] {
+			seen[s.Interface] = true
+			interfaces = append(interfaces, s.Interface)
+		}
+	}
+	return interfaces
+}
+
+// Status 返回回放状态
+func (r *Replay) Status() ReplayStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unix := func(t time.Time) float64 {
+		return float64(t.UnixMilli()) / 1000
+	}
+	return ReplayStatus{
+		Files:    r.files,
+		Samples:  len(r.samples),
+		Start:    unix(r.samples[0].Time),
+		End:      unix(r.samples[len(r.samples)-1].Time),
+		Position: unix(r.position),
+		Speed:    r.speed,
+		Playing:  r.playing,
+	}
+}
+
+// ServeHTTP 处理 /api/replay：GET 返回回放状态，POST 执行控制操作
+// 请求体: {"action": "play" | "pause" | "seek" | "speed", "position": unix秒, "speed": 倍速}
+func (r *Replay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		var body struct {
+			Action   string  `json:"action"`
+			Position float64 `json:"position"`
+			Speed    float64 `json:"speed"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := r.control(body.Action, body.Position, body.Speed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Status())
+}
+
+// control 执行回放控制操作
+func (r *Replay) control(action string, position, speed float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start, end := r.samples[0].Time, r.samples[len(r.samples)-1].Time
+	switch action {
+	case "play":
+		// 已播放到结尾时从头开始
+		if !r.position.Before(end) {
+			r.position = start
+			r.applyLocked()
+		}
+		r.playing = true
+	case "pause":
+		r.playing = false
+	case "seek":
+		t := time.UnixMilli(int64(math.Round(position * 1000)))
+		if t.Before(start) {
+			t = start
+		}
+		if t.After(end) {
+			t = end
+		}
+		r.position = t
+		r.applyLocked()
+	case "speed":
+		if speed <= 0 || speed > 1000 {
+			return fmt.Errorf("speed must be in (0, 1000]")
+		}
+		r.speed = speed
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	return nil
+}
+
+// 告警状态
+const (
+	alertPending  = "pending"
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// 只用于通知的告警事件：确认会通知并停止重复通知；静默只停止重复通知，不发送
+const (
+	alertAcknowledged = "acknowledged"
+	alertSilenced     = "silenced"
+)
+
+// alertEventBuffer 每个告警事件订阅者的缓冲区大小
+const alertEventBuffer = 100
+
+// alertResolvedRetention 已恢复的告警在 /api/alerts 中保留的时长
+const alertResolvedRetention = 15 * time.Minute
+
+// alertSeverities 告警级别，数值越大越严重
+var alertSeverities = map[string]int{"info": 0, "warning": 1, "critical": 2}
+
+// alertRulePattern 匹配规则行开头的 "名称:"
+var alertRulePattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_.-]*)\s*:\s*(.*)$`)
+
+// AlertRule 告警规则
+// 条件持续满足 For 后告警触发；触发后改用 Clear 阈值判断是否恢复（回差），避免数值在阈值附近波动时反复告警
+type AlertRule struct {
+	Name      string
+	Expr      string
+	Metric    string
+	Matchers  []labelMatcher
+	Op        string
+	Threshold float64
+	Clear     float64
+	HasClear  bool
+	For       time.Duration
+	Severity  string
+}
+
+// labelMatcher 标签匹配条件，Negate 为true时表示 !=
+type labelMatcher struct {
+	Name   string
+	Value  string
+	Negate bool
+}
+
+// Alert 一条规则在一个序列（标签组合）上的告警
+type Alert struct {
+	ID          string
+	Rule        *AlertRule
+	Labels      map[string]string
+	State       string
+	Value       float64
+	ActiveSince time.Time
+	FiredAt     time.Time
+	ResolvedAt  time.Time
+	Ack         *Acknowledgement
+	SilencedBy  string // 生效的静默或维护窗口，如 silence:1a2b3c4d、maintenance:config-1
+
+	// notified 是否已发送触发事件，静默期间为false，恢复时只对已通知的告警发送恢复事件
+	notified bool
+}
+
+// AlertStatus 告警状态（JSON）
+type AlertStatus struct {
+	ID          string            `json:"id"`
+	Rule        string            `json:"rule"`
+	Expr        string            `json:"expr"`
+	Severity    string            `json:"severity"`
+	State       string            `json:"state"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Value       float64           `json:"value"`
+	Threshold   float64           `json:"threshold"`
+	ActiveSince string            `json:"active_since,omitempty"`
+	FiredAt     string            `json:"fired_at,omitempty"`
+	ResolvedAt  string            `json:"resolved_at,omitempty"`
+	Ack         *Acknowledgement  `json:"acknowledged,omitempty"`
+	SilencedBy  string            `json:"silenced_by,omitempty"`
+}
+
+// AlertEvent 告警触发、恢复或确认事件，也是 Webhook 模板的数据
+type AlertEvent struct {
+	Status string      `json:"status"`
+	Host   string      `json:"host"`
+	Time   time.Time   `json:"time"`
+	Repeat bool        `json:"repeat"`
+	Alert  AlertStatus `json:"alert"`
+}
+
+// Notifier 告警通知渠道，Run 从events接收告警事件并发送，阻塞直到ctx被取消
+type Notifier interface {
+	Run(ctx context.Context, events <-chan AlertEvent)
+}
+
+// AlertManager 按规则评估指标并维护告警状态
+type AlertManager struct {
+	rules []*AlertRule
+
+	mu          sync.Mutex
+	alerts      map[string]*Alert
+	subscribers []chan AlertEvent
+	silences    []*Silence
+	maintenance []*MaintenanceWindow
+	acks        map[string]*Acknowledgement // 从状态文件恢复、尚未对应到告警的确认
+	statePath   string
+}
+
+// Silence 按标签静默告警，到期后自动删除
+// 除序列标签外还可以用 rule（规则名）和 severity（级别）匹配
+type Silence struct {
+	ID       string    `json:"id"`
+	Matchers string    `json:"matchers"`
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	Comment  string    `json:"comment,omitempty"`
+	matchers []labelMatcher
+}
+
+// Acknowledgement 对触发中告警的确认，告警恢复后失效
+type Acknowledgement struct {
+	Comment string    `json:"comment"`
+	At      time.Time `json:"at"`
+}
+
+// MaintenanceWindow 每周重复的维护窗口，时间按 displayZone 计算
+// 格式: 日期 HH:MM-HH:MM [{标签="值",...}]，日期为 daily、mon、mon-fri 或 sat,sun 这样的列表；
+// 结束时间早于开始时间时表示跨越午夜
+type MaintenanceWindow struct {
+	ID       string `json:"id"`
+	Spec     string `json:"spec"`
+	Comment  string `json:"comment,omitempty"`
+	Source   string `json:"source"` // config 或 api
+	Active   bool   `json:"active"`
+	days     [7]bool
+	start    int // 当天的分钟数
+	end      int
+	matchers []labelMatcher
+}
+
+// alertState 静默、确认和通过API添加的维护窗口的持久化格式
+type alertState struct {
+	Silences    []*Silence                  `json:"silences"`
+	Acks        map[string]*Acknowledgement `json:"acknowledgements"`
+	Maintenance []*MaintenanceWindow        `json:"maintenance"`
+}
+
+// LoadAlertRules 读取告警规则文件，# 开头的行为注释
+// 规则格式: [名称:] 指标[{标签="值",...}] 比较符 阈值 [for 时长] [clear 恢复阈值] [severity info|warning|critical]
+func LoadAlertRules(path string) ([]*AlertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*AlertRule
+	names := make(map[string]bool)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseAlertRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 行: %v", i+1, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("第 %d 行: 规则名 %s 重复", i+1, rule.Name)
+		}
+		names[rule.Name] = true
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseAlertRule 解析一条告警规则，未指定名称时以表达式作为名称
+func parseAlertRule(line string) (*AlertRule, error) {
+	rule := &AlertRule{Severity: "warning"}
+	expr := line
+	if m := alertRulePattern.FindStringSubmatch(line); m != nil {
+		rule.Name, expr = m[1], m[2]
+	}
+
+	// 指标名和标签选择器
+	i := 0
+	for i < len(expr) && (expr[i] == '_' || expr[i] >= 'a' && expr[i] <= 'z' || expr[i] >= 'A' && expr[i] <= 'Z' || expr[i] >= '0' && expr[i] <= '9') {
+		i++
+	}
+	rule.Metric = expr[:i]
+	if rule.Metric == "" {
+		return nil, fmt.Errorf("缺少指标名")
+	}
+	if !alertMetricKnown(rule.Metric) {
+		return nil, fmt.Errorf("未知的指标 %s", rule.Metric)
+	}
+	rest := expr[i:]
+	if strings.HasPrefix(rest, "{") {
+		end := strings.Index(rest, "}")
+		if end < 0 {
+			return nil, fmt.Errorf("标签选择器缺少 }")
+		}
+		matchers, err := parseLabelMatchers(rest[1:end])
+		if err != nil {
+			return nil, err
+		}
+		rule.Matchers = matchers
+		rest = rest[end+1:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("缺少比较符或阈值")
+	}
+	switch fields[0] {
+	case ">", ">=", "<", "<=", "==", "!=":
+		rule.Op = fields[0]
+	default:
+		return nil, fmt.Errorf("无效的比较符 %q", fields[0])
+	}
+	threshold, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("无效的阈值 %q", fields[1])
+	}
+	rule.Threshold = threshold
+	rule.Expr = strings.TrimSpace(expr[:len(expr)-len(rest)]) + " " + fields[0] + " " + fields[1]
+
+	for fields = fields[2:]; len(fields) > 0; fields = fields[2:] {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s 缺少参数", fields[0])
+		}
+		switch fields[0] {
+		case "for":
+			d, err := parseDuration(fields[1])
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("无效的持续时间 %q", fields[1])
+			}
+			rule.For = d
+			rule.Expr += " for " + fields[1]
+		case "clear":
+			v, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("无效的恢复阈值 %q", fields[1])
+			}
+			rule.Clear, rule.HasClear = v, true
+		case "severity":
+			if _, ok := alertSeverities[fields[1]]; !ok {
+				return nil, fmt.Errorf("无效的告警级别 %q", fields[1])
+			}
+			rule.Severity = fields[1]
+		default:
+			return nil, fmt.Errorf("未知的参数 %q", fields[0])
+		}
+	}
+
+	if rule.HasClear {
+		switch {
+		case rule.Op == "==" || rule.Op == "!=":
+			return nil, fmt.Errorf("%s 不支持恢复阈值", rule.Op)
+		case strings.HasPrefix(rule.Op, ">") && rule.Clear > rule.Threshold,
+			strings.HasPrefix(rule.Op, "<") && rule.Clear < rule.Threshold:
+			return nil, fmt.Errorf("恢复阈值应比触发阈值更宽松")
+		}
+	}
+	if rule.Name == "" {
+		rule.Name = rule.Expr
+	}
+	return rule, nil
+}
+
+// parseLabelMatchers 解析 name="value",name!="value" 形式的标签匹配条件
+func parseLabelMatchers(s string) ([]labelMatcher, error) {
+	var matchers []labelMatcher
+	for s = strings.TrimSpace(s); s != ""; {
+		eq := strings.Index(s, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("无效的标签选择器 %q", s)
+		}
+		m := labelMatcher{Name: strings.TrimSpace(s[:eq])}
+		if strings.HasSuffix(m.Name, "!") {
+			m.Name, m.Negate = strings.TrimSpace(strings.TrimSuffix(m.Name, "!")), true
+		}
+		s = strings.TrimSpace(s[eq+1:])
+		if !strings.HasPrefix(s, `"`) {
+			return nil, fmt.Errorf("标签 %s 的值需要用双引号括起来", m.Name)
+		}
+		end := strings.Index(s[1:], `"`)
+		if end < 0 {
+			return nil, fmt.Errorf("标签 %s 的值缺少结束引号", m.Name)
+		}
+		m.Value = s[1 : end+1]
+		matchers = append(matchers, m)
+		s = strings.TrimSpace(s[end+2:])
+		s = strings.TrimSpace(strings.TrimPrefix(s, ","))
+	}
+	return matchers, nil
+}
+
+// alertMetricKnown 判断规则中的指标名是否存在：/api/stats 的数值字段或 /metrics 中的指标
+func alertMetricKnown(name string) bool {
+	for _, field := range recordFields {
+		if field == name {
+			return true
+		}
+	}
+	for _, d := range metricDescs {
+		if d.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matches 判断序列是否属于该规则
+func (r *AlertRule) matches(p MetricPoint) bool {
+	if p.Name != r.Metric {
+		return false
+	}
+	for _, m := range r.Matchers {
+		if (p.Labels[m.Name] == m.Value) == m.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// compare 用规则的比较符比较数值和阈值
+func (r *AlertRule) compare(v, threshold float64) bool {
+	switch r.Op {
+	case ">":
+		return v > threshold
+	case ">=":
+		return v >= threshold
+	case "<":
+		return v < threshold
+	case "<=":
+		return v <= threshold
+	case "==":
+		return v == threshold
+	case "!=":
+		return v != threshold
+	}
+	return false
+}
+
+// alertSeries 返回参与告警评估的序列：/api/stats 中的数值字段（不带标签）和 /metrics 中的全部指标
+// disk_usage 按挂载点展开（带 device、mount 标签），以便对单个挂载点设置告警
+func (em *EnhancedMonitor) alertSeries() []MetricPoint {
+	values := em.monitor.values()
+	points := em.metricPoints()
+	series := make([]MetricPoint, 0, len(values)+len(points))
+	for name, v := range values {
+		if name != "disk_usage" {
+			series = append(series, MetricPoint{Name: name, Value: v})
+		}
+	}
+	for _, p := range points {
+		series = append(series, p)
+		if p.Name == "disk_usage_percent" {
+			series = append(series, MetricPoint{Name: "disk_usage", Labels: p.Labels, Value: p.Value})
+		}
+	}
+	return series
+}
+
+// NewAlertManager 创建告警管理器
+func NewAlertManager(rules []*AlertRule) *AlertManager {
+	return &AlertManager{
+		rules:  rules,
+		alerts: make(map[string]*Alert),
+		acks:   make(map[string]*Acknowledgement),
+	}
+}
+
+// alertID 告警的唯一标识：规则名加序列标签
+func alertID(rule string, labels map[string]string) string {
+	var b strings.Builder
+	b.WriteString(rule)
+	writeLabels(&b, labels)
+	return b.String()
+}
+
+// Evaluate 用当前的序列评估所有规则并更新告警状态
+func (am *AlertManager) Evaluate(now time.Time, series []MetricPoint) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, rule := range am.rules {
+		for _, p := range series {
+			if !rule.matches(p) || math.IsNaN(p.Value) {
+				continue
+			}
+			id := alertID(rule.Name, p.Labels)
+			seen[id] = true
+
+			a := am.alerts[id]
+			active := a != nil && a.State != alertResolved
+			threshold := rule.Threshold
+			if active && a.State == alertFiring && rule.HasClear {
+				// 回差只对已触发的告警生效，pending 期间条件不满足时直接取消
+				threshold = rule.Clear
+			}
+			cond := rule.compare(p.Value, threshold)
+
+			switch {
+			case cond && !active:
+				a = &Alert{ID: id, Rule: rule, Labels: p.Labels, State: alertPending, ActiveSince: now}
+				if ack := am.acks[id]; ack != nil {
+					// 重启前已确认的告警，确认在它恢复前继续有效
+					a.Ack, a.notified = ack, true
+					delete(am.acks, id)
+				}
+				am.alerts[id] = a
+			case !cond && active:
+				am.resolve(a, now)
+			}
+			if a == nil {
+				continue
+			}
+			a.Value = p.Value
+			if a.State == alertPending && now.Sub(a.ActiveSince) >= rule.For {
+				a.State, a.FiredAt = alertFiring, now
+				log.Printf("告警触发 [%s] %s: 当前值 %s", rule.Severity, id, formatFloat(p.Value))
+			}
+		}
+	}
+
+	for id, a := range am.alerts {
+		switch {
+		case a.State != alertResolved && !seen[id]:
+			// 序列已消失（如挂载点被卸载），视为恢复
+			am.resolve(a, now)
+		case a.State == alertResolved && now.Sub(a.ResolvedAt) > alertResolvedRetention:
+			delete(am.alerts, id)
+		}
+	}
+
+	// 首次评估后仍未对应到告警的确认已经没有意义
+	if len(am.acks) > 0 {
+		am.acks = make(map[string]*Acknowledgement)
+		am.saveState()
+	}
+	am.expireSilences(now)
+	am.notify(now)
+}
+
+// notify 按静默、维护窗口和确认状态发送触发中告警的事件，调用方需持有 am.mu
+// 静默开始时发送 silenced 事件让通知渠道停止重复通知；静默结束时告警仍在触发则重新发送触发事件
+func (am *AlertManager) notify(now time.Time) {
+	for _, a := range am.alerts {
+		if a.State != alertFiring {
+			continue
+		}
+		a.SilencedBy = am.silencedBy(a, now)
+		switch {
+		case a.SilencedBy != "":
+			if a.notified {
+				a.notified = false
+				am.emit(a, alertSilenced, now)
+			}
+		case !a.notified:
+			a.notified = true
+			if a.Ack == nil {
+				am.emit(a, alertFiring, now)
+			}
+		}
+	}
+}
+
+// resolve 结束一条告警，尚未触发的告警直接删除，调用方需持有 am.mu
+func (am *AlertManager) resolve(a *Alert, now time.Time) {
+	if a.State == alertPending {
+		delete(am.alerts, a.ID)
+		return
+	}
+	a.State, a.ResolvedAt = alertResolved, now
+	log.Printf("告警恢复 [%s] %s: 当前值 %s", a.Rule.Severity, a.ID, formatFloat(a.Value))
+	if a.notified {
+		a.notified = false
+		am.emit(a, alertResolved, now)
+	}
+	if a.Ack != nil {
+		am.saveState()
+	}
+}
+
+// Subscribe 订阅告警触发和恢复事件，需在开始评估前调用
+func (am *AlertManager) Subscribe() <-chan AlertEvent {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	ch := make(chan AlertEvent, alertEventBuffer)
+	am.subscribers = append(am.subscribers, ch)
+	return ch
+}
+
+// emit 向所有订阅者发送告警事件，订阅者处理不过来时丢弃事件，调用方需持有 am.mu
+func (am *AlertManager) emit(a *Alert, status string, now time.Time) {
+	event := AlertEvent{Status: status, Host: hostname(), Time: now, Alert: a.status()}
+	for _, ch := range am.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("告警通知队列已满，丢弃事件 %s %s", event.Status, a.ID)
+		}
+	}
+}
+
+// status 生成告警的JSON状态
+func (a *Alert) status() AlertStatus {
+	return AlertStatus{
+		ID:          a.ID,
+		Rule:        a.Rule.Name,
+		Expr:        a.Rule.Expr,
+		Severity:    a.Rule.Severity,
+		State:       a.State,
+		Labels:      a.Labels,
+		Value:       a.Value,
+		Threshold:   a.Rule.Threshold,
+		ActiveSince: formatTime(a.ActiveSince),
+		FiredAt:     formatTime(a.FiredAt),
+		ResolvedAt:  formatTime(a.ResolvedAt),
+		Ack:         a.Ack,
+		SilencedBy:  a.SilencedBy,
+	}
+}
+
+// Alerts 返回当前所有告警，触发中的排在前面，同状态按级别从高到低排序
+func (am *AlertManager) Alerts() []AlertStatus {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	statusOrder := map[string]int{alertFiring: 0, alertPending: 1, alertResolved: 2}
+	alerts := make([]AlertStatus, 0, len(am.alerts))
+	for _, a := range am.alerts {
+		alerts = append(alerts, a.status())
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		a, b := alerts[i], alerts[j]
+		if statusOrder[a.State] != statusOrder[b.State] {
+			return statusOrder[a.State] < statusOrder[b.State]
+		}
+		if alertSeverities[a.Severity] != alertSeverities[b.Severity] {
+			return alertSeverities[a.Severity] > alertSeverities[b.Severity]
+		}
+		return a.ID < b.ID
+	})
+	return alerts
+}
+
+// parseSelector 解析 {标签="值",...} 形式的标签选择器，花括号可以省略
+func parseSelector(s string) ([]labelMatcher, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") {
+		if !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("标签选择器缺少 '}'")
+		}
+		s = s[1 : len(s)-1]
+	}
+	return parseLabelMatchers(s)
+}
+
+// alertLabelsMatch 判断告警是否满足所有标签条件，rule 和 severity 分别匹配规则名和级别
+func alertLabelsMatch(matchers []labelMatcher, a *Alert) bool {
+	for _, m := range matchers {
+		value := a.Labels[m.Name]
+		switch m.Name {
+		case "rule":
+			value = a.Rule.Name
+		case "severity":
+			value = a.Rule.Severity
+		}
+		if (value == m.Value) == m.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// silencedBy 返回对告警生效的静默或维护窗口，调用方需持有 am.mu
+func (am *AlertManager) silencedBy(a *Alert, now time.Time) string {
+	for _, s := range am.silences {
+		if !now.Before(s.StartsAt) && now.Before(s.EndsAt) && alertLabelsMatch(s.matchers, a) {
+			return "silence:" + s.ID
+		}
+	}
+	for _, w := range am.maintenance {
+		if w.activeAt(now) && alertLabelsMatch(w.matchers, a) {
+			return "maintenance:" + w.ID
+		}
+	}
+	return ""
+}
+
+// expireSilences 删除已到期的静默，调用方需持有 am.mu
+func (am *AlertManager) expireSilences(now time.Time) {
+	kept := am.silences[:0]
+	for _, s := range am.silences {
+		if now.Before(s.EndsAt) {
+			kept = append(kept, s)
+		} else {
+			log.Printf("静默 %s %s 已到期", s.ID, s.Matchers)
+		}
+	}
+	if len(kept) == len(am.silences) {
+		return
+	}
+	for i := len(kept); i < len(am.silences); i++ {
+		am.silences[i] = nil
+	}
+	am.silences = kept
+	am.saveState()
+}
+
+// AddSilence 添加静默，matchers 为 {标签="值",...} 形式且至少包含一个条件
+func (am *AlertManager) AddSilence(matchers string, duration time.Duration, comment string) (*Silence, error) {
+	matchers = strings.TrimSpace(matchers)
+	parsed, err := parseSelector(matchers)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("至少需要一个标签条件")
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("静默时长必须大于0")
+	}
+	now := time.Now()
+	s := &Silence{
+		ID:       randomID(),
+		Matchers: matchers,
+		StartsAt: now,
+		EndsAt:   now.Add(duration),
+		Comment:  comment,
+		matchers: parsed,
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.silences = append(am.silences, s)
+	am.saveState()
+	am.notify(now)
+	log.Printf("已添加静默 %s %s，至 %s", s.ID, s.Matchers, formatTime(s.EndsAt))
+	return s, nil
+}
+
+// DeleteSilence 提前结束静默
+func (am *AlertManager) DeleteSilence(id string) bool {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for i, s := range am.silences {
+		if s.ID == id {
+			am.silences = append(am.silences[:i], am.silences[i+1:]...)
+			am.saveState()
+			am.notify(time.Now())
+			log.Printf("已删除静默 %s %s", s.ID, s.Matchers)
+			return true
+		}
+	}
+	return false
+}
+
+// Acknowledge 确认一条触发中的告警，确认后不再重复通知，直到告警恢复
+func (am *AlertManager) Acknowledge(id, comment string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	a := am.alerts[id]
+	if a == nil || a.State != alertFiring {
+		return fmt.Errorf("告警 %s 不在触发中", id)
+	}
+	now := time.Now()
+	a.Ack = &Acknowledgement{Comment: comment, At: now}
+	if a.notified {
+		am.emit(a, alertAcknowledged, now)
+	}
+	am.saveState()
+	log.Printf("告警 %s 已确认: %s", id, comment)
+	return nil
+}
+
+// Unacknowledge 取消确认，告警仍在触发时重新发送触发事件
+func (am *AlertManager) Unacknowledge(id string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	a := am.alerts[id]
+	if a == nil || a.Ack == nil {
+		return fmt.Errorf("告警 %s 未被确认", id)
+	}
+	a.Ack = nil
+	if a.State == alertFiring && a.notified {
+		am.emit(a, alertFiring, time.Now())
+	}
+	am.saveState()
+	return nil
+}
+
+// AddMaintenance 添加维护窗口，source 为 config 的窗口不会写入状态文件
+func (am *AlertManager) AddMaintenance(spec, comment, source string) (*MaintenanceWindow, error) {
+	w, err := parseMaintenanceWindow(spec)
+	if err != nil {
+		return nil, err
+	}
+	w.Comment, w.Source = comment, source
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if source == "config" {
+		n := 0
+		for _, other := range am.maintenance {
+			if other.Source == "config" {
+				n++
+			}
+		}
+		w.ID = fmt.Sprintf("config-%d", n+1)
+	} else {
+		w.ID = randomID()
+	}
+	am.maintenance = append(am.maintenance, w)
+	if source != "config" {
+		am.saveState()
+		am.notify(time.Now())
+		log.Printf("已添加维护窗口 %s %s", w.ID, w.Spec)
+	}
+	return w, nil
+}
+
+// DeleteMaintenance 删除通过API添加的维护窗口
+func (am *AlertManager) DeleteMaintenance(id string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for i, w := range am.maintenance {
+		if w.ID != id {
+			continue
+		}
+		if w.Source == "config" {
+			return fmt.Errorf("维护窗口 %s 来自配置，不能删除", id)
+		}
+		am.maintenance = append(am.maintenance[:i], am.maintenance[i+1:]...)
+		am.saveState()
+		am.notify(time.Now())
+		log.Printf("已删除维护窗口 %s %s", w.ID, w.Spec)
+		return nil
+	}
+	return fmt.Errorf("维护窗口 %s 不存在", id)
+}
+
+// Silences 返回未到期的静默，按到期时间排序
+func (am *AlertManager) Silences() []Silence {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	silences := make([]Silence, 0, len(am.silences))
+	for _, s := range am.silences {
+		silences = append(silences, *s)
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		return silences[i].EndsAt.Before(silences[j].EndsAt)
+	})
+	return silences
+}
+
+// Maintenance 返回所有维护窗口及其当前是否生效
+func (am *AlertManager) Maintenance(now time.Time) []MaintenanceWindow {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	windows := make([]MaintenanceWindow, 0, len(am.maintenance))
+	for _, w := range am.maintenance {
+		item := *w
+		item.Active = w.activeAt(now)
+		windows = append(windows, item)
+	}
+	return windows
+}
+
+// LoadState 设置状态文件并恢复静默、确认和通过API添加的维护窗口
+func (am *AlertManager) LoadState(path string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.statePath = path
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var state alertState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, s := range state.Silences {
+		matchers, err := parseSelector(s.Matchers)
+		if err != nil || !now.Before(s.EndsAt) {
+			continue
+		}
+		s.matchers = matchers
+		am.silences = append(am.silences, s)
+	}
+	for id, ack := range state.Acks {
+		am.acks[id] = ack
+	}
+	for _, saved := range state.Maintenance {
+		w, err := parseMaintenanceWindow(saved.Spec)
+		if err != nil {
+			log.Printf("忽略无效的维护窗口 %s: %v", saved.Spec, err)
+			continue
+		}
+		w.ID, w.Comment, w.Source = saved.ID, saved.Comment, "api"
+		am.maintenance = append(am.maintenance, w)
+	}
+	return nil
+}
+
+// saveState 写入状态文件，未配置数据目录时不保存，调用方需持有 am.mu
+func (am *AlertManager) saveState() {
+	if am.statePath == "" {
+		return
+	}
+	state := alertState{
+		Silences:    am.silences,
+		Acks:        make(map[string]*Acknowledgement),
+		Maintenance: []*MaintenanceWindow{},
+	}
+	for id, ack := range am.acks {
+		state.Acks[id] = ack
+	}
+	for _, a := range am.alerts {
+		if a.Ack != nil && a.State != alertResolved {
+			state.Acks[a.ID] = a.Ack
+		}
+	}
+	for _, w := range am.maintenance {
+		if w.Source != "config" {
+			state.Maintenance = append(state.Maintenance, w)
+		}
+	}
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = writeFileAtomic(am.statePath, data)
+	}
+	if err != nil {
+		log.Printf("保存告警状态失败: %v", err)
+	}
+}
+
+// weekdayNames 维护窗口中的星期缩写
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseMaintenanceWindow 解析维护窗口，如 "sun 02:00-04:00" 或 "mon-fri 23:30-00:30 {rule=\"high_cpu\"}"
+func parseMaintenanceWindow(spec string) (*MaintenanceWindow, error) {
+	spec = strings.TrimSpace(spec)
+	w := &MaintenanceWindow{Spec: spec}
+	rest := spec
+	if i := strings.Index(rest, "{"); i >= 0 {
+		matchers, err := parseSelector(rest[i:])
+		if err != nil {
+			return nil, err
+		}
+		w.matchers = matchers
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("格式应为 \"日期 HH:MM-HH:MM\"")
+	}
+
+	days := strings.ToLower(fields[0])
+	if days == "daily" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	} else {
+		for _, part := range strings.Split(days, ",") {
+			from, to := part, part
+			if i := strings.Index(part, "-"); i >= 0 {
+				from, to = part[:i], part[i+1:]
+			}
+			start, ok1 := weekdayNames[from]
+			end, ok2 := weekdayNames[to]
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("无效的日期 %q", part)
+			}
+			for d := start; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == end {
+					break
+				}
+			}
+		}
+	}
+
+	clock := strings.SplitN(fields[1], "-", 2)
+	if len(clock) != 2 {
+		return nil, fmt.Errorf("无效的时间段 %q", fields[1])
+	}
+	h1, m1, err1 := parseClock(clock[0])
+	h2, m2, err2 := parseClock(clock[1])
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("无效的时间段 %q", fields[1])
+	}
+	w.start, w.end = h1*60+m1, h2*60+m2
+	if w.start == w.end {
+		return nil, fmt.Errorf("开始和结束时间不能相同")
+	}
+	return w, nil
+}
+
+// activeAt 判断维护窗口在t时是否生效，跨越午夜的窗口属于开始的那一天
+func (w *MaintenanceWindow) activeAt(t time.Time) bool {
+	t = t.In(displayZone)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	return w.days[day] && minute >= w.start || w.days[(day+6)%7] && minute < w.end
+}
+
+// randomID 生成8位十六进制的随机ID
+func randomID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// evaluateAlerts 每个 Interval 评估一次告警规则，直到ctx被取消
+func (em *EnhancedMonitor) evaluateAlerts(ctx context.Context) {
+	ticker := time.NewTicker(em.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// 采集器完成首次采集前的数值为0，不参与评估，避免启动时误报
+			if !em.scheduler.Ready() {
+				continue
+			}
+			em.alerts.Evaluate(now, em.alertSeries())
+		}
+	}
+}
+
+// handleAlerts 处理 /api/alerts 请求，返回当前告警、规则、静默和维护窗口列表
+func (em *EnhancedMonitor) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	alerts := []AlertStatus{}
+	rules := []map[string]interface{}{}
+	silences := []Silence{}
+	maintenance := []MaintenanceWindow{}
+	if em.alerts != nil {
+		alerts = em.alerts.Alerts()
+		silences = em.alerts.Silences()
+		maintenance = em.alerts.Maintenance(time.Now())
+		for _, rule := range em.alerts.rules {
+			item := map[string]interface{}{
+				"name":     rule.Name,
+				"expr":     rule.Expr,
+				"severity": rule.Severity,
+				"for":      rule.For.String(),
+			}
+			if rule.HasClear {
+				item["clear"] = rule.Clear
+			}
+			rules = append(rules, item)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"alerts":      alerts,
+		"rules":       rules,
+		"silences":    silences,
+		"maintenance": maintenance,
+	})
+}
+
+// handleAck 处理 /api/alerts/ack 请求
+// POST {"id": "告警ID", "comment": "备注"} 确认告警；DELETE ?id=告警ID 取消确认
+func (em *EnhancedMonitor) handleAck(w http.ResponseWriter, r *http.Request) {
+	if em.alerts == nil {
+		http.Error(w, "Alerting not enabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			ID      string `json:"id"`
+			Comment string `json:"comment"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := em.alerts.Acknowledge(req.ID, req.Comment); err != nil {
+			http.Error(w, "Alert not firing", http.StatusConflict)
+			return
+		}
+	case http.MethodDelete:
+		if err := em.alerts.Unacknowledge(r.URL.Query().Get("id")); err != nil {
+			http.Error(w, "Alert not acknowledged", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// handleSilences 处理 /api/silences 请求
+// GET 返回未到期的静默；POST {"matchers": "{rule=\"high_cpu\"}", "duration": "2h", "comment": "备注"} 添加静默；
+// DELETE ?id=静默ID 提前结束静默
+func (em *EnhancedMonitor) handleSilences(w http.ResponseWriter, r *http.Request) {
+	if em.alerts == nil {
+		http.Error(w, "Alerting not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"silences": em.alerts.Silences()})
+	case http.MethodPost:
+		var req struct {
+			Matchers string `json:"matchers"`
+			Duration string `json:"duration"`
+			Comment  string `json:"comment"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+		silence, err := em.alerts.AddSilence(req.Matchers, duration, req.Comment)
+		if err != nil {
+			http.Error(w, "Invalid silence: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(silence)
+	case http.MethodDelete:
+		if !em.alerts.DeleteSilence(r.URL.Query().Get("id")) {
+			http.Error(w, "Silence not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMaintenance 处理 /api/maintenance 请求
+// GET 返回所有维护窗口；POST {"spec": "sun 02:00-04:00", "comment": "备注"} 添加维护窗口；
+// DELETE ?id=窗口ID 删除通过API添加的维护窗口
+func (em *EnhancedMonitor) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if em.alerts == nil {
+		http.Error(w, "Alerting not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"maintenance": em.alerts.Maintenance(time.Now())})
+	case http.MethodPost:
+		var req struct {
+			Spec    string `json:"spec"`
+			Comment string `json:"comment"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		window, err := em.alerts.AddMaintenance(req.Spec, req.Comment, "api")
+		if err != nil {
+			http.Error(w, "Invalid maintenance window: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(window)
+	case http.MethodDelete:
+		if err := em.alerts.DeleteMaintenance(r.URL.Query().Get("id")); err != nil {
+			http.Error(w, "Cannot delete maintenance window: "+err.Error(), http.StatusConflict)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseHeaders 解析 "名称=值,名称=值" 形式的请求头列表
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("请求头 %q 缺少 '='", item)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
+// alertQueueSize 每个通知渠道最多缓存的待发送通知数
+const alertQueueSize = 100
+
+// alertDispatcher 通知渠道共用的发送队列
+// 同一告警的同一状态只通知一次；持续触发的告警每隔 renotify 重复通知一次（Repeat 为true）；
+// 发送失败时按指数退避重试，超过 maxRetries 次或 send 表示不可重试时放弃
+type alertDispatcher struct {
+	name       string
+	renotify   time.Duration
+	maxRetries int
+	send       func(AlertEvent) (bool, error)
+
+	queue    []alertDelivery
+	nextTry  time.Time
+	backoff  time.Duration
+	notified map[string]string     // 告警ID -> 最近通知的状态
+	firing   map[string]AlertEvent // 触发中的告警，用于重复通知
+	lastSent map[string]time.Time
+}
+
+// alertDelivery 一次待发送的通知
+type alertDelivery struct {
+	event    AlertEvent
+	attempts int
+}
+
+// newAlertDispatcher 创建通知发送队列
+func newAlertDispatcher(name string, renotify time.Duration, maxRetries int, send func(AlertEvent) (bool, error)) *alertDispatcher {
+	return &alertDispatcher{
+		name:       name,
+		renotify:   renotify,
+		maxRetries: maxRetries,
+		send:       send,
+		notified:   make(map[string]string),
+		firing:     make(map[string]AlertEvent),
+		lastSent:   make(map[string]time.Time),
+	}
+}
+
+// Run 接收告警事件并按顺序发送，阻塞直到ctx被取消
+func (d *alertDispatcher) Run(ctx context.Context, events <-chan AlertEvent) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		var retry <-chan time.Time
+		if len(d.queue) > 0 {
+			retry = time.After(time.Until(d.nextTry))
+		}
+		select {
+		case <-ctx.Done():
+			if len(d.queue) > 0 {
+				log.Printf("退出时仍有 %d 条 %s 通知未发送", len(d.queue), d.name)
+			}
+			return
+		case event := <-events:
+			d.enqueue(event)
+		case now := <-ticker.C:
+			d.renotifyDue(now)
+		case <-retry:
+			d.deliver()
+		}
+	}
+}
+
+// enqueue 加入待发送队列，同一告警重复的状态只发送一次
+func (d *alertDispatcher) enqueue(event AlertEvent) {
+	id := event.Alert.ID
+	if d.notified[id] == event.Status {
+		return
+	}
+	d.notified[id] = event.Status
+	if event.Status == alertFiring {
+		d.firing[id] = event
+		d.lastSent[id] = event.Time
+	} else {
+		delete(d.firing, id)
+		delete(d.lastSent, id)
+		delete(d.notified, id)
+	}
+	if event.Status == alertSilenced {
+		return
+	}
+	d.push(event)
+}
+
+// renotifyDue 把持续触发超过重复通知间隔的告警再次加入队列
+func (d *alertDispatcher) renotifyDue(now time.Time) {
+	if d.renotify <= 0 {
+		return
+	}
+	for id, event := range d.firing {
+		if now.Sub(d.lastSent[id]) < d.renotify {
+			continue
+		}
+		d.lastSent[id] = now
+		event.Time, event.Repeat = now, true
+		d.push(event)
+	}
+}
+
+// push 加入队列，超出容量时丢弃最旧的通知
+func (d *alertDispatcher) push(event AlertEvent) {
+	if len(d.queue) == 0 {
+		d.nextTry = time.Now()
+	}
+	d.queue = append(d.queue, alertDelivery{event: event})
+	if len(d.queue) > alertQueueSize {
+		log.Printf("%s 通知队列已满，丢弃最旧的通知 %s", d.name, d.queue[0].event.Alert.ID)
+		d.queue = d.queue[1:]
+	}
+}
+
+// deliver 发送队首的通知
+func (d *alertDispatcher) deliver() {
+	item := &d.queue[0]
+	item.attempts++
+	retry, err := d.send(item.event)
+	if err == nil {
+		d.queue = d.queue[1:]
+		d.backoff = 0
+		d.nextTry = time.Now()
+		return
+	}
+	if !retry || item.attempts > d.maxRetries {
+		log.Printf("%s 通知 %s %s 发送失败，已放弃: %v", d.name, item.event.Status, item.event.Alert.ID, err)
+		d.queue = d.queue[1:]
+		d.backoff = 0
+		d.nextTry = time.Now()
+		return
+	}
+	if d.backoff == 0 {
+		d.backoff = outputMinBackoff
+	} else if d.backoff *= 2; d.backoff > outputMaxBackoff {
+		d.backoff = outputMaxBackoff
+	}
+	log.Printf("%s 通知发送失败，%s 后重试: %v", d.name, d.backoff, err)
+	d.nextTry = time.Now().Add(d.backoff)
+}
+
+// WebhookConfig Webhook 通知配置
+type WebhookConfig struct {
+	URL        string
+	Template   string
+	Headers    string
+	Secret     string
+	Renotify   time.Duration
+	MaxRetries int
+}
+
+// WebhookNotifier 以 POST 请求发送告警事件
+// 设置 Secret 时在 X-Sysmon-Signature 头中附带请求体的 HMAC-SHA256 签名: sha256=<十六进制>
+type WebhookNotifier struct {
+	config     WebhookConfig
+	url        string
+	headers    map[string]string
+	template   *texttemplate.Template
+	client     *http.Client
+	dispatcher *alertDispatcher
+}
+
+// NewWebhookNotifier 创建 Webhook 通知，模板文件中可使用 json 函数输出JSON
+func NewWebhookNotifier(config WebhookConfig) (*WebhookNotifier, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("不支持的协议 %q", u.Scheme)
+	}
+	headers, err := parseHeaders(config.Headers)
+	if err != nil {
+		return nil, err
+	}
+	n := &WebhookNotifier{
+		config:  config,
+		url:     u.String(),
+		headers: headers,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	n.dispatcher = newAlertDispatcher("Webhook", config.Renotify, config.MaxRetries, n.send)
+	if config.Template != "" {
+		data, err := os.ReadFile(config.Template)
+		if err != nil {
+			return nil, err
+		}
+		n.template, err = texttemplate.New("webhook").Funcs(texttemplate.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				data, err := json.Marshal(v)
+				return string(data), err
+			},
+			"time": formatTime,
+		}).Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("解析模板失败: %v", err)
+		}
+	}
+	return n, nil
+}
+
+// Run 接收告警事件并发送，阻塞直到ctx被取消
+func (n *WebhookNotifier) Run(ctx context.Context, events <-chan AlertEvent) {
+	log.Printf("Webhook 告警通知已启用: %s", redactURL(n.url))
+	n.dispatcher.Run(ctx, events)
+}
+
+// send 渲染并发送一条通知，返回失败时是否值得重试
+func (n *WebhookNotifier) send(event AlertEvent) (bool, error) {
+	var body bytes.Buffer
+	if n.template != nil {
+		if err := n.template.Execute(&body, event); err != nil {
+			return false, fmt.Errorf("渲染模板失败: %v", err)
+		}
+	} else if err := json.NewEncoder(&body).Encode(event); err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sysmon")
+	req.Header.Set("X-Sysmon-Event", event.Status)
+	// 自定义的头在默认头之后设置，模板输出非JSON时可以覆盖 Content-Type；签名头不可覆盖
+	for k, v := range n.headers {
+		req.Header.Set(k, v)
+	}
+	if n.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.config.Secret))
+		mac.Write(body.Bytes())
+		req.Header.Set("X-Sysmon-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// 4xx 通常是请求本身的问题，重试无意义（429除外）
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("HTTP %d", resp.StatusCode)
+}
+
+// SMTPConfig 邮件配置
+type SMTPConfig struct {
+	Addr       string
+	TLS        string // auto、starttls、tls、none
+	Username   string
+	Password   string
+	From       string
+	To         string // 逗号分隔的收件人
+	Insecure   bool
+	Renotify   time.Duration
+	MaxRetries int
+	ReportTime string // 每日报告的发送时间 HH:MM，为空时不发送
+}
+
+// smtpTimeout 一次邮件发送（连接、握手、传输）的最长时间
+const smtpTimeout = 30 * time.Second
+
+// Mailer 通过 SMTP 发送邮件，告警通知和每日报告共用
+type Mailer struct {
+	config SMTPConfig
+	host   string
+	to     []string
+}
+
+// NewMailer 校验配置并创建邮件发送器
+func NewMailer(config SMTPConfig) (*Mailer, error) {
+	host, _, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("无效的地址 %q: %v", config.Addr, err)
+	}
+	switch config.TLS {
+	case "auto", "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("不支持的加密方式 %q", config.TLS)
+	}
+	if config.From == "" {
+		return nil, fmt.Errorf("未指定发件人")
+	}
+	var to []string
+	for _, addr := range strings.Split(config.To, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	if len(to) == 0 {
+		return nil, fmt.Errorf("未指定收件人")
+	}
+	if config.ReportTime != "" {
+		if _, _, err := parseClock(config.ReportTime); err != nil {
+			return nil, fmt.Errorf("无效的报告时间 %q", config.ReportTime)
+		}
+	}
+	return &Mailer{config: config, host: host, to: to}, nil
+}
+
+// Send 发送一封邮件，contentType 如 text/plain、text/html
+// 返回失败时是否值得重试：服务器返回5xx永久错误时重试无意义
+func (m *Mailer) Send(subject, contentType string, body []byte) (bool, error) {
+	conn, err := net.DialTimeout("tcp", m.config.Addr, 10*time.Second)
+	if err != nil {
+		return true, err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	tlsConfig := &tls.Config{ServerName: m.host, InsecureSkipVerify: m.config.Insecure}
+	if m.config.TLS == "tls" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return smtpRetryable(err), err
+	}
+	defer c.Close()
+
+	if err := c.Hello(hostname()); err != nil {
+		return smtpRetryable(err), err
+	}
+	if m.config.TLS == "auto" || m.config.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return true, fmt.Errorf("STARTTLS 失败: %v", err)
+			}
+		} else if m.config.TLS == "starttls" {
+			return false, fmt.Errorf("服务器不支持 STARTTLS")
+		}
+	}
+	// PlainAuth 只允许在加密连接或本机连接上发送密码
+	if m.config.Username != "" {
+		auth := smtp.PlainAuth("", m.config.Username, m.config.Password, m.host)
+		if err := c.Auth(auth); err != nil {
+			return smtpRetryable(err), fmt.Errorf("认证失败: %v", err)
+		}
+	}
+	if err := c.Mail(m.config.From); err != nil {
+		return smtpRetryable(err), err
+	}
+	for _, addr := range m.to {
+		if err := c.Rcpt(addr); err != nil {
+			return smtpRetryable(err), fmt.Errorf("收件人 %s: %v", addr, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return smtpRetryable(err), err
+	}
+	if _, err := w.Write(m.message(subject, contentType, body)); err != nil {
+		return true, err
+	}
+	if err := w.Close(); err != nil {
+		return smtpRetryable(err), err
+	}
+	c.Quit()
+	return false, nil
+}
+
+// message 组装邮件，正文使用base64编码以兼容任意字符
+func (m *Mailer) message(subject, contentType string, body []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.config.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%d.sysmon@%s>\r\n", time.Now().UnixNano(), hostname())
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: %s; charset=utf-8\r\n", contentType)
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString(body)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return buf.Bytes()
+}
+
+// smtpRetryable 判断SMTP错误是否值得重试，5xx为永久错误
+func smtpRetryable(err error) bool {
+	var perr *textproto.Error
+	if errors.As(err, &perr) {
+		return perr.Code < 500
+	}
+	return true
+}
+
+// parseClock 解析 08:00 这样的时刻
+func parseClock(s string) (int, int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, err
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// SMTPNotifier 以邮件发送告警事件
+type SMTPNotifier struct {
+	mailer     *Mailer
+	dispatcher *alertDispatcher
+}
+
+// NewSMTPNotifier 创建邮件告警通知
+func NewSMTPNotifier(mailer *Mailer, config SMTPConfig) *SMTPNotifier {
+	n := &SMTPNotifier{mailer: mailer}
+	n.dispatcher = newAlertDispatcher("邮件", config.Renotify, config.MaxRetries, n.send)
+	return n
+}
+
+// Run 接收告警事件并发送，阻塞直到ctx被取消
+func (n *SMTPNotifier) Run(ctx context.Context, events <-chan AlertEvent) {
+	log.Printf("邮件告警通知已启用: %s -> %s", n.mailer.config.Addr, strings.Join(n.mailer.to, ", "))
+	n.dispatcher.Run(ctx, events)
+}
+
+// send 发送一封告警邮件
+func (n *SMTPNotifier) send(event AlertEvent) (bool, error) {
+	a := event.Alert
+	state := strings.ToUpper(event.Status)
+	if event.Repeat {
+		state += " 持续中"
+	}
+	subject := fmt.Sprintf("[sysmon] [%s] %s %s @ %s", state, a.Severity, a.ID, event.Host)
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "告警: %s\n", a.ID)
+	fmt.Fprintf(&body, "状态: %s\n", event.Status)
+	fmt.Fprintf(&body, "主机: %s\n", event.Host)
+	fmt.Fprintf(&body, "级别: %s\n", a.Severity)
+	fmt.Fprintf(&body, "规则: %s\n", a.Expr)
+	fmt.Fprintf(&body, "当前值: %.2f（阈值 %.2f）\n", a.Value, a.Threshold)
+	if len(a.Labels) > 0 {
+		keys := make([]string, 0, len(a.Labels))
+		for k := range a.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&body, "标签: %s=%s\n", k, a.Labels[k])
+		}
+	}
+	if a.FiredAt != "" {
+		fmt.Fprintf(&body, "触发时间: %s\n", a.FiredAt)
+	}
+	if a.ResolvedAt != "" {
+		fmt.Fprintf(&body, "恢复时间: %s\n", a.ResolvedAt)
+	}
+	fmt.Fprintf(&body, "通知时间: %s\n", formatTime(event.Time))
+	return n.mailer.Send(subject, "text/plain", body.Bytes())
+}
+
+// reportTmpl 每日报告模板
+var reportTmpl = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+}).Parse(reportTemplate))
+
+// reportMetrics 每日报告中统计的指标
+var reportMetrics = []struct {
+	metric string
+	name   string
+	format func(float64) string
+}{
+	{"cpu_usage", "CPU 使用率", formatReportPercent},
+	{"mem_usage", "内存使用率", formatReportPercent},
+	{"disk_usage", "磁盘使用率", formatReportPercent},
+	{"receive_speed", "下载速度", formatReportSpeed},
+	{"transmit_speed", "上传速度", formatReportSpeed},
+}
+
+// ReportRow 报告中一个指标的统计
+type ReportRow struct {
+	Name string
+	Min  string
+	Avg  string
+	Max  string
+}
+
+// ReportTraffic 报告中一个网卡的流量
+type ReportTraffic struct {
+	Interface string
+	Rx        uint64
+	Tx        uint64
+	Total     uint64
+}
+
+// ReportData 每日报告模板的数据
+type ReportData struct {
+	Host    string
+	From    string
+	To      string
+	Metrics []ReportRow
+	Traffic []ReportTraffic
+	Alerts  []AlertStatus
+}
+
+// formatReportPercent 格式化百分比
+func formatReportPercent(v float64) string {
+	return fmt.Sprintf("%.1f%%", v)
+}
+
+// formatReportSpeed 格式化以KB/s记录的速度
+func formatReportSpeed(v float64) string {
+	return formatBytes(uint64(v*1024)) + "/s"
+}
+
+// buildReport 统计截至now的24小时内各指标的最小/平均/最大值和各网卡流量
+// 平均值为各小时平均值的平均；流量按小时统计，包含起点所在的整小时
+func (em *EnhancedMonitor) buildReport(now time.Time) ReportData {
+	from := now.Add(-24 * time.Hour)
+	data := ReportData{Host: hostname(), From: formatTime(from), To: formatTime(now)}
+
+	for _, rm := range reportMetrics {
+		row := ReportRow{Name: rm.name, Min: "-", Avg: "-", Max: "-"}
+		points, _, _ := em.queryHistory(rm.metric, from, now, time.Hour)
+		if len(points) > 0 {
+			min, max, sum := points[0].Min, points[0].Max, 0.0
+			for _, p := range points {
+				min = math.Min(min, p.Min)
+				max = math.Max(max, p.Max)
+				sum += p.Avg
+			}
+			row.Min, row.Avg, row.Max = rm.format(min), rm.format(sum/float64(len(points))), rm.format(max)
+		}
+		data.Metrics = append(data.Metrics, row)
+	}
+
+	for _, report := range em.monitor.traffic.Reports(now) {
+		t := ReportTraffic{Interface: report.Interface}
+		for _, c := range report.Hours {
+			if c.Start+3600 <= from.Unix() {
+				continue
+			}
+			t.Rx += c.Rx
+			t.Tx += c.Tx
+		}
+		t.Total = t.Rx + t.Tx
+		data.Traffic = append(data.Traffic, t)
+	}
+
+	if em.alerts != nil {
+		for _, a := range em.alerts.Alerts() {
+			if a.State == alertFiring {
+				data.Alerts = append(data.Alerts, a)
+			}
+		}
+	}
+	return data
+}
+
+// sendReport 生成并发送每日报告
+func (em *EnhancedMonitor) sendReport(now time.Time) error {
+	var body bytes.Buffer
+	if err := reportTmpl.Execute(&body, em.buildReport(now)); err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("[sysmon] %s 每日报告 %s", hostname(), now.In(displayZone).Format("2006-01-02"))
+	_, err := em.mailer.Send(subject, "text/html", body.Bytes())
+	return err
+}
+
+// runDailyReport 每天在 ReportTime 发送报告，直到ctx被取消
+// 发送失败时只记录日志，可以通过 POST /api/report 手动补发
+func (em *EnhancedMonitor) runDailyReport(ctx context.Context) {
+	hour, minute, _ := parseClock(em.config.SMTP.ReportTime)
+	log.Printf("每日报告将在每天 %s 发送", em.config.SMTP.ReportTime)
+	for {
+		now := time.Now().In(displayZone)
+		next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, displayZone)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := em.sendReport(time.Now()); err != nil {
+			log.Printf("发送每日报告失败: %v", err)
+		} else {
+			log.Printf("每日报告已发送")
+		}
+	}
+}
+
+// handleReport 处理 /api/report 请求：GET 预览报告，POST 立即发送
+func (em *EnhancedMonitor) handleReport(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		reportTmpl.Execute(w, em.buildReport(time.Now()))
+	case http.MethodPost:
+		if em.mailer == nil {
+			http.Error(w, "SMTP not configured", http.StatusServiceUnavailable)
+			return
+		}
+		if err := em.sendReport(time.Now()); err != nil {
+			log.Printf("发送每日报告失败: %v", err)
+			http.Error(w, "Failed to send report", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// 容量预测状态
+const (
+	forecastGrowing      = "growing"
+	forecastStable       = "stable"
+	forecastInsufficient = "insufficient_data"
+)
+
+// forecastInterval 重新计算容量预测的间隔
+const forecastInterval = time.Minute
+
+// forecastBuckets 拟合前把预测窗口内的历史降采样为多少个点
+const forecastBuckets = 120
+
+// Forecast 一项资源按使用量线性趋势预测的写满时间
+type Forecast struct {
+	Resource      string            `json:"resource"` // disk、memory、swap
+	Labels        map[string]string `json:"labels,omitempty"`
+	Status        string            `json:"status"`
+	UsedBytes     float64           `json:"used_bytes"`
+	TotalBytes    float64           `json:"total_bytes"`
+	GrowthPerHour float64           `json:"growth_bytes_per_hour"`
+	SecondsToFull float64           `json:"seconds_to_full,omitempty"`
+	FullAt        string            `json:"full_at,omitempty"`
+	FullIn        string            `json:"full_in,omitempty"`
+	Samples       int               `json:"samples"`
+}
+
+// Forecaster 保存最近一次的容量预测结果
+type Forecaster struct {
+	window time.Duration
+
+	mu        sync.RWMutex
+	forecasts []Forecast
+	updated   time.Time
+}
+
+// Forecasts 返回最近一次的预测结果和计算时间
+func (f *Forecaster) Forecasts() ([]Forecast, time.Time) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.forecasts, f.updated
+}
+
+// mountValues 各挂载点的已用空间（GB），键如 disk_used_space{mount="/"}，记录到历史中用于容量预测
+func (m *Monitor) mountValues() map[string]float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	values := make(map[string]float64, len(m.diskMounts))
+	for _, d := range m.diskMounts {
+		values[mountMetric(d.Mount)] = float64(d.Used) / 1024 / 1024
+	}
+	return values
+}
+
+// mountMetric 挂载点已用空间在历史中的指标名
+func mountMetric(mount string) string {
+	var b strings.Builder
+	b.WriteString("disk_used_space")
+	writeLabels(&b, map[string]string{"mount": mount})
+	return b.String()
+}
+
+// runForecasts 采集就绪后每 forecastInterval 重新计算一次预测，直到ctx被取消
+// 预测窗口较短时改为每个降采样间隔计算一次
+func (em *EnhancedMonitor) runForecasts(ctx context.Context) {
+	interval := forecastInterval
+	if step := em.forecast.window / forecastBuckets; step < interval {
+		interval = step
+	}
+	if interval < em.config.Interval {
+		interval = em.config.Interval
+	}
+	for {
+		delay := interval
+		if em.scheduler.Ready() {
+			forecasts := em.computeForecasts(time.Now())
+			em.forecast.mu.Lock()
+			em.forecast.forecasts, em.forecast.updated = forecasts, time.Now()
+			em.forecast.mu.Unlock()
+		} else {
+			delay = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// computeForecasts 对各挂载点、内存和SWAP的使用量做线性回归，按当前使用量和增长速度估算写满时间
+func (em *EnhancedMonitor) computeForecasts(now time.Time) []Forecast {
+	window := em.forecast.window
+	from := now.Add(-window)
+	step := window / forecastBuckets
+	if step < em.config.Interval {
+		step = em.config.Interval
+	}
+
+	m := em.monitor
+	m.mu.RLock()
+	memUsed, memTotal := float64(m.memInfo["used"])*1024, float64(m.memInfo["total"])*1024
+	swapUsed, swapTotal := float64(m.swapInfo["used"])*1024, float64(m.swapInfo["total"])*1024
+	mounts := append([]DiskMount(nil), m.diskMounts...)
+	m.mu.RUnlock()
+
+	var forecasts []Forecast
+	// scale 为历史记录的单位换算为字节的倍数
+	add := func(resource, metric string, scale, used, total float64, labels map[string]string) {
+		f := Forecast{Resource: resource, Labels: labels, Status: forecastInsufficient, UsedBytes: used, TotalBytes: total}
+		points, _, _ := em.queryHistory(metric, from, now, step)
+		f.Samples = len(points)
+		slope, ok := linearTrend(points, window/10)
+		if ok {
+			f.GrowthPerHour = slope * scale * 3600
+			f.Status = forecastStable
+			if slope > 0 && total > used {
+				seconds := (total - used) / (slope * scale)
+				f.Status = forecastGrowing
+				f.SecondsToFull = math.Round(seconds)
+				f.FullAt = formatTime(now.Add(time.Duration(seconds * float64(time.Second))))
+				f.FullIn = formatETA(time.Duration(seconds * float64(time.Second)))
+			}
+		}
+		forecasts = append(forecasts, f)
+	}
+
+	for _, d := range mounts {
+		add("disk", mountMetric(d.Mount), 1024*1024*1024, float64(d.Used)*1024, float64(d.Used+d.Available)*1024,
+			map[string]string{"device": d.Device, "mount": d.Mount})
+	}
+	if memTotal > 0 {
+		add("memory", "mem_used_space", 1024*1024, memUsed, memTotal, nil)
+	}
+	if swapTotal > 0 {
+		add("swap", "swap_used_space", 1024*1024, swapUsed, swapTotal, nil)
+	}
+	return forecasts
+}
+
+// linearTrend 用最小二乘法拟合各时间桶的平均值，返回每秒的变化量
+// 样本少于5个或覆盖时间短于minSpan时返回false
+func linearTrend(points []HistoryPoint, minSpan time.Duration) (float64, bool) {
+	if len(points) < 5 || time.Duration(points[len(points)-1].Time-points[0].Time)*time.Second < minSpan {
+		return 0, false
+	}
+	t0 := points[0].Time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, p := range points {
+		x := float64(p.Time - t0)
+		sumX += x
+		sumY += p.Avg
+		sumXY += x * p.Avg
+		sumXX += x * x
+	}
+	n := float64(len(points))
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denom, true
+}
+
+// formatETA 把剩余时间格式化为 3d 4h、5h 20m 或 12m
+func formatETA(d time.Duration) string {
+	minutes := int64(d / time.Minute)
+	days, hours := minutes/1440, minutes%1440/60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes%60)
+	case minutes > 0:
+		return fmt.Sprintf("%dm", minutes)
+	}
+	return "<1m"
+}
+
+// forecastPoints 把预测的写满时间作为指标输出，供 /metrics、推送输出和告警规则使用
+func (em *EnhancedMonitor) forecastPoints() []MetricPoint {
+	if em.forecast == nil {
+		return nil
+	}
+	forecasts, _ := em.forecast.Forecasts()
+	var points []MetricPoint
+	for _, f := range forecasts {
+		if f.Status != forecastGrowing {
+			continue
+		}
+		points = append(points, MetricPoint{Name: f.Resource + "_time_to_full_seconds", Labels: f.Labels, Value: f.SecondsToFull})
+	}
+	return points
+}
+
+// handleForecast 处理 /api/forecast 请求，返回各挂载点、内存和SWAP的写满时间预测
+func (em *EnhancedMonitor) handleForecast(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{"forecasts": []Forecast{}}
+	if em.forecast != nil {
+		forecasts, updated := em.forecast.Forecasts()
+		if forecasts != nil {
+			response["forecasts"] = forecasts
+		}
+		response["window"] = em.forecast.window.String()
+		if !updated.IsZero() {
+			response["updated"] = formatTime(updated)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// AnomalyConfig 异常检测配置
+type AnomalyConfig struct {
+	Enabled   bool
+	Threshold float64       // 偏离预期值多少个标准差视为异常
+	HalfLife  time.Duration // EWMA 的半衰期
+	Seasonal  bool          // 按一天中的小时（displayZone）分别建立基线
+}
+
+// anomalyMetrics 参与异常检测的指标（/api/stats 的字段名）和标准差下限
+// 数值长期几乎不变时标准差接近0，微小的波动也会得到很大的z分数，因此设一个下限
+var anomalyMetrics = []struct {
+	name      string
+	minStdDev float64
+}{
+	{"cpu_usage", 2},
+	{"last1", 0.1},
+	{"receive_speed", 10},
+	{"transmit_speed", 10},
+	{"disk_read_speed", 10},
+	{"disk_write_speed", 10},
+}
+
+// anomalyWarmup 基线至少包含多少个样本后才开始判断异常
+const anomalyWarmup = 60
+
+// anomalySaveInterval 基线写盘的间隔
+const anomalySaveInterval = 10 * time.Minute
+
+// ewmaState 指数加权的均值和方差
+type ewmaState struct {
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+	Count    int     `json:"count"`
+}
+
+// update 加入一个样本；样本较少时按算术平均更新，避免基线长时间停留在第一个样本附近
+func (s *ewmaState) update(x, alpha float64) {
+	s.Count++
+	if a := 1 / float64(s.Count); a > alpha {
+		alpha = a
+	}
+	diff := x - s.Mean
+	incr := alpha * diff
+	s.Mean += incr
+	s.Variance = (1 - alpha) * (s.Variance + diff*incr)
+}
+
+// AnomalyStatus 一个指标最近一次的异常检测结果
+type AnomalyStatus struct {
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Expected  float64 `json:"expected"`
+	StdDev    float64 `json:"stddev"`
+	Lower     float64 `json:"lower"`
+	Upper     float64 `json:"upper"`
+	ZScore    float64 `json:"zscore"`
+	Anomalous bool    `json:"anomalous"`
+	Ready     bool    `json:"ready"`
+	Samples   int     `json:"samples"`
+}
+
+// anomalyFile 基线的持久化格式，季节模式改变后旧基线作废
+type anomalyFile struct {
+	Seasonal bool                    `json:"seasonal"`
+	States   map[string][]*ewmaState `json:"states"`
+}
+
+// AnomalyDetector 用 EWMA 跟踪各指标的均值和标准差，样本偏离均值超过 Threshold 个标准差时视为异常
+// 季节模式下每个小时有独立的基线，只用该小时的样本更新，半衰期按该小时累计的样本时间计算，
+// 因此基线反映的是最近几天同一时段的情况
+type AnomalyDetector struct {
+	config   AnomalyConfig
+	interval time.Duration
+	path     string
+
+	mu       sync.Mutex
+	states   map[string][]*ewmaState
+	status   map[string]AnomalyStatus
+	lastSave time.Time
+}
+
+// NewAnomalyDetector 创建异常检测，配置了数据目录时从 anomaly.json 恢复基线
+func NewAnomalyDetector(config Config) *AnomalyDetector {
+	d := &AnomalyDetector{
+		config:   config.Anomaly,
+		interval: config.Interval,
+		states:   make(map[string][]*ewmaState),
+		status:   make(map[string]AnomalyStatus),
+		lastSave: time.Now(),
+	}
+	if config.DataDir == "" {
+		return d
+	}
+	d.path = filepath.Join(config.DataDir, "anomaly.json")
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取异常检测基线失败: %v", err)
+		}
+		return d
+	}
+	var saved anomalyFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("异常检测基线文件损坏，重新建立基线: %v", err)
+		return d
+	}
+	if saved.Seasonal == d.config.Seasonal && saved.States != nil {
+		d.states = saved.States
+	}
+	return d
+}
+
+// alpha 每个样本的 EWMA 权重，由半衰期和记录间隔换算
+func (d *AnomalyDetector) alpha() float64 {
+	return 1 - math.Pow(0.5, d.interval.Seconds()/d.config.HalfLife.Seconds())
+}
+
+// state 返回指标在t时使用的基线，调用方需持有 d.mu
+func (d *AnomalyDetector) state(metric string, t time.Time) *ewmaState {
+	states := d.states[metric]
+	n := 1
+	if d.config.Seasonal {
+		n = 24
+	}
+	if len(states) != n {
+		states = make([]*ewmaState, n)
+		d.states[metric] = states
+	}
+	i := 0
+	if d.config.Seasonal {
+		i = t.In(displayZone).Hour()
+	}
+	if states[i] == nil {
+		states[i] = &ewmaState{}
+	}
+	return states[i]
+}
+
+// Observe 用当前样本和更新前的基线比较，再把样本加入基线
+// 返回各指标的预期范围，键如 anomaly_lower{metric="cpu_usage"}，记录到历史中用于在图表上画出范围
+func (d *AnomalyDetector) Observe(now time.Time, values map[string]float64) map[string]float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	bands := make(map[string]float64)
+	alpha := d.alpha()
+	for _, am := range anomalyMetrics {
+		x, ok := values[am.name]
+		if !ok {
+			continue
+		}
+		s := d.state(am.name, now)
+		status := AnomalyStatus{Metric: am.name, Value: x, Samples: s.Count}
+		if s.Count >= anomalyWarmup {
+			std := math.Max(math.Sqrt(s.Variance), am.minStdDev)
+			status.Ready = true
+			status.Expected, status.StdDev = s.Mean, std
+			status.Lower = math.Max(s.Mean-d.config.Threshold*std, 0)
+			status.Upper = s.Mean + d.config.Threshold*std
+			status.ZScore = (x - s.Mean) / std
+			status.Anomalous = math.Abs(status.ZScore) > d.config.Threshold
+			labels := map[string]string{"metric": am.name}
+			bands[anomalySeries("anomaly_lower", labels)] = status.Lower
+			bands[anomalySeries("anomaly_upper", labels)] = status.Upper
+		}
+		prev := d.status[am.name]
+		if status.Anomalous && !prev.Anomalous {
+			log.Printf("检测到异常: %s 当前值 %.2f，预期 %.2f ± %.2f", am.name, x, status.Expected, d.config.Threshold*status.StdDev)
+		}
+		s.update(x, alpha)
+		d.status[am.name] = status
+	}
+
+	if d.path != "" && now.Sub(d.lastSave) >= anomalySaveInterval {
+		if err := d.saveLocked(); err != nil {
+			log.Printf("保存异常检测基线失败: %v", err)
+		}
+	}
+	return bands
+}
+
+// anomalySeries 带标签的历史指标名
+func anomalySeries(name string, labels map[string]string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	writeLabels(&b, labels)
+	return b.String()
+}
+
+// Status 返回各指标最近一次的检测结果，按 anomalyMetrics 的顺序排列
+func (d *AnomalyDetector) Status() []AnomalyStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	statuses := []AnomalyStatus{}
+	for _, am := range anomalyMetrics {
+		if status, ok := d.status[am.name]; ok {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// points 以指标输出z分数和是否异常，供 /metrics、推送输出和告警规则使用
+func (d *AnomalyDetector) points() []MetricPoint {
+	var points []MetricPoint
+	for _, status := range d.Status() {
+		if !status.Ready {
+			continue
+		}
+		labels := map[string]string{"metric": status.Metric}
+		detected := 0.0
+		if status.Anomalous {
+			detected = 1
+		}
+		points = append(points,
+			MetricPoint{Name: "anomaly_zscore", Labels: labels, Value: status.ZScore},
+			MetricPoint{Name: "anomaly_detected", Labels: labels, Value: detected},
+		)
+	}
+	return points
+}
+
+// Save 把基线写入数据目录
+func (d *AnomalyDetector) Save() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.saveLocked()
+}
+
+// saveLocked 写入基线，调用方需持有 d.mu
+func (d *AnomalyDetector) saveLocked() error {
+	if d.path == "" {
+		return nil
+	}
+	d.lastSave = time.Now()
+	data, err := json.Marshal(anomalyFile{Seasonal: d.config.Seasonal, States: d.states})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.path, data)
+}
+
+// handleAnomalies 处理 /api/anomalies 请求，返回异常检测的配置和各指标最近一次的检测结果
+func (em *EnhancedMonitor) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{"enabled": em.anomaly != nil, "metrics": []AnomalyStatus{}}
+	if em.anomaly != nil {
+		response["threshold"] = em.anomaly.config.Threshold
+		response["halflife"] = em.anomaly.config.HalfLife.String()
+		response["seasonal"] = em.anomaly.config.Seasonal
+		response["metrics"] = em.anomaly.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HubConfig 多主机汇总配置
+// 作为 hub 时接收各实例推送的状态，也可以定期拉取它们的 /api/fleet/self；
+// URL 不为空时本机作为 agent，定期把状态推送到 hub。同一个实例可以同时是 hub 和 agent
+type HubConfig struct {
+	Enabled      bool
+	Pull         string        // hub 主动拉取的实例地址，逗号分隔
+	PullInterval time.Duration // 拉取间隔
+	OfflineAfter time.Duration // 超过这个时间没有收到数据视为离线
+	URL          string        // agent: hub 地址
+	Name         string        // agent: 上报的主机名，为空时使用本机主机名
+	Advertise    string        // agent: 本机面板地址，为空时由 hub 按来源地址和 Port 推断
+	Interval     time.Duration // agent: 推送间隔
+
+	EnrollSecret   string // hub: agent 注册时使用的共享密钥，为空时不开放注册
+	ClientCA       string // hub: 校验 agent 客户端证书的CA
+	CAKey          string // hub: ClientCA 的私钥，设置后注册时为 agent 签发客户端证书
+	AllowAnonymous bool   // hub: 接受未认证的推送
+	CA             string // 校验 hub 或被拉取实例的服务器证书的CA，为空时使用系统CA
+	Cert           string // 连接 hub 或被拉取实例时使用的客户端证书
+	Key            string
+	Token          string // agent: 预先分配的令牌
+	Join           string // agent: 注册密钥，没有令牌时用它向 hub 注册
+	PullToken      string // hub: 拉取启用了认证的实例时使用的令牌
+}
+
+// fleetCheckInterval hub 检查离线主机和更新本机状态的间隔
+const fleetCheckInterval = 5 * time.Second
+
+// fleetMaxReport 单次上报请求体的最大字节数
+const fleetMaxReport = 1 << 20
+
+// FleetReport 一个实例的状态摘要，agent 推送和 hub 拉取使用同一格式
+type FleetReport struct {
+	Host      string      `json:"host"`
+	URL       string      `json:"url,omitempty"`
+	Port      int         `json:"port"`
+	Interface string      `json:"interface"`
+	Health    string      `json:"health"`
+	Alerts    int         `json:"alerts"` // 触发中的告警数
+	Stats     SystemStats `json:"stats"`
+}
+
+// FleetHost /api/fleet 返回的主机状态，离线主机保留最后一次上报的数据
+type FleetHost struct {
+	Host      string       `json:"host"`
+	URL       string       `json:"url,omitempty"`
+	Source    string       `json:"source"` // local、push 或 pull
+	Online    bool         `json:"online"`
+	LastSeen  string       `json:"last_seen,omitempty"`
+	Interface string       `json:"interface,omitempty"`
+	Health    string       `json:"health,omitempty"`
+	Alerts    int          `json:"alerts"`
+	Stats     *SystemStats `json:"stats,omitempty"`
+	Error     string       `json:"error,omitempty"` // 最近一次拉取失败的原因
+}
+
+// fleetEntry hub 记录的一台主机
+type fleetEntry struct {
+	Report   FleetReport `json:"report"`
+	Source   string      `json:"source"`
+	LastSeen time.Time   `json:"last_seen"`
+	Error    string      `json:"error,omitempty"`
+	online   bool
+}
+
+// Fleet hub 记录的所有主机，配置了数据目录时主机列表保存在 fleet.json，重启后离线主机仍会列出
+type Fleet struct {
+	offlineAfter time.Duration
+	targets      []string // 拉取地址
+	path         string
+
+	mu    sync.Mutex
+	hosts map[string]*fleetEntry
+}
+
+// NewFleet 创建 hub 的主机列表并校验拉取地址
+func NewFleet(config Config) (*Fleet, error) {
+	if config.Hub.OfflineAfter <= 0 {
+		return nil, fmt.Errorf("离线判定时间必须大于0")
+	}
+	f := &Fleet{
+		offlineAfter: config.Hub.OfflineAfter,
+		hosts:        make(map[string]*fleetEntry),
+	}
+	for _, target := range strings.Split(config.Hub.Pull, ",") {
+		target = strings.TrimRight(strings.TrimSpace(target), "/")
+		if target == "" {
+			continue
+		}
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("无效的拉取地址 %q", target)
+		}
+		f.targets = append(f.targets, target)
+	}
+	if len(f.targets) > 0 && config.Hub.PullInterval <= 0 {
+		return nil, fmt.Errorf("拉取间隔必须大于0")
+	}
+
+	if config.DataDir == "" {
+		return f, nil
+	}
+	f.path = filepath.Join(config.DataDir, "fleet.json")
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取主机列表失败: %v", err)
+		}
+		return f, nil
+	}
+	if err := json.Unmarshal(data, &f.hosts); err != nil || f.hosts == nil {
+		log.Printf("主机列表文件损坏，已忽略: %v", err)
+		f.hosts = make(map[string]*fleetEntry)
+	}
+	now := time.Now()
+	for _, e := range f.hosts {
+		e.online = now.Sub(e.LastSeen) < f.offlineAfter
+	}
+	return f, nil
+}
+
+// validateHubAgent 校验 agent 的 hub 配置
+func validateHubAgent(config HubConfig) error {
+	for _, s := range []string{config.URL, config.Advertise} {
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("无效的地址 %q", s)
+		}
+	}
+	if config.Name != "" && !validFleetHost(config.Name) {
+		return fmt.Errorf("无效的主机名 %q", config.Name)
+	}
+	if config.Interval <= 0 {
+		return fmt.Errorf("推送间隔必须大于0")
+	}
+	return nil
+}
+
+// validFleetHost 主机名只能包含字母、数字和 .-_，最长253个字符
+func validFleetHost(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// validFleetURL 面板地址只能是带主机名的 http/https 地址，防止总览页面中出现 javascript: 等链接
+func validFleetURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Update 记录一台主机的最新状态
+func (f *Fleet) Update(report FleetReport, source string, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.hosts[report.Host]
+	switch {
+	case !ok:
+		log.Printf("新主机加入: %s (%s)", report.Host, source)
+		e = &fleetEntry{}
+		f.hosts[report.Host] = e
+	case !e.online:
+		log.Printf("主机 %s 恢复在线", report.Host)
+	}
+	e.Report, e.Source, e.LastSeen, e.Error, e.online = report, source, now, "", true
+	if !ok {
+		if err := f.saveLocked(); err != nil {
+			log.Printf("保存主机列表失败: %v", err)
+		}
+	}
+}
+
+// Fail 记录一次拉取失败，从未拉取成功的主机以拉取地址中的主机名列出
+func (f *Fleet) Fail(host, target string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.hosts[host]
+	if !ok {
+		e = &fleetEntry{Report: FleetReport{Host: host, URL: target}, Source: "pull"}
+		f.hosts[host] = e
+	}
+	e.Error = err.Error()
+}
+
+// Remove 从列表中移除主机，主机再次上报时会重新加入
+func (f *Fleet) Remove(host string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.hosts[host]; !ok {
+		return false
+	}
+	delete(f.hosts, host)
+	if err := f.saveLocked(); err != nil {
+		log.Printf("保存主机列表失败: %v", err)
+	}
+	return true
+}
+
+// Check 把超过 offlineAfter 没有数据的主机标记为离线
+func (f *Fleet) Check(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for host, e := range f.hosts {
+		if e.online && now.Sub(e.LastSeen) >= f.offlineAfter {
+			e.online = false
+			log.Printf("主机 %s 已离线（%s 未收到数据）", host, f.offlineAfter)
+		}
+	}
+}
+
+// Hosts 返回按主机名排序的主机列表
+func (f *Fleet) Hosts() []FleetHost {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hosts := make([]FleetHost, 0, len(f.hosts))
+	for _, e := range f.hosts {
+		h := FleetHost{
+			Host:      e.Report.Host,
+			URL:       e.Report.URL,
+			Source:    e.Source,
+			Online:    e.online,
+			LastSeen:  formatTime(e.LastSeen),
+			Interface: e.Report.Interface,
+			Health:    e.Report.Health,
+			Alerts:    e.Report.Alerts,
+			Error:     e.Error,
+		}
+		if !e.LastSeen.IsZero() {
+			stats := e.Report.Stats
+			h.Stats = &stats
+		}
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	return hosts
+}
+
+// points 以 fleet_host_up 指标输出各主机是否在线，可用于离线告警
+func (f *Fleet) points() []MetricPoint {
+	var points []MetricPoint
+	for _, h := range f.Hosts() {
+		up := 0.0
+		if h.Online {
+			up = 1
+		}
+		points = append(points, MetricPoint{Name: "fleet_host_up", Labels: map[string]string{"host": h.Host}, Value: up})
+	}
+	return points
+}
+
+// Save 把主机列表写入数据目录
+func (f *Fleet) Save() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.saveLocked()
+}
+
+// saveLocked 写入主机列表，调用方需持有 f.mu
+func (f *Fleet) saveLocked() error {
+	if f.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(f.hosts)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data)
+}
+
+// selfReport 本机的状态摘要
+func (em *EnhancedMonitor) selfReport() FleetReport {
+	report := FleetReport{
+		Host:      em.config.Hub.Name,
+		URL:       em.config.Hub.Advertise,
+		Port:      em.config.Port,
+		Interface: getSelectedInterface(),
+		Health:    "ok",
+		Stats:     em.monitor.snapshot(),
+	}
+	if report.Host == "" {
+		report.Host = hostname()
+	}
+	for _, c := range em.scheduler.Health() {
+		if !c.Healthy {
+			report.Health = "degraded"
+			break
+		}
+	}
+	if em.alerts != nil {
+		for _, a := range em.alerts.Alerts() {
+			if a.State == alertFiring {
+				report.Alerts++
+			}
+		}
+	}
+	return report
+}
+
+// runFleet hub 定期更新本机状态并检查离线主机
+func (em *EnhancedMonitor) runFleet(ctx context.Context) {
+	log.Printf("hub 模式已启用，主机总览: /fleet")
+	ticker := time.NewTicker(fleetCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if em.scheduler.Ready() {
+				report := em.selfReport()
+				report.URL = "/"
+				em.fleet.Update(report, "local", now)
+			}
+			em.fleet.Check(now)
+		}
+	}
+}
+
+// pullFleet hub 定期并发拉取各实例的 /api/fleet/self
+func (em *EnhancedMonitor) pullFleet(ctx context.Context) {
+	if len(em.fleet.targets) == 0 {
+		return
+	}
+	log.Printf("hub 将每 %s 拉取 %d 个实例", em.config.Hub.PullInterval, len(em.fleet.targets))
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = em.hubTLS
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	// 拉取地址到上报主机名的映射，拉取失败时更新对应的主机
+	names := make(map[string]string)
+	var mu sync.Mutex
+
+	pull := func(target string) {
+		report, err := fetchFleetReport(ctx, client, target, em.config.Hub.PullToken)
+		mu.Lock()
+		name, known := names[target]
+		if !known {
+			u, _ := url.Parse(target)
+			name = u.Host
+		}
+		if err == nil && report.Host != name {
+			// 首次拉取成功前以地址中的主机名占位，拿到真实主机名后去掉占位
+			if !known {
+				em.fleet.Remove(name)
+			}
+			names[target] = report.Host
+		}
+		mu.Unlock()
+
+		if err != nil {
+			if ctx.Err() == nil {
+				em.fleet.Fail(name, target, err)
+			}
+			return
+		}
+		if report.URL == "" {
+			report.URL = target
+		}
+		em.fleet.Update(report, "pull", time.Now())
+	}
+
+	ticker := time.NewTicker(em.config.Hub.PullInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, target := range em.fleet.targets {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				pull(target)
+			}(target)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchFleetReport 拉取一个实例的状态摘要，返回的面板地址无效时清空，由调用方改用拉取地址
+func fetchFleetReport(ctx context.Context, client *http.Client, target, token string) (FleetReport, error) {
+	var report FleetReport
+	req, err := http.NewRequest("GET", target+"/api/fleet/self", nil)
+	if err != nil {
+		return report, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return report, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return report, fmt.Errorf("%s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, fleetMaxReport)).Decode(&report); err != nil {
+		return report, fmt.Errorf("解析响应失败: %v", err)
+	}
+	if !validFleetHost(report.Host) {
+		return report, fmt.Errorf("无效的主机名 %q", report.Host)
+	}
+	if report.URL != "" && !validFleetURL(report.URL) {
+		// 与推送一样只接受 http/https 地址，无效时改用拉取地址
+		log.Printf("实例 %s 返回了无效的面板地址 %q，改用 %s", report.Host, report.URL, target)
+		report.URL = ""
+	}
+	return report, nil
+}
+
+// runHubAgent 定期把本机状态推送到 hub，只在失败和恢复时记录日志
+func (em *EnhancedMonitor) runHubAgent(ctx context.Context) {
+	agent := NewHubAgent(em.config, em.hubTLS)
+	log.Printf("向 hub 推送已启用: %s", agent.base)
+	ticker := time.NewTicker(em.config.Hub.Interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !em.scheduler.Ready() {
+				continue
+			}
+			err := agent.push(ctx, em.selfReport())
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil && !failing {
+				log.Printf("推送到 hub 失败: %v", err)
+			} else if err == nil && failing {
+				log.Printf("已恢复推送到 hub")
+			}
+			failing = err != nil
+		}
+	}
+}
+
+// handleFleetPush 处理 POST /api/fleet/push，接收 agent 推送的状态
+// 请求需要通过令牌或客户端证书认证，agent 没有提供面板地址时按请求的来源地址和上报的端口推断
+func (em *EnhancedMonitor) handleFleetPush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, err := em.agents.Authenticate(r, time.Now())
+	switch {
+	case errors.Is(err, errAgentRevoked):
+		http.Error(w, "Agent revoked", http.StatusForbidden)
+		return
+	case err != nil:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sysmon"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var report FleetReport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, fleetMaxReport)).Decode(&report); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !validFleetHost(report.Host) {
+		http.Error(w, "Invalid host name", http.StatusBadRequest)
+		return
+	}
+	// 凭据只能用于推送自己的状态
+	if name != "" && name != report.Host {
+		log.Printf("拒绝推送: agent %s 冒充 %s (%s)", name, report.Host, r.RemoteAddr)
+		http.Error(w, "Credentials do not match host", http.StatusForbidden)
+		return
+	}
+	if report.URL != "" {
+		if !validFleetURL(report.URL) {
+			http.Error(w, "Invalid URL", http.StatusBadRequest)
+			return
+		}
+	} else if report.Port > 0 && report.Port < 65536 {
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			report.URL = "http://" + net.JoinHostPort(host, strconv.Itoa(report.Port)) + "/"
+		}
+	}
+	em.fleet.Update(report, "push", time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleFleet 处理 /api/fleet：GET 返回所有主机的状态，DELETE ?host= 从列表中移除主机
+func (em *EnhancedMonitor) handleFleet(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		hosts := em.fleet.Hosts()
+		online := 0
+		for _, h := range hosts {
+			if h.Online {
+				online++
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"offline_after": em.fleet.offlineAfter.String(),
+			"online":        online,
+			"offline":       len(hosts) - online,
+			"hosts":         hosts,
+		})
+	case "DELETE":
+		if !em.fleet.Remove(r.URL.Query().Get("host")) {
+			http.Error(w, "Host not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// agentTokenBytes agent 令牌的随机字节数
+const agentTokenBytes = 32
+
+// agentCertValidity 注册时签发的客户端证书的有效期
+const agentCertValidity = 365 * 24 * time.Hour
+
+var (
+	errEnrollDisabled = errors.New("enrollment disabled")
+	errEnrollDenied   = errors.New("invalid enrollment secret")
+	errAgentRevoked   = errors.New("agent revoked")
+	errUnauthorized   = errors.New("unauthorized")
+)
+
+// AgentRecord hub 记录的一个 agent 的凭据，令牌只保存 SHA-256 摘要
+type AgentRecord struct {
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"token_hash,omitempty"`
+	CertSerial string     `json:"cert_serial,omitempty"`
+	CertExpiry time.Time  `json:"cert_expiry,omitempty"`
+	Enrolled   time.Time  `json:"enrolled"`
+	LastSeen   time.Time  `json:"last_seen"`
+	Revoked    *time.Time `json:"revoked,omitempty"`
+}
+
+// AgentStatus /api/fleet/agents 返回的 agent 信息
+type AgentStatus struct {
+	Name       string `json:"name"`
+	Token      bool   `json:"token"`
+	CertSerial string `json:"cert_serial,omitempty"`
+	CertExpiry string `json:"cert_expiry,omitempty"`
+	Enrolled   string `json:"enrolled,omitempty"`
+	LastSeen   string `json:"last_seen,omitempty"`
+	Revoked    string `json:"revoked,omitempty"`
+}
+
+// agentRegistryFile agents.json 的格式
+type agentRegistryFile struct {
+	Agents         map[string]*AgentRecord `json:"agents"`
+	RevokedSerials map[string]time.Time    `json:"revoked_serials"`
+}
+
+// AgentRegistry hub 上的 agent 认证：注册、令牌和客户端证书校验、吊销列表
+// 推送可以用令牌（Authorization: Bearer）或由 ClientCA 签发的客户端证书认证，证书的 CN 即主机名
+type AgentRegistry struct {
+	secret         string
+	allowAnonymous bool
+	clientCAs      *x509.CertPool
+	ca             *x509.Certificate // 签发客户端证书的CA，未配置私钥时为nil
+	caKey          crypto.Signer
+	path           string
+
+	mu             sync.Mutex
+	agents         map[string]*AgentRecord
+	revokedSerials map[string]time.Time // 吊销的证书序列号（十六进制小写）
+}
+
+// NewAgentRegistry 根据 hub 配置创建 agent 认证，配置了数据目录时从 agents.json 恢复
+func NewAgentRegistry(config Config) (*AgentRegistry, error) {
+	hub := config.Hub
+	ar := &AgentRegistry{
+		secret:         hub.EnrollSecret,
+		allowAnonymous: hub.AllowAnonymous,
+		agents:         make(map[string]*AgentRecord),
+		revokedSerials: make(map[string]time.Time),
+	}
+	if hub.ClientCA != "" {
+		if config.TLSCert == "" {
+			return nil, fmt.Errorf("校验客户端证书需要启用 HTTPS（-tls-cert）")
+		}
+		pool, err := loadCertPool(hub.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		ar.clientCAs = pool
+	}
+	if hub.CAKey != "" {
+		if hub.ClientCA == "" {
+			return nil, fmt.Errorf("签发客户端证书需要同时指定 -hub-client-ca")
+		}
+		pair, err := tls.LoadX509KeyPair(hub.ClientCA, hub.CAKey)
+		if err != nil {
+			return nil, fmt.Errorf("加载CA私钥失败: %v", err)
+		}
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok || !ca.IsCA {
+			return nil, fmt.Errorf("%s 不是CA证书", hub.ClientCA)
+		}
+		ar.ca, ar.caKey = ca, signer
+	}
+
+	switch {
+	case hub.AllowAnonymous:
+		log.Printf("警告: hub 接受未认证的推送")
+	case hub.EnrollSecret == "" && hub.ClientCA == "":
+		log.Printf("未配置 agent 认证（-hub-enroll-secret 或 -hub-client-ca），将拒绝所有推送")
+	}
+	if config.TLSCert == "" && hub.EnrollSecret != "" {
+		log.Printf("警告: 未启用 HTTPS，注册密钥和令牌将以明文传输")
+	}
+
+	if config.DataDir == "" {
+		return ar, nil
+	}
+	ar.path = filepath.Join(config.DataDir, "agents.json")
+	data, err := os.ReadFile(ar.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ar, nil
+		}
+		return nil, err
+	}
+	var saved agentRegistryFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("%s 损坏: %v", ar.path, err)
+	}
+	if saved.Agents != nil {
+		ar.agents = saved.Agents
+	}
+	if saved.RevokedSerials != nil {
+		ar.revokedSerials = saved.RevokedSerials
+	}
+	return ar, nil
+}
+
+// hashToken 令牌的 SHA-256 摘要
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Enroll 用注册密钥注册 agent，返回新分配的令牌；提供了 CSR 且 hub 有CA私钥时同时签发客户端证书
+// 已注册的 agent 重新注册时更换令牌，旧证书被吊销；已吊销的 agent 需要先删除才能重新注册
+func (ar *AgentRegistry) Enroll(name, secret, csrPEM string, now time.Time) (token, certPEM string, err error) {
+	if ar.secret == "" {
+		return "", "", errEnrollDisabled
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(ar.secret)) != 1 {
+		return "", "", errEnrollDenied
 	}
 
-	// 创建增强监控器
-	enhancedMonitor := &EnhancedMonitor{
-		config: config,
+	var cert *x509.Certificate
+	if csrPEM != "" && ar.ca != nil {
+		block, _ := pem.Decode([]byte(csrPEM))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			return "", "", fmt.Errorf("invalid CSR")
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil || csr.CheckSignature() != nil {
+			return "", "", fmt.Errorf("invalid CSR")
+		}
+		if csr.Subject.CommonName != name {
+			return "", "", fmt.Errorf("CSR common name does not match host")
+		}
+		der, err := signCertificate(ar.ca, ar.caKey, csr.PublicKey, name, nil, true, now, agentCertValidity)
+		if err != nil {
+			return "", "", err
+		}
+		if cert, err = x509.ParseCertificate(der); err != nil {
+			return "", "", err
+		}
+		certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
 	}
 
-	// 创建基础监控器
-	enhancedMonitor.monitor = &Monitor{
-		config: config,
+	b := make([]byte, agentTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
 	}
+	token = hex.EncodeToString(b)
 
-	// 初始化统计
-	enhancedMonitor.monitor.initStats()
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	rec, ok := ar.agents[name]
+	if ok && rec.Revoked != nil {
+		return "", "", errAgentRevoked
+	}
+	if !ok {
+		rec = &AgentRecord{Name: name}
+		ar.agents[name] = rec
+		log.Printf("agent %s 已注册", name)
+	} else {
+		log.Printf("agent %s 重新注册，旧令牌已失效", name)
+	}
+	rec.TokenHash, rec.Enrolled = hashToken(token), now
+	if cert != nil {
+		if rec.CertSerial != "" {
+			ar.revokedSerials[rec.CertSerial] = now
+		}
+		rec.CertSerial, rec.CertExpiry = certSerial(cert), cert.NotAfter
+	}
+	if err := ar.saveLocked(); err != nil {
+		log.Printf("保存 agent 列表失败: %v", err)
+	}
+	return token, certPEM, nil
+}
 
-	// 启动Web服务器
-	go enhancedMonitor.startWebServer()
+// Authenticate 校验推送请求的凭据，返回认证的主机名；允许匿名推送且没有凭据时返回空字符串
+// 客户端证书优先于令牌
+func (ar *AgentRegistry) Authenticate(r *http.Request, now time.Time) (string, error) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
 
-	// 开始监控循环
-	for {
-		stats := enhancedMonitor.monitor.collectStats()
-		enhancedMonitor.currentStats = stats
-		time.Sleep(config.Interval)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		if _, revoked := ar.revokedSerials[certSerial(cert)]; revoked {
+			return "", errAgentRevoked
+		}
+		name := cert.Subject.CommonName
+		rec := ar.agents[name]
+		if rec != nil && rec.Revoked != nil {
+			return "", errAgentRevoked
+		}
+		if rec != nil {
+			rec.LastSeen = now
+		}
+		return name, nil
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		hash := []byte(hashToken(strings.TrimPrefix(auth, "Bearer ")))
+		for _, rec := range ar.agents {
+			if rec.TokenHash == "" || subtle.ConstantTimeCompare(hash, []byte(rec.TokenHash)) != 1 {
+				continue
+			}
+			if rec.Revoked != nil {
+				return "", errAgentRevoked
+			}
+			rec.LastSeen = now
+			return rec.Name, nil
+		}
+		return "", errUnauthorized
+	}
+
+	if ar.allowAnonymous {
+		return "", nil
 	}
+	return "", errUnauthorized
 }
 
-// startWebServer 启动Web服务器
-func (em *EnhancedMonitor) startWebServer() {
-	tmpl := template.Must(template.New("monitor").Parse(htmlTemplate))
+// Revoke 吊销 agent（令牌和所有 CN 为该名称的证书）或单个证书序列号
+func (ar *AgentRegistry) Revoke(name, serial string, now time.Time) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	if name != "" {
+		rec, ok := ar.agents[name]
+		if !ok {
+			// 未注册的名称（如手工签发的证书）也可以吊销
+			rec = &AgentRecord{Name: name}
+			ar.agents[name] = rec
+		}
+		if rec.Revoked == nil {
+			rec.Revoked = &now
+		}
+		if rec.CertSerial != "" {
+			ar.revokedSerials[rec.CertSerial] = now
+		}
+		log.Printf("agent %s 已吊销", name)
+	}
+	if serial != "" {
+		ar.revokedSerials[normalizeSerial(serial)] = now
+		log.Printf("证书 %s 已吊销", normalizeSerial(serial))
+	}
+	if err := ar.saveLocked(); err != nil {
+		log.Printf("保存 agent 列表失败: %v", err)
+	}
+}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		data := struct {
-			Stats    SystemStats
-			Interval int
-		}{
-			Stats:    em.currentStats,
-			Interval: int(em.config.Interval.Seconds()),
+// Remove 删除 agent 的记录，之后可以重新注册；它最后一张证书仍保留在吊销列表中
+func (ar *AgentRegistry) Remove(name string, now time.Time) bool {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	rec, ok := ar.agents[name]
+	if !ok {
+		return false
+	}
+	if rec.CertSerial != "" {
+		ar.revokedSerials[rec.CertSerial] = now
+	}
+	delete(ar.agents, name)
+	if err := ar.saveLocked(); err != nil {
+		log.Printf("保存 agent 列表失败: %v", err)
+	}
+	return true
+}
+
+// Agents 返回按名称排序的 agent 列表和吊销的证书序列号
+func (ar *AgentRegistry) Agents() ([]AgentStatus, []string) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	agents := make([]AgentStatus, 0, len(ar.agents))
+	for _, rec := range ar.agents {
+		status := AgentStatus{
+			Name:       rec.Name,
+			Token:      rec.TokenHash != "",
+			CertSerial: rec.CertSerial,
+			CertExpiry: formatTime(rec.CertExpiry),
+			Enrolled:   formatTime(rec.Enrolled),
+			LastSeen:   formatTime(rec.LastSeen),
 		}
-		tmpl.Execute(w, data)
-	})
+		if rec.Revoked != nil {
+			status.Revoked = formatTime(*rec.Revoked)
+		}
+		agents = append(agents, status)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	serials := make([]string, 0, len(ar.revokedSerials))
+	for serial := range ar.revokedSerials {
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+	return agents, serials
+}
 
-	http.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(em.currentStats)
-	})
+// Save 把 agent 列表写入数据目录
+func (ar *AgentRegistry) Save() error {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	return ar.saveLocked()
+}
 
-	// 获取可用网络接口列表
-	http.HandleFunc("/api/interfaces", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		interfaces := em.monitor.getAvailableInterfaces()
-		response := map[string]interface{}{
-			"interfaces": interfaces,
-			"current":    getSelectedInterface(),
+// saveLocked 写入 agent 列表，调用方需持有 ar.mu
+func (ar *AgentRegistry) saveLocked() error {
+	if ar.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(agentRegistryFile{Agents: ar.agents, RevokedSerials: ar.revokedSerials})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomicMode(ar.path, data, 0600)
+}
+
+// certSerial 证书序列号的十六进制表示
+func certSerial(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// normalizeSerial 统一序列号格式，接受 openssl 输出的带冒号的大写形式
+func normalizeSerial(serial string) string {
+	serial = strings.ToLower(strings.ReplaceAll(serial, ":", ""))
+	return strings.TrimLeft(serial, "0")
+}
+
+// loadCertPool 读取 PEM 格式的CA证书
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("CA 文件中没有有效的证书")
+	}
+	return pool, nil
+}
+
+// newHubTLSConfig 连接 hub 或被拉取实例时使用的 TLS 配置，未配置CA时使用系统CA
+func newHubTLSConfig(config HubConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.CA != "" {
+		pool, err := loadCertPool(config.CA)
+		if err != nil {
+			return nil, err
 		}
-		json.NewEncoder(w).Encode(response)
-	})
+		tlsConfig.RootCAs = pool
+	}
+	if (config.Cert == "") != (config.Key == "") {
+		return nil, fmt.Errorf("-hub-cert 和 -hub-key 需要同时指定")
+	}
+	if config.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
 
-	// 切换网络接口
-	http.HandleFunc("/api/switch-interface", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+// signCertificate 用CA签发证书。hosts 不为空时签发服务器证书（只有 ServerAuth），
+// client 为 true 时加上 ClientAuth；服务器证书默认不能冒充 agent 身份
+func signCertificate(ca *x509.Certificate, caKey crypto.Signer, pub crypto.PublicKey, name string, hosts []string, client bool, now time.Time, validity time.Duration) ([]byte, error) {
+	if len(hosts) == 0 && !client {
+		return nil, errors.New("certificate has neither server hosts nor client usage")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if len(hosts) > 0 {
+		tmpl.ExtKeyUsage = append(tmpl.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+		for _, h := range hosts {
+			if ip := net.ParseIP(h); ip != nil {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+			} else {
+				tmpl.DNSNames = append(tmpl.DNSNames, h)
+			}
 		}
-		var req struct {
-			Interface string `json:"interface"`
+	}
+	if client {
+		tmpl.ExtKeyUsage = append(tmpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+	}
+	return x509.CreateCertificate(rand.Reader, tmpl, ca, pub, caKey)
+}
+
+// marshalPrivateKey 把私钥编码为 PKCS#8 PEM
+func marshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// hubCredentials agent 注册后得到的凭据，保存在 <data-dir>/hub-credentials.json
+type hubCredentials struct {
+	Hub   string `json:"hub"`
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Cert  string `json:"certificate,omitempty"`
+	Key   string `json:"key,omitempty"`
+}
+
+// HubAgent 向 hub 推送本机状态，按需用注册密钥注册并保存分配的令牌和证书
+type HubAgent struct {
+	config HubConfig
+	name   string
+	base   string // hub 地址，不带末尾的 /
+	path   string // 凭据文件，未配置数据目录时为空
+	client *http.Client
+
+	mu    sync.Mutex
+	creds *hubCredentials
+	cert  *tls.Certificate // 注册得到的客户端证书
+}
+
+// NewHubAgent 创建 agent，有保存的凭据时直接使用
+func NewHubAgent(config Config, tlsConfig *tls.Config) *HubAgent {
+	a := &HubAgent{
+		config: config.Hub,
+		name:   config.Hub.Name,
+		base:   strings.TrimRight(config.Hub.URL, "/"),
+	}
+	if a.name == "" {
+		a.name = hostname()
+	}
+	// 注册得到的证书优先于 -hub-cert
+	tlsConfig = tlsConfig.Clone()
+	static := tlsConfig.Certificates
+	tlsConfig.Certificates = nil
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.cert != nil {
+			return a.cert, nil
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
+		if len(static) > 0 {
+			return &static[0], nil
 		}
-		// 验证接口是否存在
-		interfaces := em.monitor.getAvailableInterfaces()
-		valid := false
-		for _, intf := range interfaces {
-			if intf == req.Interface {
-				valid = true
-				break
-			}
+		return &tls.Certificate{}, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	a.client = &http.Client{Timeout: 10 * time.Second, Transport: transport}
+
+	if strings.HasPrefix(a.base, "http://") && (config.Hub.Token != "" || config.Hub.Join != "") {
+		log.Printf("警告: hub 地址未使用 HTTPS，令牌将以明文传输")
+	}
+	if config.Hub.Token == "" && config.Hub.Join != "" && config.DataDir != "" {
+		a.path = filepath.Join(config.DataDir, "hub-credentials.json")
+		if err := a.load(); err != nil {
+			log.Printf("读取 hub 凭据失败，将重新注册: %v", err)
 		}
-		if !valid {
-			http.Error(w, "Interface not found", http.StatusBadRequest)
-			return
+	}
+	return a
+}
+
+// load 读取保存的凭据，hub 地址或主机名改变后需要重新注册
+func (a *HubAgent) load() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
-		// 切换接口
-		em.config.Interface = req.Interface
-		em.monitor.config.Interface = req.Interface
-		// 保存用户选择到内存
-		setSelectedInterface(req.Interface)
-		// 重置网络统计
-		em.monitor.prevNetRx, em.monitor.prevNetTx = em.monitor.getNetworkStats()
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+		return err
+	}
+	var creds hubCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return err
+	}
+	if creds.Hub != a.base || creds.Name != a.name {
+		return nil
+	}
+	return a.use(&creds)
+}
+
+// use 启用一组凭据
+func (a *HubAgent) use(creds *hubCredentials) error {
+	var cert *tls.Certificate
+	if creds.Cert != "" {
+		pair, err := tls.X509KeyPair([]byte(creds.Cert), []byte(creds.Key))
+		if err != nil {
+			return err
+		}
+		cert = &pair
+	}
+	a.mu.Lock()
+	a.creds, a.cert = creds, cert
+	a.mu.Unlock()
+	// 已建立的 TLS 连接仍使用旧证书
+	a.client.CloseIdleConnections()
+	return nil
+}
+
+// token 当前使用的令牌
+func (a *HubAgent) token() string {
+	if a.config.Token != "" {
+		return a.config.Token
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.creds != nil {
+		return a.creds.Token
+	}
+	return ""
+}
+
+// enroll 向 hub 注册，附带新生成密钥的 CSR，hub 能签发证书时一并使用
+func (a *HubAgent) enroll(ctx context.Context) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: a.name}}, key)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]string{
+		"host":   a.name,
+		"secret": a.config.Join,
+		"csr":    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
 	})
+	var resp struct {
+		Token       string `json:"token"`
+		Certificate string `json:"certificate"`
+	}
+	if err := a.post(ctx, "/api/fleet/enroll", body, "", &resp); err != nil {
+		return err
+	}
 
-	addr := fmt.Sprintf(":%d", em.config.Port)
-	log.Printf("Web服务器启动在 %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	creds := &hubCredentials{Hub: a.base, Name: a.name, Token: resp.Token}
+	if resp.Certificate != "" {
+		keyPEM, err := marshalPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		creds.Cert, creds.Key = resp.Certificate, string(keyPEM)
+	}
+	if err := a.use(creds); err != nil {
+		return err
+	}
+	if creds.Cert != "" {
+		log.Printf("已向 hub 注册，获得令牌和客户端证书")
+	} else {
+		log.Printf("已向 hub 注册，获得令牌")
+	}
+	if a.path != "" {
+		data, _ := json.Marshal(creds)
+		if err := writeFileAtomicMode(a.path, data, 0600); err != nil {
+			log.Printf("保存 hub 凭据失败: %v", err)
+		}
+	}
+	return nil
 }
 
-// getAvailableInterfaces 获取可用的网络接口列表
-func (m *Monitor) getAvailableInterfaces() []string {
-	data, err := os.ReadFile("/proc/net/dev")
+// push 推送一次状态；使用注册密钥时，凭据被拒绝（hub 删除了记录、更换了令牌或吊销了证书）后下次推送前重新注册
+func (a *HubAgent) push(ctx context.Context, report FleetReport) error {
+	if a.config.Token == "" && a.config.Join != "" && a.token() == "" {
+		if err := a.enroll(ctx); err != nil {
+			return fmt.Errorf("注册失败: %v", err)
+		}
+	}
+	body, err := json.Marshal(report)
 	if err != nil {
-		return []string{}
+		return err
+	}
+	err = a.post(ctx, "/api/fleet/push", body, a.token(), nil)
+	var se *hubStatusError
+	if errors.As(err, &se) && (se.code == http.StatusUnauthorized || se.code == http.StatusForbidden) &&
+		a.config.Token == "" && a.config.Join != "" {
+		a.mu.Lock()
+		a.creds, a.cert = nil, nil
+		a.mu.Unlock()
+		a.client.CloseIdleConnections()
 	}
+	return err
+}
 
-	lines := strings.Split(string(data), "\n")
-	var interfaces []string
-	for i := 2; i < len(lines); i++ {
-		if strings.TrimSpace(lines[i]) == "" {
-			continue
+// hubStatusError hub 返回的非2xx响应
+type hubStatusError struct {
+	code int
+	msg  string
+}
+
+func (e *hubStatusError) Error() string {
+	return e.msg
+}
+
+// post 向 hub 发送 JSON 请求，非2xx响应返回 *hubStatusError
+func (a *HubAgent) post(ctx context.Context, path string, body []byte, token string, result interface{}) error {
+	req, err := http.NewRequest("POST", a.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg := make([]byte, 512)
+		n, _ := resp.Body.Read(msg)
+		return &hubStatusError{code: resp.StatusCode, msg: resp.Status + ": " + strings.TrimSpace(string(msg[:n]))}
+	}
+	if result != nil {
+		return json.NewDecoder(io.LimitReader(resp.Body, fleetMaxReport)).Decode(result)
+	}
+	return nil
+}
+
+// handleEnroll 处理 POST /api/fleet/enroll，用注册密钥换取 agent 令牌（和客户端证书）
+func (em *EnhancedMonitor) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Host   string `json:"host"`
+		Secret string `json:"secret"`
+		CSR    string `json:"csr"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, fleetMaxReport)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !validFleetHost(req.Host) {
+		http.Error(w, "Invalid host name", http.StatusBadRequest)
+		return
+	}
+	token, cert, err := em.agents.Enroll(req.Host, req.Secret, req.CSR, time.Now())
+	switch {
+	case errors.Is(err, errEnrollDisabled):
+		http.Error(w, "Enrollment disabled", http.StatusForbidden)
+		return
+	case errors.Is(err, errEnrollDenied):
+		log.Printf("拒绝 %s 的注册请求: 注册密钥错误 (%s)", req.Host, r.RemoteAddr)
+		http.Error(w, "Invalid enrollment secret", http.StatusForbidden)
+		return
+	case errors.Is(err, errAgentRevoked):
+		http.Error(w, "Agent revoked", http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token, "certificate": cert})
+}
+
+// handleAgents 处理 /api/fleet/agents：GET 返回已注册的 agent 和吊销的证书，DELETE ?name= 删除 agent 记录
+func (em *EnhancedMonitor) handleAgents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		agents, serials := em.agents.Agents()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"enrollment":      em.agents.secret != "",
+			"client_certs":    em.agents.clientCAs != nil,
+			"anonymous":       em.agents.allowAnonymous,
+			"agents":          agents,
+			"revoked_serials": serials,
+		})
+	case "DELETE":
+		if !em.agents.Remove(r.URL.Query().Get("name"), time.Now()) {
+			http.Error(w, "Agent not found", http.StatusNotFound)
+			return
 		}
-		parts := strings.Split(lines[i], ":")
-		if len(parts) >= 2 {
-			intf := strings.TrimSpace(parts[0])
-			if intf != "lo" {
-				interfaces = append(interfaces, intf)
-			}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRevoke 处理 POST /api/fleet/agents/revoke，按名称吊销 agent 或按序列号吊销证书
+func (em *EnhancedMonitor) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Name   string `json:"name"`
+		Serial string `json:"serial"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, fleetMaxReport)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if (req.Name == "" && req.Serial == "") || (req.Name != "" && !validFleetHost(req.Name)) {
+		http.Error(w, "Name or serial required", http.StatusBadRequest)
+		return
+	}
+	if req.Serial != "" {
+		if _, ok := new(big.Int).SetString(normalizeSerial(req.Serial), 16); !ok {
+			http.Error(w, "Invalid serial", http.StatusBadRequest)
+			return
 		}
 	}
-	return interfaces
+	em.agents.Revoke(req.Name, req.Serial, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
 }
 
-// 当前选择的网卡接口（内存中保存）
-var currentSelectedInterface string
+// caOptions ca 子命令的参数
+type caOptions struct {
+	Dir    string   // 证书目录，CA 为其中的 ca.crt 和 ca.key
+	Name   string   // init: CA 名称；issue: 证书的 CN
+	Hosts  []string // issue: 服务器证书的域名或IP
+	Client bool     // issue: 证书可用于客户端认证
+	Force  bool     // issue: 覆盖已存在的同名证书
+	Days   int      // 有效期天数，0 为默认值
+}
 
-// setSelectedInterface 设置当前选择的网卡接口
-func setSelectedInterface(interfaceName string) {
-	currentSelectedInterface = interfaceName
+// runCA 处理 ca 子命令：生成本地测试用的自签名CA，并签发 hub 和 agent 的证书
+func runCA(args []string) {
+	if len(args) == 0 || (args[0] != "init" && args[0] != "issue") {
+		fmt.Fprintln(os.Stderr, "用法: sysmon ca init [-dir pki] | sysmon ca issue [-dir pki] -name 名称 [-hosts 域名或IP,...] [-client] [-force]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("ca "+args[0], flag.ExitOnError)
+	var (
+		dir    = fs.String("dir", "pki", "证书目录，CA 为其中的 ca.crt 和 ca.key")
+		name   = fs.String("name", "", "init: CA 名称；issue: 证书的 CN（agent 证书为上报的主机名），不能为 ca")
+		hosts  = fs.String("hosts", "", "issue: 服务器证书的域名或IP，逗号分隔；为空时签发仅用于客户端认证的证书")
+		client = fs.Bool("client", false, "issue: 服务器证书同时可用于客户端认证（默认只有 ServerAuth）")
+		force  = fs.Bool("force", false, "issue: 覆盖已存在的同名证书和私钥")
+		days   = fs.Int("days", 0, "有效期天数（默认CA 10年，证书1年）")
+	)
+	fs.Parse(args[1:])
+
+	opts := caOptions{Dir: *dir, Name: *name, Client: *client || *hosts == "", Force: *force, Days: *days}
+	for _, h := range strings.Split(*hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			opts.Hosts = append(opts.Hosts, h)
+		}
+	}
+	var (
+		certPath, keyPath string
+		cert              *x509.Certificate
+		err               error
+	)
+	if args[0] == "init" {
+		certPath, keyPath, cert, err = initCA(opts, time.Now())
+	} else {
+		certPath, keyPath, cert, err = issueCertificate(opts, time.Now())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("已生成 %s 和 %s（序列号 %s，有效期至 %s）\n", certPath, keyPath, certSerial(cert), formatTime(cert.NotAfter))
 }
 
-// getSelectedInterface 获取当前选择的网卡接口
-func getSelectedInterface() string {
-	return currentSelectedInterface
+// initCA 在 opts.Dir 下生成自签名CA，ca.key 已存在时拒绝覆盖
+func initCA(opts caOptions, now time.Time) (certPath, keyPath string, cert *x509.Certificate, err error) {
+	certPath, keyPath = filepath.Join(opts.Dir, "ca.crt"), filepath.Join(opts.Dir, "ca.key")
+	if _, err := os.Stat(keyPath); err == nil {
+		return "", "", nil, fmt.Errorf("%s 已存在", keyPath)
+	}
+	if opts.Name == "" {
+		opts.Name = "sysmon CA"
+	}
+	if opts.Days <= 0 {
+		opts.Days = 3650
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("生成私钥失败: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: opts.Name},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.AddDate(0, 0, opts.Days),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("生成CA证书失败: %v", err)
+	}
+	cert, err = writeKeyPair(certPath, keyPath, der, key)
+	return certPath, keyPath, cert, err
 }
 
-// initStats 初始化统计数据
-func (m *Monitor) initStats() {
-	m.prevNetRx, m.prevNetTx = m.getNetworkStats()
-	m.prevCPUStat = m.getCPUStats()
+// issueCertificate 用 opts.Dir 下的CA签发证书，写入 <dir>/<name>.crt 和 <name>.key。
+// 名称 ca 会覆盖CA本身，总是拒绝；其他同名文件只有 opts.Force 时才覆盖
+func issueCertificate(opts caOptions, now time.Time) (certPath, keyPath string, cert *x509.Certificate, err error) {
+	if !validFleetHost(opts.Name) {
+		return "", "", nil, fmt.Errorf("无效的 -name 参数: %q", opts.Name)
+	}
+	if strings.EqualFold(opts.Name, "ca") {
+		return "", "", nil, errors.New("-name 不能为 ca，会覆盖CA的证书和私钥")
+	}
+	certPath, keyPath = filepath.Join(opts.Dir, opts.Name+".crt"), filepath.Join(opts.Dir, opts.Name+".key")
+	if !opts.Force {
+		for _, p := range []string{certPath, keyPath} {
+			if _, err := os.Stat(p); err == nil {
+				return "", "", nil, fmt.Errorf("%s 已存在，使用 -force 覆盖", p)
+			}
+		}
+	}
+	if opts.Days <= 0 {
+		opts.Days = 365
+	}
+	pair, err := tls.LoadX509KeyPair(filepath.Join(opts.Dir, "ca.crt"), filepath.Join(opts.Dir, "ca.key"))
+	if err != nil {
+		return "", "", nil, fmt.Errorf("加载CA失败（先运行 sysmon ca init）: %v", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return "", "", nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("生成私钥失败: %v", err)
+	}
+	validity := time.Duration(opts.Days) * 24 * time.Hour
+	der, err := signCertificate(ca, pair.PrivateKey.(crypto.Signer), key.Public(), opts.Name, opts.Hosts, opts.Client, now, validity)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("签发证书失败: %v", err)
+	}
+	cert, err = writeKeyPair(certPath, keyPath, der, key)
+	return certPath, keyPath, cert, err
+}
+
+// writeKeyPair 写入私钥（0600）和 PEM 证书，返回解析后的证书
+func writeKeyPair(certPath, keyPath string, der []byte, key crypto.Signer) (*x509.Certificate, error) {
+	keyPEM, err := marshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomicMode(keyPath, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("写入私钥失败: %v", err)
+	}
+	if err := writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})); err != nil {
+		return nil, fmt.Errorf("写入证书失败: %v", err)
+	}
+	return x509.ParseCertificate(der)
 }
 
-// collectStats 收集系统统计信息
-func (m *Monitor) collectStats() SystemStats {
-	// 获取当前网络和CPU统计
-	currNetRx, currNetTx := m.getNetworkStats()
-	currCPUStat := m.getCPUStats()
+// bcrypt 实现（标准库没有 bcrypt）。兼容 htpasswd -B 和 OpenBSD 生成的 $2a$/$2b$/$2y$ 哈希
 
-	// 计算网络速度
-	receiveSpeed := float64(currNetRx-m.prevNetRx) / 1024 / m.config.Interval.Seconds()
-	transmitSpeed := float64(currNetTx-m.prevNetTx) / 1024 / m.config.Interval.Seconds()
+// bcryptAlphabet bcrypt 使用的 base64 字母表
+const bcryptAlphabet = "./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 
-	// 计算CPU使用率
-	cpuUsage := m.calculateCPUUsage(m.prevCPUStat, currCPUStat)
+var bcryptEncoding = base64.NewEncoding(bcryptAlphabet).WithPadding(base64.NoPadding)
 
-	// 更新前一次的统计数据
-	m.prevNetRx, m.prevNetTx = currNetRx, currNetTx
-	m.prevCPUStat = currCPUStat
+const (
+	bcryptMinCost     = 4
+	bcryptMaxCost     = 31
+	bcryptDefaultCost = 10
+	bcryptSaltLen     = 16
+	bcryptMaxPassword = 72 // 超出部分被忽略，与其它实现一致
+)
 
-	// 获取其他系统信息
-	uptime := m.getUptime()
-	loadAvg := m.getLoadAverage()
-	cpuTemp := m.getCPUTemperature()
-	memInfo := m.getMemoryInfo()
-	swapInfo := m.getSwapInfo()
-	diskInfo := m.getDiskInfo()
+// blowfishState Blowfish 的子密钥和S盒
+type blowfishState struct {
+	p [18]uint32
+	s [4][256]uint32
+}
 
-	return SystemStats{
-		RunTime:            uptime,
-		Last1:              fmt.Sprintf("%.2f", loadAvg[0]),
-		Last5:              fmt.Sprintf("%.2f", loadAvg[1]),
-		Last15:             fmt.Sprintf("%.2f", loadAvg[2]),
-		CPUUsage:           fmt.Sprintf("%.2f", cpuUsage),
-		CPUTemp:            cpuTemp,
-		MemTotalSpace:      fmt.Sprintf("%.2f", float64(memInfo["total"])/1024),
-		MemUsedSpace:       fmt.Sprintf("%.2f", float64(memInfo["used"])/1024),
-		MemFreeSpace:       fmt.Sprintf("%.2f", float64(memInfo["total"]-memInfo["used"])/1024),
-		MemUsage:           fmt.Sprintf("%.2f", float64(memInfo["used"])*100/float64(memInfo["total"])),
-		SwapTotalSpace:     fmt.Sprintf("%.2f", float64(swapInfo["total"])/1024),
-		SwapUsedSpace:      fmt.Sprintf("%.2f", float64(swapInfo["used"])/1024),
-		SwapFreeSpace:      fmt.Sprintf("%.2f", float64(swapInfo["free"])/1024),
-		DiskTotalSpace:     fmt.Sprintf("%.2f", float64(diskInfo["total"])/1024/1024),
-		DiskUsedSpace:      fmt.Sprintf("%.2f", float64(diskInfo["used"])/1024/1024),
-		DiskAvailableSpace: fmt.Sprintf("%.2f", float64(diskInfo["available"])/1024/1024),
-		DiskUsage:          fmt.Sprintf("%.2f", float64(diskInfo["used"])*100/float64(diskInfo["total"])),
-		ReceiveSpeed:       fmt.Sprintf("%.2f", receiveSpeed),
-		TransmitSpeed:      fmt.Sprintf("%.2f", transmitSpeed),
-		ReceiveTotal:       fmt.Sprintf("%.2f", float64(currNetRx)/1024/1024/1024),
-		TransmitTotal:      fmt.Sprintf("%.2f", float64(currNetTx)/1024/1024/1024),
-		LatestTime:         time.Now().In(time.FixedZone("CST", 8*3600)).Format("2006-01-02 15:04:05"),
-	}
-}
-
-// getNetworkStats 获取网络统计信息
-func (m *Monitor) getNetworkStats() (uint64, uint64) {
-	data, err := os.ReadFile("/proc/net/dev")
-	if err != nil {
-		return 0, 0
-	}
+var (
+	blowfishInitOnce sync.Once
+	blowfishInit     blowfishState
+)
 
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, m.config.Interface+":") {
-			fields := strings.Fields(line)
-			if len(fields) >= 10 {
-				rx, _ := strconv.ParseUint(fields[1], 10, 64)
-				tx, _ := strconv.ParseUint(fields[9], 10, 64)
-				return rx, tx
+// initialBlowfish Blowfish 的初始子密钥和S盒依次为圆周率小数部分的十六进制数字，
+// 这里用 Machin 公式 π = 16·arctan(1/5) - 4·arctan(1/239) 计算，而不是内置1042个常量
+func initialBlowfish() *blowfishState {
+	blowfishInitOnce.Do(func() {
+		const words = 18 + 4*256
+		const guard = 64 // 每一项截断的误差远小于 2^guard
+		one := new(big.Int).Lsh(big.NewInt(1), words*32+guard)
+		arctanInv := func(x int64) *big.Int {
+			sum := new(big.Int)
+			xx := big.NewInt(x * x)
+			term := new(big.Int).Div(one, big.NewInt(x))
+			t := new(big.Int)
+			for k := int64(0); term.Sign() != 0; k++ {
+				t.Div(term, big.NewInt(2*k+1))
+				if k%2 == 0 {
+					sum.Add(sum, t)
+				} else {
+					sum.Sub(sum, t)
+				}
+				term.Div(term, xx)
+			}
+			return sum
+		}
+		pi := new(big.Int).Mul(arctanInv(5), big.NewInt(16))
+		pi.Sub(pi, new(big.Int).Mul(arctanInv(239), big.NewInt(4)))
+		pi.Sub(pi, new(big.Int).Mul(one, big.NewInt(3)))
+		pi.Rsh(pi, guard)
+		digits := pi.FillBytes(make([]byte, words*4))
+		for i := 0; i < words; i++ {
+			w := binary.BigEndian.Uint32(digits[i*4:])
+			if i < 18 {
+				blowfishInit.p[i] = w
+			} else {
+				blowfishInit.s[(i-18)/256][(i-18)%256] = w
 			}
 		}
+	})
+	return &blowfishInit
+}
+
+// f Blowfish 的轮函数
+func (c *blowfishState) f(x uint32) uint32 {
+	return ((c.s[0][x>>24] + c.s[1][x>>16&0xff]) ^ c.s[2][x>>8&0xff]) + c.s[3][x&0xff]
+}
+
+// encrypt 加密一个64位分组
+func (c *blowfishState) encrypt(l, r uint32) (uint32, uint32) {
+	l ^= c.p[0]
+	for i := 1; i < 16; i += 2 {
+		r ^= c.f(l) ^ c.p[i]
+		l ^= c.f(r) ^ c.p[i+1]
 	}
-	return 0, 0
+	r ^= c.p[17]
+	return r, l
 }
 
-// getCPUStats 获取CPU统计信息
-func (m *Monitor) getCPUStats() CPUStat {
-	data, err := os.ReadFile("/proc/stat")
-	if err != nil {
-		return CPUStat{}
+// cyclicWord 从data中循环读取下一个32位大端字
+func cyclicWord(data []byte, pos *int) uint32 {
+	var w uint32
+	for i := 0; i < 4; i++ {
+		w = w<<8 | uint32(data[*pos])
+		*pos = (*pos + 1) % len(data)
 	}
+	return w
+}
 
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "cpu ") {
-			fields := strings.Fields(line)
-			if len(fields) >= 8 {
-				user, _ := strconv.ParseUint(fields[1], 10, 64)
-				nice, _ := strconv.ParseUint(fields[2], 10, 64)
-				system, _ := strconv.ParseUint(fields[3], 10, 64)
-				idle, _ := strconv.ParseUint(fields[4], 10, 64)
-				iowait, _ := strconv.ParseUint(fields[5], 10, 64)
-				irq, _ := strconv.ParseUint(fields[6], 10, 64)
-				softirq, _ := strconv.ParseUint(fields[7], 10, 64)
-				return CPUStat{
-					User:    user,
-					Nice:    nice,
-					System:  system,
-					Idle:    idle,
-					Iowait:  iowait,
-					Irq:     irq,
-					Softirq: softirq,
-				}
-			}
+// expandKey bcrypt 的 EksBlowfish 密钥扩展，salt 为 nil 时即标准 Blowfish 的密钥扩展
+func (c *blowfishState) expandKey(key, salt []byte) {
+	pos := 0
+	for i := range c.p {
+		c.p[i] ^= cyclicWord(key, &pos)
+	}
+	var l, r uint32
+	pos = 0
+	next := func() {
+		if salt != nil {
+			l ^= cyclicWord(salt, &pos)
+			r ^= cyclicWord(salt, &pos)
+		}
+		l, r = c.encrypt(l, r)
+	}
+	for i := 0; i < len(c.p); i += 2 {
+		next()
+		c.p[i], c.p[i+1] = l, r
+	}
+	for b := range c.s {
+		for i := 0; i < 256; i += 2 {
+			next()
+			c.s[b][i], c.s[b][i+1] = l, r
 		}
 	}
-	return CPUStat{}
 }
 
-// calculateCPUUsage 计算CPU使用率
-func (m *Monitor) calculateCPUUsage(prev, curr CPUStat) float64 {
-	prevTotal := prev.User + prev.Nice + prev.System + prev.Idle + prev.Iowait + prev.Irq + prev.Softirq
-	currTotal := curr.User + curr.Nice + curr.System + curr.Idle + curr.Iowait + curr.Irq + curr.Softirq
-
-	prevIdle := prev.Idle + prev.Iowait
-	currIdle := curr.Idle + curr.Iowait
-
-	totalDiff := currTotal - prevTotal
-	idleDiff := currIdle - prevIdle
-
-	if totalDiff == 0 {
-		return 0
+// bcryptRaw 计算 bcrypt 摘要（23字节）
+func bcryptRaw(password, salt []byte, cost int) []byte {
+	key := append(append([]byte{}, password...), 0)
+	if len(key) > bcryptMaxPassword {
+		key = key[:bcryptMaxPassword]
+	}
+	c := *initialBlowfish()
+	c.expandKey(key, salt)
+	for i := uint64(0); i < 1<<uint(cost); i++ {
+		c.expandKey(key, nil)
+		c.expandKey(salt, nil)
 	}
 
-	return float64(totalDiff-idleDiff) * 100.0 / float64(totalDiff)
+	ctext := []byte("OrpheanBeholderScryDoubt")
+	var words [6]uint32
+	for i := range words {
+		words[i] = binary.BigEndian.Uint32(ctext[i*4:])
+	}
+	for i := 0; i < 64; i++ {
+		for j := 0; j < 6; j += 2 {
+			words[j], words[j+1] = c.encrypt(words[j], words[j+1])
+		}
+	}
+	out := make([]byte, 24)
+	for i, w := range words {
+		binary.BigEndian.PutUint32(out[i*4:], w)
+	}
+	return out[:23]
 }
 
-// getUptime 获取系统运行时间
-func (m *Monitor) getUptime() string {
-	data, err := os.ReadFile("/proc/uptime")
+// parseBcrypt 解析 $2a$10$<22位盐><31位摘要> 形式的哈希
+func parseBcrypt(hash string) (prefix string, cost int, salt []byte, sum string, err error) {
+	if len(hash) != 60 || hash[0] != '$' || hash[3] != '$' || hash[6] != '$' {
+		return "", 0, nil, "", fmt.Errorf("不是 bcrypt 哈希")
+	}
+	prefix = hash[:4]
+	if prefix != "$2a$" && prefix != "$2b$" && prefix != "$2y$" {
+		return "", 0, nil, "", fmt.Errorf("不支持的 bcrypt 版本 %s", prefix)
+	}
+	cost, err = strconv.Atoi(hash[4:6])
+	if err != nil || cost < bcryptMinCost || cost > bcryptMaxCost {
+		return "", 0, nil, "", fmt.Errorf("无效的 bcrypt 代价 %s", hash[4:6])
+	}
+	salt, err = bcryptEncoding.DecodeString(hash[7:29])
 	if err != nil {
-		return "0天0小时0分钟"
+		return "", 0, nil, "", fmt.Errorf("无效的 bcrypt 盐: %v", err)
 	}
+	return prefix, cost, salt, hash[29:], nil
+}
 
-	fields := strings.Fields(string(data))
-	if len(fields) == 0 {
-		return "0天0小时0分钟"
+// bcryptHash 用随机盐生成 $2b$ 格式的 bcrypt 哈希
+func bcryptHash(password string, cost int) (string, error) {
+	if cost < bcryptMinCost || cost > bcryptMaxCost {
+		return "", fmt.Errorf("代价必须在%d-%d之间", bcryptMinCost, bcryptMaxCost)
+	}
+	salt := make([]byte, bcryptSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
 	}
+	sum := bcryptRaw([]byte(password), salt, cost)
+	return fmt.Sprintf("$2b$%02d$%s%s", cost, bcryptEncoding.EncodeToString(salt), bcryptEncoding.EncodeToString(sum)), nil
+}
 
-	uptime, err := strconv.ParseFloat(fields[0], 64)
+// bcryptVerify 校验密码与 bcrypt 哈希是否匹配
+func bcryptVerify(hash, password string) bool {
+	_, cost, salt, sum, err := parseBcrypt(hash)
 	if err != nil {
-		return "0天0小时0分钟"
+		return false
 	}
+	got := bcryptEncoding.EncodeToString(bcryptRaw([]byte(password), salt, cost))
+	return subtle.ConstantTimeCompare([]byte(got), []byte(sum)) == 1
+}
 
-	days := int(uptime) / 86400
-	hours := (int(uptime) % 86400) / 3600
-	minutes := (int(uptime) % 3600) / 60
+// AuthConfig 面板和API的认证配置，用户文件和令牌文件都为空时不启用认证
+type AuthConfig struct {
+	UsersFile  string        // 每行 用户名:bcrypt哈希[:角色]，前两列与 htpasswd -B 的格式相同，没有角色时为 viewer
+	TokensFile string        // 每行 名称:令牌[:权限,...]，令牌也可以写成 sha256:<十六进制摘要>
+	SessionTTL time.Duration // 登录会话的有效期
+}
 
-	return fmt.Sprintf("%d天%d小时%d分钟", days, hours, minutes)
+// sessionCookie 登录会话的 Cookie 名
+const sessionCookie = "sysmon_session"
+
+// basicAuthCacheTTL 基本认证校验结果的缓存时间，避免每个请求都计算 bcrypt
+const basicAuthCacheTTL = 5 * time.Minute
+
+// minTokenLen 明文令牌的最短长度
+const minTokenLen = 16
+
+// authPublicPaths 不需要认证的路径：登录页、探针，以及有独立认证的 agent 推送和注册
+var authPublicPaths = map[string]bool{
+	"/login":            true,
+	"/healthz":          true,
+	"/readyz":           true,
+	"/api/fleet/push":   true,
+	"/api/fleet/enroll": true,
 }
 
-// getLoadAverage 获取系统负载
-func (m *Monitor) getLoadAverage() [3]float64 {
-	data, err := os.ReadFile("/proc/loadavg")
-	if err != nil {
-		return [3]float64{0, 0, 0}
-	}
+// 用户角色：viewer 只能查看，admin 拥有全部写权限
+const (
+	roleViewer = "viewer"
+	roleAdmin  = "admin"
+)
 
-	fields := strings.Fields(string(data))
-	if len(fields) < 3 {
-		return [3]float64{0, 0, 0}
-	}
+// authScopes 可授予令牌的写权限及说明，admin 包含全部；所有通过认证的请求者都可以读取
+var authScopes = map[string]string{
+	"interface": "切换监控的网卡",
+	"alerts":    "确认告警，管理静默和维护窗口",
+	"report":    "立即发送每日报告",
+	"replay":    "控制回放",
+	"fleet":     "移除 hub 中的主机，删除和吊销 agent",
+	"admin":     "以上全部",
+}
 
-	load1, _ := strconv.ParseFloat(fields[0], 64)
-	load5, _ := strconv.ParseFloat(fields[1], 64)
-	load15, _ := strconv.ParseFloat(fields[2], 64)
+// authWriteScopes 各路径上 GET、HEAD 以外的请求需要的权限，未列出的路径需要 admin，空字符串表示不需要权限
+var authWriteScopes = map[string]string{
+	"/logout":                  "",
+	"/api/switch-interface":    "interface",
+	"/api/alerts/ack":          "alerts",
+	"/api/silences":            "alerts",
+	"/api/maintenance":         "alerts",
+	"/api/report":              "report",
+	"/api/replay":              "replay",
+	"/api/fleet":               "fleet",
+	"/api/fleet/agents":        "fleet",
+	"/api/fleet/agents/revoke": "fleet",
+}
+
+// parseScopes 解析逗号分隔的权限列表
+func parseScopes(s string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" || scope == "read" {
+			continue
+		}
+		if _, ok := authScopes[scope]; !ok {
+			return nil, fmt.Errorf("未知的权限 %q", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
 
-	return [3]float64{load1, load5, load15}
+// authIdentity 通过认证的请求者
+type authIdentity struct {
+	Name   string
+	Method string   // session、basic 或 token
+	Scopes []string // 写权限，为空时只读
 }
 
-// getCPUTemperature 获取CPU温度
-func (m *Monitor) getCPUTemperature() string {
-	data, err := os.ReadFile("/sys/class/thermal/thermal_zone0/temp")
-	if err != nil {
-		return "N/A"
+// can 判断请求者是否拥有某项写权限，未启用认证时（nil）不做限制
+func (id *authIdentity) can(scope string) bool {
+	if id == nil || scope == "" {
+		return true
+	}
+	for _, s := range id.Scopes {
+		if s == scope || s == "admin" {
+			return true
+		}
 	}
+	return false
+}
 
-	tempStr := strings.TrimSpace(string(data))
-	temp, err := strconv.Atoi(tempStr)
-	if err != nil {
-		return "N/A"
+// permissions 返回请求者拥有的各项写权限，供面板隐藏没有权限的操作
+func (id *authIdentity) permissions() map[string]bool {
+	perms := make(map[string]bool)
+	for scope := range authScopes {
+		perms[scope] = id.can(scope)
 	}
+	return perms
+}
 
-	return fmt.Sprintf("%.1f°C", float64(temp)/1000.0)
+type authContextKey struct{}
+
+// requestIdentity 返回请求的认证信息，未启用认证时为nil
+func requestIdentity(r *http.Request) *authIdentity {
+	id, _ := r.Context().Value(authContextKey{}).(*authIdentity)
+	return id
 }
 
-// getMemoryInfo 获取内存信息
-func (m *Monitor) getMemoryInfo() map[string]uint64 {
-	data, err := os.ReadFile("/proc/meminfo")
-	if err != nil {
-		return map[string]uint64{"total": 0, "free": 0, "used": 0}
-	}
+// authSession 登录会话
+type authSession struct {
+	user    string
+	expires time.Time
+}
 
-	memInfo := make(map[string]uint64)
-	lines := strings.Split(string(data), "\n")
+// authToken 静态令牌
+type authToken struct {
+	name   string
+	scopes []string
+}
 
-	for _, line := range lines {
-		if strings.HasPrefix(line, "MemTotal:") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				val, _ := strconv.ParseUint(fields[1], 10, 64)
-				memInfo["total"] = val
+// Authenticator 面板和API的认证：登录会话（Cookie）、HTTP 基本认证和静态令牌
+type Authenticator struct {
+	users  map[string]string    // 用户名 -> bcrypt 哈希
+	roles  map[string]string    // 用户名 -> 角色
+	tokens map[string]authToken // 令牌的 SHA-256 摘要 -> 令牌
+	ttl    time.Duration
+	dummy  string // 用户不存在时也计算一次 bcrypt，避免通过响应时间判断用户是否存在
+
+	mu         sync.Mutex
+	sessions   map[string]*authSession
+	basicCache map[string]time.Time // 用户名和密码的摘要 -> 过期时间
+}
+
+// NewAuthenticator 读取用户和令牌文件
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	if config.SessionTTL <= 0 {
+		return nil, fmt.Errorf("会话有效期必须大于0")
+	}
+	a := &Authenticator{
+		users:      make(map[string]string),
+		roles:      make(map[string]string),
+		tokens:     make(map[string]authToken),
+		ttl:        config.SessionTTL,
+		sessions:   make(map[string]*authSession),
+		basicCache: make(map[string]time.Time),
+	}
+	if config.UsersFile != "" {
+		var noRole []string
+		err := readCredentialFile(config.UsersFile, func(name, value string) error {
+			hash, role, _ := strings.Cut(value, ":")
+			if _, _, _, _, err := parseBcrypt(hash); err != nil {
+				return err
 			}
-		} else if strings.HasPrefix(line, "MemFree:") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				val, _ := strconv.ParseUint(fields[1], 10, 64)
-				memInfo["free"] = val
+			switch role {
+			case "":
+				// 早期的用户文件没有角色列，按权限最小的 viewer 处理，升级后不会因此无法启动，也不会多出写权限
+				role = roleViewer
+				noRole = append(noRole, name)
+			case roleViewer, roleAdmin:
+			default:
+				return fmt.Errorf("未知的角色 %q，只支持 %s 和 %s", role, roleViewer, roleAdmin)
 			}
-		} else if strings.HasPrefix(line, "Buffers:") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				val, _ := strconv.ParseUint(fields[1], 10, 64)
-				memInfo["buffers"] = val
+			a.users[name] = hash
+			a.roles[name] = role
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(noRole) > 0 {
+			log.Printf("警告: %s 中的用户 %s 没有角色，按 %s 处理；需要写权限时在行尾加上 :%s",
+				config.UsersFile, strings.Join(noRole, ", "), roleViewer, roleAdmin)
+		}
+		// 使用与代价最高的用户相同的代价，使不存在的用户耗时不短于真实用户
+		cost := bcryptMinCost
+		for _, hash := range a.users {
+			if _, c, _, _, _ := parseBcrypt(hash); c > cost {
+				cost = c
 			}
-		} else if strings.HasPrefix(line, "Cached:") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				val, _ := strconv.ParseUint(fields[1], 10, 64)
-				memInfo["cached"] = val
+		}
+		if len(a.users) > 0 {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				return nil, err
 			}
-		} else if strings.HasPrefix(line, "SReclaimable:") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				val, _ := strconv.ParseUint(fields[1], 10, 64)
-				memInfo["sreclaimable"] = val
+			if a.dummy, err = bcryptHash(hex.EncodeToString(b), cost); err != nil {
+				return nil, err
 			}
 		}
 	}
-
-	// 已使用内存 = 总内存 - 空闲内存 - 缓冲区 - 缓存 - 可回收内存
-	memInfo["used"] = memInfo["total"] - memInfo["free"] - memInfo["buffers"] - memInfo["cached"] - memInfo["sreclaimable"]
-	return memInfo
+	if config.TokensFile != "" {
+		err := readCredentialFile(config.TokensFile, func(name, value string) error {
+			digest, hashed := strings.CutPrefix(value, "sha256:")
+			if hashed {
+				value = digest
+			}
+			value, list, _ := strings.Cut(value, ":")
+			scopes, err := parseScopes(list)
+			if err != nil {
+				return err
+			}
+			hash := value
+			if hashed {
+				if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+					return fmt.Errorf("无效的 SHA-256 摘要")
+				}
+				hash = strings.ToLower(hash)
+			} else if len(value) < minTokenLen {
+				return fmt.Errorf("令牌至少需要%d个字符", minTokenLen)
+			} else {
+				hash = hashToken(value)
+			}
+			a.tokens[hash] = authToken{name: name, scopes: scopes}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(a.users) == 0 && len(a.tokens) == 0 {
+		return nil, fmt.Errorf("没有配置任何用户或令牌")
+	}
+	return a, nil
 }
 
-// getSwapInfo 获取SWAP信息
-func (m *Monitor) getSwapInfo() map[string]uint64 {
-	data, err := os.ReadFile("/proc/meminfo")
+// readCredentialFile 读取 名称:值 格式的文件，# 开头的行为注释
+func readCredentialFile(path string, add func(name, value string) error) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return map[string]uint64{"total": 0, "free": 0, "used": 0}
+		return err
 	}
-
-	swapInfo := make(map[string]uint64)
-	lines := strings.Split(string(data), "\n")
-
-	for _, line := range lines {
-		if strings.HasPrefix(line, "SwapTotal:") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				val, _ := strconv.ParseUint(fields[1], 10, 64)
-				swapInfo["total"] = val
-			}
-		} else if strings.HasPrefix(line, "SwapFree:") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				val, _ := strconv.ParseUint(fields[1], 10, 64)
-				swapInfo["free"] = val
-			}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || name == "" || value == "" {
+			return fmt.Errorf("%s 第%d行: 格式应为 名称:值", path, i+1)
+		}
+		if err := add(name, value); err != nil {
+			return fmt.Errorf("%s 第%d行: %v", path, i+1, err)
 		}
 	}
-
-	swapInfo["used"] = swapInfo["total"] - swapInfo["free"]
-	return swapInfo
+	return nil
 }
 
-// getDiskInfo 获取磁盘信息
-func (m *Monitor) getDiskInfo() map[string]uint64 {
-	cmd := exec.Command("df")
-	output, err := cmd.Output()
-	if err != nil {
-		return map[string]uint64{"total": 0, "used": 0, "available": 0}
+// checkPassword 校验用户名和密码，成功的结果缓存 basicAuthCacheTTL
+func (a *Authenticator) checkPassword(user, password string, now time.Time) bool {
+	sum := sha256.Sum256([]byte(user + "\x00" + password))
+	key := string(sum[:])
+	a.mu.Lock()
+	expires, cached := a.basicCache[key]
+	a.mu.Unlock()
+	if cached && now.Before(expires) {
+		return true
 	}
 
-	lines := strings.Split(string(output), "\n")
-	totalSpace := uint64(0)
-	usedSpace := uint64(0)
-	availableSpace := uint64(0)
+	hash, ok := a.users[user]
+	if !ok {
+		bcryptVerify(a.dummy, password)
+		return false
+	}
+	if !bcryptVerify(hash, password) {
+		return false
+	}
+	a.mu.Lock()
+	a.basicCache[key] = now.Add(basicAuthCacheTTL)
+	a.mu.Unlock()
+	return true
+}
 
-	for i := 1; i < len(lines); i++ {
-		line := strings.TrimSpace(lines[i])
-		if line == "" {
-			continue
+// userIdentity 按用户的角色生成认证信息
+func (a *Authenticator) userIdentity(user, method string) *authIdentity {
+	id := &authIdentity{Name: user, Method: method}
+	if a.roles[user] == roleAdmin {
+		id.Scopes = []string{"admin"}
+	}
+	return id
+}
+
+// identify 按会话 Cookie、Bearer 令牌、基本认证的顺序识别请求者
+func (a *Authenticator) identify(r *http.Request, now time.Time) *authIdentity {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		a.mu.Lock()
+		s, ok := a.sessions[c.Value]
+		if ok && now.After(s.expires) {
+			delete(a.sessions, c.Value)
+			ok = false
+		}
+		a.mu.Unlock()
+		if ok {
+			return a.userIdentity(s.user, "session")
 		}
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		hash := hashToken(strings.TrimPrefix(auth, "Bearer "))
+		for h, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				return &authIdentity{Name: t.name, Method: "token", Scopes: t.scopes}
+			}
+		}
+		return nil
+	}
+	if user, password, ok := r.BasicAuth(); ok && a.checkPassword(user, password, now) {
+		return a.userIdentity(user, "basic")
+	}
+	return nil
+}
 
-		fields := strings.Fields(line)
-		if len(fields) < 6 {
-			continue
+// Middleware 拒绝未认证的请求：浏览器访问页面时跳转到登录页，其它请求返回 401；
+// 没有相应写权限的修改请求返回 403
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authPublicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := a.identify(r, time.Now())
+		if id == nil {
+			if _, _, basic := r.BasicAuth(); basic || r.Header.Get("Authorization") != "" {
+				log.Printf("认证失败: %s %s (%s)", r.Method, r.URL.Path, r.RemoteAddr)
+			}
+			if len(a.users) > 0 && r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			if len(a.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="sysmon", charset="UTF-8"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="sysmon"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			scope, ok := authWriteScopes[r.URL.Path]
+			if !ok {
+				scope = "admin"
+			}
+			if !id.can(scope) {
+				log.Printf("拒绝 %s 的请求: %s %s 需要 %s 权限 (%s)", id.Name, r.Method, r.URL.Path, scope, r.RemoteAddr)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
 		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, id)))
+	})
+}
 
-		filesystem := fields[0]
+// safeRedirect 只允许跳转到本站的路径
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
 
-		// 参考shell脚本的过滤逻辑：排除虚拟文件系统和临时文件系统
-		if strings.Contains(filesystem, "-") ||
-			filesystem == "none" ||
-			strings.HasPrefix(filesystem, "tmpfs") ||
-			strings.HasPrefix(filesystem, "devtmpfs") ||
-			strings.Contains(filesystem, "by-uuid") ||
-			strings.Contains(filesystem, "chroot") ||
-			strings.HasPrefix(filesystem, "udev") ||
-			strings.Contains(filesystem, "docker") ||
-			strings.Contains(filesystem, "storage") {
-			continue
-		}
+var loginTmpl = template.Must(template.New("login").Parse(loginTemplate))
 
-		// 累加所有实际磁盘的空间信息
-		total, err1 := strconv.ParseUint(fields[1], 10, 64)
-		used, err2 := strconv.ParseUint(fields[2], 10, 64)
-		available, err3 := strconv.ParseUint(fields[3], 10, 64)
+// handleLogin GET 显示登录页，POST 校验用户名和密码并创建会话
+func (a *Authenticator) handleLogin(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Error    string
+		Next     string
+		Username string
+	}{Next: safeRedirect(r.FormValue("next"))}
 
-		if err1 == nil && err2 == nil && err3 == nil {
-			totalSpace += total
-			usedSpace += used
-			availableSpace += available
+	switch r.Method {
+	case "GET":
+	case "POST":
+		data.Username = r.PostFormValue("username")
+		now := time.Now()
+		if a.checkPassword(data.Username, r.PostFormValue("password"), now) {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+			id := hex.EncodeToString(b)
+			a.mu.Lock()
+			for k, s := range a.sessions {
+				if now.After(s.expires) {
+					delete(a.sessions, k)
+				}
+			}
+			a.sessions[id] = &authSession{user: data.Username, expires: now.Add(a.ttl)}
+			a.mu.Unlock()
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    id,
+				Path:     "/",
+				MaxAge:   int(a.ttl.Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			log.Printf("用户 %s 已登录 (%s)", data.Username, r.RemoteAddr)
+			http.Redirect(w, r, data.Next, http.StatusSeeOther)
+			return
 		}
+		log.Printf("用户 %q 登录失败 (%s)", data.Username, r.RemoteAddr)
+		data.Error = "用户名或密码错误"
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	loginTmpl.Execute(w, data)
+}
 
-	return map[string]uint64{
-		"total":     totalSpace,
-		"used":      usedSpace,
-		"available": availableSpace,
+// handleLogout 删除会话并回到登录页
+func (a *Authenticator) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		a.mu.Lock()
+		delete(a.sessions, c.Value)
+		a.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// runPasswd 处理 passwd 子命令：从标准输入读取密码，输出用于 -auth-users 文件的一行
+func runPasswd(args []string) {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	cost := fs.Int("cost", bcryptDefaultCost, "bcrypt 代价，每加1计算时间翻倍")
+	role := fs.String("role", roleViewer, "用户角色: viewer（只读）或 admin")
+	fs.Parse(args)
+	if fs.NArg() != 1 || strings.Contains(fs.Arg(0), ":") {
+		fmt.Fprintln(os.Stderr, "用法: sysmon passwd [-cost 10] [-role viewer|admin] 用户名  （从标准输入读取密码）")
+		os.Exit(2)
+	}
+	if *role != roleViewer && *role != roleAdmin {
+		log.Fatalf("无效的 -role 参数: 只支持 %s 和 %s", roleViewer, roleAdmin)
+	}
+	fmt.Fprint(os.Stderr, "密码: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatalf("读取密码失败: %v", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		log.Fatalf("密码不能为空")
+	}
+	hash, err := bcryptHash(password, *cost)
+	if err != nil {
+		log.Fatalf("生成哈希失败: %v", err)
 	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Printf("%s:%s:%s\n", fs.Arg(0), hash, *role)
 }
@@ -0,0 +1,2598 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试中的日志只会干扰输出
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// bcryptVectors 已发布的 bcrypt 测试向量（OpenBSD、jBCrypt 和 pyca/bcrypt 的测试集）
+var bcryptVectors = []struct {
+	password string
+	hash     string
+}{
+	{"", "$2a$06$DCq7YPn5Rq63x1Lad4cll.TV4S6ytwfsfvkgY8jIucDrjc8deX1s."},
+	{"a", "$2a$06$m0CrhHm10qJ3lXRY.5zDGO3rS2KdeeWLuGmsfGlMfOxih58VYVfxe"},
+	{"abc", "$2a$06$If6bvum7DFjUnE9p2uDeDu0YHzrHM6tf.iqN8.yx.jNN1ILEf7h0i"},
+	{"abcdefghijklmnopqrstuvwxyz", "$2a$06$.rCVZVOThsIa97pEDOxvGuRRgzG64bvtJ0938xuqzv18d3ZpQhstC"},
+	{"~!@#$%^&*()      ~!@#$%^&*()PNBFRD", "$2a$06$fPIsBO8qRqkjj273rfaOI.HtSV9jLDpTbZn782DC6/t7qT67P6FfO"},
+	{"Kk4DQuMMfZL9o", "$2b$04$cVWp4XaNU8a4v1uMRum2SO026BWLIoQMD/TXg5uZV.0P.uO8m3YEm"},
+	{"9IeRXmnGxMYbs", "$2b$04$pQ7gRO7e6wx/936oXhNjrOUNOHL1D0h1N2IDbJZYs.1ppzSof6SPy"},
+	{"xVQVbwa1S0M8r", "$2b$04$SQe9knOzepOVKoYXo9xTteNYr6MBwVz4tpriJVe3PNgYufGIsgKcW"},
+}
+
+func TestBcryptKnownAnswers(t *testing.T) {
+	for _, v := range bcryptVectors {
+		_, cost, salt, sum, err := parseBcrypt(v.hash)
+		if err != nil {
+			t.Fatalf("parseBcrypt(%q): %v", v.hash, err)
+		}
+		if got := bcryptEncoding.EncodeToString(bcryptRaw([]byte(v.password), salt, cost)); got != sum {
+			t.Errorf("bcrypt(%q) = %s，期望 %s", v.password, got, sum)
+		}
+		if !bcryptVerify(v.hash, v.password) {
+			t.Errorf("bcryptVerify(%q, %q) = false", v.hash, v.password)
+		}
+		if bcryptVerify(v.hash, v.password+"x") {
+			t.Errorf("bcryptVerify(%q) 接受了错误的密码", v.hash)
+		}
+	}
+}
+
+// 由 libxcrypt 的 crypt(3) 生成，覆盖 $2y$、非ASCII和超过72字节的密码
+func TestBcryptVerifiesStandardHashes(t *testing.T) {
+	tests := []struct {
+		password string
+		hash     string
+	}{
+		{"correct horse", "$2y$05$0123456789abcdefghijkeG78L3vLTCzcDmjO6hy3HNyZ.BRZcmKG"},
+		{"pässwörd", "$2b$10$abcdefghijklmnopqrstuunYspUDVwxKwnshT7FzjzjwI57RV2KKa"},
+		{strings.Repeat("x", 80), "$2b$05$abcdefghijklmnopqrstuujf8SX2ahXLwp9w/B.Y5XdysS6yR576q"},
+	}
+	for _, tt := range tests {
+		if !bcryptVerify(tt.hash, tt.password) {
+			t.Errorf("bcryptVerify(%q, %q) = false", tt.hash, tt.password)
+		}
+	}
+}
+
+func TestBcryptHashRoundTrip(t *testing.T) {
+	hash, err := bcryptHash("secret", bcryptMinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash) != 60 || hash[:7] != "$2b$04$" {
+		t.Fatalf("bcryptHash 返回 %q", hash)
+	}
+	if !bcryptVerify(hash, "secret") || bcryptVerify(hash, "Secret") {
+		t.Errorf("bcryptVerify 与 bcryptHash 的结果不一致")
+	}
+	if _, err := bcryptHash("secret", bcryptMinCost-1); err == nil {
+		t.Errorf("bcryptHash 接受了过低的代价")
+	}
+}
+
+// writeTestFile 在临时目录中写入文件并返回路径
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// 所有用户的代价都是4时，不存在的用户也要按完整的哈希计算一次
+func TestAuthenticatorDummyHash(t *testing.T) {
+	for _, tt := range []struct {
+		users string
+		cost  string
+	}{
+		{"alice:" + bcryptVectors[5].hash + ":admin\n", "04"},
+		{"alice:" + bcryptVectors[5].hash + ":admin\nbob:" + bcryptVectors[0].hash + ":viewer\n", "06"},
+	} {
+		a, err := NewAuthenticator(AuthConfig{UsersFile: writeTestFile(t, "users", tt.users), SessionTTL: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, _, err := parseBcrypt(a.dummy); err != nil {
+			t.Fatalf("dummy 哈希无效: %v", err)
+		}
+		if got := a.dummy[4:6]; got != tt.cost {
+			t.Errorf("dummy 哈希的代价为 %s，期望 %s", got, tt.cost)
+		}
+	}
+}
+
+func TestParseTimeParamRange(t *testing.T) {
+	def := time.Unix(1700000000, 0)
+	for _, s := range []string{"-1", "-9000000000000000000", "9223372036854775807", "253402300800", "abc"} {
+		if _, err := parseTimeParam(s, def); err == nil {
+			t.Errorf("parseTimeParam(%q) 没有返回错误", s)
+		}
+	}
+	for _, s := range []string{"", "0", "1700000000", "253402300799", "2024-01-01T00:00:00Z"} {
+		if _, err := parseTimeParam(s, def); err != nil {
+			t.Errorf("parseTimeParam(%q): %v", s, err)
+		}
+	}
+}
+
+// 超大的查询范围只读取存在的分段，不会长时间持有锁
+func TestStoreQueryHugeRange(t *testing.T) {
+	s, err := OpenStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		s.Add(now.Add(time.Duration(i-3)*time.Second), map[string]float64{"cpu_usage": float64(i)})
+	}
+
+	done := make(chan []HistoryPoint, 1)
+	go func() {
+		points, _ := s.Query("cpu_usage", time.Unix(0, 0), time.Unix(maxTimeParam, 0), 0)
+		done <- points
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("查询超大范围超时")
+	}
+
+	points, _ := s.Query("cpu_usage", now.Add(-time.Minute), now, 0)
+	if len(points) != 3 {
+		t.Errorf("查询到 %d 个点，期望 3", len(points))
+	}
+}
+
+// 权限测试使用的用户（密码为 bcryptVectors 中对应的明文）和各权限的令牌
+const (
+	testAdminPassword  = "9IeRXmnGxMYbs"
+	testViewerPassword = "Kk4DQuMMfZL9o"
+)
+
+var testScopeTokens = map[string]string{
+	"read":      "read-only-token-0123456789",
+	"interface": "interface-token-0123456789",
+	"alerts":    "alerts-token-0123456789",
+	"report":    "report-token-0123456789",
+	"replay":    "replay-token-0123456789",
+	"fleet":     "fleet-token-0123456789",
+	"admin":     "admin-token-0123456789",
+}
+
+// newAuthTestMonitor 创建启用认证、告警、hub 和回放的监控器，各修改接口都已注册
+func newAuthTestMonitor(t *testing.T) *EnhancedMonitor {
+	t.Helper()
+	users := "admin:" + bcryptVectors[6].hash + ":admin\nviewer:" + bcryptVectors[5].hash + ":viewer\n"
+	var tokens strings.Builder
+	for scope, token := range testScopeTokens {
+		fmt.Fprintf(&tokens, "%s:%s:%s\n", scope, token, scope)
+	}
+	auth, err := NewAuthenticator(AuthConfig{
+		UsersFile:  writeTestFile(t, "users", users),
+		TokensFile: writeTestFile(t, "tokens", tokens.String()),
+		SessionTTL: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{Interface: "lo", Interval: time.Second, HistorySize: 10, Hub: HubConfig{Enabled: true, OfflineAfter: time.Minute}}
+	em := &EnhancedMonitor{
+		config:    config,
+		history:   NewHistory(config.HistorySize),
+		stream:    NewStream(streamBacklog),
+		scheduler: &Scheduler{},
+		monitor:   &Monitor{config: config, traffic: NewTrafficAccounting(config)},
+		alerts:    NewAlertManager(nil),
+		auth:      auth,
+	}
+	if em.fleet, err = NewFleet(config); err != nil {
+		t.Fatal(err)
+	}
+	if em.agents, err = NewAgentRegistry(config); err != nil {
+		t.Fatal(err)
+	}
+	samples := []RecordSample{{Time: time.Unix(1700000000, 0), Interface: "lo", Values: map[string]float64{"cpu_usage": 1}}}
+	em.replay = NewReplay([]string{"test.jsonl"}, samples, em.monitor, em.stream.Notify, 1, false)
+	return em
+}
+
+// authWriteTests 各修改接口及其需要的权限
+var authWriteTests = []struct {
+	method string
+	path   string
+	body   string
+	scope  string
+}{
+	{"POST", "/api/switch-interface", `{"interface": "lo"}`, "interface"},
+	{"POST", "/api/alerts/ack", `{"id": "high_cpu"}`, "alerts"},
+	{"DELETE", "/api/alerts/ack?id=high_cpu", "", "alerts"},
+	{"POST", "/api/silences", `{"matchers": "{rule=\"high_cpu\"}", "duration": "1h"}`, "alerts"},
+	{"DELETE", "/api/silences?id=1", "", "alerts"},
+	{"POST", "/api/maintenance", `{"spec": "sun 02:00-04:00"}`, "alerts"},
+	{"DELETE", "/api/maintenance?id=1", "", "alerts"},
+	{"POST", "/api/report", "", "report"},
+	{"POST", "/api/replay", `{"action": "pause"}`, "replay"},
+	{"DELETE", "/api/fleet?host=web1", "", "fleet"},
+	{"DELETE", "/api/fleet/agents?name=web1", "", "fleet"},
+	{"POST", "/api/fleet/agents/revoke", `{"name": "web1"}`, "fleet"},
+	// 未在 authWriteScopes 中列出的路径默认需要 admin
+	{"POST", "/api/stats", "", "admin"},
+	{"PUT", "/api/history", "", "admin"},
+	{"DELETE", "/api/fleet/self", "", "admin"},
+}
+
+// serveAs 以指定身份发送请求，who 为用户 viewer、admin，或 "token:" 加令牌的权限名
+func serveAs(h http.Handler, who, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	setCredentials(r.Header, who)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// setCredentials 设置身份对应的 Authorization 请求头
+func setCredentials(h http.Header, who string) {
+	switch who {
+	case "viewer":
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("viewer:"+testViewerPassword)))
+	case "admin":
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:"+testAdminPassword)))
+	default:
+		h.Set("Authorization", "Bearer "+testScopeTokens[strings.TrimPrefix(who, "token:")])
+	}
+}
+
+func TestAuthWriteScopesCovered(t *testing.T) {
+	tested := make(map[string]bool)
+	for _, tt := range authWriteTests {
+		tested[strings.SplitN(tt.path, "?", 2)[0]] = true
+	}
+	for path, scope := range authWriteScopes {
+		if scope != "" && !tested[path] {
+			t.Errorf("%s 需要 %s 权限，但没有对应的测试", path, scope)
+		}
+	}
+}
+
+func TestAuthForbidsWritesWithoutScope(t *testing.T) {
+	em := newAuthTestMonitor(t)
+	h := em.newHandler(context.Background())
+
+	for _, tt := range authWriteTests {
+		denied := []string{"viewer"}
+		allowed := []string{"admin", "token:admin"}
+		for scope := range testScopeTokens {
+			switch scope {
+			case "admin":
+			case tt.scope:
+				allowed = append(allowed, "token:"+scope)
+			default:
+				denied = append(denied, "token:"+scope)
+			}
+		}
+		for _, who := range denied {
+			if w := serveAs(h, who, tt.method, tt.path, tt.body); w.Code != http.StatusForbidden {
+				t.Errorf("%s %s %s: 状态码 %d，期望 403", who, tt.method, tt.path, w.Code)
+			}
+		}
+		for _, who := range allowed {
+			if w := serveAs(h, who, tt.method, tt.path, tt.body); w.Code == http.StatusForbidden || w.Code == http.StatusUnauthorized {
+				t.Errorf("%s %s %s: 状态码 %d，期望通过认证和权限检查", who, tt.method, tt.path, w.Code)
+			}
+		}
+	}
+}
+
+// 被拒绝的请求不能产生任何修改，只读请求不受影响
+func TestAuthForbiddenWriteHasNoEffect(t *testing.T) {
+	em := newAuthTestMonitor(t)
+	h := em.newHandler(context.Background())
+
+	body := `{"matchers": "{rule=\"high_cpu\"}", "duration": "1h"}`
+	if w := serveAs(h, "viewer", "POST", "/api/silences", body); w.Code != http.StatusForbidden {
+		t.Fatalf("viewer 添加静默: 状态码 %d", w.Code)
+	}
+	if n := len(em.alerts.Silences()); n != 0 {
+		t.Errorf("viewer 被拒绝后仍添加了 %d 个静默", n)
+	}
+	if w := serveAs(h, "viewer", "GET", "/api/silences", ""); w.Code != http.StatusOK {
+		t.Errorf("viewer 查看静默: 状态码 %d", w.Code)
+	}
+	if w := serveAs(h, "token:read", "GET", "/api/history", ""); w.Code != http.StatusOK {
+		t.Errorf("只读令牌查询历史: 状态码 %d", w.Code)
+	}
+	if w := serveAs(h, "token:alerts", "POST", "/api/silences", body); w.Code != http.StatusOK {
+		t.Fatalf("alerts 令牌添加静默: 状态码 %d", w.Code)
+	}
+	if n := len(em.alerts.Silences()); n != 1 {
+		t.Errorf("静默数为 %d，期望 1", n)
+	}
+}
+
+// wsCommand 以指定身份连接 /api/ws，发送一条命令并返回结果
+func wsCommand(t *testing.T, addr, who string, req map[string]string) map[string]interface{} {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	header := http.Header{}
+	setCredentials(header, who)
+	fmt.Fprintf(conn, "GET /api/ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nAuthorization: %s\r\n\r\n",
+		addr, header.Get("Authorization"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("%s 握手: 状态码 %d", who, resp.StatusCode)
+	}
+
+	// 客户端帧必须加掩码
+	payload, _ := json.Marshal(req)
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := append([]byte{0x80 | wsText, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := int(head[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(br, message); err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(message, &result); err != nil {
+		t.Fatalf("无效的响应 %s: %v", message, err)
+	}
+	return result
+}
+
+func TestAuthWebSocketSwitchInterface(t *testing.T) {
+	em := newAuthTestMonitor(t)
+	em.replay = nil
+	srv := httptest.NewServer(em.newHandler(context.Background()))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	req := map[string]string{"type": "command", "id": "1", "command": "switch_interface", "interface": "no-such-interface"}
+	for _, who := range []string{"viewer", "token:read", "token:alerts", "token:fleet"} {
+		result := wsCommand(t, addr, who, req)
+		if result["ok"] != false || result["error"] != "没有切换网卡的权限" {
+			t.Errorf("%s: %v，期望没有权限", who, result)
+		}
+	}
+	for _, who := range []string{"admin", "token:admin", "token:interface"} {
+		result := wsCommand(t, addr, who, req)
+		if result["error"] == "没有切换网卡的权限" {
+			t.Errorf("%s: %v，期望通过权限检查", who, result)
+		}
+	}
+	if got := getSelectedInterface(); got != "lo" && got != "" {
+		t.Errorf("网卡被切换为 %s", got)
+	}
+}
+
+// 只有用户名和哈希两列的旧格式按 viewer 处理，不能修改状态
+func TestAuthenticatorDefaultRole(t *testing.T) {
+	users := writeTestFile(t, "users", "alice:"+bcryptVectors[5].hash+"\nbob:"+bcryptVectors[6].hash+":admin\n")
+	a, err := NewAuthenticator(AuthConfig{UsersFile: users, SessionTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("没有角色的用户: %v", err)
+	}
+	if role := a.roles["alice"]; role != roleViewer {
+		t.Errorf("没有角色的用户: 角色 %q，期望 %q", role, roleViewer)
+	}
+	if role := a.roles["bob"]; role != roleAdmin {
+		t.Errorf("有角色的用户: 角色 %q，期望 %q", role, roleAdmin)
+	}
+	em := newAuthTestMonitor(t)
+	em.auth = a
+	r := httptest.NewRequest("POST", "/api/switch-interface", strings.NewReader(`{"interface": "lo"}`))
+	r.SetBasicAuth("alice", testViewerPassword)
+	w := httptest.NewRecorder()
+	em.newHandler(context.Background()).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("没有角色的用户切换网卡: 状态码 %d，期望 403", w.Code)
+	}
+
+	users = writeTestFile(t, "users", "alice:"+bcryptVectors[5].hash+":root\n")
+	if _, err := NewAuthenticator(AuthConfig{UsersFile: users, SessionTTL: time.Hour}); err == nil {
+		t.Errorf("接受了未知的角色")
+	}
+}
+
+func TestStoreChunkRoundTrip(t *testing.T) {
+	for _, raw := range []bool{true, false} {
+		series := map[string][]storePoint{
+			"cpu_usage": {{t: 1700000000, avg: 1.5, min: 1, max: 2, count: 3}, {t: 1700000060, avg: -4, min: -8, max: 0, count: 60}},
+			"mem_usage": {{t: 1699999990, avg: 42, min: 42, max: 42, count: 1}},
+		}
+		if raw {
+			for name, points := range series {
+				for i := range points {
+					points[i].min, points[i].max, points[i].count = points[i].avg, points[i].avg, 1
+				}
+				series[name] = points
+			}
+		}
+		payload := encodeChunk(series, raw)
+		for name, want := range series {
+			var got []storePoint
+			if err := decodeChunk(payload, name, func(p storePoint) { got = append(got, p) }); err != nil {
+				t.Fatalf("decodeChunk(raw=%v): %v", raw, err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("%s (raw=%v): 解码出 %d 个点，期望 %d", name, raw, len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("%s (raw=%v) 第%d个点: %+v，期望 %+v", name, raw, i, got[i], want[i])
+				}
+			}
+		}
+		if err := decodeChunk(payload[:len(payload)-3], "mem_usage", func(storePoint) {}); err == nil {
+			t.Errorf("截断的数据块 (raw=%v) 没有返回错误", raw)
+		}
+	}
+}
+
+// storeTestStart 测试样本的起始时间：两小时前的整点，落在原始层的一个分段内
+func storeTestStart() time.Time {
+	return time.Now().Truncate(time.Hour).Add(-2 * time.Hour)
+}
+
+// addStoreSamples 从 start 开始每秒写入一个样本，cpu_usage 的值为秒序号
+func addStoreSamples(s *Store, start time.Time, n int) {
+	for i := 0; i < n; i++ {
+		s.Add(start.Add(time.Duration(i)*time.Second), map[string]float64{"cpu_usage": float64(i)})
+	}
+}
+
+// 崩溃时写了一半的记录在重新打开时被截断，之前的记录完整保留
+func TestStoreRepairTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := storeTestStart()
+	// 每 rawFlushEvery 个样本一条记录，Close 写出最后不足一条的10个样本
+	addStoreSamples(s, start, 2*rawFlushEvery+10)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := s.tiers[0].segmentPath(start.Unix())
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid := scanRecords(data, nil); valid != len(data) {
+		t.Errorf("重新打开后文件长度 %d，最后一条完整记录结束于 %d", len(data), valid)
+	}
+
+	points, _ := s.Query("cpu_usage", start, start.Add(time.Hour), 0)
+	if len(points) != 2*rawFlushEvery {
+		t.Fatalf("修复后查询到 %d 个点，期望 %d", len(points), 2*rawFlushEvery)
+	}
+	for i, p := range points {
+		if p.Time != start.Unix()+int64(i) || p.Avg != float64(i) {
+			t.Fatalf("第%d个点为 %+v", i, p)
+		}
+	}
+}
+
+// 原始样本逐级汇总到1分钟和1小时层
+func TestStoreRollup(t *testing.T) {
+	s, err := OpenStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := storeTestStart()
+	addStoreSamples(s, start, 180)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(tier *storeTier) []storePoint {
+		var points []storePoint
+		for _, seg := range tier.segments() {
+			data, err := os.ReadFile(tier.segmentPath(seg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			scanRecords(data, func(payload []byte) {
+				decodeChunk(payload, "cpu_usage", func(p storePoint) { points = append(points, p) })
+			})
+		}
+		return points
+	}
+
+	minutes := read(s.tiers[1])
+	if len(minutes) != 3 {
+		t.Fatalf("1分钟层有 %d 个点，期望 3", len(minutes))
+	}
+	for i, p := range minutes {
+		first := float64(i * 60)
+		want := storePoint{t: start.Unix() + int64(i*60), avg: first + 29.5, min: first, max: first + 59, count: 60}
+		if p != want {
+			t.Errorf("第%d分钟: %+v，期望 %+v", i, p, want)
+		}
+	}
+	hours := read(s.tiers[2])
+	if len(hours) != 1 || hours[0].avg != 89.5 || hours[0].min != 0 || hours[0].max != 179 || hours[0].count != 180 {
+		t.Errorf("1小时层: %+v", hours)
+	}
+}
+
+// 打开存储时删除整段都已过期的分段文件
+func TestStoreRetention(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "raw")
+	if err := os.MkdirAll(raw, 0755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	old := now.Add(-5*time.Hour).Unix() / 3600 * 3600
+	recent := now.Unix() / 3600 * 3600
+	for _, seg := range []int64{old, recent} {
+		if err := os.WriteFile(filepath.Join(raw, fmt.Sprintf("%d.dat", seg)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := OpenStore(dir, map[string]time.Duration{"raw": 2 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := os.Stat(filepath.Join(raw, fmt.Sprintf("%d.dat", old))); !os.IsNotExist(err) {
+		t.Errorf("过期的分段没有被删除: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(raw, fmt.Sprintf("%d.dat", recent))); err != nil {
+		t.Errorf("未过期的分段被删除: %v", err)
+	}
+}
+
+// 查询读取文件时不持有锁，并发写入的数据既不丢失也不重复
+func TestStoreQueryConcurrentAdd(t *testing.T) {
+	s, err := OpenStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	start := storeTestStart()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		addStoreSamples(s, start, 600)
+	}()
+	for i := 0; i < 50; i++ {
+		points, _ := s.Query("cpu_usage", start, start.Add(time.Hour), 0)
+		for j, p := range points {
+			if p.Time != start.Unix()+int64(j) {
+				t.Fatalf("第%d个点的时间为 %d，期望 %d", j, p.Time, start.Unix()+int64(j))
+			}
+		}
+	}
+	<-done
+	if points, _ := s.Query("cpu_usage", start, start.Add(time.Hour), 0); len(points) != 600 {
+		t.Errorf("查询到 %d 个点，期望 600", len(points))
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		last, curr uint64
+		rebooted   bool
+		want       uint64
+	}{
+		{100, 150, false, 50},
+		{100, 100, false, 0},
+		{0, 42, false, 42},
+		// 网卡重建后计数器从0重新开始
+		{1000, 30, false, 30},
+		// 64位计数器接近上限时仍按差值计算
+		{math.MaxUint64 - 10, math.MaxUint64, false, 10},
+		// 重启后即使读数更大，也只能是重启以来的流量
+		{100, 500, true, 500},
+		{500, 100, true, 100},
+	}
+	for _, tt := range tests {
+		if got := counterDelta(tt.last, tt.curr, tt.rebooted); got != tt.want {
+			t.Errorf("counterDelta(%d, %d, %v) = %d，期望 %d", tt.last, tt.curr, tt.rebooted, got, tt.want)
+		}
+	}
+}
+
+func TestCycleStart(t *testing.T) {
+	at := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, displayZone)
+	}
+	tests := []struct {
+		billingDay int
+		now        time.Time
+		start      time.Time
+		end        time.Time
+	}{
+		{1, at(2024, 3, 15, 12), at(2024, 3, 1, 0), at(2024, 4, 1, 0)},
+		{1, at(2024, 1, 1, 0), at(2024, 1, 1, 0), at(2024, 2, 1, 0)},
+		{15, at(2024, 3, 14, 23), at(2024, 2, 15, 0), at(2024, 3, 15, 0)},
+		{15, at(2024, 3, 15, 0), at(2024, 3, 15, 0), at(2024, 4, 15, 0)},
+		// 跨年
+		{15, at(2024, 1, 10, 0), at(2023, 12, 15, 0), at(2024, 1, 15, 0)},
+		// 31日在短月取月末，下一个周期回到31日
+		{31, at(2024, 2, 29, 0), at(2024, 2, 29, 0), at(2024, 3, 31, 0)},
+		{31, at(2024, 2, 28, 23), at(2024, 1, 31, 0), at(2024, 2, 29, 0)},
+		{31, at(2023, 2, 28, 1), at(2023, 2, 28, 0), at(2023, 3, 31, 0)},
+		{31, at(2024, 4, 30, 0), at(2024, 4, 30, 0), at(2024, 5, 31, 0)},
+		{31, at(2024, 5, 15, 0), at(2024, 4, 30, 0), at(2024, 5, 31, 0)},
+		{30, at(2024, 3, 1, 0), at(2024, 2, 29, 0), at(2024, 3, 30, 0)},
+		// UTC 的月末在 displayZone 已是下个月
+		{1, time.Date(2024, 3, 31, 17, 0, 0, 0, time.UTC), at(2024, 4, 1, 0), at(2024, 5, 1, 0)},
+	}
+	for _, tt := range tests {
+		ta := NewTrafficAccounting(Config{BillingDay: tt.billingDay})
+		start := ta.cycleStart(tt.now)
+		if !start.Equal(tt.start) {
+			t.Errorf("账单日 %d, %s: 周期开始于 %s，期望 %s", tt.billingDay, tt.now, start, tt.start)
+		}
+		if end := ta.billingDate(start.Year(), start.Month()+1); !end.Equal(tt.end) {
+			t.Errorf("账单日 %d, %s: 周期结束于 %s，期望 %s", tt.billingDay, tt.now, end, tt.end)
+		}
+	}
+}
+
+func TestFormatLineProtocol(t *testing.T) {
+	now := time.Unix(1704085200, 0)
+	points := []MetricPoint{
+		{Name: "cpu_usage_percent", Value: 12.5},
+		{Name: "disk_used_bytes", Labels: map[string]string{"mount": "/mnt/my disk", "device": "a,b=c"}, Value: 1.2e10},
+		{Name: "fleet_host_up", Labels: map[string]string{"host": "db1"}, Value: 1},
+		{Name: "bad value", Value: math.NaN()},
+		{Name: "odd name,x", Labels: map[string]string{"empty": ""}, Value: math.Inf(1)},
+		{Name: "odd name,x", Labels: map[string]string{"empty": ""}, Value: -3},
+	}
+	want := []string{
+		`sysmon_cpu_usage_percent,host=web\ 1 value=12.5 1704085200`,
+		`sysmon_disk_used_bytes,device=a\,b\=c,host=web\ 1,mount=/mnt/my\ disk value=1.2e+10 1704085200`,
+		`sysmon_fleet_host_up,exported_host=db1,host=web\ 1 value=1 1704085200`,
+		`sysmon_odd\ name\,x,host=web\ 1 value=-3 1704085200`,
+	}
+	got := formatLineProtocol(points, "web 1", now)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("行协议:\n%s\n期望:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// influxStub 模拟 InfluxDB 写入接口，按顺序返回 codes 中的状态码，用完后返回 204
+type influxStub struct {
+	codes  []int
+	bodies []string
+	query  string
+	auth   string
+}
+
+func (s *influxStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.bodies = append(s.bodies, string(body))
+	s.query = r.URL.Path + "?" + r.URL.RawQuery
+	s.auth = r.Header.Get("Authorization")
+	code := http.StatusNoContent
+	if len(s.codes) > 0 {
+		code, s.codes = s.codes[0], s.codes[1:]
+	}
+	w.WriteHeader(code)
+}
+
+func newInfluxStub(t *testing.T, config InfluxConfig, codes ...int) (*InfluxOutput, *influxStub) {
+	t.Helper()
+	stub := &influxStub{codes: codes}
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+	config.URL = srv.URL
+	config.Interval = time.Second
+	if config.BatchSize == 0 {
+		config.BatchSize = 10
+	}
+	config.QueueSize = 100
+	o, err := NewInfluxOutput(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, stub
+}
+
+func TestInfluxWriteEndpoints(t *testing.T) {
+	o, stub := newInfluxStub(t, InfluxConfig{Database: "sysmon"})
+	if _, err := o.write(context.Background(), []string{"a value=1 1", "b value=2 1"}); err != nil {
+		t.Fatal(err)
+	}
+	if stub.query != "/write?db=sysmon&precision=s" || stub.bodies[0] != "a value=1 1\nb value=2 1\n" || stub.auth != "" {
+		t.Errorf("v1 写入: %s %q %q", stub.query, stub.bodies[0], stub.auth)
+	}
+
+	o, stub = newInfluxStub(t, InfluxConfig{Org: "my org", Bucket: "b", Token: "secret"})
+	if _, err := o.write(context.Background(), []string{"a value=1 1"}); err != nil {
+		t.Fatal(err)
+	}
+	if stub.query != "/api/v2/write?bucket=b&org=my+org&precision=s" || stub.auth != "Token secret" {
+		t.Errorf("v2 写入: %s %q", stub.query, stub.auth)
+	}
+}
+
+func TestInfluxRetryPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		code  int
+		retry bool
+	}{
+		{http.StatusInternalServerError, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusForbidden, false},
+		{http.StatusNotFound, false},
+		{http.StatusRequestEntityTooLarge, false},
+	} {
+		o, _ := newInfluxStub(t, InfluxConfig{Database: "sysmon"}, tt.code)
+		retry, err := o.write(context.Background(), []string{"a value=1 1"})
+		if err == nil || retry != tt.retry {
+			t.Errorf("状态码 %d: retry=%v err=%v，期望 retry=%v", tt.code, retry, err, tt.retry)
+		}
+	}
+}
+
+func TestInfluxQueueBackoff(t *testing.T) {
+	o, stub := newInfluxStub(t, InfluxConfig{Database: "sysmon", BatchSize: 2},
+		http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusBadRequest)
+	send := func(lines []string) (bool, error) { return o.write(context.Background(), lines) }
+	now := time.Unix(1704085200, 0)
+	o.queue.push([]string{"a", "b", "c"})
+
+	// 第一次失败后退避1秒，期间不再发送
+	o.queue.flush(now, send)
+	o.queue.flush(now.Add(500*time.Millisecond), send)
+	if len(stub.bodies) != 1 || len(o.queue.lines) != 3 || o.queue.backoff != outputMinBackoff {
+		t.Fatalf("第一次失败后发送 %d 次，队列 %d 行，退避 %s", len(stub.bodies), len(o.queue.lines), o.queue.backoff)
+	}
+	// 第二次失败退避翻倍
+	now = now.Add(time.Second)
+	o.queue.flush(now, send)
+	if len(stub.bodies) != 2 || o.queue.backoff != 2*time.Second || !o.queue.nextTry.Equal(now.Add(2*time.Second)) {
+		t.Fatalf("第二次失败后发送 %d 次，退避 %s", len(stub.bodies), o.queue.backoff)
+	}
+	// 400 丢弃该批但不退避，继续发送剩余数据
+	now = now.Add(2 * time.Second)
+	o.queue.flush(now, send)
+	if len(stub.bodies) != 4 || len(o.queue.lines) != 0 || o.queue.backoff != 0 {
+		t.Fatalf("恢复后发送 %d 次，队列 %d 行，退避 %s", len(stub.bodies), len(o.queue.lines), o.queue.backoff)
+	}
+	if stub.bodies[2] != "a\nb\n" || stub.bodies[3] != "c\n" {
+		t.Errorf("分批发送: %q", stub.bodies[2:])
+	}
+
+	// 退避上限
+	o.queue.backoff = outputMaxBackoff
+	stub.codes = []int{http.StatusInternalServerError}
+	o.queue.push([]string{"d"})
+	o.queue.flush(now, send)
+	if o.queue.backoff != outputMaxBackoff {
+		t.Errorf("退避超过上限: %s", o.queue.backoff)
+	}
+
+	// 队列满时丢弃最旧的数据
+	q := newLineQueue("test", 3, 10)
+	q.push([]string{"1", "2"})
+	q.push([]string{"3", "4", "5"})
+	if strings.Join(q.lines, ",") != "3,4,5" || q.dropped != 2 {
+		t.Errorf("队列满: %v，丢弃 %d", q.lines, q.dropped)
+	}
+}
+
+func TestOTLPCounterStartTime(t *testing.T) {
+	o, err := NewOTLPOutput(OTLPConfig{Endpoint: "http://127.0.0.1:4318", Interval: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	boot, started := time.Unix(1700000000, 0), time.Unix(1704085000, 0)
+	o.bootTime, o.startTime = boot, started
+
+	// starts 返回每个计数器序列的起始时间，键为指标名和第一个属性值
+	starts := func(now time.Time, points ...MetricPoint) map[string]time.Time {
+		got := make(map[string]time.Time)
+		for _, m := range o.request(points, now).ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			if m.Sum == nil {
+				if m.Gauge == nil || m.Gauge.DataPoints[0].StartTimeUnixNano != "" {
+					t.Errorf("%s: gauge 不应带起始时间", m.Name)
+				}
+				continue
+			}
+			if !m.Sum.IsMonotonic || m.Sum.AggregationTemporality != otlpTemporalityCumulative {
+				t.Errorf("%s: 不是单调累计 Sum", m.Name)
+			}
+			for _, dp := range m.Sum.DataPoints {
+				ns, _ := strconv.ParseInt(dp.StartTimeUnixNano, 10, 64)
+				got[m.Name+" "+dp.Attributes[0].Value.StringValue] = time.Unix(0, ns)
+			}
+		}
+		return got
+	}
+	eth0 := func(v float64) MetricPoint {
+		return MetricPoint{Name: "network_receive_bytes", Labels: map[string]string{"interface": "eth0"}, Value: v}
+	}
+	eth1 := MetricPoint{Name: "network_receive_bytes", Labels: map[string]string{"interface": "eth1"}, Value: 10}
+	runs := func(v float64) MetricPoint {
+		return MetricPoint{Name: "collector_runs", Labels: map[string]string{"collector": "cpu"}, Value: v}
+	}
+	load := MetricPoint{Name: "load1", Value: 0.5}
+
+	t1 := time.Unix(1704085200, 0)
+	got := starts(t1, eth0(1000), eth1, runs(5), load)
+	if !got["sysmon.network_receive_bytes eth0"].Equal(boot) || !got["sysmon.collector_runs cpu"].Equal(started) {
+		t.Fatalf("首次起始时间: %v", got)
+	}
+
+	// eth0 计数器归零（网卡重建），起始时间变为上一次采样的时间，其他序列不变
+	t2 := t1.Add(10 * time.Second)
+	got = starts(t2, eth0(20), eth1, runs(6))
+	if !got["sysmon.network_receive_bytes eth0"].Equal(t1) || !got["sysmon.network_receive_bytes eth1"].Equal(boot) ||
+		!got["sysmon.collector_runs cpu"].Equal(started) {
+		t.Fatalf("重置后起始时间: %v", got)
+	}
+	t3 := t2.Add(10 * time.Second)
+	if got = starts(t3, eth0(30), runs(7)); !got["sysmon.network_receive_bytes eth0"].Equal(t1) {
+		t.Errorf("重置后继续增长，起始时间应保持不变: %v", got)
+	}
+	// eth1 消失后重新出现，作为新序列从开机时间开始
+	if got = starts(t3.Add(10*time.Second), eth1); !got["sysmon.network_receive_bytes eth1"].Equal(boot) {
+		t.Errorf("重新出现的序列: %v", got)
+	}
+
+	// 读不到开机时间时退回程序启动时间
+	o.bootTime = time.Time{}
+	o.counters = make(map[string]otlpCounter)
+	if got = starts(t1, eth0(1)); !got["sysmon.network_receive_bytes eth0"].Equal(started) {
+		t.Errorf("没有开机时间: %v", got)
+	}
+}
+
+func TestReadBootTime(t *testing.T) {
+	if _, err := os.Stat("/proc/stat"); err != nil {
+		t.Skip("没有 /proc/stat")
+	}
+	boot := readBootTime()
+	if boot.IsZero() || boot.After(time.Now()) {
+		t.Errorf("开机时间: %v", boot)
+	}
+}
+
+// newMQTTTestOutput 创建连接到 net.Pipe 另一端的 MQTT 输出，返回的 broker 端由测试扮演 broker
+func newMQTTTestOutput(t *testing.T, config MQTTConfig) (*MQTTOutput, net.Conn, *bufio.Reader) {
+	t.Helper()
+	config.Broker = "tcp://127.0.0.1"
+	config.Interval = 10 * time.Second
+	if config.Topic == "" {
+		config.Topic = "sysmon/test"
+	}
+	o, err := NewMQTTOutput(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, broker := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		broker.Close()
+	})
+	o.timeout = time.Second
+	o.conn, o.reader = client, bufio.NewReader(client)
+	o.discovered = make(map[string]bool)
+	broker.SetDeadline(time.Now().Add(5 * time.Second))
+	return o, broker, bufio.NewReader(broker)
+}
+
+// readMQTTPacket 读取一个完整报文，返回首字节、剩余长度的编码和剩余部分
+func readMQTTPacket(t *testing.T, r *bufio.Reader) (byte, []byte, []byte) {
+	t.Helper()
+	header, err := r.ReadByte()
+	if err != nil {
+		t.Fatalf("读取报文: %v", err)
+	}
+	var lenBytes []byte
+	length, multiplier := 0, 1
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatalf("读取报文长度: %v", err)
+		}
+		lenBytes = append(lenBytes, b)
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("读取报文内容: %v", err)
+	}
+	return header, lenBytes, body
+}
+
+// mqttPublished 解析 PUBLISH 报文，返回主题、报文ID（QoS 0 时为0）和负载
+func mqttPublished(t *testing.T, header byte, body []byte) (string, uint16, []byte) {
+	t.Helper()
+	if header&0xF0 != mqttPublish {
+		t.Fatalf("期望 PUBLISH，收到 0x%x", header)
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	topic, body := string(body[2:2+n]), body[2+n:]
+	var id uint16
+	if header&0x06 != 0 {
+		id, body = binary.BigEndian.Uint16(body), body[2:]
+	}
+	return topic, id, body
+}
+
+// mqttReadString 读取带2字节长度前缀的字符串
+func mqttReadString(b []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func TestMQTTConnect(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		config   MQTTConfig
+		flags    byte
+		trailing []string
+	}{
+		{"匿名", MQTTConfig{ClientID: "c1"}, 0x2E, nil},
+		{"用户名", MQTTConfig{ClientID: "c1", Username: "u"}, 0xAE, []string{"u"}},
+		{"用户名密码", MQTTConfig{ClientID: "c1", Username: "u", Password: "p w"}, 0xEE, []string{"u", "p w"}},
+	} {
+		o, broker, r := newMQTTTestOutput(t, tt.config)
+		client := o.conn
+		o.conn = nil
+		done := make(chan error, 1)
+		go func() { done <- o.handshake(client) }()
+
+		header, _, body := readMQTTPacket(t, r)
+		if header != mqttConnect {
+			t.Fatalf("%s: 期望 CONNECT，收到 0x%x", tt.name, header)
+		}
+		proto, body := mqttReadString(body)
+		if proto != "MQTT" || body[0] != 4 || body[1] != tt.flags {
+			t.Errorf("%s: 协议 %q 版本 %d 标志 0x%x，期望标志 0x%x", tt.name, proto, body[0], body[1], tt.flags)
+		}
+		if keepAlive := binary.BigEndian.Uint16(body[2:]); keepAlive != 30 {
+			t.Errorf("%s: 保活时间 %d", tt.name, keepAlive)
+		}
+		var fields []string
+		for rest := body[4:]; len(rest) > 0; {
+			var f string
+			f, rest = mqttReadString(rest)
+			fields = append(fields, f)
+		}
+		want := append([]string{"c1", "sysmon/test/status", "offline"}, tt.trailing...)
+		if strings.Join(fields, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: CONNECT 负载 %q，期望 %q", tt.name, fields, want)
+		}
+
+		broker.Write([]byte{mqttConnack, 2, 0, 0})
+		header, _, body = readMQTTPacket(t, r)
+		topic, id, payload := mqttPublished(t, header, body)
+		if topic != "sysmon/test/status" || string(payload) != "online" || header&0x07 != 0x03 {
+			t.Errorf("%s: 在线状态 %s %q 标志 0x%x", tt.name, topic, payload, header&0x07)
+		}
+		broker.Write([]byte{mqttPuback, 2, byte(id >> 8), byte(id)})
+		if err := <-done; err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	// broker 拒绝连接
+	o, broker, r := newMQTTTestOutput(t, MQTTConfig{ClientID: "c1", Username: "u", Password: "bad"})
+	done := make(chan error, 1)
+	go func() { done <- o.handshake(o.conn) }()
+	readMQTTPacket(t, r)
+	broker.Write([]byte{mqttConnack, 2, 0, 4})
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "用户名或密码错误") {
+		t.Errorf("拒绝连接: %v", err)
+	}
+}
+
+func TestMQTTRemainingLength(t *testing.T) {
+	for _, tt := range []struct {
+		n       int
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	} {
+		o, broker, r := newMQTTTestOutput(t, MQTTConfig{})
+		body := make([]byte, tt.n)
+		if tt.n > 0 {
+			body[tt.n-1] = 0xAB
+		}
+		done := make(chan error, 1)
+		go func() { done <- o.writePacket(mqttPublish, body) }()
+		header, lenBytes, got := readMQTTPacket(t, r)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if header != mqttPublish || string(lenBytes) != string(tt.encoded) || len(got) != tt.n {
+			t.Errorf("长度 %d: 编码为 % x，期望 % x", tt.n, lenBytes, tt.encoded)
+		}
+
+		// 反向：broker 发来的报文能按同样的编码解析
+		go func() {
+			broker.Write(append(append([]byte{mqttPuback}, tt.encoded...), body...))
+		}()
+		packetType, payload, err := o.readPacket()
+		if err != nil || packetType != mqttPuback || len(payload) != tt.n {
+			t.Errorf("长度 %d: 解析为 0x%x %d %v", tt.n, packetType, len(payload), err)
+		}
+	}
+
+	// 剩余长度最多4个字节
+	o, broker, _ := newMQTTTestOutput(t, MQTTConfig{})
+	go broker.Write([]byte{mqttPuback, 0x80, 0x80, 0x80, 0x80, 0x01})
+	if _, _, err := o.readPacket(); err == nil {
+		t.Error("5字节的剩余长度应当报错")
+	}
+}
+
+func TestMQTTPublishQoS1(t *testing.T) {
+	o, broker, r := newMQTTTestOutput(t, MQTTConfig{QoS: 1})
+	done := make(chan error, 1)
+	go func() { done <- o.publish("sysmon/test/load1", []byte("0.5"), 1, false) }()
+	header, _, body := readMQTTPacket(t, r)
+	topic, id, payload := mqttPublished(t, header, body)
+	if topic != "sysmon/test/load1" || string(payload) != "0.5" || header&0x07 != 0x02 || id == 0 {
+		t.Fatalf("PUBLISH: %s %q 标志 0x%x ID %d", topic, payload, header&0x07, id)
+	}
+	// 其他报文ID的 PUBACK 被忽略，继续等待
+	broker.Write([]byte{mqttPuback, 2, byte((id + 1) >> 8), byte(id + 1)})
+	select {
+	case err := <-done:
+		t.Fatalf("收到错误ID的 PUBACK 就返回了: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	broker.Write([]byte{mqttPuback, 2, byte(id >> 8), byte(id)})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// 报文ID递增；一直没有 PUBACK 时超时返回错误
+	o.timeout = 100 * time.Millisecond
+	start := time.Now()
+	go func() { done <- o.publish("a", nil, 1, false) }()
+	header, _, body = readMQTTPacket(t, r)
+	if _, next, _ := mqttPublished(t, header, body); next != id+1 {
+		t.Errorf("下一个报文ID %d，期望 %d", next, id+1)
+	}
+	err := <-done
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("等待 PUBACK 应当超时: %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("等待 PUBACK 用了 %s", time.Since(start))
+	}
+
+	// QoS 0 不等待确认
+	go func() { done <- o.publish("b", []byte("1"), 0, true) }()
+	header, _, body = readMQTTPacket(t, r)
+	if _, id, payload := mqttPublished(t, header, body); header&0x07 != 0x01 || id != 0 || string(payload) != "1" {
+		t.Errorf("QoS 0: 标志 0x%x ID %d 负载 %q", header&0x07, id, payload)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMQTTDiscovery(t *testing.T) {
+	o, broker, r := newMQTTTestOutput(t, MQTTConfig{JSON: true, Discovery: true, DiscoveryPrefix: "homeassistant"})
+	points := []MetricPoint{
+		{Name: "disk_used_bytes", Labels: map[string]string{"device": "/dev/sda1", "mount": "/mnt/o'neil disk"}, Value: 42},
+		{Name: "cpu_seconds", Labels: map[string]string{"mode": "user"}, Value: 7},
+	}
+	done := make(chan error, 1)
+	go func() { done <- o.publishPoints(points, time.Unix(1704085200, 0)) }()
+
+	var configs []map[string]interface{}
+	for i := 0; i < 2; i++ {
+		header, _, body := readMQTTPacket(t, r)
+		topic, id, payload := mqttPublished(t, header, body)
+		if header&0x07 != 0x03 {
+			t.Errorf("自动发现消息应为 QoS 1 retain: 0x%x", header&0x07)
+		}
+		if !strings.HasPrefix(topic, "homeassistant/sensor/"+o.nodeID+"/") || !strings.HasSuffix(topic, "/config") {
+			t.Errorf("自动发现主题: %s", topic)
+		}
+		var config map[string]interface{}
+		if err := json.Unmarshal(payload, &config); err != nil {
+			t.Fatalf("自动发现负载不是 JSON: %v: %s", err, payload)
+		}
+		configs = append(configs, config)
+		broker.Write([]byte{mqttPuback, 2, byte(id >> 8), byte(id)})
+	}
+	header, _, body := readMQTTPacket(t, r)
+	topic, _, payload := mqttPublished(t, header, body)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	disk, cpu := configs[0], configs[1]
+	if disk["value_template"] != "{{ value_json['disk_used_bytes_dev_sda1_mnt_o_neil_disk'] }}" {
+		t.Errorf("value_template: %v", disk["value_template"])
+	}
+	if disk["state_topic"] != "sysmon/test/state" || disk["unit_of_measurement"] != "B" ||
+		disk["device_class"] != "data_size" || disk["availability_topic"] != "sysmon/test/status" {
+		t.Errorf("磁盘传感器配置: %v", disk)
+	}
+	if cpu["state_class"] != "total_increasing" || cpu["value_template"] != "{{ value_json['cpu_seconds_user'] }}" {
+		t.Errorf("CPU 传感器配置: %v", cpu)
+	}
+
+	var state map[string]float64
+	if err := json.Unmarshal(payload, &state); err != nil || topic != "sysmon/test/state" {
+		t.Fatalf("状态消息 %s: %v: %s", topic, err, payload)
+	}
+	if state["disk_used_bytes_dev_sda1_mnt_o_neil_disk"] != 42 || state["cpu_seconds_user"] != 7 || state["time"] != 1704085200 {
+		t.Errorf("状态消息: %v", state)
+	}
+
+	// 已发布过的传感器不再重复发布自动发现消息
+	go func() { done <- o.publishPoints(points, time.Unix(1704085210, 0)) }()
+	header, _, body = readMQTTPacket(t, r)
+	if topic, _, _ := mqttPublished(t, header, body); topic != "sysmon/test/state" {
+		t.Errorf("重复发布了自动发现消息: %s", topic)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSwitchInterfaceConcurrent(t *testing.T) {
+	em := newAuthTestMonitor(t)
+	em.replay = nil
+	interfaces := em.monitor.getAvailableInterfaces()
+	if len(interfaces) == 0 {
+		t.Skip("没有可切换的网卡")
+	}
+	h := em.newHandler(context.Background())
+
+	// HTTP 接口、WebSocket 命令和读取当前网卡同时进行，用 -race 运行时检查数据竞争
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		intf := interfaces[i%len(interfaces)]
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if rec := serveAs(h, "admin", "POST", "/api/switch-interface", `{"interface": "`+intf+`"}`); rec.Code != http.StatusOK {
+					t.Errorf("切换到 %s: 状态码 %d", intf, rec.Code)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				req := wsRequest{Type: "command", Command: "switch_interface", Interface: intf}
+				if result := em.runCommand(req, nil); result["ok"] != true {
+					t.Errorf("命令切换到 %s: %v", intf, result)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				getSelectedInterface()
+				em.monitor.snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+
+	em.monitor.mu.RLock()
+	monitored := em.monitor.config.Interface
+	em.monitor.mu.RUnlock()
+	if selected := getSelectedInterface(); selected != monitored {
+		t.Errorf("记录的选择 %s 与监控的网卡 %s 不一致", selected, monitored)
+	}
+}
+
+// wsServe 让服务端 wsConn 读取客户端发来的帧，返回读到的消息和服务端回复的帧（操作码和负载）
+func wsServe(t *testing.T, frames ...[]byte) (byte, []byte, [][2]string, error) {
+	t.Helper()
+	srv, client := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	ws := &wsConn{conn: srv, reader: bufio.NewReader(srv)}
+
+	type result struct {
+		op  byte
+		msg []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		op, msg, err := ws.ReadMessage()
+		srv.Close()
+		done <- result{op, msg, err}
+	}()
+	go client.Write(bytes.Join(frames, nil))
+
+	var replies [][2]string
+	br := bufio.NewReader(client)
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(br, head[:]); err != nil {
+			break
+		}
+		if head[1]&0x80 != 0 || head[1]&0x7F > 125 {
+			t.Fatalf("服务端帧格式错误: % x", head)
+		}
+		payload := make([]byte, head[1]&0x7F)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			t.Fatal(err)
+		}
+		if head[0]&0x80 == 0 {
+			t.Errorf("服务端帧没有设置 FIN")
+		}
+		replies = append(replies, [2]string{fmt.Sprint(head[0] & 0x0F), string(payload)})
+	}
+	r := <-done
+	return r.op, r.msg, replies, r.err
+}
+
+// wsClientFrame 构造一个客户端帧，masked 为 false 时不加掩码
+func wsClientFrame(fin bool, op byte, payload []byte, masked bool) []byte {
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	mask := []byte{0xA1, 0xB2, 0xC3, 0xD4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestWebSocketFraming(t *testing.T) {
+	closeFrame := func(code int) [2]string {
+		return [2]string{fmt.Sprint(wsClose), string([]byte{byte(code >> 8), byte(code)})}
+	}
+	long := bytes.Repeat([]byte("x"), 300)
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		op      byte
+		message string
+		replies [][2]string
+	}{
+		{"单帧文本", [][]byte{wsClientFrame(true, wsText, []byte("hello"), true)}, wsText, "hello", nil},
+		{"16位长度", [][]byte{wsClientFrame(true, wsBinary, long, true)}, wsBinary, string(long), nil},
+		{"分片", [][]byte{
+			wsClientFrame(false, wsText, []byte("he"), true),
+			wsClientFrame(false, wsContinuation, []byte("ll"), true),
+			wsClientFrame(true, wsContinuation, []byte("o"), true),
+		}, wsText, "hello", nil},
+		{"分片中间的 ping", [][]byte{
+			wsClientFrame(false, wsText, []byte("hel"), true),
+			wsClientFrame(true, wsPing, []byte("p1"), true),
+			wsClientFrame(true, wsPong, []byte("ignored"), true),
+			wsClientFrame(true, wsContinuation, []byte("lo"), true),
+		}, wsText, "hello", [][2]string{{fmt.Sprint(wsPong), "p1"}}},
+		{"未加掩码", [][]byte{wsClientFrame(true, wsText, []byte("hello"), false)}, 0, "", [][2]string{closeFrame(1002)}},
+		{"保留位", [][]byte{append([]byte{0x80 | 0x40 | wsText}, wsClientFrame(true, wsText, []byte("hi"), true)[1:]...)},
+			0, "", [][2]string{closeFrame(1002)}},
+		{"控制帧超过125字节", [][]byte{wsClientFrame(true, wsPing, bytes.Repeat([]byte("p"), 126), true)},
+			0, "", [][2]string{closeFrame(1002)}},
+		{"控制帧分片", [][]byte{wsClientFrame(false, wsPing, []byte("p"), true)}, 0, "", [][2]string{closeFrame(1002)}},
+		{"close 帧分片", [][]byte{wsClientFrame(false, wsClose, nil, true)}, 0, "", [][2]string{closeFrame(1002)}},
+		{"分片中插入新的数据帧", [][]byte{
+			wsClientFrame(false, wsText, []byte("he"), true),
+			wsClientFrame(true, wsText, []byte("llo"), true),
+		}, 0, "", [][2]string{closeFrame(1002)}},
+		{"没有开始的后续帧", [][]byte{wsClientFrame(true, wsContinuation, []byte("x"), true)}, 0, "", [][2]string{closeFrame(1002)}},
+		{"未知操作码", [][]byte{wsClientFrame(true, 0x3, []byte("x"), true)}, 0, "", [][2]string{closeFrame(1002)}},
+		{"消息过大", [][]byte{wsClientFrame(true, wsText, make([]byte, wsMaxMessage+1), true)}, 0, "",
+			[][2]string{{fmt.Sprint(wsClose), "\x03\xf1message too big"}}},
+		{"close", [][]byte{wsClientFrame(true, wsClose, []byte{0x03, 0xe8}, true)}, 0, "", [][2]string{closeFrame(1000)}},
+	}
+	for _, tt := range tests {
+		op, msg, replies, err := wsServe(t, tt.frames...)
+		if tt.op != 0 && (err != nil || op != tt.op || string(msg) != tt.message) {
+			t.Errorf("%s: 读到 %d %.20q %v", tt.name, op, msg, err)
+		}
+		if tt.op == 0 && err == nil {
+			t.Errorf("%s: 期望返回错误，读到 %d %.20q", tt.name, op, msg)
+		}
+		if tt.name == "close" && err != io.EOF {
+			t.Errorf("close: 期望 io.EOF，得到 %v", err)
+		}
+		if len(replies) != len(tt.replies) {
+			t.Errorf("%s: 服务端回复 %q，期望 %q", tt.name, replies, tt.replies)
+			continue
+		}
+		for i := range replies {
+			// 1002 的 close 帧只比较状态码
+			if got, want := replies[i], tt.replies[i]; got[0] != want[0] || !strings.HasPrefix(got[1], want[1]) {
+				t.Errorf("%s: 服务端回复 %q，期望 %q", tt.name, replies, tt.replies)
+			}
+		}
+	}
+}
+
+func TestParseAlertRule(t *testing.T) {
+	tests := []struct {
+		line string
+		want AlertRule // 只比较 Name、Expr、Metric、Op、Threshold、Clear、HasClear、For、Severity
+		err  string
+	}{
+		{line: "cpu_usage > 90", want: AlertRule{Name: "cpu_usage > 90", Expr: "cpu_usage > 90", Metric: "cpu_usage", Op: ">", Threshold: 90, Severity: "warning"}},
+		{line: "high_cpu: cpu_usage >= 90 for 5m severity critical",
+			want: AlertRule{Name: "high_cpu", Expr: "cpu_usage >= 90 for 5m", Metric: "cpu_usage", Op: ">=", Threshold: 90, For: 5 * time.Minute, Severity: "critical"}},
+		{line: "low_mem: mem_usage < 10 clear 15", want: AlertRule{Name: "low_mem", Expr: "mem_usage < 10", Metric: "mem_usage", Op: "<", Threshold: 10, Clear: 15, HasClear: true, Severity: "warning"}},
+		{line: "x: cpu_usage <= 1.5e1", want: AlertRule{Name: "x", Expr: "cpu_usage <= 1.5e1", Metric: "cpu_usage", Op: "<=", Threshold: 15, Severity: "warning"}},
+		{line: "x: load1 == 0 for 1d", want: AlertRule{Name: "x", Expr: "load1 == 0 for 1d", Metric: "load1", Op: "==", For: 24 * time.Hour, Severity: "warning"}},
+		{line: "x: load1 != 0 severity info", want: AlertRule{Name: "x", Expr: "load1 != 0", Metric: "load1", Op: "!=", Severity: "info"}},
+		{line: `disk: disk_usage{mount="/", device!="tmpfs"} > 80 clear 75 for 10m`,
+			want: AlertRule{Name: "disk", Expr: `disk_usage{mount="/", device!="tmpfs"} > 80 for 10m`, Metric: "disk_usage", Op: ">", Threshold: 80, Clear: 75, HasClear: true, For: 10 * time.Minute, Severity: "warning"}},
+		// 恢复阈值等于触发阈值时没有滞后，但是合法
+		{line: "x: cpu_usage > 90 clear 90", want: AlertRule{Name: "x", Expr: "cpu_usage > 90", Metric: "cpu_usage", Op: ">", Threshold: 90, Clear: 90, HasClear: true, Severity: "warning"}},
+
+		{line: "x: > 90", err: "缺少指标名"},
+		{line: "x: no_such_metric > 90", err: "未知的指标"},
+		{line: "x: cpu_usage", err: "缺少比较符或阈值"},
+		{line: "x: cpu_usage > ", err: "缺少比较符或阈值"},
+		{line: "x: cpu_usage => 90", err: "无效的比较符"},
+		{line: "x: cpu_usage = 90", err: "无效的比较符"},
+		{line: "x: cpu_usage > ninety", err: "无效的阈值"},
+		{line: `x: disk_usage{mount="/" > 80`, err: "缺少 }"},
+		{line: `x: disk_usage{mount=/} > 80`, err: "双引号"},
+		{line: "x: cpu_usage > 90 for", err: "缺少参数"},
+		{line: "x: cpu_usage > 90 for 5", err: "无效的持续时间"},
+		{line: "x: cpu_usage > 90 for -5m", err: "无效的持续时间"},
+		{line: "x: cpu_usage > 90 clear high", err: "无效的恢复阈值"},
+		{line: "x: cpu_usage > 90 severity page", err: "无效的告警级别"},
+		{line: "x: cpu_usage > 90 every 5m", err: "未知的参数"},
+		{line: "x: cpu_usage > 90 clear 95", err: "更宽松"},
+		{line: "x: cpu_usage >= 90 clear 91", err: "更宽松"},
+		{line: "x: mem_usage < 10 clear 5", err: "更宽松"},
+		{line: "x: mem_usage <= 10 clear 9", err: "更宽松"},
+		{line: "x: load1 == 0 clear 1", err: "不支持恢复阈值"},
+		{line: "x: load1 != 0 clear 1", err: "不支持恢复阈值"},
+	}
+	for _, tt := range tests {
+		rule, err := parseAlertRule(tt.line)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: 错误 %v，期望包含 %q", tt.line, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.line, err)
+			continue
+		}
+		got := *rule
+		got.Matchers = nil
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n得到 %+v\n期望 %+v", tt.line, got, tt.want)
+		}
+	}
+
+	rule, err := parseAlertRule(`disk_usage{mount="/", device!="tmpfs"} > 80`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		labels map[string]string
+		match  bool
+	}{
+		{map[string]string{"mount": "/", "device": "/dev/sda1"}, true},
+		{map[string]string{"mount": "/", "device": "tmpfs"}, false},
+		{map[string]string{"mount": "/home", "device": "/dev/sda2"}, false},
+		{map[string]string{"mount": "/"}, true},
+	} {
+		if got := rule.matches(MetricPoint{Name: "disk_usage", Labels: tt.labels}); got != tt.match {
+			t.Errorf("%v: 匹配 %v，期望 %v", tt.labels, got, tt.match)
+		}
+	}
+	if rule.matches(MetricPoint{Name: "disk_usage_percent", Labels: map[string]string{"mount": "/"}}) {
+		t.Error("不同指标名不应匹配")
+	}
+}
+
+func TestAlertRuleCompare(t *testing.T) {
+	for _, tt := range []struct {
+		op               string
+		below, at, above bool
+	}{
+		{">", false, false, true},
+		{">=", false, true, true},
+		{"<", true, false, false},
+		{"<=", true, true, false},
+		{"==", false, true, false},
+		{"!=", true, false, true},
+	} {
+		r := &AlertRule{Op: tt.op}
+		if r.compare(9, 10) != tt.below || r.compare(10, 10) != tt.at || r.compare(11, 10) != tt.above {
+			t.Errorf("%s: 9/10/11 与 10 比较得到 %v %v %v", tt.op, r.compare(9, 10), r.compare(10, 10), r.compare(11, 10))
+		}
+	}
+}
+
+func TestAlertEvaluateForAndClear(t *testing.T) {
+	rule, err := parseAlertRule("high_cpu: cpu_usage > 90 for 2m clear 80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	am := NewAlertManager([]*AlertRule{rule})
+	events := am.Subscribe()
+	start := time.Unix(1704085200, 0)
+
+	steps := []struct {
+		offset time.Duration
+		value  float64
+		state  string // 为空表示没有告警
+		event  string // 本步发出的事件
+	}{
+		{0, 95, alertPending, ""},
+		// 持续时间内回落直接删除，不发通知
+		{time.Minute, 85, "", ""},
+		{2 * time.Minute, 95, alertPending, ""},
+		{3 * time.Minute, 92, alertPending, ""},
+		{4 * time.Minute, 91, alertFiring, alertFiring},
+		// 低于触发阈值但高于恢复阈值时保持触发
+		{5 * time.Minute, 85, alertFiring, ""},
+		{6 * time.Minute, 80.1, alertFiring, ""},
+		{7 * time.Minute, 80, alertResolved, alertResolved},
+		// 恢复后要重新超过触发阈值才会再次进入 pending
+		{8 * time.Minute, 85, alertResolved, ""},
+		{9 * time.Minute, 90.5, alertPending, ""},
+	}
+	for _, s := range steps {
+		am.Evaluate(start.Add(s.offset), []MetricPoint{{Name: "cpu_usage", Value: s.value}})
+		state := ""
+		if a := am.alerts["high_cpu"]; a != nil {
+			state = a.State
+		}
+		if state != s.state {
+			t.Errorf("%s 值 %g: 状态 %q，期望 %q", s.offset, s.value, state, s.state)
+		}
+		event := ""
+		select {
+		case e := <-events:
+			event = e.Status
+		default:
+		}
+		if event != s.event {
+			t.Errorf("%s 值 %g: 事件 %q，期望 %q", s.offset, s.value, event, s.event)
+		}
+	}
+}
+
+// webhookRequest 测试服务器收到的一次 Webhook 请求
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// newWebhookServer 启动记录请求的测试服务器，按顺序返回 codes 中的状态码，用完后返回 200
+func newWebhookServer(t *testing.T, codes ...int) (*httptest.Server, chan webhookRequest) {
+	t.Helper()
+	requests := make(chan webhookRequest, 10)
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- webhookRequest{r.Header, body}
+		mu.Lock()
+		code := http.StatusOK
+		if len(codes) > 0 {
+			code, codes = codes[0], codes[1:]
+		}
+		mu.Unlock()
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+// testAlertEvent 构造一条告警事件
+func testAlertEvent(id, status string) AlertEvent {
+	return AlertEvent{
+		Status: status,
+		Host:   "web1",
+		Time:   time.Date(2024, 1, 1, 12, 0, 0, 0, displayZone),
+		Alert:  AlertStatus{ID: id, Rule: "high_cpu", Severity: "critical", State: status, Value: 95.25, Labels: map[string]string{"mount": "/"}},
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	srv, requests := newWebhookServer(t)
+	n, err := NewWebhookNotifier(WebhookConfig{URL: srv.URL + "/hook", Headers: "Authorization=Bearer abc, X-Team = ops", Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := testAlertEvent("high_cpu", alertFiring)
+	if retry, err := n.send(event); err != nil || retry {
+		t.Fatalf("发送: %v %v", retry, err)
+	}
+	req := <-requests
+
+	var got AlertEvent
+	if err := json.Unmarshal(req.body, &got); err != nil || got.Alert.ID != "high_cpu" || got.Status != alertFiring || !got.Time.Equal(event.Time) {
+		t.Errorf("默认请求体: %s %v", req.body, err)
+	}
+	for k, want := range map[string]string{
+		"Content-Type":   "application/json",
+		"User-Agent":     "sysmon",
+		"X-Sysmon-Event": "firing",
+		"Authorization":  "Bearer abc",
+		"X-Team":         "ops",
+	} {
+		if v := req.header.Get(k); v != want {
+			t.Errorf("请求头 %s: %q，期望 %q", k, v, want)
+		}
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(req.body)
+	if sig := req.header.Get("X-Sysmon-Signature"); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("签名 %s 与请求体不符", sig)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	srv, requests := newWebhookServer(t)
+	tmpl := writeTestFile(t, "hook.tmpl", `{"text": {{json (printf "[%s] %s %s %.1f" .Status .Host .Alert.ID .Alert.Value)}}, "at": "{{time .Time}}", "mount": {{json .Alert.Labels.mount}}, "repeat": {{.Repeat}}}`)
+	n, err := NewWebhookNotifier(WebhookConfig{URL: srv.URL, Template: tmpl, Headers: "Content-Type=text/plain; charset=utf-8", Secret: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.send(testAlertEvent(`disk "root"`, alertResolved)); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	want := `{"text": "[resolved] web1 disk \"root\" 95.2", "at": "` + formatTime(time.Date(2024, 1, 1, 12, 0, 0, 0, displayZone)) + `", "mount": "/", "repeat": false}`
+	if string(req.body) != want {
+		t.Errorf("模板输出:\n%s\n期望:\n%s", req.body, want)
+	}
+	if ct := req.header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("-webhook-headers 应能覆盖 Content-Type: %q", ct)
+	}
+	mac := hmac.New(sha256.New, []byte("k"))
+	mac.Write([]byte(want))
+	if sig := req.header.Get("X-Sysmon-Signature"); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("模板请求体的签名 %s 不符", sig)
+	}
+
+	// 模板执行出错时不重试
+	bad := writeTestFile(t, "bad.tmpl", `{{.NoSuchField}}`)
+	if n, err = NewWebhookNotifier(WebhookConfig{URL: srv.URL, Template: bad}); err != nil {
+		t.Fatal(err)
+	}
+	if retry, err := n.send(testAlertEvent("x", alertFiring)); err == nil || retry {
+		t.Errorf("模板执行出错: retry=%v err=%v", retry, err)
+	}
+	if _, err := NewWebhookNotifier(WebhookConfig{URL: srv.URL, Template: writeTestFile(t, "broken.tmpl", `{{if}}`)}); err == nil {
+		t.Error("无效的模板应当报错")
+	}
+}
+
+func TestWebhookRetryPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		code  int
+		retry bool
+	}{
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusNotFound, false},
+	} {
+		srv, _ := newWebhookServer(t, tt.code)
+		n, err := NewWebhookNotifier(WebhookConfig{URL: srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retry, err := n.send(testAlertEvent("x", alertFiring)); err == nil || retry != tt.retry {
+			t.Errorf("状态码 %d: retry=%v err=%v，期望 retry=%v", tt.code, retry, err, tt.retry)
+		}
+	}
+
+	// 网络错误可以重试
+	srv, _ := newWebhookServer(t)
+	n, err := NewWebhookNotifier(WebhookConfig{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	if retry, err := n.send(testAlertEvent("x", alertFiring)); err == nil || !retry {
+		t.Errorf("连接失败: retry=%v err=%v", retry, err)
+	}
+}
+
+func TestAlertDispatcherRetries(t *testing.T) {
+	srv, requests := newWebhookServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable,
+		http.StatusTooManyRequests, http.StatusOK, http.StatusBadRequest, http.StatusOK)
+	n, err := NewWebhookNotifier(WebhookConfig{URL: srv.URL, MaxRetries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := n.dispatcher
+	attempts := func() int {
+		count := 0
+		for {
+			select {
+			case <-requests:
+				count++
+			default:
+				return count
+			}
+		}
+	}
+
+	// 5xx 重试 maxRetries 次后放弃，继续发送下一条
+	d.enqueue(testAlertEvent("a", alertFiring))
+	d.enqueue(testAlertEvent("b", alertFiring))
+	for i := 0; i < 3; i++ {
+		d.deliver()
+	}
+	if got := attempts(); got != 3 || len(d.queue) != 1 || d.queue[0].event.Alert.ID != "b" || d.backoff != 0 {
+		t.Fatalf("重试 %d 次后队列 %d 条，退避 %s", got, len(d.queue), d.backoff)
+	}
+	// 429 后退避，成功后清除退避
+	d.deliver()
+	if d.backoff != outputMinBackoff || !d.nextTry.After(time.Now()) {
+		t.Errorf("429 后退避 %s", d.backoff)
+	}
+	d.deliver()
+	if len(d.queue) != 0 || d.backoff != 0 || attempts() != 2 {
+		t.Errorf("成功后队列 %d 条，退避 %s", len(d.queue), d.backoff)
+	}
+	// 4xx 立即放弃
+	d.enqueue(testAlertEvent("a", alertResolved))
+	d.enqueue(testAlertEvent("c", alertFiring))
+	d.deliver()
+	if len(d.queue) != 1 || d.queue[0].event.Alert.ID != "c" || attempts() != 1 {
+		t.Errorf("400 后队列: %v", d.queue)
+	}
+	d.deliver()
+	if len(d.queue) != 0 || attempts() != 1 {
+		t.Errorf("队列未清空: %v", d.queue)
+	}
+}
+
+func TestAlertDispatcherRenotify(t *testing.T) {
+	var sent []AlertEvent
+	d := newAlertDispatcher("test", time.Hour, 0, func(e AlertEvent) (bool, error) {
+		sent = append(sent, e)
+		return false, nil
+	})
+	flush := func() {
+		for len(d.queue) > 0 {
+			d.deliver()
+		}
+	}
+	firing := testAlertEvent("a", alertFiring)
+	start := firing.Time
+
+	// 同一状态只通知一次
+	d.enqueue(firing)
+	d.enqueue(firing)
+	flush()
+	if len(sent) != 1 || sent[0].Repeat {
+		t.Fatalf("重复的触发事件被发送: %d", len(sent))
+	}
+	// 未到重复通知间隔
+	d.renotifyDue(start.Add(59 * time.Minute))
+	flush()
+	if len(sent) != 1 {
+		t.Fatalf("未到间隔就重复通知")
+	}
+	// 到达间隔后以 Repeat 重新发送，并从这次开始重新计时
+	d.renotifyDue(start.Add(time.Hour))
+	flush()
+	if len(sent) != 2 || !sent[1].Repeat || !sent[1].Time.Equal(start.Add(time.Hour)) || sent[1].Alert.ID != "a" {
+		t.Fatalf("重复通知: %+v", sent)
+	}
+	d.renotifyDue(start.Add(90 * time.Minute))
+	d.renotifyDue(start.Add(2 * time.Hour))
+	flush()
+	if len(sent) != 3 {
+		t.Fatalf("第二次重复通知: 共发送 %d 条", len(sent))
+	}
+
+	// 静默后不再发送也不再重复通知
+	d.enqueue(testAlertEvent("a", alertSilenced))
+	d.renotifyDue(start.Add(10 * time.Hour))
+	flush()
+	if len(sent) != 3 {
+		t.Fatalf("静默后仍然发送: %+v", sent[3:])
+	}
+	// 静默结束后重新触发会再次通知；恢复后停止重复通知
+	d.enqueue(firing)
+	d.enqueue(testAlertEvent("a", alertResolved))
+	d.renotifyDue(start.Add(20 * time.Hour))
+	flush()
+	if len(sent) != 5 || sent[3].Status != alertFiring || sent[4].Status != alertResolved {
+		t.Fatalf("重新触发和恢复: %+v", sent[3:])
+	}
+
+	// renotify 为0时不重复通知
+	d = newAlertDispatcher("test", 0, 0, func(e AlertEvent) (bool, error) {
+		sent = append(sent, e)
+		return false, nil
+	})
+	d.enqueue(firing)
+	d.renotifyDue(start.Add(1000 * time.Hour))
+	if len(d.queue) != 1 {
+		t.Errorf("renotify 为0时队列 %d 条", len(d.queue))
+	}
+}
+
+// fakeSMTP 模拟 SMTP 服务器，记录收到的命令和邮件内容
+// reject 中的命令（如 "RCPT"）以指定的回复拒绝
+type fakeSMTP struct {
+	addr     string
+	reject   map[string]string
+	mu       sync.Mutex
+	commands []string
+	data     []string
+}
+
+func newFakeSMTP(t *testing.T, reject map[string]string) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &fakeSMTP{addr: ln.Addr().String(), reject: reject}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+		if resp, ok := s.reject[verb]; ok {
+			reply(resp)
+			continue
+		}
+		switch verb {
+		case "EHLO":
+			reply("250-fake")
+			reply("250-AUTH PLAIN")
+			reply("250 8BITMIME")
+		case "AUTH":
+			reply("235 2.7.0 accepted")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.data = append(s.data, data.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// received 返回收到的命令和邮件
+func (s *fakeSMTP) received() ([]string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...), append([]string(nil), s.data...)
+}
+
+// decodeMail 解析邮件，返回解码后的主题、头和 base64 解码后的正文
+func decodeMail(t *testing.T, raw string) (string, textproto.MIMEHeader, string) {
+	t.Helper()
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(raw)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("解析邮件头: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("解码主题: %v", err)
+	}
+	rest, _ := io.ReadAll(r.R)
+	for _, line := range strings.Split(strings.TrimRight(string(rest), "\r\n"), "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("正文行超过76个字符: %d", len(line))
+		}
+	}
+	body, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(rest), "\r\n", ""))
+	if err != nil {
+		t.Fatalf("正文不是 base64: %v", err)
+	}
+	return subject, header, string(body)
+}
+
+func TestMailerSend(t *testing.T) {
+	srv := newFakeSMTP(t, nil)
+	m, err := NewMailer(SMTPConfig{Addr: srv.addr, TLS: "auto", Username: "mon", Password: "p@ss", From: "sysmon@example.com", To: "a@example.com, b@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("告警: 磁盘使用率过高，当前值 95.5%\n", 10)
+	if retry, err := m.Send("[sysmon] 磁盘告警 ✓", "text/plain", []byte(body)); err != nil {
+		t.Fatalf("发送失败: retry=%v %v", retry, err)
+	}
+
+	commands, data := srv.received()
+	want := []string{
+		"EHLO " + hostname(),
+		"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00mon\x00p@ss")),
+		"MAIL FROM:<sysmon@example.com>",
+		"RCPT TO:<a@example.com>",
+		"RCPT TO:<b@example.com>",
+		"DATA",
+		"QUIT",
+	}
+	var got []string
+	for _, c := range commands {
+		if !strings.HasPrefix(c, "MAIL FROM:") {
+			got = append(got, c)
+			continue
+		}
+		// net/smtp 可能附带 BODY=8BITMIME 参数
+		got = append(got, strings.Fields(c)[0]+" "+strings.Fields(c)[1])
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("SMTP 命令:\n%s\n期望:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(data) != 1 {
+		t.Fatalf("收到 %d 封邮件", len(data))
+	}
+	subject, header, decoded := decodeMail(t, data[0])
+	if subject != "[sysmon] 磁盘告警 ✓" {
+		t.Errorf("主题: %q", subject)
+	}
+	if header.Get("From") != "sysmon@example.com" || header.Get("To") != "a@example.com, b@example.com" ||
+		header.Get("Content-Type") != "text/plain; charset=utf-8" || header.Get("Content-Transfer-Encoding") != "base64" {
+		t.Errorf("邮件头: %v", header)
+	}
+	if decoded != body {
+		t.Errorf("正文解码为 %q", decoded)
+	}
+}
+
+func TestMailerSendErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		config SMTPConfig
+		reject map[string]string
+		retry  bool
+		err    string
+	}{
+		{"认证失败", SMTPConfig{Username: "u", Password: "bad"}, map[string]string{"AUTH": "535 5.7.8 bad credentials"}, false, "认证失败"},
+		{"发件人被拒绝", SMTPConfig{}, map[string]string{"MAIL": "550 5.7.1 relay denied"}, false, "relay denied"},
+		{"收件人不存在", SMTPConfig{}, map[string]string{"RCPT": "550 5.1.1 no such user"}, false, "收件人 a@example.com"},
+		{"暂时拒绝", SMTPConfig{}, map[string]string{"RCPT": "451 4.7.1 greylisted"}, true, "greylisted"},
+		{"服务器繁忙", SMTPConfig{}, map[string]string{"MAIL": "421 4.3.2 busy"}, true, "busy"},
+		{"正文被拒绝", SMTPConfig{}, map[string]string{"DATA": "554 5.6.0 rejected"}, false, "rejected"},
+		{"不支持 STARTTLS", SMTPConfig{TLS: "starttls"}, nil, false, "STARTTLS"},
+	} {
+		srv := newFakeSMTP(t, tt.reject)
+		config := tt.config
+		config.Addr, config.From, config.To = srv.addr, "sysmon@example.com", "a@example.com"
+		if config.TLS == "" {
+			config.TLS = "none"
+		}
+		m, err := NewMailer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		retry, err := m.Send("s", "text/plain", []byte("b"))
+		if err == nil || retry != tt.retry || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: retry=%v err=%v，期望 retry=%v 错误包含 %q", tt.name, retry, err, tt.retry, tt.err)
+		}
+		if _, data := srv.received(); len(data) != 0 {
+			t.Errorf("%s: 不应发出邮件", tt.name)
+		}
+	}
+
+	// 连接失败可以重试
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	m, _ := NewMailer(SMTPConfig{Addr: addr, TLS: "none", From: "f@example.com", To: "a@example.com"})
+	if retry, err := m.Send("s", "text/plain", nil); err == nil || !retry {
+		t.Errorf("连接失败: retry=%v err=%v", retry, err)
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	now := time.Date(2024, 1, 2, 8, 0, 0, 0, displayZone)
+	from := now.Add(-24 * time.Hour)
+	config := Config{HistorySize: 1000}
+	em := &EnhancedMonitor{
+		config:  config,
+		history: NewHistory(config.HistorySize),
+		monitor: &Monitor{config: config, traffic: NewTrafficAccounting(config)},
+		alerts:  NewAlertManager(nil),
+	}
+	// 第 i 小时内 cpu_usage 为 i 和 i+2：小时平均 i+1，全天最小0、最大25、平均12.5
+	// receive_speed 恒为 1024 KB/s；24小时之前的样本不计入
+	em.history.Add(from.Add(-time.Hour), map[string]float64{"cpu_usage": 99, "receive_speed": 1e9})
+	for i := 0; i < 24; i++ {
+		hour := from.Add(time.Duration(i) * time.Hour)
+		em.history.Add(hour.Add(10*time.Minute), map[string]float64{"cpu_usage": float64(i), "receive_speed": 1024})
+		em.history.Add(hour.Add(20*time.Minute), map[string]float64{"cpu_usage": float64(i + 2), "receive_speed": 1024})
+	}
+	// 流量按小时统计，起点所在的整小时也计入
+	em.monitor.traffic.data.Interfaces = map[string]*interfaceTraffic{
+		"eth0": {Hours: []TrafficCounter{
+			{Start: from.Unix() - 7200, Rx: 1 << 30, Tx: 1 << 30},
+			{Start: from.Unix() - 1800, Rx: 100, Tx: 10},
+			{Start: from.Unix() + 3600, Rx: 1000, Tx: 200},
+		}},
+	}
+	rule, _ := parseAlertRule("high_cpu: cpu_usage > 90 severity critical")
+	em.alerts = NewAlertManager([]*AlertRule{rule})
+	em.alerts.Evaluate(now, []MetricPoint{{Name: "cpu_usage", Value: 95}})
+
+	data := em.buildReport(now)
+	want := map[string]ReportRow{
+		"CPU 使用率": {Min: "0.0%", Avg: "12.5%", Max: "25.0%"},
+		"内存使用率":   {Min: "-", Avg: "-", Max: "-"},
+		"下载速度":    {Min: "1.00 MB/s", Avg: "1.00 MB/s", Max: "1.00 MB/s"},
+	}
+	for _, row := range data.Metrics {
+		w, ok := want[row.Name]
+		if !ok {
+			continue
+		}
+		if row.Min != w.Min || row.Avg != w.Avg || row.Max != w.Max {
+			t.Errorf("%s: %s/%s/%s，期望 %s/%s/%s", row.Name, row.Min, row.Avg, row.Max, w.Min, w.Avg, w.Max)
+		}
+		delete(want, row.Name)
+	}
+	if len(want) > 0 {
+		t.Errorf("报告缺少指标: %v", want)
+	}
+	if len(data.Traffic) != 1 || data.Traffic[0] != (ReportTraffic{Interface: "eth0", Rx: 1100, Tx: 210, Total: 1310}) {
+		t.Errorf("流量: %+v", data.Traffic)
+	}
+	if len(data.Alerts) != 1 || data.Alerts[0].ID != "high_cpu" {
+		t.Errorf("告警: %+v", data.Alerts)
+	}
+
+	// 发送的报告是 HTML 邮件
+	srv := newFakeSMTP(t, nil)
+	if em.mailer, _ = NewMailer(SMTPConfig{Addr: srv.addr, TLS: "none", From: "f@example.com", To: "a@example.com"}); em.mailer == nil {
+		t.Fatal("创建邮件发送器失败")
+	}
+	if err := em.sendReport(now); err != nil {
+		t.Fatal(err)
+	}
+	_, mails := srv.received()
+	if len(mails) != 1 {
+		t.Fatalf("收到 %d 封邮件", len(mails))
+	}
+	subject, header, body := decodeMail(t, mails[0])
+	if subject != "[sysmon] "+hostname()+" 每日报告 2024-01-02" || header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("报告邮件: %q %v", subject, header)
+	}
+	for _, s := range []string{"12.5%", "25.0%", "eth0", "high_cpu"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("报告正文缺少 %q", s)
+		}
+	}
+}
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	w, err := parseMaintenanceWindow(` SAT,sun-mon 23:30-00:30 {rule="high_cpu", mount!="/"} `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.days != [7]bool{true, true, false, false, false, false, true} || w.start != 23*60+30 || w.end != 30 {
+		t.Errorf("解析结果: 日期 %v，%d-%d", w.days, w.start, w.end)
+	}
+	if len(w.matchers) != 2 || w.matchers[0] != (labelMatcher{Name: "rule", Value: "high_cpu"}) ||
+		w.matchers[1] != (labelMatcher{Name: "mount", Value: "/", Negate: true}) {
+		t.Errorf("标签选择器: %+v", w.matchers)
+	}
+
+	for _, spec := range []string{
+		"",
+		"mon",
+		"02:00-04:00",
+		"mon 02:00",
+		"mon 02:00-04:00 extra",
+		"xyz 02:00-04:00",
+		"mon-xyz 02:00-04:00",
+		"mon,,tue 02:00-04:00",
+		"mon 2:00pm-04:00",
+		"mon 24:00-01:00",
+		"mon 02:60-04:00",
+		"mon 02:00-02:00",
+		`mon 02:00-04:00 {rule=high_cpu}`,
+		`mon 02:00-04:00 {rule="high_cpu"`,
+	} {
+		if _, err := parseMaintenanceWindow(spec); err == nil {
+			t.Errorf("%q 应当解析失败", spec)
+		}
+	}
+}
+
+func TestMaintenanceWindowActiveAt(t *testing.T) {
+	// 2024-01-01 是星期一，时间按 displayZone（UTC+8）计算
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, displayZone)
+	}
+	tests := []struct {
+		spec   string
+		t      time.Time
+		active bool
+	}{
+		{"sun 02:00-04:00", at(7, 2, 0), true},
+		{"sun 02:00-04:00", at(7, 3, 59), true},
+		{"sun 02:00-04:00", at(7, 4, 0), false},
+		{"sun 02:00-04:00", at(7, 1, 59), false},
+		{"sun 02:00-04:00", at(6, 3, 0), false},
+		// UTC 星期六 18:30 在 displayZone 已是星期日 02:30
+		{"sun 02:00-04:00", time.Date(2024, 1, 6, 18, 30, 0, 0, time.UTC), true},
+		{"sun 02:00-04:00", time.Date(2024, 1, 7, 2, 30, 0, 0, time.UTC), false},
+
+		// 跨越午夜的窗口属于开始的那一天
+		{"mon-fri 23:30-00:30", at(1, 23, 29), false},
+		{"mon-fri 23:30-00:30", at(1, 23, 30), true},
+		{"mon-fri 23:30-00:30", at(2, 0, 0), true},
+		{"mon-fri 23:30-00:30", at(2, 0, 30), false},
+		{"mon-fri 23:30-00:30", at(1, 0, 15), false}, // 从星期日开始，不在范围内
+		{"mon-fri 23:30-00:30", at(6, 0, 15), true},  // 从星期五开始
+		{"mon-fri 23:30-00:30", at(6, 23, 45), false},
+		{"mon-fri 23:30-00:30", at(7, 0, 15), false},
+		// UTC 星期一 15:45 是 displayZone 星期一 23:45；UTC 星期日 16:15 是星期一 00:15
+		{"mon-fri 23:30-00:30", time.Date(2024, 1, 1, 15, 45, 0, 0, time.UTC), true},
+		{"mon-fri 23:30-00:30", time.Date(2023, 12, 31, 16, 15, 0, 0, time.UTC), false},
+		{"mon-fri 23:30-00:30", time.Date(2024, 1, 5, 16, 15, 0, 0, time.UTC), true},
+
+		// 星期六开始的窗口跨到星期日，星期日开始的跨到星期一
+		{"sat 22:00-02:00", at(7, 1, 59), true},
+		{"sat 22:00-02:00", at(7, 2, 0), false},
+		{"sun 23:00-01:00", at(8, 0, 30), true},
+		{"sun 23:00-01:00", at(7, 0, 30), false},
+
+		{"daily 22:00-06:00", at(3, 23, 0), true},
+		{"daily 22:00-06:00", at(3, 5, 59), true},
+		{"daily 22:00-06:00", at(3, 6, 0), false},
+		{"daily 22:00-06:00", at(3, 21, 59), false},
+		{"daily 00:00-23:59", at(3, 23, 58), true},
+		{"daily 00:00-23:59", at(3, 23, 59), false},
+
+		// 跨周末的日期范围
+		{"fri-mon 12:00-13:00", at(6, 12, 30), true},
+		{"fri-mon 12:00-13:00", at(7, 12, 30), true},
+		{"fri-mon 12:00-13:00", at(1, 12, 30), true},
+		{"fri-mon 12:00-13:00", at(2, 12, 30), false},
+		{"sat,sun 09:00-10:00", at(6, 9, 0), true},
+		{"sat,sun 09:00-10:00", at(5, 9, 0), false},
+	}
+	for _, tt := range tests {
+		w, err := parseMaintenanceWindow(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.spec, err)
+		}
+		if got := w.activeAt(tt.t); got != tt.active {
+			t.Errorf("%s 在 %s (%s): %v，期望 %v", tt.spec, tt.t.In(displayZone).Format("Mon 15:04"), tt.t, got, tt.active)
+		}
+	}
+}
+
+func TestValidFleetURL(t *testing.T) {
+	for _, tt := range []struct {
+		url   string
+		valid bool
+	}{
+		{"http://web1:8080/", true},
+		{"https://10.0.0.5/", true},
+		{"HTTPS://web1/", true},
+		{"javascript:alert(document.cookie)", false},
+		{"JavaScript://web1/%0aalert(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"//web1:8080/", false},
+		{"/", false},
+		{"http:///path", false},
+		{"ftp://web1/", false},
+		{"http://web1:bad port/", false},
+	} {
+		if got := validFleetURL(tt.url); got != tt.valid {
+			t.Errorf("%q: %v，期望 %v", tt.url, got, tt.valid)
+		}
+	}
+}
+
+func TestFetchFleetReportURL(t *testing.T) {
+	var reportURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(FleetReport{Host: "web1", URL: reportURL})
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		url  string
+		want string
+	}{
+		{"https://web1:8443/", "https://web1:8443/"},
+		{"", ""},
+		{"javascript:alert(1)", ""},
+		{"data:text/html,x", ""},
+		{"//evil.example/", ""},
+	} {
+		reportURL = tt.url
+		report, err := fetchFleetReport(context.Background(), srv.Client(), srv.URL, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.URL != tt.want {
+			t.Errorf("实例返回 %q: 保存为 %q，期望 %q", tt.url, report.URL, tt.want)
+		}
+	}
+}
+
+func TestFleetPushRejectsBadURL(t *testing.T) {
+	em := newAuthTestMonitor(t)
+	em.agents.allowAnonymous = true
+	for _, tt := range []struct {
+		url  string
+		code int
+	}{
+		{"javascript:alert(1)", http.StatusBadRequest},
+		{"data:text/html,x", http.StatusBadRequest},
+		{"//web1/", http.StatusBadRequest},
+		{"http://web1:8080/", http.StatusOK},
+	} {
+		body, _ := json.Marshal(FleetReport{Host: "web1", URL: tt.url})
+		rec := httptest.NewRecorder()
+		em.handleFleetPush(rec, httptest.NewRequest("POST", "/api/fleet/push", strings.NewReader(string(body))))
+		if rec.Code != tt.code {
+			t.Errorf("推送 %q: 状态码 %d，期望 %d", tt.url, rec.Code, tt.code)
+		}
+	}
+	for _, h := range em.fleet.Hosts() {
+		if h.Host == "web1" && h.URL != "http://web1:8080/" {
+			t.Errorf("保存的面板地址 %q", h.URL)
+		}
+	}
+}
+
+// newTLSHub 用 ca 子命令生成的CA启动 HTTPS hub：开放注册、校验客户端证书并能签发证书。
+// 返回的目录中有 ca.crt、ca.key 和服务器证书 hub.crt、hub.key
+func newTLSHub(t *testing.T) (*httptest.Server, string, *x509.CertPool) {
+	t.Helper()
+	dir := t.TempDir()
+	now := time.Now()
+	if _, _, _, err := initCA(caOptions{Dir: dir}, now); err != nil {
+		t.Fatal(err)
+	}
+	hubCert, hubKey, _, err := issueCertificate(caOptions{Dir: dir, Name: "hub", Hosts: []string{"127.0.0.1"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	em := newAuthTestMonitor(t)
+	em.config.TLSCert, em.config.TLSKey = hubCert, hubKey
+	em.config.Hub.EnrollSecret = "enroll-secret"
+	em.config.Hub.ClientCA = filepath.Join(dir, "ca.crt")
+	em.config.Hub.CAKey = filepath.Join(dir, "ca.key")
+	if em.agents, err = NewAgentRegistry(em.config); err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := tls.LoadX509KeyPair(hubCert, hubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(em.newHandler(context.Background()))
+	srv.TLS = em.serverTLSConfig()
+	srv.TLS.Certificates = []tls.Certificate{pair}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	roots, err := loadCertPool(em.config.Hub.ClientCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, dir, roots
+}
+
+// tlsClient 信任 roots 的客户端，cert 不为 nil 时出示客户端证书
+func tlsClient(roots *x509.CertPool, cert *tls.Certificate) *http.Client {
+	config := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}, Timeout: 5 * time.Second}
+}
+
+// tlsPush 以 host 的名义推送，token 不为空时带上令牌
+func tlsPush(client *http.Client, url, host, token string) (int, error) {
+	body, _ := json.Marshal(FleetReport{Host: host})
+	req, _ := http.NewRequest("POST", url+"/api/fleet/push", bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// tlsEnroll 用新生成的密钥向 hub 注册，成功时返回令牌和可用的客户端证书
+func tlsEnroll(t *testing.T, client *http.Client, url, host, secret string) (int, string, *tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: host}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(map[string]string{
+		"host":   host,
+		"secret": secret,
+		"csr":    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	})
+	resp, err := client.Post(url+"/api/fleet/enroll", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, "", nil
+	}
+	var creds struct {
+		Token       string `json:"token"`
+		Certificate string `json:"certificate"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := marshalPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair([]byte(creds.Certificate), keyPEM)
+	if err != nil {
+		t.Fatalf("注册返回的证书不可用: %v", err)
+	}
+	return resp.StatusCode, creds.Token, &pair
+}
+
+// tlsRevoke 以管理员身份吊销 agent 或证书
+func tlsRevoke(t *testing.T, client *http.Client, url, body string) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url+"/api/fleet/agents/revoke", strings.NewReader(body))
+	setCredentials(req.Header, "admin")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("吊销 %s: 状态码 %d", body, resp.StatusCode)
+	}
+}
+
+func TestHubTLSEnrollAndPush(t *testing.T) {
+	srv, dir, roots := newTLSHub(t)
+	anonymous := tlsClient(roots, nil)
+
+	if code, _, _ := tlsEnroll(t, anonymous, srv.URL, "web1", "wrong"); code != http.StatusForbidden {
+		t.Errorf("错误的注册密钥: 状态码 %d，期望 403", code)
+	}
+	code, token, cert := tlsEnroll(t, anonymous, srv.URL, "web1", "enroll-secret")
+	if code != http.StatusOK || token == "" || cert == nil {
+		t.Fatalf("注册: 状态码 %d", code)
+	}
+	web1 := tlsClient(roots, cert)
+
+	for _, tt := range []struct {
+		name   string
+		client *http.Client
+		host   string
+		token  string
+		want   int
+	}{
+		{"客户端证书", web1, "web1", "", http.StatusOK},
+		{"令牌", anonymous, "web1", token, http.StatusOK},
+		{"证书与主机名不符", web1, "web2", "", http.StatusForbidden},
+		{"令牌与主机名不符", anonymous, "web2", token, http.StatusForbidden},
+		{"匿名", anonymous, "web1", "", http.StatusUnauthorized},
+	} {
+		code, err := tlsPush(tt.client, srv.URL, tt.host, tt.token)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if code != tt.want {
+			t.Errorf("%s: 状态码 %d，期望 %d", tt.name, code, tt.want)
+		}
+	}
+
+	// 按名称吊销后证书和令牌都失效
+	tlsRevoke(t, anonymous, srv.URL, `{"name": "web1"}`)
+	if code, err := tlsPush(web1, srv.URL, "web1", ""); err != nil || code != http.StatusForbidden {
+		t.Errorf("吊销后用证书推送: 状态码 %d (%v)，期望 403", code, err)
+	}
+	if code, err := tlsPush(anonymous, srv.URL, "web1", token); err != nil || code != http.StatusForbidden {
+		t.Errorf("吊销后用令牌推送: 状态码 %d (%v)，期望 403", code, err)
+	}
+	if code, _, _ := tlsEnroll(t, anonymous, srv.URL, "web1", "enroll-secret"); code != http.StatusForbidden {
+		t.Errorf("吊销后重新注册: 状态码 %d，期望 403", code)
+	}
+
+	// 用 ca issue 签发的证书不经过注册，按序列号吊销
+	certPath, keyPath, issued, err := issueCertificate(caOptions{Dir: dir, Name: "web3", Client: true}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web3 := tlsClient(roots, &pair)
+	if code, err := tlsPush(web3, srv.URL, "web3", ""); err != nil || code != http.StatusOK {
+		t.Fatalf("签发的客户端证书推送: 状态码 %d (%v)", code, err)
+	}
+	tlsRevoke(t, anonymous, srv.URL, `{"serial": "`+certSerial(issued)+`"}`)
+	if code, err := tlsPush(web3, srv.URL, "web3", ""); err != nil || code != http.StatusForbidden {
+		t.Errorf("按序列号吊销后推送: 状态码 %d (%v)，期望 403", code, err)
+	}
+}
+
+// hub 自己的服务器证书只有 ServerAuth，不能当作 agent 身份
+func TestHubTLSRejectsServerCertAsClient(t *testing.T) {
+	srv, dir, roots := newTLSHub(t)
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "hub.crt"), filepath.Join(dir, "hub.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, err := tlsPush(tlsClient(roots, &pair), srv.URL, "hub", ""); err == nil {
+		t.Errorf("服务器证书被接受为客户端证书: 状态码 %d", code)
+	}
+
+	// 明确要求 -client 时服务器证书也能用于客户端认证
+	certPath, keyPath, _, err := issueCertificate(caOptions{Dir: dir, Name: "hub2", Hosts: []string{"127.0.0.1"}, Client: true}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair, err = tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if code, err := tlsPush(tlsClient(roots, &pair), srv.URL, "hub2", ""); err != nil || code != http.StatusOK {
+		t.Errorf("带 ClientAuth 的服务器证书推送: 状态码 %d (%v)", code, err)
+	}
+}
+
+func TestIssueCertificate(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	caPath, caKeyPath, ca, err := initCA(caOptions{Dir: dir}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.IsCA || ca.Subject.CommonName != "sysmon CA" {
+		t.Errorf("CA证书 IsCA=%v CN=%q", ca.IsCA, ca.Subject.CommonName)
+	}
+	if _, _, _, err := initCA(caOptions{Dir: dir}, now); err == nil {
+		t.Errorf("重复 init 覆盖了已有的CA")
+	}
+	caKey, err := os.ReadFile(caKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := loadCertPool(caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 名称 ca 会覆盖CA的证书和私钥，-force 也不行
+	for _, name := range []string{"ca", "CA"} {
+		if _, _, _, err := issueCertificate(caOptions{Dir: dir, Name: name, Client: true, Force: true}, now); err == nil {
+			t.Errorf("接受了名称 %q", name)
+		}
+	}
+	if data, _ := os.ReadFile(caKeyPath); !bytes.Equal(data, caKey) {
+		t.Fatalf("CA私钥被覆盖")
+	}
+
+	for _, tt := range []struct {
+		opts  caOptions
+		usage []x509.ExtKeyUsage
+		dns   []string
+		ips   int
+	}{
+		{caOptions{Name: "web1", Client: true}, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, nil, 0},
+		{caOptions{Name: "hub", Hosts: []string{"hub.example.com", "10.0.0.1"}}, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, []string{"hub.example.com"}, 1},
+		{caOptions{Name: "both", Hosts: []string{"both.example.com"}, Client: true}, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, []string{"both.example.com"}, 0},
+	} {
+		tt.opts.Dir = dir
+		certPath, keyPath, cert, err := issueCertificate(tt.opts, now)
+		if err != nil {
+			t.Errorf("%s: %v", tt.opts.Name, err)
+			continue
+		}
+		if certPath != filepath.Join(dir, tt.opts.Name+".crt") || keyPath != filepath.Join(dir, tt.opts.Name+".key") {
+			t.Errorf("%s: 写入 %s 和 %s", tt.opts.Name, certPath, keyPath)
+		}
+		if info, err := os.Stat(keyPath); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: 私钥权限 %v (%v)", tt.opts.Name, info.Mode().Perm(), err)
+		}
+		if !reflect.DeepEqual(cert.ExtKeyUsage, tt.usage) {
+			t.Errorf("%s: 用途 %v，期望 %v", tt.opts.Name, cert.ExtKeyUsage, tt.usage)
+		}
+		if !reflect.DeepEqual(cert.DNSNames, tt.dns) || len(cert.IPAddresses) != tt.ips {
+			t.Errorf("%s: 域名 %v IP %v", tt.opts.Name, cert.DNSNames, cert.IPAddresses)
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: tt.usage}); err != nil {
+			t.Errorf("%s: 不能用CA校验: %v", tt.opts.Name, err)
+		}
+	}
+
+	// 同名证书只有 -force 时才覆盖
+	_, _, old, _ := issueCertificate(caOptions{Dir: dir, Name: "web2", Client: true}, now)
+	if _, _, _, err := issueCertificate(caOptions{Dir: dir, Name: "web2", Client: true}, now); err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Errorf("覆盖已有证书: %v", err)
+	}
+	_, _, renewed, err := issueCertificate(caOptions{Dir: dir, Name: "web2", Client: true, Force: true}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certSerial(renewed) == certSerial(old) {
+		t.Errorf("-force 没有重新签发证书")
+	}
+
+	if _, _, _, err := issueCertificate(caOptions{Dir: dir, Name: "nousage"}, now); err == nil {
+		t.Errorf("签发了既不是服务器也不是客户端的证书")
+	}
+	if _, _, _, err := issueCertificate(caOptions{Dir: dir, Name: "../evil", Client: true}, now); err == nil {
+		t.Errorf("接受了包含路径的名称")
+	}
+}